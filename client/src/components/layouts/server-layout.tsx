@@ -1,6 +1,6 @@
 import { ScrollArea, ScrollBar } from "@/components/ui/scroll-area"
-import { useRoomsQuery } from "@/lib/queries/rooms"
-import type { Room } from "@/types/room"
+import { useCategoriesQuery, useRoomsQuery } from "@/lib/queries/rooms"
+import type { Room, RoomCategory } from "@/types/room"
 import { RoomsServer } from "@/types/rooms-server"
 import { Hash } from "lucide-react"
 import Link from "next/link"
@@ -30,6 +30,7 @@ export default function ServerLayout({
     const { activeServer } = context
 
     const { data: rooms, initCache } = useRoomsQuery(activeServer?.id)
+    const { data: categories } = useCategoriesQuery(activeServer?.id)
     initCache()
 
     const wrappedContext: ServerLayoutContext = {
@@ -48,7 +49,7 @@ export default function ServerLayout({
                     </div>
 
                     <ScrollArea className="flex-1 overflow-y-auto">
-                        <ChatRooms activeRoomId={roomId} rooms={rooms} />
+                        <ChatRooms activeRoomId={roomId} rooms={rooms} categories={categories} />
                         <ScrollBar />
                     </ScrollArea>
                 </ServerSidebarContextMenu>
@@ -60,25 +61,33 @@ export default function ServerLayout({
 
 function ChatRooms({
     activeRoomId,
-    rooms = []
+    rooms = [],
+    categories = []
 }: {
     activeRoomId?: string
     rooms?: Room[]
+    categories?: RoomCategory[]
 }) {
-    const groups = rooms?.reduce((acc, room) => {
-        if (!acc[room.groupName])
-            acc[room.groupName] = []
-        acc[room.groupName].push(room)
-        return acc
-    }, {} as { [key: string]: Room[] }) || []
+    // rooms without a category are listed before the categories
+    const groups = [
+        { id: "", name: "", rooms: [] as Room[] },
+        ...[...categories]
+            .sort((a, b) => a.position - b.position)
+            .map(category => ({ id: category.id, name: category.name, rooms: [] as Room[] }))
+    ]
+
+    for (const room of [...rooms].sort((a, b) => a.position - b.position)) {
+        const group = groups.find(group => group.id === (room.categoryId ?? "")) ?? groups[0]
+        group.rooms.push(room)
+    }
 
     return (
         <div className="p-2">
-            {Object.entries(groups).map(([groupName, rooms]) => (
-                <div key={groupName} className="my-2">
-                    <h3 className="my-2 text-sm text-foreground/50 font-medium">{groupName}</h3>
+            {groups.filter(group => group.id === "" || group.rooms.length > 0).map(group => (
+                <div key={group.id} className="my-2">
+                    {group.name && <h3 className="my-2 text-sm text-foreground/50 font-medium">{group.name}</h3>}
                     <div className="grid gap-1">
-                        {rooms.map(room => (
+                        {group.rooms.map(room => (
                             <RoomPanel key={room.id} room={room} isActive={room.id === activeRoomId} />
                         ))}
                     </div>
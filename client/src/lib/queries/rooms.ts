@@ -1,6 +1,6 @@
 import { useQuery } from "@tanstack/react-query";
 import { queryClient } from "@/components/providers/layout-providers";
-import type { Room } from "@/types/room";
+import type { Room, RoomCategory } from "@/types/room";
 import http from "../../lib/http";
 
 const SERVERS_URL = "http://localhost:8080/v1/servers"
@@ -23,6 +23,13 @@ export function useRoomsQuery(serverId?: string) {
     return { initCache, ...usequery };
 }
 
+export function useCategoriesQuery(serverId?: string) {
+    return useQuery<RoomCategory[]>({
+        queryKey: ["categories", serverId],
+        queryFn: async () => await http(SERVERS_URL + '/' + serverId + '/categories').get(),
+    }, queryClient);
+}
+
 
 
 export function mutateRoomsCache(serverId: string, roomId?: string) {
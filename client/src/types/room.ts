@@ -11,9 +11,19 @@ export interface Room {
     id: string
     serverId: string
     name: string
-    groupName: string
+    categoryId: string | null
+    position: number
     type: RoomType
     createdAt: number
     updatedAt: number
     status: RoomUserStatus
-}
\ No newline at end of file
+}
+
+export interface RoomCategory {
+    id: string
+    serverId: string
+    name: string
+    position: number
+    createdAt: number
+    updatedAt: number
+}
@@ -7,42 +7,79 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-const JwtTimeToLive = 10 * 24 * time.Hour
+// access tokens are short-lived, clients renew them with the refresh token
+const JwtTimeToLive = 15 * time.Minute
 const JwtSessionCookieName = "Authorization"
 
-func GenerateJwtToken(secret, userId string) (string, error) {
-	headerAndPayload := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+const RefreshTokenTimeToLive = 30 * 24 * time.Hour
+const RefreshTokenCookieName = "RefreshToken"
+
+// the refresh cookie is only sent to the session endpoints (refresh & logout)
+const RefreshTokenCookiePath = "/v1/auth/sessions"
+
+// sessionId is carried as the `jti` claim and checked against the sessions table
+func GenerateJwtToken(keys *Keyring, userId, sessionId string) (string, error) {
+	jwtToken, err := keys.Sign(jwt.MapClaims{
 		"sub": userId,
+		"jti": sessionId,
 		"iat": time.Now().Unix(),
 		"exp": time.Now().Add(JwtTimeToLive).Unix(),
 	})
-
-	jwtToken, err := headerAndPayload.SignedString([]byte(secret))
 	if err != nil {
 		return "", err
 	}
 	return jwtToken, nil
 }
 
-func ValidateJwtToken(secret, tokenString string) (*jwt.Token, jwt.MapClaims, bool) {
-	token, _ := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
+const ChallengeTokenTimeToLive = 5 * time.Minute
+const challengePurposeTwoFactor = "2fa"
+
+// GenerateChallengeToken signs a short-lived token proving the password step of a two-factor login,
+// it has no `jti` so it is never accepted as an access token, its own ID is in `cid`
+func GenerateChallengeToken(keys *Keyring, userId, device string) (string, error) {
+	id, err := GenerateRandomToken(16)
+	if err != nil {
+		return "", err
+	}
 
-		return []byte(secret), nil
+	return keys.Sign(jwt.MapClaims{
+		"sub":     userId,
+		"cid":     id,
+		"purpose": challengePurposeTwoFactor,
+		"device":  device,
+		"iat":     time.Now().Unix(),
+		"exp":     time.Now().Add(ChallengeTokenTimeToLive).Unix(),
 	})
+}
+
+// Challenge is the password step of a two-factor login, its ID counts the codes tried with it
+type Challenge struct {
+	ID     string
+	UserID string
+	Device string
+}
 
-	if !token.Valid {
-		return nil, nil, false
+// ValidateChallengeToken returns the challenge of a valid two-factor challenge token
+func ValidateChallengeToken(keys *Keyring, tokenString string) (*Challenge, bool) {
+	_, claims, ok := ValidateJwtToken(keys, tokenString)
+	if !ok || claims["purpose"] != challengePurposeTwoFactor {
+		return nil, false
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return nil, nil, false
+	userId, err := claims.GetSubject()
+	if err != nil {
+		return nil, false
+	}
+	id, _ := claims["cid"].(string)
+	if id == "" {
+		return nil, false
 	}
+	device, _ := claims["device"].(string)
+	return &Challenge{ID: id, UserID: userId, Device: device}, true
+}
 
-	return token, claims, true
+func ValidateJwtToken(keys *Keyring, tokenString string) (*jwt.Token, jwt.MapClaims, bool) {
+	return keys.Parse(tokenString)
 }
 
 func SerializeCookieWithToken(token string, secure ...bool) string {
@@ -57,3 +94,76 @@ func SerializeCookieWithToken(token string, secure ...bool) string {
 	}
 	return cookie
 }
+
+// an empty token clears the cookie
+func SerializeRefreshCookie(token string, secure ...bool) string {
+	formatedExpire := time.Now().Add(RefreshTokenTimeToLive).Format(time.RFC1123Z)
+	if token == "" {
+		formatedExpire = time.Unix(0, 0).UTC().Format(time.RFC1123Z)
+	}
+
+	cookie := fmt.Sprintf("%s=%s; SameSite=Strict; Expires=%s; Path=%s; HttpOnly;", RefreshTokenCookieName, token, formatedExpire, RefreshTokenCookiePath)
+	if len(secure) > 0 && secure[0] {
+		return cookie + " Secure;"
+	}
+	return cookie
+}
+
+const OIDCStateTimeToLive = 10 * time.Minute
+const OIDCStateCookieName = "OIDCState"
+
+// only sent back to the provider callbacks
+const OIDCStateCookiePath = "/v1/auth/oidc"
+const oidcPurpose = "oidc"
+
+// OIDCState is what the callback needs from the login request, kept in a signed cookie
+type OIDCState struct {
+	Provider     string
+	State        string
+	Nonce        string
+	CodeVerifier string
+	// set when an existing account links the provider, empty on login
+	LinkUserID string
+}
+
+func GenerateOIDCStateToken(keys *Keyring, state OIDCState) (string, error) {
+	return keys.Sign(jwt.MapClaims{
+		"purpose":  oidcPurpose,
+		"provider": state.Provider,
+		"state":    state.State,
+		"nonce":    state.Nonce,
+		"verifier": state.CodeVerifier,
+		"sub":      state.LinkUserID,
+		"iat":      time.Now().Unix(),
+		"exp":      time.Now().Add(OIDCStateTimeToLive).Unix(),
+	})
+}
+
+func ValidateOIDCStateToken(keys *Keyring, tokenString string) (*OIDCState, bool) {
+	_, claims, ok := ValidateJwtToken(keys, tokenString)
+	if !ok || claims["purpose"] != oidcPurpose {
+		return nil, false
+	}
+
+	state := &OIDCState{}
+	state.Provider, _ = claims["provider"].(string)
+	state.State, _ = claims["state"].(string)
+	state.Nonce, _ = claims["nonce"].(string)
+	state.CodeVerifier, _ = claims["verifier"].(string)
+	state.LinkUserID, _ = claims["sub"].(string)
+	return state, true
+}
+
+// Lax so the cookie is sent on the top-level redirect back from the provider, an empty token clears it
+func SerializeOIDCStateCookie(token string, secure ...bool) string {
+	formatedExpire := time.Now().Add(OIDCStateTimeToLive).Format(time.RFC1123Z)
+	if token == "" {
+		formatedExpire = time.Unix(0, 0).UTC().Format(time.RFC1123Z)
+	}
+
+	cookie := fmt.Sprintf("%s=%s; SameSite=Lax; Expires=%s; Path=%s; HttpOnly;", OIDCStateCookieName, token, formatedExpire, OIDCStateCookiePath)
+	if len(secure) > 0 && secure[0] {
+		return cookie + " Secure;"
+	}
+	return cookie
+}
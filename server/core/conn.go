@@ -0,0 +1,342 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// close codes of any connection, in the range reserved for applications, clients act on them
+// instead of reconnecting blindly
+const (
+	CloseAuthExpired    = 4004 // the access token expired, refresh it then reconnect, gateway sessions can be resumed
+	CloseKicked         = 4006 // removed from the server by a moderator, the reason says kicked or banned
+	CloseRateLimited    = 4007 // more messages than ConnOptions.RateLimit
+	CloseSlowConsumer   = 4008 // the client fell too far behind, see SlowConsumerPolicy
+	CloseIdleTimeout    = 4009 // nothing was received for ConnOptions.IdleTimeout, e.g. missed heartbeats
+	CloseServerShutdown = 4010 // the server is restarting, reconnect with a backoff
+)
+
+// SlowConsumerPolicy is what happens to a connection whose outbound queue is full
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerDisconnect closes the connection with CloseSlowConsumer, gateway clients resume
+	// and catch up from the replay buffer
+	SlowConsumerDisconnect SlowConsumerPolicy = iota
+	// SlowConsumerDropFrames drops the frames that don't fit and keeps the connection,
+	// gateway clients see a gap in the sequence numbers
+	SlowConsumerDropFrames
+)
+
+// ConnOptions bounds how far behind a client can fall, how long it can stay silent and how much it can send,
+// the durations and limits are disabled when 0
+type ConnOptions struct {
+	QueueSize    int           // writes waiting for the client
+	WriteTimeout time.Duration // deadline of each frame
+	SlowConsumer SlowConsumerPolicy
+	PingInterval time.Duration // how often the client is pinged, its pongs keep the connection alive
+	ReadTimeout  time.Duration // the connection is dropped once nothing, not even a pong, was received for this long
+	IdleTimeout  time.Duration // the connection is closed with CloseIdleTimeout once no message was received for this long
+	// bytes, larger messages close the connection with a message too big
+	MaxMessageSize int64
+	// messages per minute, more close the connection with CloseRateLimited
+	RateLimit int
+}
+
+var DefaultConnOptions = ConnOptions{
+	QueueSize:      64,
+	WriteTimeout:   10 * time.Second,
+	SlowConsumer:   SlowConsumerDisconnect,
+	PingInterval:   30 * time.Second,
+	ReadTimeout:    60 * time.Second,
+	MaxMessageSize: 64 * 1024,
+	RateLimit:      120,
+}
+
+var (
+	ErrConnClosed   = errors.New("connection closed")
+	ErrSlowConsumer = errors.New("outbound queue is full")
+	ErrRateLimited  = errors.New("too many messages")
+)
+
+// Conn is a websocket with its own writer, frames are queued and written with a deadline
+// so publishing to a topic never waits on a slow client. Messages are read with ReadJSON from a single goroutine
+type Conn struct {
+	ws    *websocket.Conn
+	opt   ConnOptions
+	queue chan [][]byte
+	done  chan struct{} // closed once the connection is closing
+	once  sync.Once
+	// set before done is closed, the close frame and whether queued frames are written first
+	closeMsg []byte
+	flush    bool
+	exited   chan struct{} // closed once the writer stopped
+	release  func()        // called once the writer stopped, e.g. to untrack the connection
+
+	lastRead atomic.Int64 // unix nanoseconds of the last message
+	// the rate limit window, used by the reader only
+	window time.Time
+	count  int
+}
+
+// NewConn starts the writer of the websocket, it stops once the connection is closed
+func NewConn(ws *websocket.Conn, opt ConnOptions) *Conn {
+	c := newConn(ws, opt)
+	c.start()
+	return c
+}
+
+func newConn(ws *websocket.Conn, opt ConnOptions) *Conn {
+	c := &Conn{
+		ws:     ws,
+		opt:    opt,
+		queue:  make(chan [][]byte, opt.QueueSize),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	c.lastRead.Store(time.Now().UnixNano())
+
+	if opt.MaxMessageSize > 0 {
+		ws.SetReadLimit(opt.MaxMessageSize)
+	}
+	c.extendReadDeadline()
+	ws.SetPongHandler(func(string) error {
+		c.extendReadDeadline()
+		return nil
+	})
+	return c
+}
+
+func (c *Conn) start() {
+	go c.writePump()
+}
+
+func (c *Conn) extendReadDeadline() {
+	if c.opt.ReadTimeout > 0 {
+		c.ws.SetReadDeadline(time.Now().Add(c.opt.ReadTimeout))
+	}
+}
+
+// ReadJSON reads the next message, which pushes back the read and idle deadlines.
+// It fails with ErrRateLimited once the client sent more than RateLimit messages in a minute, the connection is then closed
+func (c *Conn) ReadJSON(v any) error {
+	err := c.ws.ReadJSON(v)
+	if err != nil && !isDecodeError(err) {
+		return err
+	}
+
+	now := time.Now()
+	c.lastRead.Store(now.UnixNano())
+	c.extendReadDeadline()
+
+	if c.opt.RateLimit > 0 {
+		if now.Sub(c.window) >= time.Minute {
+			c.window = now
+			c.count = 0
+		}
+		c.count++
+		if c.count > c.opt.RateLimit {
+			c.close(websocket.FormatCloseMessage(CloseRateLimited, "rate limited"), false)
+			return ErrRateLimited
+		}
+	}
+	return err
+}
+
+// a message was read but isn't valid JSON, or doesn't fit the value
+func isDecodeError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
+
+// Write queues text frames without blocking, frames written together take one place in the queue, e.g. a replay.
+// It fails with ErrConnClosed, or with ErrSlowConsumer if the queue is full and the connection was closed for it
+func (c *Conn) Write(frames ...[]byte) error {
+	select {
+	case <-c.done:
+		return ErrConnClosed
+	default:
+	}
+
+	select {
+	case c.queue <- frames:
+		return nil
+	default:
+	}
+
+	if c.opt.SlowConsumer == SlowConsumerDropFrames {
+		return nil
+	}
+	c.close(websocket.FormatCloseMessage(CloseSlowConsumer, "too slow"), false)
+	return ErrSlowConsumer
+}
+
+// Close writes the frames already queued then closes with the code and reason, it can be called many times
+func (c *Conn) Close(code int, reason string) {
+	c.close(websocket.FormatCloseMessage(code, reason), true)
+}
+
+// CloseAt closes the connection with the code and reason at the deadline, e.g. once its credentials expire
+func (c *Conn) CloseAt(deadline time.Time, code int, reason string) {
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		c.Close(code, reason)
+	})
+	go func() {
+		<-c.exited
+		timer.Stop()
+	}()
+}
+
+func (c *Conn) close(msg []byte, flush bool) {
+	c.once.Do(func() {
+		c.closeMsg = msg
+		c.flush = flush
+		close(c.done)
+	})
+}
+
+func (c *Conn) writePump() {
+	defer func() {
+		c.ws.Close()
+		close(c.exited)
+		if c.release != nil {
+			c.release()
+		}
+	}()
+
+	var ping, idle <-chan time.Time
+	if c.opt.PingInterval > 0 {
+		ticker := time.NewTicker(c.opt.PingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	var idleTimer *time.Timer
+	if c.opt.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(c.opt.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	for {
+		select {
+		case frames := <-c.queue:
+			if err := c.write(frames); err != nil {
+				c.close(nil, false)
+				return
+			}
+		case <-ping:
+			if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.opt.WriteTimeout)); err != nil {
+				c.close(nil, false)
+				return
+			}
+		case <-idle:
+			elapsed := time.Since(time.Unix(0, c.lastRead.Load()))
+			if elapsed < c.opt.IdleTimeout {
+				idleTimer.Reset(c.opt.IdleTimeout - elapsed)
+				continue
+			}
+			c.close(websocket.FormatCloseMessage(CloseIdleTimeout, "idle"), false)
+		case <-c.done:
+			// the frames queued before closing, e.g. the event that explains it
+			if c.flush && c.drain() != nil {
+				return
+			}
+			if c.closeMsg != nil {
+				c.ws.WriteControl(websocket.CloseMessage, c.closeMsg, time.Now().Add(time.Second))
+			}
+			return
+		}
+	}
+}
+
+// drain writes the frames left in the queue
+func (c *Conn) drain() error {
+	for {
+		select {
+		case frames := <-c.queue:
+			if err := c.write(frames); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *Conn) write(frames [][]byte) error {
+	for _, frame := range frames {
+		c.ws.SetWriteDeadline(time.Now().Add(c.opt.WriteTimeout))
+		if err := c.ws.WriteMessage(websocket.TextMessage, frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Connections tracks the open connections so they can be closed together on shutdown
+type Connections struct {
+	mu     sync.Mutex
+	conns  map[*Conn]struct{}
+	closed bool
+}
+
+func NewConnections() *Connections {
+	return &Connections{
+		conns: make(map[*Conn]struct{}),
+	}
+}
+
+// Open starts the connection like NewConn and tracks it until its writer stops,
+// connections opened after CloseAll are closed right away with CloseServerShutdown
+func (s *Connections) Open(ws *websocket.Conn, opt ConnOptions) *Conn {
+	c := newConn(ws, opt)
+	c.release = func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.conns, c)
+	}
+
+	s.mu.Lock()
+	closed := s.closed
+	if !closed {
+		s.conns[c] = struct{}{}
+	}
+	s.mu.Unlock()
+
+	c.start()
+	if closed {
+		c.Close(CloseServerShutdown, "server shutting down")
+	}
+	return c
+}
+
+// Len returns the number of open connections
+func (s *Connections) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// CloseAll closes every connection with the code and reason, and waits for their close frames to be written
+func (s *Connections) CloseAll(code int, reason string) {
+	s.mu.Lock()
+	s.closed = true
+	conns := make([]*Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close(code, reason)
+	}
+	for _, c := range conns {
+		<-c.exited
+	}
+}
@@ -2,8 +2,10 @@ package core
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"strings"
@@ -28,20 +30,48 @@ func GenerateRandomString(length uint32) (string, error) {
 	return base64.RawStdEncoding.EncodeToString(bytes), nil
 }
 
-type hashingOptions struct {
-	iterations  uint32
-	memory      uint32
-	parallelism uint8
-	keyLength   uint32
-	saltLength  uint32
+// URL and cookie safe random token, used for opaque tokens (refresh tokens, etc.)
+func GenerateRandomToken(length uint32) (string, error) {
+	bytes, err := GenerateRandomBytes(length)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
 }
 
-var defaultHashingOptions = &hashingOptions{
-	memory:      4 * 1024,
-	iterations:  3,
-	parallelism: 1,
-	keyLength:   32,
-	saltLength:  16,
+// HashToken hashes high-entropy opaque tokens with SHA-256 so they can be looked up by their hash,
+// argon2 is only needed for low-entropy secrets like passwords
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// argon2id parameters, memory is in KiB
+type HashingOptions struct {
+	Iterations  uint32
+	Memory      uint32
+	Parallelism uint8
+	KeyLength   uint32
+	SaltLength  uint32
+}
+
+// target parameters of new hashes, hashes with other parameters still verify with their own
+var DefaultHashingOptions = HashingOptions{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	KeyLength:   32,
+	SaltLength:  16,
+}
+
+// upper bounds of the parameters read from stored hashes, so a tampered hash can't make verifying it
+// allocate or spin without limit. The target parameters must stay within them
+var MaxHashingOptions = HashingOptions{
+	Memory:      1024 * 1024,
+	Iterations:  64,
+	Parallelism: 64,
+	KeyLength:   128,
+	SaltLength:  128,
 }
 
 // Hashing with Argon2id
@@ -49,28 +79,28 @@ func CreateHashWithSalt(value string, providedSalt ...[]byte) ([]byte, []byte, e
 	var (
 		err  error
 		salt []byte
-		opt  = defaultHashingOptions
+		opt  = DefaultHashingOptions
 	)
 
 	if len(providedSalt) > 0 {
 		salt = providedSalt[0]
 	} else {
-		if salt, err = GenerateRandomBytes(opt.saltLength); err != nil {
+		if salt, err = GenerateRandomBytes(opt.SaltLength); err != nil {
 			return nil, nil, err
 		}
 	}
 
-	hash := argon2.IDKey([]byte(value), salt, opt.iterations, opt.memory, opt.parallelism, opt.keyLength)
+	hash := argon2.IDKey([]byte(value), salt, opt.Iterations, opt.Memory, opt.Parallelism, opt.KeyLength)
 	return hash, salt, nil
 }
 
 // Serialize the hash and salt into a string format
 func SerializeHashWithSalt(hash []byte, salt []byte) string {
-	opt := defaultHashingOptions
+	opt := DefaultHashingOptions
 	b64Salt := base64.RawStdEncoding.EncodeToString(salt)
 	b64Hash := base64.RawStdEncoding.EncodeToString(hash)
 
-	serializedHash := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, opt.memory, opt.iterations, opt.parallelism, b64Salt, b64Hash)
+	serializedHash := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, opt.Memory, opt.Iterations, opt.Parallelism, b64Salt, b64Hash)
 	return serializedHash
 }
 
@@ -79,39 +109,72 @@ var (
 	ErrHashVerificationFailed = errors.New("hash verification failed")
 )
 
-func DeserializeHash(serializedHash string) ([]byte, []byte, error) {
+// DeserializeHash returns the hash, the salt and the parameters the hash was created with
+func DeserializeHash(serializedHash string) ([]byte, []byte, *HashingOptions, error) {
 	parts := strings.Split(serializedHash, "$")
-	if len(parts) != 6 {
-		return nil, nil, ErrInvalidHashFormat
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, ErrInvalidHashFormat
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, ErrInvalidHashFormat
+	}
+
+	opt := &HashingOptions{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &opt.Memory, &opt.Iterations, &opt.Parallelism); err != nil {
+		return nil, nil, nil, ErrInvalidHashFormat
+	}
+	limit := MaxHashingOptions
+	if opt.Memory == 0 || opt.Iterations == 0 || opt.Parallelism == 0 ||
+		opt.Memory > limit.Memory || opt.Iterations > limit.Iterations || opt.Parallelism > limit.Parallelism {
+		return nil, nil, nil, ErrInvalidHashFormat
 	}
 
 	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	return hash, salt, nil
+	opt.SaltLength = uint32(len(salt))
+	opt.KeyLength = uint32(len(hash))
+	if opt.KeyLength == 0 || opt.KeyLength > limit.KeyLength || opt.SaltLength > limit.SaltLength {
+		return nil, nil, nil, ErrInvalidHashFormat
+	}
+	return hash, salt, opt, nil
 }
 
-// Verify a row unhashed value against the stored hash.
+// Verify a row unhashed value against the stored hash, using the parameters stored in the hash.
 func VerifyHashWithSalt(raw, dataHash string) error {
-	storedHash, salt, err := DeserializeHash(dataHash)
+	storedHash, salt, opt, err := DeserializeHash(dataHash)
 	if err != nil {
 		return err
 	}
 
-	toHash, _, err := CreateHashWithSalt(raw, salt)
-	if err != nil {
-		return err
-	}
+	toHash := argon2.IDKey([]byte(raw), salt, opt.Iterations, opt.Memory, opt.Parallelism, opt.KeyLength)
 
-	if subtle.ConstantTimeCompare(storedHash, []byte(toHash)) == 1 {
+	if subtle.ConstantTimeCompare(storedHash, toHash) == 1 {
 		return nil
 	}
 	return ErrHashVerificationFailed
 }
+
+// NeedsRehash reports whether the stored hash is weaker than the target parameters, stronger hashes are kept
+// so lowering the target never downgrades them
+func NeedsRehash(dataHash string) bool {
+	_, _, opt, err := DeserializeHash(dataHash)
+	if err != nil {
+		return true
+	}
+
+	target := DefaultHashingOptions
+	return opt.Memory < target.Memory ||
+		opt.Iterations < target.Iterations ||
+		opt.Parallelism < target.Parallelism ||
+		opt.KeyLength < target.KeyLength
+}
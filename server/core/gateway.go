@@ -0,0 +1,256 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// gateway opcodes, what the envelope carries
+const (
+	OpDispatch       = 0  // server → client, an event with its type and sequence number
+	OpHeartbeat      = 1  // client → server, keeps the connection alive
+	OpIdentify       = 2  // client → server, starts the session
+	OpCommand        = 3  // client → server, an action with its type, e.g. MESSAGE_CREATE
+	OpResume         = 6  // client → server, resumes a session after the last sequence number it received
+	OpInvalidSession = 9  // server → client, the session can't be resumed, re-sync through REST and identify
+	OpHello          = 10 // server → client, sent on connect with the heartbeat interval
+	OpHeartbeatAck   = 11 // server → client, answers a heartbeat
+	OpCommandError   = 12 // server → client, a command failed, with the command type
+)
+
+// gateway close codes, in the range reserved for applications, the codes of any connection are in conn.go
+const (
+	CloseUnknownOpcode     = 4001
+	CloseDecodeError       = 4002
+	CloseNotIdentified     = 4003
+	CloseAlreadyIdentified = 4005
+)
+
+const (
+	// HeartbeatInterval is how often clients are told to send heartbeats
+	HeartbeatInterval = 30 * time.Second
+	// HeartbeatTimeout is the idle timeout of gateway connections, a client that missed a heartbeat is closed
+	// with CloseIdleTimeout
+	HeartbeatTimeout = 2 * HeartbeatInterval
+)
+
+const (
+	// ReplayBufferSize is how many dispatches a session keeps for resuming
+	ReplayBufferSize = 256
+	// ResumeTimeout is how long a session outlives its connection
+	ResumeTimeout = 2 * time.Minute
+)
+
+var (
+	ErrSessionNotFound   = errors.New("session not found")
+	ErrReplayUnavailable = errors.New("missed dispatches are no longer buffered")
+)
+
+// Envelope is the frame the gateway sends, the type and sequence number are set on dispatches only
+type Envelope struct {
+	Op   int    `json:"op"`
+	Type string `json:"t,omitempty"`
+	Data any    `json:"d"`
+	Seq  int64  `json:"s,omitempty"`
+}
+
+// Command is the frame clients send, the data is decoded by the handler of its op and type
+type Command struct {
+	Op   int             `json:"op"`
+	Type string          `json:"t"`
+	Data json.RawMessage `json:"d"`
+}
+
+type dispatch struct {
+	seq   int64
+	frame []byte
+}
+
+// Session is a gateway connection, it is subscribed to the user's own topic, their servers and the rooms they can view,
+// it keeps its last dispatches so a client that lost its connection can resume it on a new one
+type Session struct {
+	ID     string
+	userID string
+	conn   *Conn      // nil while detached
+	mu     sync.Mutex // topics publish concurrently
+	seq    int64
+	replay []dispatch // the last dispatches, oldest first
+	expiry *time.Timer
+}
+
+func NewSession(conn *Conn, userID string) *Session {
+	id, _ := GenerateRandomToken(16)
+	return &Session{
+		ID:     id,
+		userID: userID,
+		conn:   conn,
+	}
+}
+
+func (s *Session) UserID() string {
+	return s.userID
+}
+
+// Send dispatches the event with the next sequence number, detached sessions only buffer it.
+// It never fails so sessions stay subscribed until they are resumed or expire, even once their connection
+// was closed for being slow
+func (s *Session) Send(event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	frame, err := json.Marshal(Envelope{Op: OpDispatch, Type: event.Type, Data: event.Data, Seq: s.seq})
+	if err != nil {
+		return nil
+	}
+
+	if len(s.replay) == ReplayBufferSize {
+		s.replay = s.replay[1:]
+	}
+	s.replay = append(s.replay, dispatch{seq: s.seq, frame: frame})
+
+	if s.conn != nil {
+		s.conn.Write(frame)
+	}
+	return nil
+}
+
+// Write sends a frame that is not a dispatch, e.g. hello or a heartbeat ack
+func (s *Session) Write(envelope Envelope) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return ErrConnClosed
+	}
+	frame, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	return s.conn.Write(frame)
+}
+
+// Leave is a no-op, the session stays connected to its other topics
+func (s *Session) Leave(topicID string, code int, reason string) {}
+
+// Close closes the connection with the close code and reason
+func (s *Session) Close(code int, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return
+	}
+	s.conn.Close(code, reason)
+}
+
+// attach replaces the connection and replays the dispatches after seq, a previous connection is closed
+func (s *Session) attach(conn *Conn, seq int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the client can't be ahead, and the dispatch right after seq must still be buffered
+	oldest := s.seq + 1
+	if len(s.replay) > 0 {
+		oldest = s.replay[0].seq
+	}
+	if seq > s.seq || seq+1 < oldest {
+		return ErrReplayUnavailable
+	}
+
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	if s.conn != nil && s.conn != conn {
+		s.conn.Close(websocket.CloseNormalClosure, "session resumed")
+	}
+	s.conn = conn
+
+	var missed [][]byte
+	for _, d := range s.replay {
+		if d.seq > seq {
+			missed = append(missed, d.frame)
+		}
+	}
+	if len(missed) > 0 {
+		conn.Write(missed...)
+	}
+	return nil
+}
+
+// SessionStore keeps the gateway sessions that can be resumed
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewSessionStore() *SessionStore {
+	return &SessionStore{
+		sessions: make(map[string]*Session),
+	}
+}
+
+// Add makes the identified session resumable
+func (s *SessionStore) Add(session *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ID] = session
+}
+
+// Detach is called once the connection of the session is gone, the session keeps buffering dispatches
+// for ResumeTimeout then it is removed and expire is called, e.g. to unsubscribe it.
+// Connections the session was already resumed from are ignored
+func (s *SessionStore) Detach(session *Session, conn *Conn, expire func()) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.conn != conn {
+		return
+	}
+	session.conn = nil
+
+	var timer *time.Timer
+	timer = time.AfterFunc(ResumeTimeout, func() {
+		s.mu.Lock()
+		session.mu.Lock()
+		// resumed in the meantime
+		if session.expiry != timer {
+			session.mu.Unlock()
+			s.mu.Unlock()
+			return
+		}
+		delete(s.sessions, session.ID)
+		session.mu.Unlock()
+		s.mu.Unlock()
+		expire()
+	})
+	session.expiry = timer
+}
+
+// Resume attaches the connection to the user's session and replays the dispatches after seq,
+// it fails with ErrSessionNotFound, or with ErrReplayUnavailable if they are no longer buffered,
+// in which case the session is removed and returned so it can be unsubscribed
+func (s *SessionStore) Resume(id, userID string, conn *Conn, seq int64) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, exists := s.sessions[id]
+	if !exists || session.userID != userID {
+		return nil, ErrSessionNotFound
+	}
+
+	if err := session.attach(conn, seq); err != nil {
+		delete(s.sessions, id)
+		session.mu.Lock()
+		if session.expiry != nil {
+			session.expiry.Stop()
+			session.expiry = nil
+		}
+		if session.conn != nil {
+			session.conn.Close(websocket.CloseNormalClosure, "session invalidated")
+		}
+		session.mu.Unlock()
+		return session, err
+	}
+	return session, nil
+}
@@ -0,0 +1,374 @@
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// supported signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// tokens without a `kid` header (issued before the keyring) are checked against the key with this ID
+const LegacyKeyID = "default"
+
+const DefaultKeyGraceWindow = 24 * time.Hour
+
+var (
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	ErrNoActiveKey          = errors.New("keyring has no active signing key")
+)
+
+// SigningKey is a JWT signing key identified by its `kid`
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	// zero while the key is in use, a retired key only validates tokens during the grace window
+	RetiredAt time.Time
+
+	secret  []byte
+	private crypto.Signer
+}
+
+func NewHMACKey(kid string, secret []byte) *SigningKey {
+	return &SigningKey{ID: kid, Algorithm: AlgHS256, secret: secret}
+}
+
+func NewECDSAKey(kid string, key *ecdsa.PrivateKey) (*SigningKey, error) {
+	if key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("%w: ES256 needs a P-256 key", ErrUnsupportedAlgorithm)
+	}
+	return &SigningKey{ID: kid, Algorithm: AlgES256, private: key}, nil
+}
+
+func NewEd25519Key(kid string, key ed25519.PrivateKey) *SigningKey {
+	return &SigningKey{ID: kid, Algorithm: AlgEdDSA, private: key}
+}
+
+// GenerateSigningKey creates a random key for the algorithm
+func GenerateSigningKey(kid, alg string) (*SigningKey, error) {
+	switch alg {
+	case AlgHS256:
+		secret, err := GenerateRandomBytes(32)
+		if err != nil {
+			return nil, err
+		}
+		return NewHMACKey(kid, secret), nil
+	case AlgES256:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return NewECDSAKey(kid, key)
+	case AlgEdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return NewEd25519Key(kid, key), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, alg)
+}
+
+// ParsePrivateKeyPEM parses a PKCS#8 (or SEC 1 for EC) private key for the algorithm
+func ParsePrivateKeyPEM(kid, alg string, data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("key %s: no PEM block found", kid)
+	}
+
+	var parsed any
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil && alg == AlgES256 {
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", kid, err)
+	}
+
+	switch key := parsed.(type) {
+	case *ecdsa.PrivateKey:
+		if alg == AlgES256 {
+			return NewECDSAKey(kid, key)
+		}
+	case ed25519.PrivateKey:
+		if alg == AlgEdDSA {
+			return NewEd25519Key(kid, key), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: key %s is not a %s key", ErrUnsupportedAlgorithm, kid, alg)
+}
+
+func (k *SigningKey) method() jwt.SigningMethod {
+	switch k.Algorithm {
+	case AlgES256:
+		return jwt.SigningMethodES256
+	case AlgEdDSA:
+		return jwt.SigningMethodEdDSA
+	default:
+		return jwt.SigningMethodHS256
+	}
+}
+
+func (k *SigningKey) signingKey() any {
+	if k.Algorithm == AlgHS256 {
+		return k.secret
+	}
+	return k.private
+}
+
+func (k *SigningKey) verificationKey() any {
+	if k.Algorithm == AlgHS256 {
+		return k.secret
+	}
+	return k.private.Public()
+}
+
+// Keyring holds the active signing key and the retired keys still accepted during the grace window
+type Keyring struct {
+	mu          sync.RWMutex
+	keys        map[string]*SigningKey
+	activeID    string
+	graceWindow time.Duration
+}
+
+func NewKeyring(graceWindow time.Duration) *Keyring {
+	return &Keyring{
+		keys:        make(map[string]*SigningKey),
+		graceWindow: graceWindow,
+	}
+}
+
+// NewKeyringFromSecret creates a keyring with a single HS256 key, the setup before keyrings existed
+func NewKeyringFromSecret(secret string) *Keyring {
+	keys := NewKeyring(DefaultKeyGraceWindow)
+	keys.Add(NewHMACKey(LegacyKeyID, []byte(secret)), true)
+	return keys
+}
+
+// Add adds a key, an active key becomes the one used for signing
+func (k *Keyring) Add(key *SigningKey, active bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[key.ID] = key
+	if active {
+		k.activeID = key.ID
+	}
+}
+
+// Rotate makes the key the active one and retires the previously active key
+func (k *Keyring) Rotate(key *SigningKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if previous, ok := k.keys[k.activeID]; ok {
+		previous.RetiredAt = time.Now()
+	}
+	k.keys[key.ID] = key
+	k.activeID = key.ID
+}
+
+// usable keys are active or retired within the grace window
+func (k *Keyring) usable(key *SigningKey) bool {
+	return key.RetiredAt.IsZero() || time.Since(key.RetiredAt) < k.graceWindow
+}
+
+// Sign signs the claims with the active key and sets the `kid` header
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	k.mu.RLock()
+	key, ok := k.keys[k.activeID]
+	k.mu.RUnlock()
+	if !ok {
+		return "", ErrNoActiveKey
+	}
+
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.signingKey())
+}
+
+// Parse validates a token against the key named by its `kid`, the algorithm must match the key's
+func (k *Keyring) Parse(tokenString string) (*jwt.Token, jwt.MapClaims, bool) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			kid = LegacyKeyID
+		}
+
+		k.mu.RLock()
+		key, ok := k.keys[kid]
+		usable := ok && k.usable(key)
+		k.mu.RUnlock()
+		if !usable {
+			return nil, fmt.Errorf("unknown or expired signing key: %s", kid)
+		}
+
+		if token.Method.Alg() != key.method().Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return key.verificationKey(), nil
+	})
+
+	if err != nil || token == nil || !token.Valid {
+		return nil, nil, false
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, nil, false
+	}
+
+	return token, claims, true
+}
+
+// JSON Web Key (RFC 7517) of a public key
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys that can still validate tokens, symmetric keys are never published
+func (k *Keyring) JWKS() JWKSet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := JWKSet{Keys: make([]JWK, 0)}
+	for _, key := range k.keys {
+		if key.Algorithm == AlgHS256 || !k.usable(key) {
+			continue
+		}
+
+		switch public := key.private.Public().(type) {
+		case *ecdsa.PublicKey:
+			ecdhKey, err := public.ECDH()
+			if err != nil {
+				continue
+			}
+			// uncompressed point: 0x04 || X || Y
+			point := ecdhKey.Bytes()
+			size := (len(point) - 1) / 2
+			set.Keys = append(set.Keys, JWK{
+				Kty: "EC",
+				Crv: "P-256",
+				X:   base64.RawURLEncoding.EncodeToString(point[1 : 1+size]),
+				Y:   base64.RawURLEncoding.EncodeToString(point[1+size:]),
+				Kid: key.ID,
+				Alg: key.Algorithm,
+				Use: "sig",
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "OKP",
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(public),
+				Kid: key.ID,
+				Alg: key.Algorithm,
+				Use: "sig",
+			})
+		}
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+// keyring file format, private key paths are relative to the file
+type keyringFile struct {
+	GraceWindow string `json:"graceWindow"`
+	Keys        []struct {
+		ID             string    `json:"kid"`
+		Algorithm      string    `json:"alg"`
+		Secret         string    `json:"secret"`
+		PrivateKeyFile string    `json:"privateKeyFile"`
+		Active         bool      `json:"active"`
+		RetiredAt      time.Time `json:"retiredAt"`
+	} `json:"keys"`
+}
+
+// LoadKeyringFile loads a keyring from a JSON file:
+//
+//	{"graceWindow": "24h", "keys": [
+//	  {"kid": "2025-01", "alg": "EdDSA", "privateKeyFile": "ed25519.pem", "active": true},
+//	  {"kid": "default", "alg": "HS256", "secret": "...", "retiredAt": "2025-01-01T00:00:00Z"}
+//	]}
+func LoadKeyringFile(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file keyringFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid keyring file: %w", err)
+	}
+
+	graceWindow := DefaultKeyGraceWindow
+	if file.GraceWindow != "" {
+		if graceWindow, err = time.ParseDuration(file.GraceWindow); err != nil {
+			return nil, fmt.Errorf("invalid grace window: %w", err)
+		}
+	}
+
+	keys := NewKeyring(graceWindow)
+	for _, entry := range file.Keys {
+		var key *SigningKey
+
+		switch entry.Algorithm {
+		case AlgHS256:
+			if entry.Secret == "" {
+				return nil, fmt.Errorf("key %s: HS256 needs a secret", entry.ID)
+			}
+			key = NewHMACKey(entry.ID, []byte(entry.Secret))
+		case AlgES256, AlgEdDSA:
+			keyPath := entry.PrivateKeyFile
+			if !filepath.IsAbs(keyPath) {
+				keyPath = filepath.Join(filepath.Dir(path), keyPath)
+			}
+			pemData, err := os.ReadFile(keyPath)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", entry.ID, err)
+			}
+			if key, err = ParsePrivateKeyPEM(entry.ID, entry.Algorithm, pemData); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, entry.Algorithm)
+		}
+
+		key.RetiredAt = entry.RetiredAt
+		keys.Add(key, entry.Active)
+	}
+
+	if keys.activeID == "" {
+		return nil, ErrNoActiveKey
+	}
+	return keys, nil
+}
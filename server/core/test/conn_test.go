@@ -0,0 +1,293 @@
+package core_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/khalidibnwalid/Luma/core"
+)
+
+// queued sends the events through the writer of its connection, events carrying a frame are written as they are
+type queued struct {
+	conn   *core.Conn
+	userID string
+}
+
+func (s *queued) UserID() string {
+	return s.userID
+}
+
+func (s *queued) Send(event core.Event) error {
+	if frame, ok := event.Data.([]byte); ok {
+		return s.conn.Write(frame)
+	}
+	frame, _ := json.Marshal(event)
+	return s.conn.Write(frame)
+}
+
+func (s *queued) Leave(topicID string, code int, reason string) {
+	s.conn.Close(code, reason)
+}
+
+// serverConn is the server side of a test connection, err receives why reading from it stopped
+type serverConn struct {
+	*core.Conn
+	err chan error
+}
+
+// mockConnServer starts every connection with open and hands it over on the returned channel
+func mockConnServer(t *testing.T, open func(ws *websocket.Conn) *core.Conn) (*httptest.Server, <-chan *serverConn) {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	conns := make(chan *serverConn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn := &serverConn{Conn: open(ws), err: make(chan error, 1)}
+		defer conn.Close(websocket.CloseNormalClosure, "")
+		conns <- conn
+		for {
+			var v any
+			if err := conn.ReadJSON(&v); err != nil {
+				conn.err <- err
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, conns
+}
+
+func dial(t *testing.T, open func(ws *websocket.Conn) *core.Conn) (*websocket.Conn, *serverConn) {
+	t.Helper()
+	server, conns := mockConnServer(t, open)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	select {
+	case conn := <-conns:
+		return client, conn
+	case <-time.After(time.Second):
+		t.Fatal("Expected a connection")
+		return nil, nil
+	}
+}
+
+func dialConn(t *testing.T, opt core.ConnOptions) (*websocket.Conn, *serverConn) {
+	t.Helper()
+	return dial(t, func(ws *websocket.Conn) *core.Conn {
+		return core.NewConn(ws, opt)
+	})
+}
+
+// expectClose reads from the client until the connection is closed with the code
+func expectClose(t *testing.T, client *websocket.Conn, code int) {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := client.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, code) {
+			t.Errorf("Expected the close code %d, got %v", code, err)
+		}
+		return
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	client, conn := dialConn(t, core.DefaultConnOptions)
+
+	conn.Write([]byte(`"first"`), []byte(`"second"`))
+	conn.Close(4000, "bye")
+	if err := conn.Write([]byte(`"third"`)); err != core.ErrConnClosed {
+		t.Errorf("Expected a closed connection, got %v", err)
+	}
+
+	// the queued frames are written before the close frame
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	for _, expected := range []string{`"first"`, `"second"`} {
+		_, frame, err := client.ReadMessage()
+		if err != nil || string(frame) != expected {
+			t.Fatalf("Expected %s, got %s %v", expected, frame, err)
+		}
+	}
+	if _, _, err := client.ReadMessage(); !websocket.IsCloseError(err, 4000) {
+		t.Errorf("Expected the close code, got %v", err)
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	const events = 256
+	// large enough for the socket buffers of a client that never reads to fill up, marshalled once
+	// so the publish loop stays fast under -race
+	frame, _ := json.Marshal(core.Event{Type: "MESSAGE_CREATE", Data: strings.Repeat("x", 128*1024)})
+
+	publish := func(t *testing.T, slowOptions core.ConnOptions) (*core.Topic, *queued, int) {
+		t.Helper()
+		topic := &core.Topic{ID: "room", Subscribers: make(map[core.Subscriber]struct{})}
+
+		fastClient, fastConn := dialConn(t, core.ConnOptions{QueueSize: events, WriteTimeout: 5 * time.Second})
+		_, slowConn := dialConn(t, slowOptions)
+		slow := &queued{conn: slowConn.Conn, userID: "slow"}
+		topic.Subscribe(&queued{conn: fastConn.Conn, userID: "fast"})
+		topic.Subscribe(slow)
+
+		received := make(chan int)
+		go func() {
+			count := 0
+			fastClient.SetReadDeadline(time.Now().Add(10 * time.Second))
+			for count < events {
+				if _, _, err := fastClient.ReadMessage(); err != nil {
+					break
+				}
+				count++
+			}
+			received <- count
+		}()
+
+		// publishing never waits on the slow client
+		start := time.Now()
+		for range events {
+			topic.Publish(core.Event{Type: "MESSAGE_CREATE", Data: frame})
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("Expected publishing not to block, took %s", elapsed)
+		}
+		return topic, slow, <-received
+	}
+
+	t.Run("Should disconnect clients that fall behind", func(t *testing.T) {
+		topic, slow, received := publish(t, core.ConnOptions{QueueSize: 4, WriteTimeout: 5 * time.Second})
+		if received != events {
+			t.Errorf("Expected the fast client to receive %d events, got %d", events, received)
+		}
+		if _, subscribed := topic.Subscribers[slow]; subscribed || len(topic.Subscribers) != 1 {
+			t.Error("Expected only the slow client to be removed")
+		}
+		if err := slow.conn.Write([]byte(`"late"`)); err != core.ErrConnClosed {
+			t.Errorf("Expected the slow connection to be closed, got %v", err)
+		}
+	})
+
+	t.Run("Should drop the frames of clients that fall behind", func(t *testing.T) {
+		// the writer of the slow client must not time out while the test runs, that would drop it
+		topic, slow, received := publish(t, core.ConnOptions{QueueSize: 4, WriteTimeout: time.Minute, SlowConsumer: core.SlowConsumerDropFrames})
+		if received != events {
+			t.Errorf("Expected the fast client to receive %d events, got %d", events, received)
+		}
+		if _, subscribed := topic.Subscribers[slow]; !subscribed {
+			t.Error("Expected the slow client to stay subscribed")
+		}
+	})
+}
+
+func TestConnKeepalive(t *testing.T) {
+	opt := core.ConnOptions{QueueSize: 8, WriteTimeout: time.Second, PingInterval: 20 * time.Millisecond, ReadTimeout: 100 * time.Millisecond}
+
+	t.Run("Should keep connections that answer pings", func(t *testing.T) {
+		client, conn := dialConn(t, opt)
+		// the client answers pings while it reads
+		go func() {
+			for {
+				if _, _, err := client.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		select {
+		case err := <-conn.err:
+			t.Errorf("Expected the connection to stay open, got %v", err)
+		case <-time.After(300 * time.Millisecond):
+		}
+	})
+
+	t.Run("Should drop connections that stop answering", func(t *testing.T) {
+		_, conn := dialConn(t, opt)
+		select {
+		case err := <-conn.err:
+			if netErr, ok := err.(interface{ Timeout() bool }); !ok || !netErr.Timeout() {
+				t.Errorf("Expected a read timeout, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Error("Expected the connection to be dropped")
+		}
+	})
+}
+
+func TestConnIdleTimeout(t *testing.T) {
+	opt := core.ConnOptions{QueueSize: 8, WriteTimeout: time.Second, IdleTimeout: 150 * time.Millisecond}
+	client, _ := dialConn(t, opt)
+
+	// messages push the idle deadline back
+	for range 4 {
+		client.WriteJSON(map[string]int{"op": 1})
+		time.Sleep(50 * time.Millisecond)
+	}
+	start := time.Now()
+	expectClose(t, client, core.CloseIdleTimeout)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected the messages to push the idle deadline back, closed after %s", elapsed)
+	}
+}
+
+func TestConnLimits(t *testing.T) {
+	t.Run("Should close connections that send too large messages", func(t *testing.T) {
+		client, _ := dialConn(t, core.ConnOptions{QueueSize: 8, WriteTimeout: time.Second, MaxMessageSize: 16})
+		client.WriteJSON(map[string]string{"content": strings.Repeat("x", 64)})
+		expectClose(t, client, websocket.CloseMessageTooBig)
+	})
+
+	t.Run("Should close connections that send too many messages", func(t *testing.T) {
+		client, conn := dialConn(t, core.ConnOptions{QueueSize: 8, WriteTimeout: time.Second, RateLimit: 3})
+		for range 4 {
+			client.WriteJSON(map[string]int{"op": 1})
+		}
+		expectClose(t, client, core.CloseRateLimited)
+		if err := <-conn.err; err != core.ErrRateLimited {
+			t.Errorf("Expected the reader to be rate limited, got %v", err)
+		}
+	})
+
+	t.Run("Should close connections at their deadline", func(t *testing.T) {
+		client, conn := dialConn(t, core.DefaultConnOptions)
+		conn.CloseAt(time.Now().Add(50*time.Millisecond), core.CloseAuthExpired, "token expired")
+		expectClose(t, client, core.CloseAuthExpired)
+	})
+}
+
+func TestConnectionsCloseAll(t *testing.T) {
+	connections := core.NewConnections()
+	open := func(ws *websocket.Conn) *core.Conn {
+		return connections.Open(ws, core.DefaultConnOptions)
+	}
+
+	first, _ := dial(t, open)
+	second, _ := dial(t, open)
+	if connections.Len() != 2 {
+		t.Fatalf("Expected 2 connections, got %d", connections.Len())
+	}
+
+	connections.CloseAll(core.CloseServerShutdown, "server shutting down")
+	if connections.Len() != 0 {
+		t.Errorf("Expected the connections to be untracked, got %d", connections.Len())
+	}
+	expectClose(t, first, core.CloseServerShutdown)
+	expectClose(t, second, core.CloseServerShutdown)
+
+	// late connections are closed right away
+	late, _ := dial(t, open)
+	expectClose(t, late, core.CloseServerShutdown)
+}
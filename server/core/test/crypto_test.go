@@ -0,0 +1,66 @@
+package core_test
+
+import (
+	"testing"
+
+	"github.com/khalidibnwalid/Luma/core"
+)
+
+// hash the value with the given target parameters, restoring the defaults afterwards
+func hashWithOptions(value string, opt core.HashingOptions) string {
+	defaults := core.DefaultHashingOptions
+	defer func() { core.DefaultHashingOptions = defaults }()
+
+	core.DefaultHashingOptions = opt
+	hash, salt, _ := core.CreateHashWithSalt(value)
+	return core.SerializeHashWithSalt(hash, salt)
+}
+
+func TestVerifyHashWithSalt(t *testing.T) {
+	legacy := core.HashingOptions{Memory: 4 * 1024, Iterations: 3, Parallelism: 1, KeyLength: 32, SaltLength: 16}
+
+	t.Run("Should verify hashes made with other parameters than the target", func(t *testing.T) {
+		hash := hashWithOptions("password", legacy)
+
+		if err := core.VerifyHashWithSalt("password", hash); err != nil {
+			t.Errorf("Expected legacy hash to verify, got %v", err)
+		}
+		if err := core.VerifyHashWithSalt("wrong", hash); err != core.ErrHashVerificationFailed {
+			t.Errorf("Expected ErrHashVerificationFailed, got %v", err)
+		}
+	})
+
+	t.Run("Should reject malformed hashes", func(t *testing.T) {
+		for _, hash := range []string{
+			"",
+			"$argon2id$v=19$m=0,t=3,p=1$c2FsdA$aGFzaA",
+			"$argon2i$v=19$m=4096,t=3,p=1$c2FsdA$aGFzaA",
+			"$argon2id$v=19$t=3$c2FsdA$aGFzaA",
+			// parameters above the bounds, e.g. terabytes of memory
+			"$argon2id$v=19$m=4294967295,t=3,p=1$c2FsdA$aGFzaA",
+			"$argon2id$v=19$m=4096,t=4294967295,p=1$c2FsdA$aGFzaA",
+		} {
+			if err := core.VerifyHashWithSalt("password", hash); err != core.ErrInvalidHashFormat {
+				t.Errorf("Expected ErrInvalidHashFormat for %q, got %v", hash, err)
+			}
+		}
+	})
+}
+
+func TestNeedsRehash(t *testing.T) {
+	legacy := core.HashingOptions{Memory: 4 * 1024, Iterations: 3, Parallelism: 1, KeyLength: 32, SaltLength: 16}
+
+	if !core.NeedsRehash(hashWithOptions("password", legacy)) {
+		t.Error("Expected legacy hash to need a rehash")
+	}
+	if core.NeedsRehash(hashWithOptions("password", core.DefaultHashingOptions)) {
+		t.Error("Expected hash with the target parameters to not need a rehash")
+	}
+
+	stronger := core.DefaultHashingOptions
+	stronger.Memory *= 2
+	stronger.Iterations++
+	if core.NeedsRehash(hashWithOptions("password", stronger)) {
+		t.Error("Expected hash stronger than the target to be kept")
+	}
+}
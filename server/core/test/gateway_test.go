@@ -0,0 +1,174 @@
+package core_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/khalidibnwalid/Luma/core"
+)
+
+func TestSessionDispatch(t *testing.T) {
+	store := core.NewTopicStore()
+	sessions := make(chan *core.Session, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn := core.NewConn(ws, core.DefaultConnOptions)
+		defer conn.Close(websocket.CloseNormalClosure, "")
+		session := core.NewSession(conn, "user")
+		defer store.Unsubscribe(session)
+		store.Subscribe(session, "server", "room")
+		sessions <- session
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	var session *core.Session
+	select {
+	case session = <-sessions:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a session")
+	}
+
+	session.Write(core.Envelope{Op: core.OpHello})
+	store.Broadcast(core.Event{Type: "FIRST"}, "server", "room")
+	// removed from the room, the session keeps the server
+	store.DisconnectUser("user", core.CloseKicked, "kicked", "room")
+	store.Broadcast(core.Event{Type: "SECOND"}, "room")
+	store.Broadcast(core.Event{Type: "THIRD"}, "server")
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	expected := []core.Envelope{
+		{Op: core.OpHello},
+		{Op: core.OpDispatch, Type: "FIRST", Seq: 1},
+		{Op: core.OpDispatch, Type: "THIRD", Seq: 2},
+	}
+	for _, want := range expected {
+		var got core.Envelope
+		if err := conn.ReadJSON(&got); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if got.Op != want.Op || got.Type != want.Type || got.Seq != want.Seq {
+			t.Errorf("Expected %+v, got %+v", want, got)
+		}
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	store := core.NewTopicStore()
+	sessions := core.NewSessionStore()
+	identified := make(chan *core.Session, 1)
+	upgrader := websocket.Upgrader{}
+	// a gateway that identifies, or resumes the session in the query after the sequence number
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn := core.NewConn(ws, core.DefaultConnOptions)
+		defer conn.Close(websocket.CloseNormalClosure, "")
+
+		session := core.NewSession(conn, "user")
+		if id := r.URL.Query().Get("resume"); id != "" {
+			seq, _ := strconv.ParseInt(r.URL.Query().Get("seq"), 10, 64)
+			resumed, err := sessions.Resume(id, "user", conn, seq)
+			if err != nil {
+				if resumed != nil {
+					store.Unsubscribe(resumed)
+				}
+				session.Write(core.Envelope{Op: core.OpInvalidSession})
+				return
+			}
+			session = resumed
+		} else {
+			sessions.Add(session)
+			store.Subscribe(session, "room")
+			identified <- session
+		}
+		defer sessions.Detach(session, conn, func() { store.Unsubscribe(session) })
+
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	dial := func(query string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?"+query, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		return conn
+	}
+
+	read := func(conn *websocket.Conn) core.Envelope {
+		var envelope core.Envelope
+		if err := conn.ReadJSON(&envelope); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return envelope
+	}
+
+	first := dial("")
+	session := <-identified
+	store.Broadcast(core.Event{Type: "FIRST"}, "room")
+	if got := read(first); got.Seq != 1 {
+		t.Fatalf("Expected the first dispatch, got %+v", got)
+	}
+
+	// the dispatches sent while disconnected are buffered
+	first.Close()
+	store.Broadcast(core.Event{Type: "SECOND"}, "room")
+	store.Broadcast(core.Event{Type: "THIRD"}, "room")
+
+	second := dial("resume=" + url.QueryEscape(session.ID) + "&seq=1")
+	for _, expected := range []string{"SECOND", "THIRD"} {
+		if got := read(second); got.Type != expected {
+			t.Fatalf("Expected %s to be replayed, got %+v", expected, got)
+		}
+	}
+
+	t.Run("Should not resume once the missed dispatches overflowed", func(t *testing.T) {
+		for range core.ReplayBufferSize + 1 {
+			store.Broadcast(core.Event{Type: "FLOOD"}, "room")
+		}
+
+		third := dial("resume=" + url.QueryEscape(session.ID) + "&seq=3")
+		if got := read(third); got.Op != core.OpInvalidSession {
+			t.Errorf("Expected an invalid session, got %+v", got)
+		}
+		if len(store.Subscribers("room")) != 0 {
+			t.Error("Expected the session to be unsubscribed")
+		}
+	})
+
+	t.Run("Should not resume unknown sessions", func(t *testing.T) {
+		conn := dial("resume=unknown&seq=0")
+		if got := read(conn); got.Op != core.OpInvalidSession {
+			t.Errorf("Expected an invalid session, got %+v", got)
+		}
+	})
+}
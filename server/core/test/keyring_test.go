@@ -0,0 +1,138 @@
+package core_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/khalidibnwalid/Luma/core"
+)
+
+func mustGenerateKey(t *testing.T, kid, alg string) *core.SigningKey {
+	key, err := core.GenerateSigningKey(kid, alg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return key
+}
+
+func TestKeyringSignParse(t *testing.T) {
+	for _, alg := range []string{core.AlgHS256, core.AlgES256, core.AlgEdDSA} {
+		t.Run("Should sign and parse "+alg, func(t *testing.T) {
+			keys := core.NewKeyring(time.Hour)
+			keys.Add(mustGenerateKey(t, "k1", alg), true)
+
+			token, err := core.GenerateJwtToken(keys, "user", "session")
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			parsed, claims, ok := keys.Parse(token)
+			if !ok {
+				t.Fatal("Expected token to be valid")
+			}
+			if parsed.Header["kid"] != "k1" {
+				t.Errorf("Expected kid k1, got %v", parsed.Header["kid"])
+			}
+			if claims["sub"] != "user" {
+				t.Errorf("Expected sub user, got %v", claims["sub"])
+			}
+		})
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	t.Run("Should accept tokens of a retired key during the grace window", func(t *testing.T) {
+		keys := core.NewKeyring(time.Hour)
+		keys.Add(mustGenerateKey(t, "old", core.AlgHS256), true)
+		token, _ := core.GenerateJwtToken(keys, "user", "session")
+
+		keys.Rotate(mustGenerateKey(t, "new", core.AlgEdDSA))
+
+		if _, _, ok := keys.Parse(token); !ok {
+			t.Error("Expected token of the retired key to be valid")
+		}
+
+		newToken, _ := core.GenerateJwtToken(keys, "user", "session")
+		parsed, _, ok := keys.Parse(newToken)
+		if !ok || parsed.Header["kid"] != "new" {
+			t.Error("Expected new tokens to be signed with the new key")
+		}
+	})
+
+	t.Run("Should reject tokens of a retired key after the grace window", func(t *testing.T) {
+		keys := core.NewKeyring(time.Hour)
+		old := mustGenerateKey(t, "old", core.AlgES256)
+		keys.Add(old, true)
+		token, _ := core.GenerateJwtToken(keys, "user", "session")
+
+		keys.Rotate(mustGenerateKey(t, "new", core.AlgES256))
+		old.RetiredAt = time.Now().Add(-2 * time.Hour)
+
+		if _, _, ok := keys.Parse(token); ok {
+			t.Error("Expected token of the expired key to be rejected")
+		}
+		if len(keys.JWKS().Keys) != 1 {
+			t.Error("Expected the expired key to be removed from the JWKS")
+		}
+	})
+
+	t.Run("Should check tokens without kid against the legacy key", func(t *testing.T) {
+		keys := core.NewKeyringFromSecret("SECRET")
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user"}).SignedString([]byte("SECRET"))
+
+		if _, _, ok := keys.Parse(token); !ok {
+			t.Error("Expected legacy token to be valid")
+		}
+	})
+}
+
+func TestKeyringRejects(t *testing.T) {
+	keys := core.NewKeyring(time.Hour)
+	keys.Add(mustGenerateKey(t, "k1", core.AlgHS256), true)
+
+	t.Run("Should reject unknown kid", func(t *testing.T) {
+		other := core.NewKeyring(time.Hour)
+		other.Add(mustGenerateKey(t, "k2", core.AlgHS256), true)
+		token, _ := core.GenerateJwtToken(other, "user", "session")
+
+		if _, _, ok := keys.Parse(token); ok {
+			t.Error("Expected token with unknown kid to be rejected")
+		}
+	})
+
+	t.Run("Should reject a different algorithm than the key's", func(t *testing.T) {
+		// signed with the right kid but none as algorithm
+		token := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"sub": "user"})
+		token.Header["kid"] = "k1"
+		tokenString, _ := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+		if _, _, ok := keys.Parse(tokenString); ok {
+			t.Error("Expected token with mismatched algorithm to be rejected")
+		}
+	})
+}
+
+func TestKeyringJWKS(t *testing.T) {
+	keys := core.NewKeyring(time.Hour)
+	keys.Add(mustGenerateKey(t, "hmac", core.AlgHS256), false)
+	keys.Add(mustGenerateKey(t, "ec", core.AlgES256), false)
+	keys.Add(mustGenerateKey(t, "ed", core.AlgEdDSA), true)
+
+	set := keys.JWKS()
+	if len(set.Keys) != 2 {
+		t.Fatalf("Expected 2 public keys, got %d", len(set.Keys))
+	}
+
+	for _, key := range set.Keys {
+		if key.Kid == "hmac" {
+			t.Error("Expected HS256 keys to never be published")
+		}
+		if key.Kid == "ec" && (key.Kty != "EC" || len(key.X) != 43 || len(key.Y) != 43) {
+			t.Errorf("Unexpected EC key: %+v", key)
+		}
+		if key.Kid == "ed" && (key.Kty != "OKP" || len(key.X) != 43) {
+			t.Errorf("Unexpected OKP key: %+v", key)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/testutil"
+)
+
+func TestOIDCProviderFlow(t *testing.T) {
+	issuer := testutil.NewMockOIDCIssuer(t)
+	provider := issuer.Provider("mock", "http://localhost/callback")
+	ctx := context.Background()
+
+	verifier, challenge, err := core.GeneratePKCE()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", challenge)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	t.Run("Should exchange the code for the verified claims", func(t *testing.T) {
+		callback := issuer.Authorize(t, authURL)
+		if callback.Query().Get("state") != "state" {
+			t.Errorf("Expected state to be passed back, got %s", callback.Query().Get("state"))
+		}
+
+		claims, err := provider.Exchange(ctx, callback.Query().Get("code"), verifier, "nonce")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if claims.Subject != issuer.Identity.Subject || claims.Email != issuer.Identity.Email || !claims.EmailVerified {
+			t.Errorf("Unexpected claims: %+v", claims)
+		}
+	})
+
+	t.Run("Should reject a wrong code verifier", func(t *testing.T) {
+		callback := issuer.Authorize(t, authURL)
+		if _, err := provider.Exchange(ctx, callback.Query().Get("code"), "wrong-verifier", "nonce"); !errors.Is(err, core.ErrOIDCExchange) {
+			t.Errorf("Expected ErrOIDCExchange, got %v", err)
+		}
+	})
+
+	t.Run("Should reject a nonce mismatch", func(t *testing.T) {
+		callback := issuer.Authorize(t, authURL)
+		if _, err := provider.Exchange(ctx, callback.Query().Get("code"), verifier, "other"); !errors.Is(err, core.ErrOIDCInvalidToken) {
+			t.Errorf("Expected ErrOIDCInvalidToken, got %v", err)
+		}
+	})
+
+	t.Run("Should send the PKCE challenge and scopes", func(t *testing.T) {
+		parsed, _ := url.Parse(authURL)
+		query := parsed.Query()
+		if query.Get("code_challenge") != challenge || query.Get("code_challenge_method") != "S256" {
+			t.Errorf("Expected the S256 challenge, got %s", parsed.RawQuery)
+		}
+		if query.Get("scope") != "openid email profile" {
+			t.Errorf("Unexpected scope %s", query.Get("scope"))
+		}
+	})
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	issuer := testutil.NewMockOIDCIssuer(t)
+	provider := issuer.Provider("mock", "http://localhost/callback")
+	ctx := context.Background()
+
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":   issuer.Issuer(),
+			"aud":   issuer.ClientID,
+			"sub":   "subject",
+			"nonce": "nonce",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+		}
+	}
+
+	if _, err := provider.VerifyIDToken(ctx, issuer.SignIDToken(validClaims()), "nonce"); err != nil {
+		t.Fatalf("Expected token to be valid, got %v", err)
+	}
+
+	cases := map[string]func(jwt.MapClaims){
+		"another audience": func(c jwt.MapClaims) { c["aud"] = "other-client" },
+		"another issuer":   func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" },
+		"an expired token": func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no expiry":        func(c jwt.MapClaims) { delete(c, "exp") },
+		"no subject":       func(c jwt.MapClaims) { delete(c, "sub") },
+	}
+
+	for name, mutate := range cases {
+		t.Run("Should reject "+name, func(t *testing.T) {
+			claims := validClaims()
+			mutate(claims)
+			if _, err := provider.VerifyIDToken(ctx, issuer.SignIDToken(claims), "nonce"); !errors.Is(err, core.ErrOIDCInvalidToken) {
+				t.Errorf("Expected ErrOIDCInvalidToken, got %v", err)
+			}
+		})
+	}
+
+	t.Run("Should reject a token not signed by the issuer", func(t *testing.T) {
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims()).SignedString([]byte("secret"))
+		if _, err := provider.VerifyIDToken(ctx, token, "nonce"); !errors.Is(err, core.ErrOIDCInvalidToken) {
+			t.Errorf("Expected ErrOIDCInvalidToken, got %v", err)
+		}
+	})
+}
+
+func TestOIDCStateToken(t *testing.T) {
+	keys := core.NewKeyringFromSecret("SECRET")
+	token, err := core.GenerateOIDCStateToken(keys, core.OIDCState{Provider: "mock", State: "state", Nonce: "nonce", CodeVerifier: "verifier"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	state, ok := core.ValidateOIDCStateToken(keys, token)
+	if !ok || state.Provider != "mock" || state.State != "state" || state.Nonce != "nonce" || state.CodeVerifier != "verifier" || state.LinkUserID != "" {
+		t.Errorf("Unexpected state: %+v", state)
+	}
+
+	// access tokens aren't state tokens
+	accessToken, _ := core.GenerateJwtToken(keys, "user", "session")
+	if _, ok := core.ValidateOIDCStateToken(keys, accessToken); ok {
+		t.Error("Expected access token to be rejected")
+	}
+}
@@ -0,0 +1,253 @@
+package core_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/khalidibnwalid/Luma/core"
+)
+
+// socket writes the events as they are
+type socket struct {
+	conn   *websocket.Conn
+	userID string
+}
+
+func (s *socket) UserID() string {
+	return s.userID
+}
+
+func (s *socket) Send(event core.Event) error {
+	return s.conn.WriteJSON(event)
+}
+
+func (s *socket) Leave(topicID string, code int, reason string) {
+	s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	s.conn.Close()
+}
+
+// mockTopicServer subscribes every connection to the topics of the store as the user in the query,
+// and signals each subscription on the returned channel
+func mockTopicServer(t *testing.T, store *core.TopicStore, topicIDs ...string) (*httptest.Server, <-chan struct{}) {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	subscribed := make(chan struct{}, 8)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sub := &socket{conn: conn, userID: r.URL.Query().Get("user")}
+		store.Subscribe(sub, topicIDs...)
+		defer store.Unsubscribe(sub)
+		subscribed <- struct{}{}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, subscribed
+}
+
+func dialTopic(t *testing.T, server *httptest.Server, userID string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?user="+userID, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestTopicDisconnectUser(t *testing.T) {
+	store := core.NewTopicStore()
+	server, subscribed := mockTopicServer(t, store, "room")
+
+	kicked := dialTopic(t, server, "kicked")
+	other := dialTopic(t, server, "other")
+	for range 2 {
+		select {
+		case <-subscribed:
+		case <-time.After(time.Second):
+			t.Fatal("Expected 2 subscribers")
+		}
+	}
+
+	store.DisconnectUser("kicked", core.CloseKicked, "kicked", "room", "unknown")
+
+	kicked.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := kicked.ReadMessage()
+	if !websocket.IsCloseError(err, core.CloseKicked) {
+		t.Errorf("Expected a kicked close, got %v", err)
+	}
+
+	store.Broadcast(core.Event{Type: "STILL_HERE"}, "room")
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	var event core.Event
+	if err := other.ReadJSON(&event); err != nil || event.Type != "STILL_HERE" {
+		t.Errorf("Expected the other user to stay connected, got %+v %v", event, err)
+	}
+}
+
+func TestTopicStoreBroadcastAndClose(t *testing.T) {
+	store := core.NewTopicStore()
+	server, subscribed := mockTopicServer(t, store, "server", "room")
+
+	conn := dialTopic(t, server, "member")
+	select {
+	case <-subscribed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a subscriber")
+	}
+
+	// subscribers of both topics receive it once
+	store.Broadcast(core.Event{Type: "FIRST"}, "server", "room", "unknown")
+	store.Broadcast(core.Event{Type: "SECOND"}, "room")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for _, expected := range []string{"FIRST", "SECOND"} {
+		var event core.Event
+		if err := conn.ReadJSON(&event); err != nil || event.Type != expected {
+			t.Fatalf("Expected %s, got %+v %v", expected, event, err)
+		}
+	}
+
+	store.Close("server deleted", "room")
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("Expected a going away close, got %v", err)
+	}
+
+	if store.SubscriberCount("room") != 0 || store.SubscriberCount("server") != 1 {
+		t.Error("Expected only the room to be removed")
+	}
+}
+
+func TestTopicStoreOnlineUsers(t *testing.T) {
+	store := core.NewTopicStore()
+	server, subscribed := mockTopicServer(t, store, "room")
+
+	dialTopic(t, server, "online")
+	select {
+	case <-subscribed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a subscriber")
+	}
+
+	online := store.OnlineUsers("online", "offline")
+	if !online["online"] || online["offline"] {
+		t.Errorf("Expected only the connected user to be online, got %v", online)
+	}
+}
+
+// recorder counts the events it receives, or fails every send
+type recorder struct {
+	userID   string
+	failing  bool
+	received atomic.Int64
+}
+
+func (s *recorder) UserID() string {
+	return s.userID
+}
+
+func (s *recorder) Send(event core.Event) error {
+	if s.failing {
+		return errors.New("closed")
+	}
+	s.received.Add(1)
+	return nil
+}
+
+func (s *recorder) Leave(topicID string, code int, reason string) {}
+
+func TestTopicStoreConcurrentSubscribers(t *testing.T) {
+	const subscribers = 200
+	store := core.NewTopicStore()
+	recorders := make([]*recorder, subscribers)
+	for i := range recorders {
+		recorders[i] = &recorder{userID: strconv.Itoa(i)}
+	}
+
+	// subscribing while the room is being broadcast to
+	var wg sync.WaitGroup
+	for _, r := range recorders {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			store.Subscribe(r, "room", r.userID)
+		}()
+		go func() {
+			defer wg.Done()
+			store.Broadcast(core.Event{Type: "TYPING_START"}, "room")
+			store.OnlineUsers(r.userID)
+			store.SubscriberCount("room")
+		}()
+	}
+	wg.Wait()
+
+	if count := store.SubscriberCount("room"); count != subscribers {
+		t.Fatalf("Expected %d subscribers, got %d", subscribers, count)
+	}
+	if store.Len() != subscribers+1 {
+		t.Fatalf("Expected a topic per user and the room, got %d", store.Len())
+	}
+
+	for _, r := range recorders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			before := r.received.Load()
+			store.Broadcast(core.Event{Type: "MESSAGE_CREATE"}, "room", r.userID)
+			if r.received.Load() == before {
+				t.Errorf("Expected subscriber %s to receive its own broadcast", r.userID)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// topics are removed with their last subscriber
+	for i, r := range recorders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i%2 == 0 {
+				store.Unsubscribe(r)
+			} else {
+				store.Unsubscribe(r, r.userID)
+				store.DisconnectUser(r.userID, core.CloseKicked, "kicked", "room")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if store.Len() != 0 || store.SubscriberCount("room") != 0 {
+		t.Errorf("Expected every topic to be removed, got %d", store.Len())
+	}
+}
+
+func TestTopicStoreRemovesFailingSubscribers(t *testing.T) {
+	store := core.NewTopicStore()
+	alive := &recorder{userID: "alive"}
+	closed := &recorder{userID: "closed", failing: true}
+	store.Subscribe(alive, "server", "room")
+	store.Subscribe(closed, "room", "closed")
+
+	store.Broadcast(core.Event{Type: "MESSAGE_CREATE"}, "server", "room", "closed")
+	if alive.received.Load() != 1 {
+		t.Errorf("Expected the event once, got %d", alive.received.Load())
+	}
+	if store.SubscriberCount("room") != 1 || store.SubscriberCount("closed") != 0 || store.Len() != 2 {
+		t.Errorf("Expected the failing subscriber and its empty topic to be removed, got %d topics", store.Len())
+	}
+}
@@ -0,0 +1,73 @@
+package core_test
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/khalidibnwalid/Luma/core"
+)
+
+// RFC 6238 appendix B secret for SHA1
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestTotpCode(t *testing.T) {
+	// RFC 6238 appendix B vectors truncated to 6 digits
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+
+	for unix, expected := range vectors {
+		code, err := core.TotpCode(rfcSecret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if code != expected {
+			t.Errorf("Expected code at %d to be %s, got %s", unix, expected, code)
+		}
+	}
+}
+
+func TestValidateTotp(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	t.Run("Should accept codes of adjacent steps", func(t *testing.T) {
+		previous, _ := core.TotpCode(rfcSecret, now.Add(-core.TotpPeriod*time.Second))
+		step, ok := core.ValidateTotp(rfcSecret, previous, now)
+		if !ok {
+			t.Fatalf("Expected previous code to be accepted")
+		}
+		if step != core.TotpStep(now)-1 {
+			t.Errorf("Expected step %d, got %d", core.TotpStep(now)-1, step)
+		}
+	})
+
+	t.Run("Should reject codes outside the skew window", func(t *testing.T) {
+		old, _ := core.TotpCode(rfcSecret, now.Add(-5*core.TotpPeriod*time.Second))
+		if _, ok := core.ValidateTotp(rfcSecret, old, now); ok {
+			t.Errorf("Expected old code to be rejected")
+		}
+	})
+
+	t.Run("Should reject malformed codes", func(t *testing.T) {
+		if _, ok := core.ValidateTotp(rfcSecret, "12345", now); ok {
+			t.Errorf("Expected short code to be rejected")
+		}
+	})
+}
+
+func TestTotpURI(t *testing.T) {
+	uri := core.TotpURI("Luma", "user@example.com", rfcSecret)
+	if !strings.HasPrefix(uri, "otpauth://totp/Luma:user@example.com?") {
+		t.Errorf("Unexpected uri %s", uri)
+	}
+	if !strings.Contains(uri, "secret="+rfcSecret) {
+		t.Errorf("Expected uri to contain the secret, got %s", uri)
+	}
+}
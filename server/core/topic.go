@@ -1,60 +1,259 @@
 package core
 
 import (
-	"log"
 	"sync"
 
 	"github.com/gorilla/websocket"
 )
 
+// Subscriber is a live connection subscribed to topics, a room socket or a gateway session
+type Subscriber interface {
+	UserID() string
+	// Send delivers the event, a failing subscriber is removed from the topic and has to close itself
+	Send(event Event) error
+	// Leave is called once the subscriber was removed from the topic by the server, e.g. the user was kicked,
+	// room sockets close with the code while gateway sessions stay connected to their other topics
+	Leave(topicID string, code int, reason string)
+}
+
 type Topic struct {
-	ID      string
-	Clients map[*websocket.Conn]bool
-	mu      sync.Mutex // Mutex to protect the Clients map
+	ID          string
+	Subscribers map[Subscriber]struct{}
+	mu          sync.Mutex // Mutex to protect the Subscribers map
+}
+
+// Event is a real-time notification sent to the subscribers of a topic
+type Event struct {
+	Type string `json:"t"`
+	Data any    `json:"d"`
 }
 
+// TopicStore is the registry of topics, a topic exists while it has subscribers
 type TopicStore struct {
-	Topics map[string]*Topic
+	mu     sync.RWMutex // guards topics, taken before the lock of a topic
+	topics map[string]*Topic
 }
 
 func NewTopicStore() *TopicStore {
 	return &TopicStore{
-		Topics: make(map[string]*Topic),
+		topics: make(map[string]*Topic),
 	}
 }
 
-func (s *TopicStore) GetOrCreateRoom(id string) *Topic {
-	if topic, exists := s.Topics[id]; exists {
-		return topic
-	}
-	topic := &Topic{
-		ID:      id,
-		Clients: make(map[*websocket.Conn]bool),
-	}
-	s.Topics[id] = topic
-	return topic
+func (t *Topic) Subscribe(sub Subscriber) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Subscribers[sub] = struct{}{}
 }
 
-func (t *Topic) Subscribe(conn *websocket.Conn) {
+func (t *Topic) Unsubscribe(sub Subscriber) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	t.Clients[conn] = true
+	delete(t.Subscribers, sub)
 }
 
-func (t *Topic) Unsubscribe(conn *websocket.Conn) {
+// Len returns the number of subscribers
+func (t *Topic) Len() int {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	delete(t.Clients, conn)
-	conn.Close()
+	return len(t.Subscribers)
 }
 
-func (t *Topic) Publish(message []byte) {
+func (t *Topic) Publish(event Event) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	for ws := range t.Clients {
-		if err := ws.WriteMessage(websocket.TextMessage, message); err != nil {
-			log.Println("Broadcast error:", err)
-			t.Unsubscribe(ws)
+	for sub := range t.Subscribers {
+		if err := sub.Send(event); err != nil {
+			delete(t.Subscribers, sub)
+		}
+	}
+}
+
+// Disconnect removes the subscribers of the user with the close code and reason
+func (t *Topic) Disconnect(userID string, code int, reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for sub := range t.Subscribers {
+		if sub.UserID() != userID {
+			continue
+		}
+		delete(t.Subscribers, sub)
+		sub.Leave(t.ID, code, reason)
+	}
+}
+
+// Subscribe subscribes to the given topics, creating the missing ones
+func (s *TopicStore) Subscribe(sub Subscriber, topicIDs ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range topicIDs {
+		topic, exists := s.topics[id]
+		if !exists {
+			topic = &Topic{
+				ID:          id,
+				Subscribers: make(map[Subscriber]struct{}),
+			}
+			s.topics[id] = topic
+		}
+		topic.Subscribe(sub)
+	}
+}
+
+// Unsubscribe removes the subscriber from the given topics, or from every topic when none are given,
+// e.g. once its connection is closed. Topics left without subscribers are removed
+func (s *TopicStore) Unsubscribe(sub Subscriber, topicIDs ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(topicIDs) == 0 {
+		for id, topic := range s.topics {
+			topic.Unsubscribe(sub)
+			s.removeIfEmpty(id, topic)
+		}
+		return
+	}
+
+	for _, id := range topicIDs {
+		if topic, exists := s.topics[id]; exists {
+			topic.Unsubscribe(sub)
+			s.removeIfEmpty(id, topic)
+		}
+	}
+}
+
+// removeIfEmpty is called with the store locked
+func (s *TopicStore) removeIfEmpty(id string, topic *Topic) {
+	if topic.Len() == 0 && s.topics[id] == topic {
+		delete(s.topics, id)
+	}
+}
+
+// Subscribers returns the subscribers of the topic, if any
+func (s *TopicStore) Subscribers(topicID string) []Subscriber {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	topic, exists := s.topics[topicID]
+	if !exists {
+		return nil
+	}
+
+	topic.mu.Lock()
+	defer topic.mu.Unlock()
+	subs := make([]Subscriber, 0, len(topic.Subscribers))
+	for sub := range topic.Subscribers {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// SubscriberCount returns the number of subscribers of the topic, 0 if it doesn't exist
+func (s *TopicStore) SubscriberCount(topicID string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	topic, exists := s.topics[topicID]
+	if !exists {
+		return 0
+	}
+	return topic.Len()
+}
+
+// Len returns the number of topics, which all have subscribers
+func (s *TopicStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.topics)
+}
+
+// DisconnectUser removes the user from the given topics with the close code and reason, e.g. the rooms of a server
+func (s *TopicStore) DisconnectUser(userID string, code int, reason string, topicIDs ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range topicIDs {
+		if topic, exists := s.topics[id]; exists {
+			topic.Disconnect(userID, code, reason)
+			s.removeIfEmpty(id, topic)
+		}
+	}
+}
+
+// Broadcast publishes the event to the given topics that have subscribers, e.g. a server and its rooms,
+// subscribers of many of the topics receive it once
+func (s *TopicStore) Broadcast(event Event, topicIDs ...string) {
+	// topics that lost subscribers which failed, removed once the read lock is released
+	var failed []string
+
+	s.mu.RLock()
+	// whether the send failed, subscribers that failed are removed from every topic of the broadcast
+	sent := make(map[Subscriber]bool)
+	for _, id := range topicIDs {
+		topic, exists := s.topics[id]
+		if !exists {
+			continue
+		}
+		topic.mu.Lock()
+		for sub := range topic.Subscribers {
+			sendFailed, done := sent[sub]
+			if !done {
+				sendFailed = sub.Send(event) != nil
+				sent[sub] = sendFailed
+			}
+			if sendFailed {
+				delete(topic.Subscribers, sub)
+				failed = append(failed, id)
+			}
+		}
+		topic.mu.Unlock()
+	}
+	s.mu.RUnlock()
+
+	if len(failed) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range failed {
+		if topic, exists := s.topics[id]; exists {
+			s.removeIfEmpty(id, topic)
+		}
+	}
+}
+
+// Close removes every subscriber of the given topics with a going away and the reason, and removes the topics
+func (s *TopicStore) Close(reason string, topicIDs ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range topicIDs {
+		topic, exists := s.topics[id]
+		if !exists {
+			continue
+		}
+		topic.mu.Lock()
+		for sub := range topic.Subscribers {
+			delete(topic.Subscribers, sub)
+			sub.Leave(id, websocket.CloseGoingAway, reason)
+		}
+		topic.mu.Unlock()
+		delete(s.topics, id)
+	}
+}
+
+// OnlineUsers returns which of the users have at least one connection in any topic
+func (s *TopicStore) OnlineUsers(userIDs ...string) map[string]bool {
+	wanted := make(map[string]bool, len(userIDs))
+	for _, id := range userIDs {
+		wanted[id] = true
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	online := make(map[string]bool)
+	for _, topic := range s.topics {
+		topic.mu.Lock()
+		for sub := range topic.Subscribers {
+			if wanted[sub.UserID()] {
+				online[sub.UserID()] = true
+			}
 		}
+		topic.mu.Unlock()
 	}
+	return online
 }
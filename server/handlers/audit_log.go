@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"gorm.io/gorm"
+)
+
+// clients can attach a reason to any audited request with this header
+const AuditReasonHeader = "X-Audit-Log-Reason"
+
+// audit records an action of the current user in the server's audit log, a failure to record
+// is logged and doesn't fail the request since the action already happened
+func (ctx *ServerContext) audit(r *http.Request, serverID uuid.UUID, action, targetType, targetID string, changes map[string]models.AuditChange) {
+	rCtx := r.Context()
+	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+
+	entry := models.NewAuditLogEntry().
+		WithServerID(serverID).
+		WithActorID(userID).
+		WithAction(action).
+		WithTarget(targetType, targetID).
+		WithChanges(changes).
+		WithReason(r.Header.Get(AuditReasonHeader))
+
+	if err := entry.Create(ctx.Database.Client.WithContext(rCtx)); err != nil {
+		log.Printf("Error recording %s in the audit log of server [%s]: %v\n", action, serverID, err)
+	}
+}
+
+// paginated with ?before=<entry id>&limit=, filtered with ?action=&actorId=&targetId=
+func (ctx *ServerContext) GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	server, err := ctx.validateRoomsServerID(w, r)
+	if err != nil {
+		return
+	}
+
+	if _, ok := ctx.requirePermission(w, r, server, models.PermissionViewAuditLog); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := models.AuditLogFilter{
+		Action:   query.Get("action"),
+		TargetID: query.Get("targetId"),
+	}
+
+	for param, id := range map[string]*uuid.UUID{"actorId": &filter.ActorID, "before": &filter.Before} {
+		if value := query.Get(param); value != "" {
+			if *id, err = uuid.Parse(value); err != nil {
+				newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid "+param)
+				return
+			}
+		}
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid limit")
+			return
+		}
+	}
+
+	entries, err := models.GetAuditLog(ctx.Database.Client.WithContext(r.Context()), server.ID, filter)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid before")
+			return
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	json, _ := json.Marshal(entries)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"gorm.io/gorm"
+)
+
+type botWithToken struct {
+	*models.Bot
+	Token    string          `json:"token"`
+	ApiToken models.ApiToken `json:"apiToken"`
+}
+
+// UsersOnly rejects bots from the routes of the user's own account, e.g. sessions, two-factor and identities
+func UsersOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if middlewares.IsBot(r) {
+			newErrorResponse(w, http.StatusForbidden, EnumForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// validateBotManager checks the server in the path and that the user (not a bot) is allowed to manage its bots
+func (ctx *ServerContext) validateBotManager(w http.ResponseWriter, r *http.Request) (*models.RoomsServer, bool) {
+	server, err := ctx.validateRoomsServerID(w, r)
+	if err != nil {
+		return nil, false
+	}
+
+	userID := r.Context().Value(middlewares.CtxUserIDKey).(uuid.UUID)
+	if middlewares.IsBot(r) || server.OwnerID != userID {
+		newErrorResponse(w, http.StatusForbidden, EnumForbidden)
+		return nil, false
+	}
+
+	return server, true
+}
+
+// validateBotID checks the bot in the path belongs to the server
+func (ctx *ServerContext) validateBotID(w http.ResponseWriter, r *http.Request, server *models.RoomsServer) (*models.Bot, bool) {
+	botID, err := uuid.Parse(r.PathValue("botId"))
+	if err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumBotIdInvalid)
+		return nil, false
+	}
+
+	bot := models.NewBot().WithUserID(botID).WithServerID(server.ID)
+	if err := bot.Find(ctx.Database.Client.WithContext(r.Context())); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			newErrorResponse(w, http.StatusNotFound, EnumBotNotFound)
+			return nil, false
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return nil, false
+	}
+
+	return bot, true
+}
+
+// issueApiToken creates a token for the bot and returns the raw token (shown once)
+func (ctx *ServerContext) issueApiToken(db *gorm.DB, botID uuid.UUID, name string) (*models.ApiToken, string, error) {
+	token := models.NewApiToken().WithBotID(botID).WithName(name)
+	raw, err := token.Generate()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := token.Create(db); err != nil {
+		return nil, "", err
+	}
+
+	return token, raw, nil
+}
+
+// create a bot in the server, responds with the bot and its first API token
+func (ctx *ServerContext) PostBot(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	db := ctx.Database.Client.WithContext(rCtx)
+	server, ok := ctx.validateBotManager(w, r)
+	if !ok {
+		return
+	}
+
+	var t struct {
+		Name string `json:"name"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+		return
+	}
+
+	if t.Name == "" {
+		newErrorResponse(w, http.StatusBadRequest, EnumUsernameRequired)
+		return
+	}
+
+	if err := models.NewUser().WithUsername(t.Name).FindByUsername(db); err == nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumUsernameExists)
+		return
+	} else if err != gorm.ErrRecordNotFound {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+	bot := models.NewBot().WithServerID(server.ID).WithOwnerID(userID)
+	if err := bot.Create(db, t.Name); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	token, raw, err := ctx.issueApiToken(db, bot.UserID, "default")
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	json, _ := json.Marshal(botWithToken{
+		Bot:      bot,
+		Token:    raw,
+		ApiToken: *token,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(json)
+}
+
+func (ctx *ServerContext) GetBots(w http.ResponseWriter, r *http.Request) {
+	server, ok := ctx.validateBotManager(w, r)
+	if !ok {
+		return
+	}
+
+	bots, err := models.GetServerBots(ctx.Database.Client.WithContext(r.Context()), server.ID)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	json, _ := json.Marshal(bots)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// delete the bot user, its tokens stop working right away
+func (ctx *ServerContext) DeleteBot(w http.ResponseWriter, r *http.Request) {
+	server, ok := ctx.validateBotManager(w, r)
+	if !ok {
+		return
+	}
+
+	bot, ok := ctx.validateBotID(w, r, server)
+	if !ok {
+		return
+	}
+
+	if err := bot.Delete(ctx.Database.Client.WithContext(r.Context())); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ctx *ServerContext) GetBotTokens(w http.ResponseWriter, r *http.Request) {
+	server, ok := ctx.validateBotManager(w, r)
+	if !ok {
+		return
+	}
+
+	bot, ok := ctx.validateBotID(w, r, server)
+	if !ok {
+		return
+	}
+
+	tokens, err := models.GetBotTokens(ctx.Database.Client.WithContext(r.Context()), bot.UserID)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	json, _ := json.Marshal(tokens)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// issue an additional token, e.g. to rotate a token without downtime
+func (ctx *ServerContext) PostBotToken(w http.ResponseWriter, r *http.Request) {
+	server, ok := ctx.validateBotManager(w, r)
+	if !ok {
+		return
+	}
+
+	bot, ok := ctx.validateBotID(w, r, server)
+	if !ok {
+		return
+	}
+
+	var t struct {
+		Name string `json:"name"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+		return
+	}
+
+	token, raw, err := ctx.issueApiToken(ctx.Database.Client.WithContext(r.Context()), bot.UserID, t.Name)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	json, _ := json.Marshal(botWithToken{
+		Bot:      bot,
+		Token:    raw,
+		ApiToken: *token,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(json)
+}
+
+func (ctx *ServerContext) DeleteBotToken(w http.ResponseWriter, r *http.Request) {
+	db := ctx.Database.Client.WithContext(r.Context())
+	server, ok := ctx.validateBotManager(w, r)
+	if !ok {
+		return
+	}
+
+	bot, ok := ctx.validateBotID(w, r, server)
+	if !ok {
+		return
+	}
+
+	tokenID, err := uuid.Parse(r.PathValue("tokenId"))
+	if err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumApiTokenIdInvalid)
+		return
+	}
+
+	token := models.NewApiToken().WithID(tokenID).WithBotID(bot.UserID)
+	if err := token.Find(db); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			newErrorResponse(w, http.StatusNotFound, EnumApiTokenNotFound)
+			return
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	if err := token.Revoke(db); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/models"
+	"gorm.io/gorm"
+)
+
+// the server directory, paginated with ?after=<server id>&limit=, searched with ?q=,
+// filtered with one or more ?tag= and sorted with ?sort=popular|new
+func (ctx *ServerContext) GetDiscoverableServers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := models.DiscoveryFilter{
+		Query: query.Get("q"),
+		Sort:  query.Get("sort"),
+	}
+
+	if filter.Sort == "" {
+		filter.Sort = models.DiscoverySortPopular
+	}
+	if filter.Sort != models.DiscoverySortPopular && filter.Sort != models.DiscoverySortNew {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid sort")
+		return
+	}
+
+	if tags := query["tag"]; len(tags) > 0 {
+		normalized, err := models.NormalizeTags(tags)
+		if err != nil {
+			newErrorResponse(w, http.StatusBadRequest, EnumServerTagsInvalid)
+			return
+		}
+		filter.Tags = normalized
+	}
+
+	var err error
+	if after := query.Get("after"); after != "" {
+		if filter.After, err = uuid.Parse(after); err != nil {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid after")
+			return
+		}
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid limit")
+			return
+		}
+	}
+
+	servers, err := models.DiscoverServers(ctx.Database.Client.WithContext(r.Context()), filter)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid after")
+			return
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	if servers == nil {
+		servers = []models.DiscoverableServer{}
+	}
+
+	json, _ := json.Marshal(servers)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"gorm.io/gorm"
+)
+
+const emailVerificationTokenTTL = 48 * time.Hour
+
+// sendVerificationMail issues a new verification token (invalidating older ones) and mails it in the background
+func (s *ServerContext) sendVerificationMail(db *gorm.DB, user *models.User) error {
+	if err := models.InvalidateUserTokens(db, user.ID, models.TokenPurposeEmailVerification); err != nil {
+		return err
+	}
+
+	token := models.NewUserToken().WithUserID(user.ID).WithPurpose(models.TokenPurposeEmailVerification)
+	rawToken, err := token.Generate(emailVerificationTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	if err := token.Create(db); err != nil {
+		return err
+	}
+
+	mail := core.Mail{
+		To:      user.Email,
+		Subject: "Verify your Luma email",
+		Body: fmt.Sprintf("Hi %s,\n\nConfirm your email address with the link below, it expires in %s:\n\n%s/verify-email?token=%s\n",
+			user.Username, emailVerificationTokenTTL, s.AppURL, url.QueryEscape(rawToken)),
+	}
+
+	go func() {
+		if err := s.Mailer.Send(context.Background(), mail); err != nil {
+			log.Printf("Error sending verification mail: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// Resend the verification mail to the logged in user
+func (s *ServerContext) PostEmailVerification(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	db := s.Database.Client.WithContext(rCtx)
+	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+
+	user := models.NewUser().WithID(userID)
+	if err := user.FindByID(db); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			newErrorResponse(w, http.StatusNotFound, EnumUserDoesNotExist)
+			return
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	if user.IsVerified() {
+		newErrorResponse(w, http.StatusBadRequest, EnumEmailAlreadyVerified)
+		return
+	}
+
+	if err := s.sendVerificationMail(db, user); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	newOkResponse(w, http.StatusAccepted, EnumVerificationSent)
+}
+
+// Confirm the email with the mailed token
+func (s *ServerContext) PostEmailVerificationConfirm(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	db := s.Database.Client.WithContext(rCtx)
+
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+		return
+	}
+
+	if req.Token == "" {
+		newErrorResponse(w, http.StatusBadRequest, EnumVerificationTokenInvalid)
+		return
+	}
+
+	token := models.NewUserToken()
+	if err := token.Consume(db, req.Token, models.TokenPurposeEmailVerification); err != nil {
+		if err == models.ErrUserTokenInvalid {
+			newErrorResponse(w, http.StatusBadRequest, EnumVerificationTokenInvalid)
+			return
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	user := models.NewUser().WithID(token.UserID)
+	if err := user.MarkVerified(db); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	newOkResponse(w, http.StatusOK, EnumEmailVerified)
+}
@@ -40,11 +40,52 @@ const (
 	EnumEmailInvalid     = "EMAIL_INVALID"
 )
 
+// email verification error codes
+const (
+	EnumEmailNotVerified         = "EMAIL_NOT_VERIFIED"
+	EnumEmailAlreadyVerified     = "EMAIL_ALREADY_VERIFIED"
+	EnumVerificationTokenInvalid = "VERIFICATION_TOKEN_INVALID"
+)
+
+// session error codes
+const (
+	EnumRefreshTokenInvalid = "REFRESH_TOKEN_INVALID"
+	EnumSessionIdInvalid    = "SESSION_ID_INVALID"
+	EnumSessionNotFound     = "SESSION_NOT_FOUND"
+	EnumResetTokenInvalid   = "RESET_TOKEN_INVALID"
+	// replaces USER_DOES_NOT_EXIST and PASSWORD_INVALID on login when generic login errors are enabled
+	EnumInvalidCredentials   = "INVALID_CREDENTIALS"
+	EnumTooManyLoginAttempts = "TOO_MANY_LOGIN_ATTEMPTS"
+)
+
+// identity provider error codes, also passed to the client app in the callback redirect
+const (
+	EnumOIDCProviderNotFound  = "OIDC_PROVIDER_NOT_FOUND"
+	EnumOIDCStateInvalid      = "OIDC_STATE_INVALID"
+	EnumOIDCLoginFailed       = "OIDC_LOGIN_FAILED"
+	EnumIdentityEmailRequired = "IDENTITY_EMAIL_REQUIRED"
+	EnumIdentityEmailInUse    = "IDENTITY_EMAIL_IN_USE"
+	EnumIdentityAlreadyLinked = "IDENTITY_ALREADY_LINKED"
+	EnumIdentityIdInvalid     = "IDENTITY_ID_INVALID"
+	EnumIdentityNotFound      = "IDENTITY_NOT_FOUND"
+	EnumLastLoginMethod       = "LAST_LOGIN_METHOD"
+)
+
+// two-factor error codes
+const (
+	EnumTwoFactorAlreadyEnabled = "TWO_FACTOR_ALREADY_ENABLED"
+	EnumTwoFactorNotEnrolled    = "TWO_FACTOR_NOT_ENROLLED"
+	EnumTwoFactorCodeRequired   = "TWO_FACTOR_CODE_REQUIRED"
+	EnumTwoFactorCodeInvalid    = "TWO_FACTOR_CODE_INVALID"
+	EnumChallengeTokenInvalid   = "CHALLENGE_TOKEN_INVALID"
+)
+
 const (
 	EnumInternalServerError = "INTERNAL_SERVER_ERROR"
 	EnumNotFound            = "NOT_FOUND"
 	EnumBadRequest          = "BAD_REQUEST"
 	EnumUnauthorized        = "UNAUTHORIZED"
+	EnumForbidden           = "FORBIDDEN"
 )
 
 const (
@@ -53,5 +94,41 @@ const (
 	EnumServerNotFound   = "SERVER_NOT_FOUND"
 	EnumServerTypeRequired = "SERVER_TYPE_REQUIRED"
 	EnumServerNameRequired = "SERVER_NAME_REQUIRED"
+	EnumBotIdInvalid       = "BOT_ID_INVALID"
+	EnumBotNotFound        = "BOT_NOT_FOUND"
+	EnumApiTokenIdInvalid  = "API_TOKEN_ID_INVALID"
+	EnumApiTokenNotFound   = "API_TOKEN_NOT_FOUND"
+	EnumServerIconInvalid  = "SERVER_ICON_INVALID"
+	EnumNotOwner           = "NOT_OWNER"
+	EnumOwnerCannotLeave   = "OWNER_CANNOT_LEAVE"
+	EnumServerTagsInvalid  = "SERVER_TAGS_INVALID"
 	
 )
+
+const (
+	EnumNotMember            = "NOT_MEMBER"
+	EnumMissingPermission    = "MISSING_PERMISSION"
+	EnumRoleIdInvalid        = "ROLE_ID_INVALID"
+	EnumRoleNotFound         = "ROLE_NOT_FOUND"
+	EnumRoleNameRequired     = "ROLE_NAME_REQUIRED"
+	EnumRoleHierarchy        = "ROLE_HIERARCHY"
+	EnumDefaultRoleImmutable = "DEFAULT_ROLE_IMMUTABLE"
+	EnumUserIdInvalid        = "USER_ID_INVALID"
+	EnumMemberNotFound       = "MEMBER_NOT_FOUND"
+
+	EnumOverwriteTargetInvalid = "OVERWRITE_TARGET_INVALID"
+)
+
+const (
+	EnumCategoryIdInvalid    = "CATEGORY_ID_INVALID"
+	EnumCategoryNotFound     = "CATEGORY_NOT_FOUND"
+	EnumCategoryNameRequired = "CATEGORY_NAME_REQUIRED"
+	EnumRoomNameRequired     = "ROOM_NAME_REQUIRED"
+)
+
+const (
+	EnumInviteRequired = "INVITE_REQUIRED"
+	EnumInviteNotFound = "INVITE_NOT_FOUND"
+	EnumInviteExpired  = "INVITE_EXPIRED"
+	EnumBanned         = "BANNED"
+)
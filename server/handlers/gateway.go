@@ -0,0 +1,453 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"gorm.io/gorm"
+)
+
+// gateway events, commands share the names of the events they cause
+const (
+	EventReady           = "READY"
+	EventResumed         = "RESUMED"
+	EventMessageCreate   = "MESSAGE_CREATE"
+	EventTypingStart     = "TYPING_START"
+	EventReadStateUpdate = "READ_STATE_UPDATE"
+	EventRoomCreate      = "ROOM_CREATE"
+	EventRoomUpdate      = "ROOM_UPDATE"
+	EventRoomDelete      = "ROOM_DELETE"
+	EventServerCreate    = "SERVER_CREATE" // the user joined a server
+	EventServerRemove    = "SERVER_REMOVE" // the user left or was removed from a server
+)
+
+// gatewayServer is a server of the user with the rooms they can view
+type gatewayServer struct {
+	models.RoomsServerWithStatus
+	Rooms []models.RoomWithStatus `json:"rooms"`
+}
+
+// visibleRooms returns the rooms of the server the member can view, category overwrites apply first
+func visibleRooms(db *gorm.DB, server *models.RoomsServer, member *models.MemberPermissions) ([]models.RoomWithStatus, error) {
+	rooms, err := server.GetRooms(db, member.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	overwrites, err := models.GetServerOverwrites(db, server.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make([]models.RoomWithStatus, 0, len(rooms))
+	for _, room := range rooms {
+		var categoryOverwrites []models.PermissionOverwrite
+		if room.CategoryID != nil {
+			categoryOverwrites = overwrites[*room.CategoryID]
+		}
+		if member.InRoom(categoryOverwrites, overwrites[room.ID]).Has(models.PermissionViewRooms) {
+			visible = append(visible, room)
+		}
+	}
+	return visible, nil
+}
+
+// loadGatewayServer returns the server with the rooms the user can view, and the topics to subscribe to
+func loadGatewayServer(db *gorm.DB, server models.RoomsServerWithStatus, userID uuid.UUID) (*gatewayServer, []string, error) {
+	member, err := models.LoadMemberPermissions(db, server.RoomsServer, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rooms, err := visibleRooms(db, server.RoomsServer, member)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	topicIDs := []string{server.ID.String()}
+	for _, room := range rooms {
+		topicIDs = append(topicIDs, room.ID.String())
+	}
+	return &gatewayServer{RoomsServerWithStatus: server, Rooms: rooms}, topicIDs, nil
+}
+
+// subscribeServer subscribes the gateway sessions of a new member to the server and the rooms they can view,
+// and dispatches the server to them
+func (ctx *ServerContext) subscribeServer(db *gorm.DB, store *core.TopicStore, server models.RoomsServerWithStatus, userID uuid.UUID) {
+	sessions := store.Subscribers(userID.String())
+	if len(sessions) == 0 {
+		return
+	}
+
+	gatewayServer, topicIDs, err := loadGatewayServer(db, server, userID)
+	if err != nil {
+		log.Printf("Error loading server [%s] for user [%s]: %v\n", server.ID, userID, err)
+		return
+	}
+
+	for _, session := range sessions {
+		store.Subscribe(session, topicIDs...)
+	}
+	store.Broadcast(core.Event{Type: EventServerCreate, Data: gatewayServer}, userID.String())
+}
+
+// subscribeRoom subscribes the gateway sessions of the members who can view the new room,
+// and dispatches the room to them
+func (ctx *ServerContext) subscribeRoom(db *gorm.DB, store *core.TopicStore, server *models.RoomsServer, room *models.Room) {
+	canView := make(map[string]bool)
+	for _, session := range store.Subscribers(server.ID.String()) {
+		userID := session.UserID()
+		if _, resolved := canView[userID]; !resolved {
+			permissions, err := models.ResolveRoomPermissions(db, server, room, uuid.MustParse(userID))
+			canView[userID] = err == nil && permissions.Has(models.PermissionViewRooms)
+		}
+		if canView[userID] {
+			store.Subscribe(session, room.ID.String())
+		}
+	}
+	store.Broadcast(core.Event{Type: EventRoomCreate, Data: room}, room.ID.String())
+}
+
+// syncRooms re-evaluates which rooms of the server the connected users can view once roles, overwrites
+// or categories changed, all of them when no user is given. Their gateway sessions are subscribed to the rooms
+// they gained with ROOM_CREATE and removed from the rooms they lost with ROOM_DELETE, room sockets of lost rooms are closed
+func (ctx *ServerContext) syncRooms(db *gorm.DB, store *core.TopicStore, server *models.RoomsServer, userIDs ...uuid.UUID) {
+	roomIDs, err := server.GetRoomIDs(db)
+	if err != nil {
+		log.Printf("Error getting the rooms of server [%s]: %v\n", server.ID, err)
+		return
+	}
+
+	wanted := make(map[string]bool, len(userIDs))
+	for _, id := range userIDs {
+		wanted[id.String()] = true
+	}
+
+	// the topics of the server each subscriber is in, by user
+	subscriptions := make(map[string]map[core.Subscriber]map[string]bool)
+	for _, topicID := range append([]string{server.ID.String()}, uuidStrings(roomIDs)...) {
+		for _, sub := range store.Subscribers(topicID) {
+			userID := sub.UserID()
+			if len(wanted) > 0 && !wanted[userID] {
+				continue
+			}
+			if subscriptions[userID] == nil {
+				subscriptions[userID] = make(map[core.Subscriber]map[string]bool)
+			}
+			if subscriptions[userID][sub] == nil {
+				subscriptions[userID][sub] = make(map[string]bool)
+			}
+			subscriptions[userID][sub][topicID] = true
+		}
+	}
+
+	for userID, subs := range subscriptions {
+		member, err := models.LoadMemberPermissions(db, server, uuid.MustParse(userID))
+		if err != nil {
+			log.Printf("Error loading the permissions of user [%s] in server [%s]: %v\n", userID, server.ID, err)
+			continue
+		}
+		rooms, err := visibleRooms(db, server, member)
+		if err != nil {
+			log.Printf("Error loading the rooms of user [%s] in server [%s]: %v\n", userID, server.ID, err)
+			continue
+		}
+
+		visible := make(map[string]bool, len(rooms))
+		for _, room := range rooms {
+			roomID := room.ID.String()
+			visible[roomID] = true
+			for sub, topics := range subs {
+				if session, ok := sub.(*core.Session); ok && !topics[roomID] {
+					store.Subscribe(session, roomID)
+					session.Send(core.Event{Type: EventRoomCreate, Data: room})
+				}
+			}
+		}
+
+		for _, roomID := range roomIDs {
+			id := roomID.String()
+			if visible[id] {
+				continue
+			}
+
+			var lost []*core.Session
+			subscribed := false
+			for sub, topics := range subs {
+				if !topics[id] {
+					continue
+				}
+				subscribed = true
+				if session, ok := sub.(*core.Session); ok {
+					lost = append(lost, session)
+				}
+			}
+			if !subscribed {
+				continue
+			}
+
+			store.DisconnectUser(userID, websocket.ClosePolicyViolation, "room access lost", id)
+			for _, session := range lost {
+				session.Send(core.Event{Type: EventRoomDelete, Data: map[string]uuid.UUID{
+					"id":       roomID,
+					"serverId": server.ID,
+				}})
+			}
+		}
+	}
+}
+
+func uuidStrings(ids []uuid.UUID) []string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+	return strs
+}
+
+// identify subscribes the session to the user's own topic, their servers and the rooms they can view,
+// and dispatches READY with all of them
+func (ctx *ServerContext) identify(db *gorm.DB, store *core.TopicStore, session *core.Session, user *models.User) error {
+	servers, err := models.NewServerUserStatus().WithUserID(user.ID).GetServers(db)
+	if err != nil {
+		return err
+	}
+
+	ready := struct {
+		SessionID string          `json:"sessionId"`
+		User      *models.User    `json:"user"`
+		Servers   []gatewayServer `json:"servers"`
+	}{
+		SessionID: session.ID,
+		User:      user,
+		Servers:   make([]gatewayServer, 0, len(servers)),
+	}
+
+	topicIDs := []string{user.ID.String()}
+	for _, server := range servers {
+		gatewayServer, serverTopicIDs, err := loadGatewayServer(db, server, user.ID)
+		if err != nil {
+			return err
+		}
+		ready.Servers = append(ready.Servers, *gatewayServer)
+		topicIDs = append(topicIDs, serverTopicIDs...)
+	}
+
+	store.Subscribe(session, topicIDs...)
+	return session.Send(core.Event{Type: EventReady, Data: ready})
+}
+
+// handleCommand runs a command of an identified session, failures are answered with OpCommandError
+// and the command's nonce, if any
+func (ctx *ServerContext) handleCommand(db *gorm.DB, store *core.TopicStore, session *core.Session, user *models.User, command core.Command) {
+	// the fields of every command, each uses its own
+	var t struct {
+		Nonce         string    `json:"nonce"`
+		RoomID        uuid.UUID `json:"roomId"`
+		Content       string    `json:"content"`
+		LastReadMsgID uuid.UUID `json:"lastReadMsgId"`
+	}
+
+	fail := func(code string) {
+		session.Write(core.Envelope{Op: core.OpCommandError, Type: command.Type, Data: map[string]string{
+			"code":  code,
+			"nonce": t.Nonce,
+		}})
+	}
+
+	if err := json.Unmarshal(command.Data, &t); err != nil {
+		fail(EnumBadRequest)
+		return
+	}
+
+	room := models.NewRoom()
+	if err := room.FindByID(db, t.RoomID); err != nil {
+		fail(EnumNotFound)
+		return
+	}
+
+	server := models.NewRoomsServer()
+	if err := server.FindByID(db, room.ServerID); err != nil {
+		fail(EnumInternalServerError)
+		return
+	}
+
+	// rooms the user can't view are not found
+	permissions, err := models.ResolveRoomPermissions(db, server, room, user.ID)
+	if err != nil || !permissions.Has(models.PermissionViewRooms) {
+		fail(EnumNotFound)
+		return
+	}
+
+	switch command.Type {
+	case EventMessageCreate:
+		if t.Content == "" {
+			fail(EnumBadRequest)
+			return
+		}
+
+		if _, err := ctx.sendMessage(db, store, server, room, user, t.Content); err != nil {
+			switch err {
+			case errRoomAccessLost:
+				fail(EnumNotFound)
+			case errCannotSend:
+				fail(EnumMissingPermission)
+			default:
+				fail(EnumInternalServerError)
+			}
+		}
+
+	case EventTypingStart:
+		if !permissions.Has(models.PermissionSendMessages) {
+			fail(EnumMissingPermission)
+			return
+		}
+
+		store.Broadcast(core.Event{Type: EventTypingStart, Data: map[string]uuid.UUID{
+			"roomId": room.ID,
+			"userId": user.ID,
+		}}, room.ID.String())
+
+	case EventReadStateUpdate:
+		status := models.NewRoomUserStatus().WithUserID(user.ID).WithRoomID(room.ID)
+		if err := status.Find(db); err != nil {
+			fail(EnumNotFound)
+			return
+		}
+
+		if status.LastReadMsgID != t.LastReadMsgID {
+			status.LastReadMsgID = t.LastReadMsgID
+			if err := status.Update(db); err != nil {
+				fail(EnumInternalServerError)
+				return
+			}
+		}
+
+		// the other sessions of the user catch up
+		store.Broadcast(core.Event{Type: EventReadStateUpdate, Data: map[string]uuid.UUID{
+			"roomId":        room.ID,
+			"lastReadMsgId": status.LastReadMsgID,
+		}}, user.ID.String())
+
+	default:
+		fail(EnumBadRequest)
+	}
+}
+
+// Gateway is the real-time connection of a client: after hello the client identifies and receives READY
+// with its servers and rooms, then the events of all of them, and sends its commands over the same connection.
+// A client that lost its connection resumes its session on a new one and receives the dispatches it missed
+func (ctx *ServerContext) Gateway(store *core.TopicStore, sessions *core.SessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rCtx := r.Context()
+		userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+		db := ctx.Database.Client.WithContext(rCtx)
+
+		user := models.NewUser().WithID(userID)
+		if err := user.FindByID(db); err != nil {
+			newErrorResponse(w, http.StatusUnauthorized, EnumUnauthorized)
+			return
+		}
+
+		// clients that stop sending heartbeats are closed
+		opt := core.DefaultConnOptions
+		opt.IdleTimeout = core.HeartbeatTimeout
+		conn, err := ctx.upgrade(w, r, opt)
+		if err != nil {
+			log.Println("Upgrade error:", err)
+			return
+		}
+		defer conn.Close(websocket.CloseNormalClosure, "")
+
+		session := core.NewSession(conn, userID.String())
+		session.Write(core.Envelope{Op: core.OpHello, Data: map[string]int64{
+			"heartbeatInterval": core.HeartbeatInterval.Milliseconds(),
+		}})
+
+		// the session outlives the connection until it is resumed or expires
+		identified := false
+		defer func() {
+			if identified {
+				resumable := session
+				sessions.Detach(resumable, conn, func() { store.Unsubscribe(resumable) })
+			}
+		}()
+
+		for {
+			var command core.Command
+			if err := conn.ReadJSON(&command); err != nil {
+				var syntaxErr *json.SyntaxError
+				var typeErr *json.UnmarshalTypeError
+				if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+					session.Close(core.CloseDecodeError, "invalid frame")
+				}
+				return
+			}
+
+			switch command.Op {
+			case core.OpHeartbeat:
+				session.Write(core.Envelope{Op: core.OpHeartbeatAck})
+
+			case core.OpIdentify:
+				if identified {
+					session.Close(core.CloseAlreadyIdentified, "already identified")
+					return
+				}
+				if err := ctx.identify(db, store, session, user); err != nil {
+					log.Printf("Error identifying user [%s]: %v\n", userID, err)
+					store.Unsubscribe(session)
+					session.Close(websocket.CloseInternalServerErr, "identify failed")
+					return
+				}
+				sessions.Add(session)
+				identified = true
+
+			case core.OpResume:
+				if identified {
+					session.Close(core.CloseAlreadyIdentified, "already identified")
+					return
+				}
+
+				var t struct {
+					SessionID string `json:"sessionId"`
+					Seq       int64  `json:"seq"`
+				}
+				if err := json.Unmarshal(command.Data, &t); err != nil {
+					session.Close(core.CloseDecodeError, "invalid frame")
+					return
+				}
+
+				resumed, err := sessions.Resume(t.SessionID, userID.String(), conn, t.Seq)
+				if err != nil {
+					if err == core.ErrReplayUnavailable {
+						store.Unsubscribe(resumed)
+					}
+					// the client re-syncs through REST then identifies on this connection
+					session.Write(core.Envelope{Op: core.OpInvalidSession, Data: false})
+					continue
+				}
+				session = resumed
+				identified = true
+				session.Send(core.Event{Type: EventResumed})
+
+			case core.OpCommand:
+				if !identified {
+					session.Close(core.CloseNotIdentified, "not identified")
+					return
+				}
+				ctx.handleCommand(db, store, session, user, command)
+
+			default:
+				session.Close(core.CloseUnknownOpcode, "unknown opcode")
+				return
+			}
+		}
+	}
+}
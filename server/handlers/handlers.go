@@ -4,18 +4,29 @@ import (
 	"log"
 
 	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/models"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 )
 
 // TODO remove mongoDB Db and Client
 type ServerContext struct {
-	Db        *mongo.Database
-	Client    *mongo.Client
-	Database  *core.DBClient
-	JwtSecret string
+	Db       *mongo.Database
+	Client   *mongo.Client
+	Database *core.DBClient
+	// signing keys of access and challenge tokens
+	Keys   *core.Keyring
+	Mailer core.Mailer
+	// public URL of the client app, used to build links sent by email
+	AppURL string
+	// respond to failed logins with INVALID_CREDENTIALS only, so account existence isn't leaked
+	GenericLoginErrors bool
+	// OpenID Connect providers by name
+	OIDCProviders map[string]*core.OIDCProvider
+	// open websockets, closed together on shutdown
+	Connections *core.Connections
 }
 
-func NewServerContext(mongoUri, postgresUri, dbName, jwtSecret string) *ServerContext {
+func NewServerContext(mongoUri, postgresUri, dbName string, keys *core.Keyring) *ServerContext {
 	var (
 		client *mongo.Client
 		err    error
@@ -49,11 +60,16 @@ func NewServerContext(mongoUri, postgresUri, dbName, jwtSecret string) *ServerCo
 
 	log.Printf("Postgres Connected!\n")
 
+	if err = models.MigrateRoomGroups(db.Client); err != nil {
+		log.Panicf("Room groups migration error: %v", err)
+	}
+
 	ctx := &ServerContext{
-		Db:        client.Database(dbName),
-		Client:    client,
-		Database:  db,
-		JwtSecret: jwtSecret,
+		Db:          client.Database(dbName),
+		Client:      client,
+		Database:    db,
+		Keys:        keys,
+		Connections: core.NewConnections(),
 	}
 	return ctx
 }
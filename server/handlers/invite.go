@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"gorm.io/gorm"
+)
+
+// invites can't live longer than a week, unless they never expire
+const maxInviteAge = 7 * 24 * time.Hour
+
+func (ctx *ServerContext) PostInvite(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	server, err := ctx.validateRoomsServerID(w, r)
+	if err != nil {
+		return
+	}
+
+	if _, ok := ctx.requirePermission(w, r, server, models.PermissionCreateInvites); !ok {
+		return
+	}
+
+	// maxAge in seconds, 0 never expires, maxUses 0 is unlimited
+	var t struct {
+		MaxAge  int `json:"maxAge"`
+		MaxUses int `json:"maxUses"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+		return
+	}
+
+	maxAge := time.Duration(t.MaxAge) * time.Second
+	if maxAge < 0 || maxAge > maxInviteAge || t.MaxUses < 0 {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid maxAge or maxUses")
+		return
+	}
+
+	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+	invite := models.NewInvite().WithServerID(server.ID).WithCreatorID(userID).WithMaxAge(maxAge).WithMaxUses(t.MaxUses)
+	if err := invite.Create(ctx.Database.Client.WithContext(rCtx)); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	ctx.audit(r, server.ID, models.AuditInviteCreate, models.AuditTargetInvite, invite.Code, models.DiffChanges(nil, invite))
+
+	json, _ := json.Marshal(invite)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(json)
+}
+
+func (ctx *ServerContext) GetInvites(w http.ResponseWriter, r *http.Request) {
+	server, err := ctx.validateRoomsServerID(w, r)
+	if err != nil {
+		return
+	}
+
+	if _, ok := ctx.requirePermission(w, r, server, models.PermissionManageServer); !ok {
+		return
+	}
+
+	invites, err := models.GetServerInvites(ctx.Database.Client.WithContext(r.Context()), server.ID)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	json, _ := json.Marshal(invites)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// creators can revoke their own invites, others need ManageServer
+func (ctx *ServerContext) DeleteInvite(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	db := ctx.Database.Client.WithContext(rCtx)
+	server, err := ctx.validateRoomsServerID(w, r)
+	if err != nil {
+		return
+	}
+
+	permissions, ok := ctx.requirePermission(w, r, server, 0)
+	if !ok {
+		return
+	}
+
+	invite := models.NewInvite().WithCode(r.PathValue("code"))
+	if err := invite.Find(db); err != nil || invite.ServerID != server.ID {
+		newErrorResponse(w, http.StatusNotFound, EnumInviteNotFound)
+		return
+	}
+
+	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+	if invite.CreatorID != userID && !permissions.Has(models.PermissionManageServer) {
+		newErrorResponse(w, http.StatusForbidden, EnumMissingPermission)
+		return
+	}
+
+	if err := invite.Delete(db); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	ctx.audit(r, server.ID, models.AuditInviteDelete, models.AuditTargetInvite, invite.Code, models.DiffChanges(invite, nil))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// joins the server of the invite
+func (ctx *ServerContext) RedeemInvite(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := ctx.Database.Client.WithContext(r.Context())
+
+		invite := models.NewInvite().WithCode(r.PathValue("code"))
+		if err := invite.Find(db); err != nil {
+			if err == gorm.ErrRecordNotFound {
+				newErrorResponse(w, http.StatusNotFound, EnumInviteNotFound)
+				return
+			}
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		if !invite.IsValid() {
+			newErrorResponse(w, http.StatusGone, EnumInviteExpired)
+			return
+		}
+
+		server := models.NewRoomsServer()
+		if err := server.FindByID(db, invite.ServerID); err != nil {
+			newErrorResponse(w, http.StatusNotFound, EnumServerNotFound)
+			return
+		}
+
+		ctx.joinServer(w, r, store, server, invite)
+	}
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"gorm.io/gorm"
+)
+
+// loginThrottles are the throttles a login attempt counts against, the client IP and the submitted identifier,
+// the identifier is used so unknown accounts are throttled exactly like existing ones.
+// Once the account is resolved the user ID is counted too, so its username and email share one budget
+type loginThrottles struct {
+	ip      *models.LoginThrottle
+	account *models.LoginThrottle
+	user    *models.LoginThrottle // nil until the account is resolved
+}
+
+func newLoginThrottles(r *http.Request, usernameOrEmail string) *loginThrottles {
+	return &loginThrottles{
+		ip:      models.NewLoginThrottle().WithKey("ip:" + middlewares.ClientIP(r)),
+		account: models.NewLoginThrottle().WithKey(accountThrottleKey(usernameOrEmail)),
+	}
+}
+
+// newTwoFactorThrottles are the throttles of the second login step, wrong codes count like wrong passwords
+func newTwoFactorThrottles(r *http.Request, userID uuid.UUID) *loginThrottles {
+	t := &loginThrottles{
+		ip: models.NewLoginThrottle().WithKey("ip:" + middlewares.ClientIP(r)),
+	}
+	return t.withUser(userID)
+}
+
+func accountThrottleKey(usernameOrEmail string) string {
+	return "account:" + strings.ToLower(usernameOrEmail)
+}
+
+func userThrottleKey(userID uuid.UUID) string {
+	return "user:" + userID.String()
+}
+
+func (t *loginThrottles) withUser(userID uuid.UUID) *loginThrottles {
+	t.user = models.NewLoginThrottle().WithKey(userThrottleKey(userID))
+	return t
+}
+
+// the account throttles that are known, the IP one aside
+func (t *loginThrottles) accounts() []*models.LoginThrottle {
+	var throttles []*models.LoginThrottle
+	for _, throttle := range []*models.LoginThrottle{t.account, t.user} {
+		if throttle != nil {
+			throttles = append(throttles, throttle)
+		}
+	}
+	return throttles
+}
+
+// check responds with 429 and a Retry-After header when the IP or the account is locked
+func (t *loginThrottles) check(w http.ResponseWriter, db *gorm.DB) bool {
+	var lockout time.Duration
+	for _, throttle := range append(t.accounts(), t.ip) {
+		locked, err := throttle.LockedFor(db)
+		if err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return false
+		}
+		lockout = max(lockout, locked)
+	}
+
+	if lockout > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(lockout.Seconds()))))
+		newErrorResponse(w, http.StatusTooManyRequests, EnumTooManyLoginAttempts)
+		return false
+	}
+
+	return true
+}
+
+func (t *loginThrottles) fail(db *gorm.DB) {
+	if err := t.ip.RecordFailure(db, models.IPThrottlePolicy); err != nil {
+		log.Printf("Error recording login failure: %v", err)
+	}
+	for _, throttle := range t.accounts() {
+		if err := throttle.RecordFailure(db, models.AccountThrottlePolicy); err != nil {
+			log.Printf("Error recording login failure: %v", err)
+		}
+	}
+}
+
+// resetLoginThrottles forgets the failures of the user once they are fully logged in, after the second factor if enabled,
+// under both identifiers since either may have been used.
+// The IP counter isn't reset, an attacker could otherwise clear it by logging into their own account
+func resetLoginThrottles(db *gorm.DB, user *models.User) {
+	keys := []string{userThrottleKey(user.ID), accountThrottleKey(user.Username)}
+	if user.Email != "" {
+		keys = append(keys, accountThrottleKey(user.Email))
+	}
+
+	for _, key := range keys {
+		if err := models.NewLoginThrottle().WithKey(key).Reset(db); err != nil {
+			log.Printf("Error resetting login throttle: %v", err)
+		}
+	}
+}
+
+// loginFailed records the failure and responds with the specific error, or the generic one when enabled
+func (s *ServerContext) loginFailed(w http.ResponseWriter, db *gorm.DB, throttles *loginThrottles, enum string) {
+	throttles.fail(db)
+	if s.GenericLoginErrors {
+		enum = EnumInvalidCredentials
+	}
+	newErrorResponse(w, http.StatusUnauthorized, enum)
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// verifyDummyPassword spends the same time as a real password check,
+// so the response time doesn't tell whether the account exists
+func verifyDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		hash, salt, _ := core.CreateHashWithSalt("dummy-password")
+		dummyHash = core.SerializeHashWithSalt(hash, salt)
+	})
+	_ = core.VerifyHashWithSalt(password, dummyHash)
+}
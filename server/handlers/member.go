@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"gorm.io/gorm"
+)
+
+const maxNicknameLength = 32
+
+// paginated with ?after=<user id>&limit=, filtered with ?q=&roleId=,
+// the presence of each member comes from their live connections
+func (ctx *ServerContext) GetMembers(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		server, err := ctx.validateRoomsServerID(w, r)
+		if err != nil {
+			return
+		}
+
+		if _, ok := ctx.requirePermission(w, r, server, 0); !ok {
+			return
+		}
+
+		query := r.URL.Query()
+		filter := models.MemberFilter{Query: query.Get("q")}
+
+		for param, id := range map[string]*uuid.UUID{"roleId": &filter.RoleID, "after": &filter.After} {
+			if value := query.Get(param); value != "" {
+				if *id, err = uuid.Parse(value); err != nil {
+					newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid "+param)
+					return
+				}
+			}
+		}
+
+		if limit := query.Get("limit"); limit != "" {
+			if filter.Limit, err = strconv.Atoi(limit); err != nil {
+				newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid limit")
+				return
+			}
+		}
+
+		db := ctx.Database.Client.WithContext(r.Context())
+		if filter.RoleID != uuid.Nil {
+			role := models.NewRole().WithID(filter.RoleID).WithServerID(server.ID)
+			if err := role.Find(db); err != nil {
+				newErrorResponse(w, http.StatusNotFound, EnumRoleNotFound)
+				return
+			}
+			// everyone has @everyone
+			if role.IsDefault {
+				filter.RoleID = uuid.Nil
+			}
+		}
+
+		members, err := models.GetServerMembers(db, server.ID, filter)
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid after")
+				return
+			}
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		userIDs := make([]string, len(members))
+		for i, member := range members {
+			userIDs[i] = member.User.ID.String()
+		}
+		online := store.OnlineUsers(userIDs...)
+		for i := range members {
+			if online[userIDs[i]] {
+				members[i].Presence = models.PresenceOnline
+			}
+		}
+
+		json, _ := json.Marshal(members)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+	}
+}
+
+// members set their own nickname, an empty one shows the username
+func (ctx *ServerContext) PatchMemberMe(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+	server, err := ctx.validateRoomsServerID(w, r)
+	if err != nil {
+		return
+	}
+
+	var t struct {
+		Nickname *string `json:"nickname"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+		return
+	}
+
+	status := models.NewServerUserStatus().WithUserID(userID).WithServerID(server.ID)
+	if err := status.Find(ctx.Database.Client.WithContext(rCtx)); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			newErrorResponse(w, http.StatusForbidden, EnumNotMember)
+			return
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	if t.Nickname != nil {
+		if len([]rune(*t.Nickname)) > maxNicknameLength {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Nickname is too long")
+			return
+		}
+
+		previous := status.Nickname
+		if err := status.SetNickname(ctx.Database.Client.WithContext(rCtx), *t.Nickname); err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		ctx.audit(r, server.ID, models.AuditMemberUpdate, models.AuditTargetMember, userID.String(),
+			models.DiffChanges(map[string]string{"nickname": previous}, map[string]string{"nickname": status.Nickname}))
+	}
+
+	json, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// members leave the server with their room statuses and roles, the owner has to transfer
+// or delete the server instead
+func (ctx *ServerContext) LeaveServer(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rCtx := r.Context()
+		userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+		server, err := ctx.validateRoomsServerID(w, r)
+		if err != nil {
+			return
+		}
+
+		// bots belong to the server they were created in
+		if middlewares.IsBot(r) {
+			newErrorResponse(w, http.StatusForbidden, EnumForbidden)
+			return
+		}
+
+		if server.OwnerID == userID {
+			newErrorResponse(w, http.StatusBadRequest, EnumOwnerCannotLeave)
+			return
+		}
+
+		if _, ok := ctx.findMember(w, r, server.ID, userID); !ok {
+			return
+		}
+
+		if err := models.RemoveMember(ctx.Database.Client.WithContext(rCtx), server.ID, userID); err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		ctx.disconnectMember(r, store, server, userID, websocket.CloseNormalClosure, "left")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"gorm.io/gorm"
+)
+
+const maxTimeout = 28 * 24 * time.Hour
+
+// longer bans are made permanent with no duration
+const maxBanDuration = 10 * 365 * 24 * time.Hour
+
+// validateModerationTarget parses the user in the path and checks the user can moderate them,
+// nobody can moderate the owner or themselves, and members only moderate those below their top role
+func (ctx *ServerContext) validateModerationTarget(w http.ResponseWriter, r *http.Request, server *models.RoomsServer) (uuid.UUID, bool) {
+	rCtx := r.Context()
+	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+
+	targetID, err := uuid.Parse(r.PathValue("userId"))
+	if err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumUserIdInvalid)
+		return uuid.Nil, false
+	}
+
+	if targetID == userID {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "You can't moderate yourself")
+		return uuid.Nil, false
+	}
+
+	if targetID == server.OwnerID {
+		newErrorResponse(w, http.StatusForbidden, EnumRoleHierarchy)
+		return uuid.Nil, false
+	}
+
+	if userID == server.OwnerID {
+		return targetID, true
+	}
+
+	db := ctx.Database.Client.WithContext(rCtx)
+	top, err := models.TopRolePosition(db, server, userID)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return uuid.Nil, false
+	}
+	targetTop, err := models.TopRolePosition(db, server, targetID)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return uuid.Nil, false
+	}
+
+	if targetTop >= top {
+		newErrorResponse(w, http.StatusForbidden, EnumRoleHierarchy)
+		return uuid.Nil, false
+	}
+
+	return targetID, true
+}
+
+// findMember responds with 404 if the user is not a member of the server
+func (ctx *ServerContext) findMember(w http.ResponseWriter, r *http.Request, serverID, userID uuid.UUID) (*models.ServerUserStatus, bool) {
+	status := models.NewServerUserStatus().WithUserID(userID).WithServerID(serverID)
+	if err := status.Find(ctx.Database.Client.WithContext(r.Context())); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			newErrorResponse(w, http.StatusNotFound, EnumMemberNotFound)
+			return nil, false
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return nil, false
+	}
+	return status, true
+}
+
+// disconnectMember closes the room sockets of the user in the server with the code and unsubscribes their gateway sessions,
+// which are told why
+func (ctx *ServerContext) disconnectMember(r *http.Request, store *core.TopicStore, server *models.RoomsServer, userID uuid.UUID, code int, reason string) {
+	store.DisconnectUser(userID.String(), code, reason, ctx.serverTopicIDs(r, server)...)
+	store.Broadcast(core.Event{Type: EventServerRemove, Data: map[string]any{
+		"id":     server.ID,
+		"reason": reason,
+	}}, userID.String())
+}
+
+// kicked members can join again
+func (ctx *ServerContext) KickMember(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		server, err := ctx.validateRoomsServerID(w, r)
+		if err != nil {
+			return
+		}
+
+		if _, ok := ctx.requirePermission(w, r, server, models.PermissionKickMembers); !ok {
+			return
+		}
+
+		targetID, ok := ctx.validateModerationTarget(w, r, server)
+		if !ok {
+			return
+		}
+
+		if _, ok := ctx.findMember(w, r, server.ID, targetID); !ok {
+			return
+		}
+
+		if err := models.RemoveMember(ctx.Database.Client.WithContext(r.Context()), server.ID, targetID); err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		ctx.disconnectMember(r, store, server, targetID, core.CloseKicked, "kicked")
+		ctx.audit(r, server.ID, models.AuditMemberKick, models.AuditTargetMember, targetID.String(), nil)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (ctx *ServerContext) GetBans(w http.ResponseWriter, r *http.Request) {
+	server, err := ctx.validateRoomsServerID(w, r)
+	if err != nil {
+		return
+	}
+
+	if _, ok := ctx.requirePermission(w, r, server, models.PermissionBanMembers); !ok {
+		return
+	}
+
+	bans, err := models.GetServerBans(ctx.Database.Client.WithContext(r.Context()), server.ID)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	json, _ := json.Marshal(bans)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// bans the user and removes them from the server, users who are not members can be banned too
+func (ctx *ServerContext) PutBan(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rCtx := r.Context()
+		db := ctx.Database.Client.WithContext(rCtx)
+		server, err := ctx.validateRoomsServerID(w, r)
+		if err != nil {
+			return
+		}
+
+		if _, ok := ctx.requirePermission(w, r, server, models.PermissionBanMembers); !ok {
+			return
+		}
+
+		targetID, ok := ctx.validateModerationTarget(w, r, server)
+		if !ok {
+			return
+		}
+
+		// duration in seconds, 0 is permanent
+		var t struct {
+			Reason   string `json:"reason"`
+			Duration int    `json:"duration"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+			return
+		}
+
+		// checked in seconds, a large duration would overflow once converted
+		if t.Duration < 0 || t.Duration > int(maxBanDuration/time.Second) {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid duration")
+			return
+		}
+
+		if err := models.NewUser().WithID(targetID).FindByID(db); err != nil {
+			newErrorResponse(w, http.StatusNotFound, EnumUserDoesNotExist)
+			return
+		}
+
+		userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+		ban := models.NewBan().WithServerID(server.ID).WithUserID(targetID).WithModeratorID(userID).
+			WithReason(t.Reason).WithDuration(time.Duration(t.Duration) * time.Second)
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := ban.Upsert(tx); err != nil {
+				return err
+			}
+			return models.RemoveMember(tx, server.ID, targetID)
+		})
+		if err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		ctx.disconnectMember(r, store, server, targetID, core.CloseKicked, "banned")
+		ctx.audit(r, server.ID, models.AuditMemberBan, models.AuditTargetMember, targetID.String(), models.DiffChanges(nil, map[string]any{
+			"reason":    ban.Reason,
+			"expiresAt": ban.ExpiresAt,
+		}))
+
+		json, _ := json.Marshal(ban)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+	}
+}
+
+func (ctx *ServerContext) DeleteBan(w http.ResponseWriter, r *http.Request) {
+	server, err := ctx.validateRoomsServerID(w, r)
+	if err != nil {
+		return
+	}
+
+	if _, ok := ctx.requirePermission(w, r, server, models.PermissionBanMembers); !ok {
+		return
+	}
+
+	targetID, err := uuid.Parse(r.PathValue("userId"))
+	if err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumUserIdInvalid)
+		return
+	}
+
+	if err := models.NewBan().WithServerID(server.ID).WithUserID(targetID).Delete(ctx.Database.Client.WithContext(r.Context())); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	ctx.audit(r, server.ID, models.AuditMemberUnban, models.AuditTargetMember, targetID.String(), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// timed out members keep reading but can't send until the deadline, a zero duration clears the timeout
+func (ctx *ServerContext) PutMemberTimeout(w http.ResponseWriter, r *http.Request) {
+	server, err := ctx.validateRoomsServerID(w, r)
+	if err != nil {
+		return
+	}
+
+	if _, ok := ctx.requirePermission(w, r, server, models.PermissionTimeoutMembers); !ok {
+		return
+	}
+
+	targetID, ok := ctx.validateModerationTarget(w, r, server)
+	if !ok {
+		return
+	}
+
+	status, ok := ctx.findMember(w, r, server.ID, targetID)
+	if !ok {
+		return
+	}
+
+	// duration in seconds
+	var t struct {
+		Duration int `json:"duration"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+		return
+	}
+
+	if t.Duration < 0 || t.Duration > int(maxTimeout/time.Second) {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid duration")
+		return
+	}
+	duration := time.Duration(t.Duration) * time.Second
+
+	var until *time.Time
+	if duration > 0 {
+		deadline := time.Now().Add(duration)
+		until = &deadline
+	}
+
+	previous := status.TimeoutUntil
+	if err := status.SetTimeout(ctx.Database.Client.WithContext(r.Context()), until); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	ctx.audit(r, server.ID, models.AuditMemberTimeout, models.AuditTargetMember, targetID.String(),
+		models.DiffChanges(map[string]any{"timeoutUntil": previous}, map[string]any{"timeoutUntil": until}))
+
+	json, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
@@ -0,0 +1,379 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"gorm.io/gorm"
+)
+
+// pages of the client app the provider callback redirects to
+const (
+	oidcLoginPath      = "/login"
+	oidcTwoFactorPath  = "/login/2fa"
+	oidcIdentitiesPath = "/settings/identities"
+)
+
+var (
+	errIdentityEmailRequired = errors.New("the provider didn't share an email")
+	errIdentityEmailInUse    = errors.New("an account with this email already exists")
+)
+
+func (s *ServerContext) findOIDCProvider(w http.ResponseWriter, r *http.Request) (*core.OIDCProvider, bool) {
+	provider, ok := s.OIDCProviders[r.PathValue("provider")]
+	if !ok {
+		newErrorResponse(w, http.StatusNotFound, EnumOIDCProviderNotFound)
+		return nil, false
+	}
+	return provider, true
+}
+
+// startOIDCFlow keeps state, nonce and PKCE verifier in a signed cookie and redirects to the provider
+func (s *ServerContext) startOIDCFlow(w http.ResponseWriter, r *http.Request, provider *core.OIDCProvider, linkUserID string) {
+	state, err := core.GenerateRandomToken(16)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	nonce, err := core.GenerateRandomToken(16)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	verifier, challenge, err := core.GeneratePKCE()
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, challenge)
+	if err != nil {
+		log.Printf("Error starting OIDC login with %s: %v", provider.Config.Name, err)
+		newErrorResponse(w, http.StatusBadGateway, EnumOIDCLoginFailed)
+		return
+	}
+
+	token, err := core.GenerateOIDCStateToken(s.Keys, core.OIDCState{
+		Provider:     provider.Config.Name,
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		LinkUserID:   linkUserID,
+	})
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	w.Header().Add("Set-Cookie", core.SerializeOIDCStateCookie(token))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcRedirect sends the browser back to the client app
+func (s *ServerContext) oidcRedirect(w http.ResponseWriter, r *http.Request, path string, query url.Values) {
+	target := s.AppURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// oidcRedirectFragment redirects to the app with the values in the fragment, which isn't sent to servers
+// nor kept in Referer headers, e.g. the challenge token
+func (s *ServerContext) oidcRedirectFragment(w http.ResponseWriter, r *http.Request, path string, fragment url.Values) {
+	http.Redirect(w, r, s.AppURL+path+"#"+fragment.Encode(), http.StatusFound)
+}
+
+// Sign in with the provider
+func (s *ServerContext) GetOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := s.findOIDCProvider(w, r)
+	if !ok {
+		return
+	}
+
+	s.startOIDCFlow(w, r, provider, "")
+}
+
+// Link the provider to the logged in account
+func (s *ServerContext) GetOIDCLink(w http.ResponseWriter, r *http.Request) {
+	if middlewares.IsBot(r) {
+		newErrorResponse(w, http.StatusForbidden, EnumForbidden)
+		return
+	}
+
+	provider, ok := s.findOIDCProvider(w, r)
+	if !ok {
+		return
+	}
+
+	userID := r.Context().Value(middlewares.CtxUserIDKey).(uuid.UUID)
+	s.startOIDCFlow(w, r, provider, userID.String())
+}
+
+// The provider redirects here with the code, logs in (or signs up) or links the identity,
+// then redirects to the client app, errors are passed in the `error` query parameter
+func (s *ServerContext) GetOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	db := s.Database.Client.WithContext(rCtx)
+
+	provider, ok := s.findOIDCProvider(w, r)
+	if !ok {
+		return
+	}
+
+	cookie, err := r.Cookie(core.OIDCStateCookieName)
+	if err != nil {
+		s.oidcRedirect(w, r, oidcLoginPath, url.Values{"error": {EnumOIDCStateInvalid}})
+		return
+	}
+
+	// single use
+	w.Header().Add("Set-Cookie", core.SerializeOIDCStateCookie(""))
+
+	state, ok := core.ValidateOIDCStateToken(s.Keys, cookie.Value)
+	if !ok || state.Provider != provider.Config.Name || state.State != r.URL.Query().Get("state") {
+		s.oidcRedirect(w, r, oidcLoginPath, url.Values{"error": {EnumOIDCStateInvalid}})
+		return
+	}
+
+	errorPath := oidcLoginPath
+	if state.LinkUserID != "" {
+		errorPath = oidcIdentitiesPath
+	}
+
+	// e.g. the user denied the consent
+	if r.URL.Query().Get("error") != "" || r.URL.Query().Get("code") == "" {
+		s.oidcRedirect(w, r, errorPath, url.Values{"error": {EnumOIDCLoginFailed}})
+		return
+	}
+
+	claims, err := provider.Exchange(rCtx, r.URL.Query().Get("code"), state.CodeVerifier, state.Nonce)
+	if err != nil {
+		log.Printf("Error exchanging OIDC code with %s: %v", provider.Config.Name, err)
+		s.oidcRedirect(w, r, errorPath, url.Values{"error": {EnumOIDCLoginFailed}})
+		return
+	}
+
+	if state.LinkUserID != "" {
+		s.linkIdentity(w, r, db, provider, state, claims)
+		return
+	}
+
+	identity := models.NewIdentity().WithProvider(provider.Config.Name).WithSubject(claims.Subject)
+	user := models.NewUser()
+	if err := identity.FindBySubject(db); err == nil {
+		if err := user.FindByID(db, identity.UserID); err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+	} else if err == gorm.ErrRecordNotFound {
+		if user, err = s.signUpWithIdentity(db, identity, claims); err != nil {
+			switch err {
+			case errIdentityEmailRequired:
+				s.oidcRedirect(w, r, oidcLoginPath, url.Values{"error": {EnumIdentityEmailRequired}})
+				return
+			case errIdentityEmailInUse:
+				s.oidcRedirect(w, r, oidcLoginPath, url.Values{"error": {EnumIdentityEmailInUse}})
+				return
+			}
+			log.Printf("Error creating user from identity: %v", err)
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+	} else {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	// the provider replaces the password, not the second factor
+	if user.TwoFactorEnabled() {
+		challengeToken, err := core.GenerateChallengeToken(s.Keys, user.ID.String(), "")
+		if err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+		s.oidcRedirectFragment(w, r, oidcTwoFactorPath, url.Values{"challengeToken": {challengeToken}})
+		return
+	}
+
+	if err := s.issueSession(w, r, user.ID, ""); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	s.oidcRedirect(w, r, "/", nil)
+}
+
+// signUpWithIdentity creates a password-less user for a new identity,
+// an existing account with the same email has to link the provider itself so it can't be taken over
+func (s *ServerContext) signUpWithIdentity(db *gorm.DB, identity *models.Identity, claims *core.OIDCClaims) (*models.User, error) {
+	if claims.Email == "" {
+		return nil, errIdentityEmailRequired
+	}
+
+	if err := models.NewUser().WithEmail(claims.Email).FindByEmail(db); err == nil {
+		return nil, errIdentityEmailInUse
+	} else if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	username, err := availableUsername(db, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	user := models.NewUser().WithUsername(username).WithEmail(claims.Email)
+	if claims.EmailVerified {
+		now := time.Now()
+		user.VerifiedAt = &now
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := user.Create(tx); err != nil {
+			return err
+		}
+		return identity.WithUserID(user.ID).WithEmail(claims.Email).Create(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !user.IsVerified() {
+		if err := s.sendVerificationMail(db, user); err != nil {
+			log.Printf("Error creating verification token: %v", err)
+		}
+	}
+
+	return user, nil
+}
+
+var usernameDisallowedChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// availableUsername derives a username from the claims, with a random suffix when it is taken
+func availableUsername(db *gorm.DB, claims *core.OIDCClaims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base = claims.Name
+	}
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	base = usernameDisallowedChars.ReplaceAllString(base, "")
+	if base == "" {
+		base = "user"
+	}
+
+	username := base
+	for range 5 {
+		if err := models.NewUser().WithUsername(username).FindByUsername(db); err == gorm.ErrRecordNotFound {
+			return username, nil
+		} else if err != nil {
+			return "", err
+		}
+		username = fmt.Sprintf("%s-%s", base, uuid.NewString()[:6])
+	}
+	return "", errors.New("no available username")
+}
+
+func (s *ServerContext) linkIdentity(w http.ResponseWriter, r *http.Request, db *gorm.DB, provider *core.OIDCProvider, state *core.OIDCState, claims *core.OIDCClaims) {
+	userID, err := uuid.Parse(state.LinkUserID)
+	if err != nil {
+		s.oidcRedirect(w, r, oidcIdentitiesPath, url.Values{"error": {EnumOIDCStateInvalid}})
+		return
+	}
+
+	identity := models.NewIdentity().WithProvider(provider.Config.Name).WithSubject(claims.Subject)
+	if err := identity.FindBySubject(db); err == nil {
+		if identity.UserID != userID {
+			s.oidcRedirect(w, r, oidcIdentitiesPath, url.Values{"error": {EnumIdentityAlreadyLinked}})
+			return
+		}
+		// already linked to this account
+		s.oidcRedirect(w, r, oidcIdentitiesPath, url.Values{"linked": {provider.Config.Name}})
+		return
+	} else if err != gorm.ErrRecordNotFound {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	if err := identity.WithUserID(userID).WithEmail(claims.Email).Create(db); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	s.oidcRedirect(w, r, oidcIdentitiesPath, url.Values{"linked": {provider.Config.Name}})
+}
+
+func (s *ServerContext) GetIdentities(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+
+	identities, err := models.GetUserIdentities(s.Database.Client.WithContext(rCtx), userID)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	json, _ := json.Marshal(identities)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// Unlink a provider, the account must keep a way to log in (a password or another identity)
+func (s *ServerContext) DeleteIdentity(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	db := s.Database.Client.WithContext(rCtx)
+
+	user, ok := s.findCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	identityID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumIdentityIdInvalid)
+		return
+	}
+
+	identity := models.NewIdentity().WithID(identityID).WithUserID(user.ID)
+	if err := identity.Find(db); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			newErrorResponse(w, http.StatusNotFound, EnumIdentityNotFound)
+			return
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	if !user.HasPassword() {
+		identities, err := models.GetUserIdentities(db, user.ID)
+		if err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+		if len(identities) <= 1 {
+			newErrorResponse(w, http.StatusBadRequest, EnumLastLoginMethod)
+			return
+		}
+	}
+
+	if err := identity.Delete(db); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -6,7 +6,13 @@ import (
 )
 
 const (
-	EnumLoggedOut = "LOGGED_OUT"
+	EnumLoggedOut        = "LOGGED_OUT"
+	EnumSessionRefreshed = "SESSION_REFRESHED"
+	// sent whether the email exists or not, to not leak registered emails
+	EnumPasswordResetRequested = "PASSWORD_RESET_REQUESTED"
+	EnumPasswordResetDone      = "PASSWORD_RESET_DONE"
+	EnumVerificationSent       = "VERIFICATION_SENT"
+	EnumEmailVerified          = "EMAIL_VERIFIED"
 )
 
 func newOkResponse(w http.ResponseWriter, code int, msg string) {
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/models"
+	"gorm.io/gorm"
+)
+
+const passwordResetTokenTTL = time.Hour
+
+// Request a password reset link by email,
+// always responds the same way so registered emails are not leaked
+func (s *ServerContext) PostPasswordReset(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	db := s.Database.Client.WithContext(rCtx)
+
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+		return
+	}
+
+	if req.Email == "" {
+		newErrorResponse(w, http.StatusBadRequest, EnumEmailRequired)
+		return
+	}
+	if !validateEmail(req.Email) {
+		newErrorResponse(w, http.StatusBadRequest, EnumEmailInvalid)
+		return
+	}
+
+	user := models.NewUser().WithEmail(req.Email)
+	if err := user.FindByEmail(db); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			newOkResponse(w, http.StatusAccepted, EnumPasswordResetRequested)
+			return
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	// only the latest link is valid
+	if err := models.InvalidateUserTokens(db, user.ID, models.TokenPurposePasswordReset); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	token := models.NewUserToken().WithUserID(user.ID).WithPurpose(models.TokenPurposePasswordReset)
+	rawToken, err := token.Generate(passwordResetTokenTTL)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	if err := token.Create(db); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	mail := core.Mail{
+		To:      user.Email,
+		Subject: "Reset your Luma password",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the link below to set a new password, it expires in %s:\n\n%s/reset-password?token=%s\n\nIf you didn't request this, you can ignore this email.\n",
+			user.Username, passwordResetTokenTTL, s.AppURL, url.QueryEscape(rawToken)),
+	}
+
+	// sent in the background so the response time doesn't reveal whether the email exists
+	go func() {
+		if err := s.Mailer.Send(context.Background(), mail); err != nil {
+			log.Printf("Error sending password reset mail: %v", err)
+		}
+	}()
+
+	newOkResponse(w, http.StatusAccepted, EnumPasswordResetRequested)
+}
+
+// Set a new password with a reset token, all sessions of the user are revoked
+func (s *ServerContext) PostPasswordResetConfirm(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	db := s.Database.Client.WithContext(rCtx)
+
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+		return
+	}
+
+	if req.Token == "" {
+		newErrorResponse(w, http.StatusBadRequest, EnumResetTokenInvalid)
+		return
+	}
+
+	if req.Password == "" {
+		newErrorResponse(w, http.StatusBadRequest, EnumPasswordRequired)
+		return
+	}
+
+	token := models.NewUserToken()
+	if err := token.Consume(db, req.Token, models.TokenPurposePasswordReset); err != nil {
+		if err == models.ErrUserTokenInvalid {
+			newErrorResponse(w, http.StatusBadRequest, EnumResetTokenInvalid)
+			return
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	user := models.NewUser().WithID(token.UserID)
+	if err := user.UpdatePassword(db, req.Password); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	// a stolen session shouldn't survive a password reset
+	if err := models.RevokeAllSessions(db, user.ID); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	newOkResponse(w, http.StatusOK, EnumPasswordResetDone)
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"gorm.io/gorm"
+)
+
+// overwriteScope validates the room or category in the path and returns an overwrite scoped to it,
+// with the server and the user's permissions there
+type overwriteScope func(w http.ResponseWriter, r *http.Request) (*models.PermissionOverwrite, *models.RoomsServer, models.Permission, bool)
+
+func (ctx *ServerContext) roomOverwriteScope(w http.ResponseWriter, r *http.Request) (*models.PermissionOverwrite, *models.RoomsServer, models.Permission, bool) {
+	room, server, permissions, ok := ctx.validateRoomAccess(w, r, models.PermissionManageRoles)
+	if !ok {
+		return nil, nil, 0, false
+	}
+	return models.NewPermissionOverwrite().WithRoomID(room.ID).WithServerID(server.ID), server, permissions, true
+}
+
+func (ctx *ServerContext) categoryOverwriteScope(w http.ResponseWriter, r *http.Request) (*models.PermissionOverwrite, *models.RoomsServer, models.Permission, bool) {
+	server, err := ctx.validateRoomsServerID(w, r)
+	if err != nil {
+		return nil, nil, 0, false
+	}
+
+	category, ok := ctx.validateCategoryID(w, r, server)
+	if !ok {
+		return nil, nil, 0, false
+	}
+
+	userID := r.Context().Value(middlewares.CtxUserIDKey).(uuid.UUID)
+	permissions, err := models.ResolveCategoryPermissions(ctx.Database.Client.WithContext(r.Context()), server, category, userID)
+	if !checkPermissions(w, permissions, err, models.PermissionManageRoles) {
+		return nil, nil, 0, false
+	}
+	return models.NewPermissionOverwrite().WithCategoryID(category.ID).WithServerID(server.ID), server, permissions, true
+}
+
+// validateOverwriteTarget checks the role or member in the path belongs to the server of the room or category,
+// and that the user is allowed to change their overwrite
+func (ctx *ServerContext) validateOverwriteTarget(w http.ResponseWriter, r *http.Request, scope overwriteScope, changed models.Permission) (*models.PermissionOverwrite, *models.RoomsServer, bool) {
+	db := ctx.Database.Client.WithContext(r.Context())
+	overwrite, server, permissions, ok := scope(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	targetType := r.PathValue("targetType")
+	targetID, err := uuid.Parse(r.PathValue("targetId"))
+	if err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumOverwriteTargetInvalid)
+		return nil, nil, false
+	}
+
+	// members overwrites are not bound by the hierarchy, only by the permissions of the user
+	position := -1
+	switch targetType {
+	case models.OverwriteTargetRole:
+		role := models.NewRole().WithID(targetID).WithServerID(server.ID)
+		if err := role.Find(db); err != nil {
+			if err == gorm.ErrRecordNotFound {
+				newErrorResponse(w, http.StatusNotFound, EnumRoleNotFound)
+				return nil, nil, false
+			}
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return nil, nil, false
+		}
+		if !role.IsDefault {
+			position = role.Position
+		}
+	case models.OverwriteTargetMember:
+		if err := models.NewServerUserStatus().WithUserID(targetID).WithServerID(server.ID).Find(db); err != nil {
+			if err == gorm.ErrRecordNotFound {
+				newErrorResponse(w, http.StatusNotFound, EnumMemberNotFound)
+				return nil, nil, false
+			}
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return nil, nil, false
+		}
+	default:
+		newErrorResponse(w, http.StatusBadRequest, EnumOverwriteTargetInvalid)
+		return nil, nil, false
+	}
+
+	if !ctx.canManageRole(w, r, server, permissions, position, changed) {
+		return nil, nil, false
+	}
+
+	return overwrite.WithTarget(targetType, targetID), server, true
+}
+
+func (ctx *ServerContext) GetRoomOverwrites(w http.ResponseWriter, r *http.Request) {
+	room, _, _, ok := ctx.validateRoomAccess(w, r, models.PermissionManageRoles)
+	if !ok {
+		return
+	}
+
+	overwrites, err := models.GetRoomOverwrites(ctx.Database.Client.WithContext(r.Context()), room.ID)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	json, _ := json.Marshal(overwrites)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func (ctx *ServerContext) GetCategoryOverwrites(w http.ResponseWriter, r *http.Request) {
+	overwrite, _, _, ok := ctx.categoryOverwriteScope(w, r)
+	if !ok {
+		return
+	}
+
+	overwrites, err := models.GetCategoryOverwrites(ctx.Database.Client.WithContext(r.Context()), *overwrite.CategoryID)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	json, _ := json.Marshal(overwrites)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// replaces the overwrite of a role or a member in the room
+func (ctx *ServerContext) PutRoomOverwrite(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx.putOverwrite(w, r, store, ctx.roomOverwriteScope)
+	}
+}
+
+// replaces the overwrite of a role or a member in every room of the category
+func (ctx *ServerContext) PutCategoryOverwrite(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx.putOverwrite(w, r, store, ctx.categoryOverwriteScope)
+	}
+}
+
+func (ctx *ServerContext) putOverwrite(w http.ResponseWriter, r *http.Request, store *core.TopicStore, scope overwriteScope) {
+	var t struct {
+		Allow models.Permission `json:"allow"`
+		Deny  models.Permission `json:"deny"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+		return
+	}
+
+	if (t.Allow|t.Deny)&models.PermissionAdministrator != 0 {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Administrator can't be overwritten")
+		return
+	}
+	t.Allow &= models.PermissionOverwritable
+	t.Deny &= models.PermissionOverwritable
+	if t.Allow&t.Deny != 0 {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "A permission can't be both allowed and denied")
+		return
+	}
+
+	overwrite, server, ok := ctx.validateOverwriteTarget(w, r, scope, t.Allow|t.Deny)
+	if !ok {
+		return
+	}
+
+	db := ctx.Database.Client.WithContext(r.Context())
+	before := *overwrite
+	if err := before.Find(db); err != nil {
+		// a new overwrite, only its target is known
+		before = *overwrite
+	}
+
+	overwrite.WithAllow(t.Allow).WithDeny(t.Deny)
+	if err := overwrite.Upsert(db); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	ctx.syncOverwriteRooms(db, store, server, overwrite)
+	ctx.audit(r, overwrite.ServerID, models.AuditOverwriteUpdate, models.AuditTargetOverwrite, overwrite.ID.String(), models.DiffChanges(before, overwrite))
+
+	json, _ := json.Marshal(overwrite)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func (ctx *ServerContext) DeleteRoomOverwrite(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx.deleteOverwrite(w, r, store, ctx.roomOverwriteScope)
+	}
+}
+
+func (ctx *ServerContext) DeleteCategoryOverwrite(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx.deleteOverwrite(w, r, store, ctx.categoryOverwriteScope)
+	}
+}
+
+func (ctx *ServerContext) deleteOverwrite(w http.ResponseWriter, r *http.Request, store *core.TopicStore, scope overwriteScope) {
+	overwrite, server, ok := ctx.validateOverwriteTarget(w, r, scope, 0)
+	if !ok {
+		return
+	}
+
+	db := ctx.Database.Client.WithContext(r.Context())
+	if err := overwrite.Find(db); err != nil {
+		// nothing to delete
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := overwrite.Delete(db); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	ctx.syncOverwriteRooms(db, store, server, overwrite)
+	ctx.audit(r, overwrite.ServerID, models.AuditOverwriteDelete, models.AuditTargetOverwrite, overwrite.ID.String(), models.DiffChanges(overwrite, nil))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// syncOverwriteRooms re-evaluates the rooms of the members the overwrite applies to, everyone for a role
+func (ctx *ServerContext) syncOverwriteRooms(db *gorm.DB, store *core.TopicStore, server *models.RoomsServer, overwrite *models.PermissionOverwrite) {
+	if overwrite.TargetType == models.OverwriteTargetMember {
+		ctx.syncRooms(db, store, server, overwrite.TargetID)
+		return
+	}
+	ctx.syncRooms(db, store, server)
+}
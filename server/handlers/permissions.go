@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+)
+
+// checkPermissions responds with 403 for non members or if perm is missing
+func checkPermissions(w http.ResponseWriter, permissions models.Permission, err error, perm models.Permission) bool {
+	if err != nil {
+		if err == models.ErrNotMember {
+			newErrorResponse(w, http.StatusForbidden, EnumNotMember)
+			return false
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return false
+	}
+
+	if !permissions.Has(perm) {
+		newErrorResponse(w, http.StatusForbidden, EnumMissingPermission)
+		return false
+	}
+
+	return true
+}
+
+// requirePermission resolves the permissions of the user in the server and responds with 403 if perm is missing,
+// a zero perm only requires the user to be a member
+func (ctx *ServerContext) requirePermission(w http.ResponseWriter, r *http.Request, server *models.RoomsServer, perm models.Permission) (models.Permission, bool) {
+	rCtx := r.Context()
+	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+
+	permissions, err := models.ResolvePermissions(ctx.Database.Client.WithContext(rCtx), server, userID)
+	return permissions, checkPermissions(w, permissions, err, perm)
+}
+
+// validateRoomAccess checks the room in the path and the permission in it, after the room's overwrites
+func (ctx *ServerContext) validateRoomAccess(w http.ResponseWriter, r *http.Request, perm models.Permission) (*models.Room, *models.RoomsServer, models.Permission, bool) {
+	rCtx := r.Context()
+	room, err := ctx.validateRoomID(w, r)
+	if err != nil {
+		return nil, nil, 0, false
+	}
+
+	db := ctx.Database.Client.WithContext(rCtx)
+	server := models.NewRoomsServer()
+	if err := server.FindByID(db, room.ServerID); err != nil {
+		newErrorResponse(w, http.StatusNotFound, EnumServerNotFound)
+		return nil, nil, 0, false
+	}
+
+	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+	permissions, err := models.ResolveRoomPermissions(db, server, room, userID)
+	if !checkPermissions(w, permissions, err, perm) {
+		return nil, nil, 0, false
+	}
+
+	return room, server, permissions, true
+}
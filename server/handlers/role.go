@@ -0,0 +1,368 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"gorm.io/gorm"
+)
+
+// validateRoleID checks the role in the path belongs to the server
+func (ctx *ServerContext) validateRoleID(w http.ResponseWriter, r *http.Request, server *models.RoomsServer) (*models.Role, bool) {
+	roleID, err := uuid.Parse(r.PathValue("roleId"))
+	if err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumRoleIdInvalid)
+		return nil, false
+	}
+
+	role := models.NewRole().WithID(roleID).WithServerID(server.ID)
+	if err := role.Find(ctx.Database.Client.WithContext(r.Context())); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			newErrorResponse(w, http.StatusNotFound, EnumRoleNotFound)
+			return nil, false
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return nil, false
+	}
+
+	return role, true
+}
+
+// canManageRole enforces the role hierarchy, members can only manage roles below their highest role
+// and only grant permissions they have themselves, the owner is above every role
+func (ctx *ServerContext) canManageRole(w http.ResponseWriter, r *http.Request, server *models.RoomsServer, permissions models.Permission, position int, granted models.Permission) bool {
+	rCtx := r.Context()
+	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+	if server.OwnerID == userID {
+		return true
+	}
+
+	top, err := models.TopRolePosition(ctx.Database.Client.WithContext(rCtx), server, userID)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return false
+	}
+
+	if position >= top || granted&^permissions != 0 {
+		newErrorResponse(w, http.StatusForbidden, EnumRoleHierarchy)
+		return false
+	}
+
+	return true
+}
+
+func (ctx *ServerContext) GetRoles(w http.ResponseWriter, r *http.Request) {
+	server, err := ctx.validateRoomsServerID(w, r)
+	if err != nil {
+		return
+	}
+
+	if _, ok := ctx.requirePermission(w, r, server, 0); !ok {
+		return
+	}
+
+	roles, err := models.GetServerRoles(ctx.Database.Client.WithContext(r.Context()), server.ID)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	json, _ := json.Marshal(roles)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// the resolved permissions of the current user in the server
+func (ctx *ServerContext) GetServerPermissions(w http.ResponseWriter, r *http.Request) {
+	server, err := ctx.validateRoomsServerID(w, r)
+	if err != nil {
+		return
+	}
+
+	permissions, ok := ctx.requirePermission(w, r, server, 0)
+	if !ok {
+		return
+	}
+
+	json, _ := json.Marshal(map[string]models.Permission{"permissions": permissions})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// new roles are placed right above @everyone
+func (ctx *ServerContext) PostRole(w http.ResponseWriter, r *http.Request) {
+	server, err := ctx.validateRoomsServerID(w, r)
+	if err != nil {
+		return
+	}
+
+	permissions, ok := ctx.requirePermission(w, r, server, models.PermissionManageRoles)
+	if !ok {
+		return
+	}
+
+	var t struct {
+		Name        string            `json:"name"`
+		Color       int               `json:"color"`
+		Permissions models.Permission `json:"permissions"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+		return
+	}
+
+	if t.Name == "" {
+		newErrorResponse(w, http.StatusBadRequest, EnumRoleNameRequired)
+		return
+	}
+
+	t.Permissions &= models.PermissionAll
+	// position 0 is always below the member's top role, only the granted permissions matter
+	if !ctx.canManageRole(w, r, server, permissions, 0, t.Permissions) {
+		return
+	}
+
+	role := models.NewRole().WithServerID(server.ID).WithName(t.Name).WithColor(t.Color).WithPermissions(t.Permissions)
+	if err := role.Create(ctx.Database.Client.WithContext(r.Context())); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	ctx.audit(r, server.ID, models.AuditRoleCreate, models.AuditTargetRole, role.ID.String(), models.DiffChanges(nil, role))
+
+	json, _ := json.Marshal(role)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(json)
+}
+
+// omitted fields are left unchanged, @everyone can only change its permissions
+func (ctx *ServerContext) PatchRole(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := ctx.Database.Client.WithContext(r.Context())
+		server, err := ctx.validateRoomsServerID(w, r)
+		if err != nil {
+			return
+		}
+
+		permissions, ok := ctx.requirePermission(w, r, server, models.PermissionManageRoles)
+		if !ok {
+			return
+		}
+
+		role, ok := ctx.validateRoleID(w, r, server)
+		if !ok {
+			return
+		}
+
+		before := *role
+
+		var t struct {
+			Name        *string            `json:"name"`
+			Color       *int               `json:"color"`
+			Permissions *models.Permission `json:"permissions"`
+			Position    *int               `json:"position"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+			return
+		}
+
+		if role.IsDefault && (t.Name != nil || t.Position != nil) {
+			newErrorResponse(w, http.StatusBadRequest, EnumDefaultRoleImmutable)
+			return
+		}
+
+		var granted models.Permission
+		if t.Permissions != nil {
+			*t.Permissions &= models.PermissionAll
+			granted = *t.Permissions &^ role.Permissions
+		}
+		if !ctx.canManageRole(w, r, server, permissions, role.Position, granted) {
+			return
+		}
+
+		if t.Position != nil {
+			if *t.Position < 1 {
+				newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Position must be above @everyone")
+				return
+			}
+			if !ctx.canManageRole(w, r, server, permissions, *t.Position, 0) {
+				return
+			}
+		}
+		if t.Name != nil && *t.Name == "" {
+			newErrorResponse(w, http.StatusBadRequest, EnumRoleNameRequired)
+			return
+		}
+
+		if t.Name != nil {
+			role.Name = *t.Name
+		}
+		if t.Color != nil {
+			role.Color = *t.Color
+		}
+		if t.Permissions != nil {
+			role.Permissions = *t.Permissions
+		}
+
+		// everything was validated, the move and the other fields are saved together
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if t.Position != nil {
+				if err := role.Move(tx, *t.Position); err != nil {
+					return err
+				}
+			}
+			return role.Update(tx)
+		})
+		if err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		if role.Permissions != before.Permissions {
+			ctx.syncRooms(db, store, server)
+		}
+		ctx.audit(r, server.ID, models.AuditRoleUpdate, models.AuditTargetRole, role.ID.String(), models.DiffChanges(before, role))
+
+		json, _ := json.Marshal(role)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+	}
+}
+
+func (ctx *ServerContext) DeleteRole(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		server, err := ctx.validateRoomsServerID(w, r)
+		if err != nil {
+			return
+		}
+
+		permissions, ok := ctx.requirePermission(w, r, server, models.PermissionManageRoles)
+		if !ok {
+			return
+		}
+
+		role, ok := ctx.validateRoleID(w, r, server)
+		if !ok {
+			return
+		}
+
+		if role.IsDefault {
+			newErrorResponse(w, http.StatusBadRequest, EnumDefaultRoleImmutable)
+			return
+		}
+
+		if !ctx.canManageRole(w, r, server, permissions, role.Position, 0) {
+			return
+		}
+
+		db := ctx.Database.Client.WithContext(r.Context())
+		if err := role.Delete(db); err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		ctx.syncRooms(db, store, server)
+
+		ctx.audit(r, server.ID, models.AuditRoleDelete, models.AuditTargetRole, role.ID.String(), models.DiffChanges(role, nil))
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// validateMemberRole checks the member and the role in the path and that the user can assign the role
+func (ctx *ServerContext) validateMemberRole(w http.ResponseWriter, r *http.Request) (*models.MemberRole, *models.RoomsServer, bool) {
+	db := ctx.Database.Client.WithContext(r.Context())
+	server, err := ctx.validateRoomsServerID(w, r)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	permissions, ok := ctx.requirePermission(w, r, server, models.PermissionManageRoles)
+	if !ok {
+		return nil, nil, false
+	}
+
+	role, ok := ctx.validateRoleID(w, r, server)
+	if !ok {
+		return nil, nil, false
+	}
+
+	// everyone has @everyone already
+	if role.IsDefault {
+		newErrorResponse(w, http.StatusBadRequest, EnumDefaultRoleImmutable)
+		return nil, nil, false
+	}
+
+	memberID, err := uuid.Parse(r.PathValue("userId"))
+	if err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumUserIdInvalid)
+		return nil, nil, false
+	}
+
+	if err := models.NewServerUserStatus().WithUserID(memberID).WithServerID(server.ID).Find(db); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			newErrorResponse(w, http.StatusNotFound, EnumMemberNotFound)
+			return nil, nil, false
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return nil, nil, false
+	}
+
+	if !ctx.canManageRole(w, r, server, permissions, role.Position, 0) {
+		return nil, nil, false
+	}
+
+	return models.NewMemberRole().WithUserID(memberID).WithRoleID(role.ID).WithServerID(server.ID), server, true
+}
+
+func (ctx *ServerContext) PutMemberRole(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		memberRole, server, ok := ctx.validateMemberRole(w, r)
+		if !ok {
+			return
+		}
+
+		db := ctx.Database.Client.WithContext(r.Context())
+		if err := memberRole.Create(db); err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		ctx.syncRooms(db, store, server, memberRole.UserID)
+
+		ctx.audit(r, memberRole.ServerID, models.AuditMemberRoleAdd, models.AuditTargetMember, memberRole.UserID.String(),
+			map[string]models.AuditChange{"roleId": {New: memberRole.RoleID}})
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (ctx *ServerContext) DeleteMemberRole(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		memberRole, server, ok := ctx.validateMemberRole(w, r)
+		if !ok {
+			return
+		}
+
+		db := ctx.Database.Client.WithContext(r.Context())
+		if err := memberRole.Delete(db); err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		ctx.syncRooms(db, store, server, memberRole.UserID)
+
+		ctx.audit(r, memberRole.ServerID, models.AuditMemberRoleRemove, models.AuditTargetMember, memberRole.UserID.String(),
+			map[string]models.AuditChange{"roleId": {Old: memberRole.RoleID}})
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
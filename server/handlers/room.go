@@ -2,14 +2,17 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/khalidibnwalid/Luma/core"
 	"github.com/khalidibnwalid/Luma/middlewares"
 	"github.com/khalidibnwalid/Luma/models"
+	"gorm.io/gorm"
 )
 
 var upgrader = websocket.Upgrader{
@@ -20,6 +23,21 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// upgrade upgrades the request to a websocket tracked by the context,
+// it is closed with CloseAuthExpired once the access token expires
+func (ctx *ServerContext) upgrade(w http.ResponseWriter, r *http.Request, opt core.ConnOptions) (*core.Conn, error) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := ctx.Connections.Open(ws, opt)
+	if expiresAt, ok := r.Context().Value(middlewares.CtxExpiresAtKey).(time.Time); ok {
+		conn.CloseAt(expiresAt, core.CloseAuthExpired, "token expired")
+	}
+	return conn, nil
+}
+
 func (ctx *ServerContext) validateRoomID(w http.ResponseWriter, r *http.Request) (*models.Room, error) {
 	rCtx := r.Context()
 	roomID := r.PathValue("id")
@@ -27,45 +45,109 @@ func (ctx *ServerContext) validateRoomID(w http.ResponseWriter, r *http.Request)
 
 	if roomID == "" {
 		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Room ID is required")
-		return &models.Room{}, nil
+		return &models.Room{}, errors.New(EnumBadRequest)
 	}
 
 	uuidRoomID, err := uuid.Parse(roomID)
 	if err != nil {
 		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid Room ID format")
-		return &models.Room{}, nil
+		return &models.Room{}, errors.New(EnumBadRequest)
 	}
 
 	roomData := models.Room{}
 	if err := roomData.FindByID(ctx.Database.Client.WithContext(rCtx), uuidRoomID); err != nil {
 		newErrorResponse(w, http.StatusNotFound, EnumNotFound, "Room not found")
-		return &models.Room{}, nil
+		return &models.Room{}, errors.New(EnumNotFound)
 	}
 
 	return &roomData, nil
 }
 
+var (
+	errRoomAccessLost = errors.New("room access lost")
+	errCannotSend     = errors.New("cannot send messages")
+)
+
+// EventMessageError tells a room socket its message wasn't posted, gateway sessions get an OpCommandError instead
+const EventMessageError = "MESSAGE_ERROR"
+
+// roomSocket is a socket of a single room, it predates the gateway so messages are sent bare
+// and the other events as {t, d}
+type roomSocket struct {
+	conn   *core.Conn
+	userID string
+}
+
+func (s *roomSocket) UserID() string {
+	return s.userID
+}
+
+func (s *roomSocket) Send(event core.Event) error {
+	var data any = event
+	if event.Type == EventMessageCreate {
+		data = event.Data
+	}
+	frame, err := json.Marshal(data)
+	if err != nil {
+		return nil
+	}
+	if err := s.conn.Write(frame); err != nil {
+		log.Println("Broadcast error:", err)
+		return err
+	}
+	return nil
+}
+
+func (s *roomSocket) Leave(topicID string, code int, reason string) {
+	s.conn.Close(code, reason)
+}
+
+// sendMessage posts the message if the user can still view the room and send in it, then publishes it to the room,
+// roles and overwrites can change while connected so they are resolved on every message
+func (ctx *ServerContext) sendMessage(db *gorm.DB, store *core.TopicStore, server *models.RoomsServer, room *models.Room, user *models.User, content string) (*models.Message, error) {
+	permissions, err := models.ResolveRoomPermissions(db, server, room, user.ID)
+	if err != nil || !permissions.Has(models.PermissionViewRooms) {
+		return nil, errRoomAccessLost
+	}
+
+	// unverified users can still read the room
+	verified := !server.RequireVerifiedEmail || user.IsVerified()
+	if !verified || !permissions.Has(models.PermissionSendMessages) {
+		return nil, errCannotSend
+	}
+
+	msg := models.NewMessage().WithContent(content).WithRoomID(room.ID).WithServerID(room.ServerID).WithAuthorID(user.ID)
+	if err := msg.Create(db); err != nil {
+		return nil, err
+	}
+	msg.Author = *user
+
+	store.Broadcast(core.Event{Type: EventMessageCreate, Data: msg}, room.ID.String())
+	return msg, nil
+}
+
+// Deprecated: use the gateway, it carries every room of every server over one connection
 func (ctx *ServerContext) WSRoom(store *core.TopicStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		rCtx := r.Context()
-		room, err := ctx.validateRoomID(w, r)
-		if err != nil {
+		room, server, _, ok := ctx.validateRoomAccess(w, r, models.PermissionViewRooms)
+		if !ok {
 			return
 		}
 
-		conn, err := upgrader.Upgrade(w, r, nil)
+		conn, err := ctx.upgrade(w, r, core.DefaultConnOptions)
 		if err != nil {
 			log.Println("Upgrade error:", err)
 			return
 		}
-		defer conn.Close()
+		defer conn.Close(websocket.CloseNormalClosure, "")
 
 		log.Printf("Room [%s] Connected\n", room.ID)
-		roomTopic := store.GetOrCreateRoom(room.ID.String())
-		roomTopic.Subscribe(conn)
-		defer roomTopic.Unsubscribe(conn)
-
 		userId := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+		socket := &roomSocket{conn: conn, userID: userId.String()}
+		store.Subscribe(socket, room.ID.String())
+		defer store.Unsubscribe(socket, room.ID.String())
+
 		user := models.NewUser().WithID(userId)
 		user.FindByID(ctx.Database.Client) // not finding the user
 
@@ -78,29 +160,30 @@ func (ctx *ServerContext) WSRoom(store *core.TopicStore) http.HandlerFunc {
 			err := conn.ReadJSON(&body)
 			if err != nil {
 				log.Println("Read error:", err)
-				roomTopic.Unsubscribe(conn)
 				break
 			}
 
-			var msg models.Message
-			msg.Content = body.Content
-			msg.RoomID = room.ID
-			msg.ServerID = room.ServerID
-			msg.AuthorID = user.ID
-			msg.Create(ctx.Database.Client.WithContext(rCtx))
-
-			msg.Author = *user
-
-			json, _ := json.Marshal(msg)
-			roomTopic.Publish([]byte(json))
+			_, err = ctx.sendMessage(ctx.Database.Client.WithContext(rCtx), store, server, room, user, body.Content)
+			if err == errRoomAccessLost {
+				log.Printf("User [%s] lost access to room [%s]\n", user.ID, room.ID)
+				break
+			}
+			if err != nil {
+				log.Printf("User [%s] can't post in room [%s]\n", user.ID, room.ID)
+				code := EnumInternalServerError
+				if err == errCannotSend {
+					code = EnumMissingPermission
+				}
+				socket.Send(core.Event{Type: EventMessageError, Data: map[string]string{"code": code}})
+			}
 		}
 	}
 }
 
 func (ctx *ServerContext) GETRoomMessages(w http.ResponseWriter, r *http.Request) {
 	rCtx := r.Context()
-	room, err := ctx.validateRoomID(w, r)
-	if err != nil {
+	room, _, _, ok := ctx.validateRoomAccess(w, r, models.PermissionViewRooms)
+	if !ok {
 		return
 	}
 
@@ -117,8 +200,8 @@ func (ctx *ServerContext) GETRoomMessages(w http.ResponseWriter, r *http.Request
 
 func (ctx *ServerContext) PatchRoomStatus(w http.ResponseWriter, r *http.Request) {
 	rCtx := r.Context()
-	room, err := ctx.validateRoomID(w, r)
-	if err != nil {
+	room, _, _, ok := ctx.validateRoomAccess(w, r, models.PermissionViewRooms)
+	if !ok {
 		return
 	}
 
@@ -160,3 +243,103 @@ func (ctx *ServerContext) PatchRoomStatus(w http.ResponseWriter, r *http.Request
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// rename the room or move it, a null categoryId moves it out of its category,
+// the other rooms are shifted so positions stay unique
+func (ctx *ServerContext) PatchRoom(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, server, _, ok := ctx.validateRoomAccess(w, r, models.PermissionManageRooms)
+		if !ok {
+			return
+		}
+
+		before := *room
+
+		var t struct {
+			Name       *string      `json:"name"`
+			Position   *int         `json:"position"`
+			CategoryID nullableUUID `json:"categoryId"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+			return
+		}
+
+		if t.Name != nil {
+			if *t.Name == "" {
+				newErrorResponse(w, http.StatusBadRequest, EnumRoomNameRequired)
+				return
+			}
+			room.Name = *t.Name
+		}
+		if t.Position != nil && *t.Position < 0 {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid position")
+			return
+		}
+		categoryID := room.CategoryID
+		if t.CategoryID.Set {
+			if t.CategoryID.ID != nil {
+				if _, ok := ctx.findCategory(w, r, server, *t.CategoryID.ID); !ok {
+					return
+				}
+			}
+			categoryID = t.CategoryID.ID
+		}
+
+		// the same category without a position keeps the room where it is
+		moved := (categoryID == nil) != (room.CategoryID == nil) || (categoryID != nil && *categoryID != *room.CategoryID)
+
+		err := ctx.Database.Client.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			if t.Position != nil || moved {
+				if err := room.Move(tx, categoryID, t.Position); err != nil {
+					return err
+				}
+			}
+			return room.Update(tx)
+		})
+		if err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		store.Broadcast(core.Event{Type: EventRoomUpdate, Data: room}, server.ID.String(), room.ID.String())
+		// a room moved to another category gets its overwrites
+		if moved {
+			ctx.syncRooms(ctx.Database.Client.WithContext(r.Context()), store, server)
+		}
+		ctx.audit(r, server.ID, models.AuditRoomUpdate, models.AuditTargetRoom, room.ID.String(), models.DiffChanges(before, room))
+
+		json, _ := json.Marshal(room)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+	}
+}
+
+// deletes the room with its messages and disconnects everyone in it
+func (ctx *ServerContext) DeleteRoom(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, server, _, ok := ctx.validateRoomAccess(w, r, models.PermissionManageRooms)
+		if !ok {
+			return
+		}
+
+		if err := room.Delete(ctx.Database.Client.WithContext(r.Context())); err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		store.Broadcast(core.Event{Type: EventRoomDelete, Data: map[string]uuid.UUID{
+			"id":       room.ID,
+			"serverId": server.ID,
+		}}, server.ID.String(), room.ID.String())
+		store.Close("room deleted", room.ID.String())
+		ctx.audit(r, server.ID, models.AuditRoomDelete, models.AuditTargetRoom, room.ID.String(), models.DiffChanges(map[string]any{
+			"name":       room.Name,
+			"type":       room.Type,
+			"categoryId": room.CategoryID,
+		}, nil))
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
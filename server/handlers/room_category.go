@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"gorm.io/gorm"
+)
+
+// nullableUUID tells an omitted field apart from an explicit null
+type nullableUUID struct {
+	Set bool
+	ID  *uuid.UUID
+}
+
+func (n *nullableUUID) UnmarshalJSON(data []byte) error {
+	n.Set = true
+	if string(data) == "null" {
+		n.ID = nil
+		return nil
+	}
+	return json.Unmarshal(data, &n.ID)
+}
+
+// findCategory responds with 404 if the category is not in the server
+func (ctx *ServerContext) findCategory(w http.ResponseWriter, r *http.Request, server *models.RoomsServer, categoryID uuid.UUID) (*models.RoomCategory, bool) {
+	category := models.NewRoomCategory().WithID(categoryID).WithServerID(server.ID)
+	if err := category.Find(ctx.Database.Client.WithContext(r.Context())); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			newErrorResponse(w, http.StatusNotFound, EnumCategoryNotFound)
+			return nil, false
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return nil, false
+	}
+	return category, true
+}
+
+// validateCategoryID checks the category in the path belongs to the server
+func (ctx *ServerContext) validateCategoryID(w http.ResponseWriter, r *http.Request, server *models.RoomsServer) (*models.RoomCategory, bool) {
+	categoryID, err := uuid.Parse(r.PathValue("categoryId"))
+	if err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumCategoryIdInvalid)
+		return nil, false
+	}
+	return ctx.findCategory(w, r, server, categoryID)
+}
+
+// the categories the user can view, in order
+func (ctx *ServerContext) GetCategories(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+	server, err := ctx.validateRoomsServerID(w, r)
+	if err != nil {
+		return
+	}
+
+	db := ctx.Database.Client.WithContext(rCtx)
+	member, err := models.LoadMemberPermissions(db, server, userID)
+	if !checkPermissions(w, 0, err, 0) {
+		return
+	}
+
+	categories, err := models.GetServerCategories(db, server.ID)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	overwrites, err := models.GetServerOverwrites(db, server.ID)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	visible := make([]models.RoomCategory, 0, len(categories))
+	for _, category := range categories {
+		if member.InRoom(overwrites[category.ID]).Has(models.PermissionViewRooms) {
+			visible = append(visible, category)
+		}
+	}
+
+	json, _ := json.Marshal(visible)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// new categories are placed after the last one
+func (ctx *ServerContext) PostCategory(w http.ResponseWriter, r *http.Request) {
+	server, err := ctx.validateRoomsServerID(w, r)
+	if err != nil {
+		return
+	}
+
+	if _, ok := ctx.requirePermission(w, r, server, models.PermissionManageRooms); !ok {
+		return
+	}
+
+	var t struct {
+		Name string `json:"name"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+		return
+	}
+
+	if t.Name == "" {
+		newErrorResponse(w, http.StatusBadRequest, EnumCategoryNameRequired)
+		return
+	}
+
+	category := models.NewRoomCategory().WithServerID(server.ID).WithName(t.Name)
+	if err := category.Create(ctx.Database.Client.WithContext(r.Context())); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	ctx.audit(r, server.ID, models.AuditCategoryCreate, models.AuditTargetCategory, category.ID.String(), models.DiffChanges(nil, category))
+
+	json, _ := json.Marshal(category)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(json)
+}
+
+// omitted fields are left unchanged
+func (ctx *ServerContext) PatchCategory(w http.ResponseWriter, r *http.Request) {
+	server, err := ctx.validateRoomsServerID(w, r)
+	if err != nil {
+		return
+	}
+
+	if _, ok := ctx.requirePermission(w, r, server, models.PermissionManageRooms); !ok {
+		return
+	}
+
+	category, ok := ctx.validateCategoryID(w, r, server)
+	if !ok {
+		return
+	}
+
+	before := *category
+
+	var t struct {
+		Name     *string `json:"name"`
+		Position *int    `json:"position"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+		return
+	}
+
+	if t.Name != nil {
+		if *t.Name == "" {
+			newErrorResponse(w, http.StatusBadRequest, EnumCategoryNameRequired)
+			return
+		}
+		category.Name = *t.Name
+	}
+	if t.Position != nil {
+		if *t.Position < 0 {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid position")
+			return
+		}
+		category.Position = *t.Position
+	}
+
+	if err := category.Update(ctx.Database.Client.WithContext(r.Context())); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	ctx.audit(r, server.ID, models.AuditCategoryUpdate, models.AuditTargetCategory, category.ID.String(), models.DiffChanges(before, category))
+
+	json, _ := json.Marshal(category)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// the rooms of the category are kept without a category
+func (ctx *ServerContext) DeleteCategory(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		server, err := ctx.validateRoomsServerID(w, r)
+		if err != nil {
+			return
+		}
+
+		if _, ok := ctx.requirePermission(w, r, server, models.PermissionManageRooms); !ok {
+			return
+		}
+
+		category, ok := ctx.validateCategoryID(w, r, server)
+		if !ok {
+			return
+		}
+
+		db := ctx.Database.Client.WithContext(r.Context())
+		if err := category.Delete(db); err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		// its rooms lose the category overwrites
+		ctx.syncRooms(db, store, server)
+
+		ctx.audit(r, server.ID, models.AuditCategoryDelete, models.AuditTargetCategory, category.ID.String(), models.DiffChanges(category, nil))
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// sets the positions of many rooms and categories at once, rooms can also move between categories,
+// either everything is changed or nothing is
+func (ctx *ServerContext) PatchServerPositions(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		server, err := ctx.validateRoomsServerID(w, r)
+		if err != nil {
+			return
+		}
+
+		if _, ok := ctx.requirePermission(w, r, server, models.PermissionManageRooms); !ok {
+			return
+		}
+
+		// an omitted categoryId keeps the room in its category, null moves it out
+		var t struct {
+			Categories []struct {
+				ID       uuid.UUID `json:"id"`
+				Position int       `json:"position"`
+			} `json:"categories"`
+			Rooms []struct {
+				ID         uuid.UUID    `json:"id"`
+				Position   int          `json:"position"`
+				CategoryID nullableUUID `json:"categoryId"`
+			} `json:"rooms"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+			return
+		}
+
+		categories := make([]models.CategoryPosition, len(t.Categories))
+		for i, c := range t.Categories {
+			if c.Position < 0 {
+				newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid position")
+				return
+			}
+			categories[i] = models.CategoryPosition{ID: c.ID, Position: c.Position}
+		}
+
+		moved := false
+		rooms := make([]models.RoomPosition, len(t.Rooms))
+		for i, room := range t.Rooms {
+			if room.Position < 0 {
+				newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Invalid position")
+				return
+			}
+			rooms[i] = models.RoomPosition{
+				ID:            room.ID,
+				Position:      room.Position,
+				CategoryID:    room.CategoryID.ID,
+				Uncategorized: room.CategoryID.Set && room.CategoryID.ID == nil,
+			}
+			moved = moved || room.CategoryID.Set
+		}
+
+		db := ctx.Database.Client.WithContext(r.Context())
+		if err := models.ReorderServer(db, server.ID, categories, rooms); err != nil {
+			if err == gorm.ErrRecordNotFound {
+				newErrorResponse(w, http.StatusNotFound, EnumNotFound, "Room or category not found")
+				return
+			}
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		// rooms moved between categories get other overwrites
+		if moved {
+			ctx.syncRooms(db, store, server)
+		}
+		ctx.audit(r, server.ID, models.AuditRoomReorder, models.AuditTargetServer, server.ID.String(), nil)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
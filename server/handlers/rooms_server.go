@@ -5,12 +5,23 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"net/url"
 
 	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
 	"github.com/khalidibnwalid/Luma/middlewares"
 	"github.com/khalidibnwalid/Luma/models"
+	"gorm.io/gorm"
 )
 
+// real-time events sent to the rooms of a server
+const (
+	EventServerUpdate = "SERVER_UPDATE"
+	EventServerDelete = "SERVER_DELETE"
+)
+
+const maxServerDescriptionLength = 1024
+
 func (ctx *ServerContext) validateRoomsServerID(w http.ResponseWriter, r *http.Request) (*models.RoomsServer, error) {
 	rCtx := r.Context()
 	serverID := r.PathValue("id")
@@ -44,6 +55,10 @@ func (ctx *ServerContext) GetRoomsServer(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if _, ok := ctx.requirePermission(w, r, server, 0); !ok {
+		return
+	}
+
 	json, _ := json.Marshal(server)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(json)
@@ -80,6 +95,11 @@ func (ctx *ServerContext) PostRoomsServer(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if middlewares.IsBot(r) {
+		newErrorResponse(w, http.StatusForbidden, EnumForbidden)
+		return
+	}
+
 	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
 
 	server := models.NewRoomsServer().WithOwnerID(userID)
@@ -90,6 +110,11 @@ func (ctx *ServerContext) PostRoomsServer(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if err := models.NewEveryoneRole(server.ID).Create(ctx.Database.Client.WithContext(rCtx)); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
 	userStatus := models.NewServerUserStatus().WithUserID(userID).WithServerID(server.ID)
 	if err := userStatus.Create(ctx.Database.Client.WithContext(rCtx)); err != nil {
 		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
@@ -114,11 +139,19 @@ func (ctx *ServerContext) GetRoomsOfServer(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	rooms, err := server.GetRooms(ctx.Database.Client.WithContext(rCtx), userId)
+	db := ctx.Database.Client.WithContext(rCtx)
+	member, err := models.LoadMemberPermissions(db, server, userId)
+	if !checkPermissions(w, 0, err, 0) {
+		return
+	}
+
+	// hide the rooms the user can't view
+	rooms, err := visibleRooms(db, server, member)
 	if err != nil {
 		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
 		return
 	}
+
 	json, _ := json.Marshal(rooms)
 	log.Println("rooms", rooms)
 	log.Println("json", string(json))
@@ -126,86 +159,444 @@ func (ctx *ServerContext) GetRoomsOfServer(w http.ResponseWriter, r *http.Reques
 	w.Write(json)
 }
 
-func (ctx *ServerContext) PostRoomToServer(w http.ResponseWriter, r *http.Request) {
-	rCtx := r.Context()
-	server, err := ctx.validateRoomsServerID(w, r)
-	if err != nil {
-		return
+// the members connected to the gateway who can view the room are subscribed to it
+func (ctx *ServerContext) PostRoomToServer(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rCtx := r.Context()
+		server, err := ctx.validateRoomsServerID(w, r)
+		if err != nil {
+			return
+		}
+
+		if _, ok := ctx.requirePermission(w, r, server, models.PermissionManageRooms); !ok {
+			return
+		}
+
+		var t struct {
+			Type       string     `json:"type"`
+			Name       string     `json:"name"`
+			CategoryID *uuid.UUID `json:"categoryId"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+			return
+		}
+		if t.Type == "" {
+			newErrorResponse(w, http.StatusBadRequest, EnumServerTypeRequired)
+			return
+		}
+
+		if t.Name == "" {
+			newErrorResponse(w, http.StatusBadRequest, EnumServerNameRequired)
+			return
+		}
+
+		if t.CategoryID != nil {
+			if _, ok := ctx.findCategory(w, r, server, *t.CategoryID); !ok {
+				return
+			}
+		}
+
+		userId := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+
+		room := models.Room{
+			ServerID:   server.ID,
+			Type:       t.Type,
+			Name:       t.Name,
+			CategoryID: t.CategoryID,
+		}
+
+		db := ctx.Database.Client.WithContext(rCtx)
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := room.Create(tx); err != nil {
+				return err
+			}
+			return models.CreateRoomStatuses(tx, &room)
+		})
+		if err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		ctx.audit(r, server.ID, models.AuditRoomCreate, models.AuditTargetRoom, room.ID.String(), models.DiffChanges(nil, map[string]any{
+			"name":       room.Name,
+			"type":       room.Type,
+			"categoryId": room.CategoryID,
+		}))
+
+		// the creator always gets a status, even without a membership
+		status := models.NewRoomUserStatus().WithUserID(userId).WithRoomID(room.ID).WithServerID(server.ID)
+		if err := status.Find(db); err != nil {
+			status.Create(db)
+		}
+
+		RoomWithStatus := models.RoomWithStatus{
+			Room:   &room,
+			Status: status,
+		}
+
+		ctx.subscribeRoom(db, store, server, &room)
+
+		json, _ := json.Marshal(RoomWithStatus)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
 	}
+}
 
-	var t struct {
-		Type      string `json:"type"`
-		Name      string `json:"name"`
-		GroupName string `json:"groupName"`
-	}
+// joins public and discoverable servers only, other servers need an invite
+func (ctx *ServerContext) JoinServer(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		server, err := ctx.validateRoomsServerID(w, r)
+		if err != nil {
+			return
+		}
 
-	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
-		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
-		return
-	}
-	if t.Type == "" {
-		newErrorResponse(w, http.StatusBadRequest, EnumServerTypeRequired)
-		return
+		if !server.IsPublic && !server.IsDiscoverable {
+			newErrorResponse(w, http.StatusForbidden, EnumInviteRequired)
+			return
+		}
+
+		ctx.joinServer(w, r, store, server, nil)
 	}
+}
 
-	if t.Name == "" {
-		newErrorResponse(w, http.StatusBadRequest, EnumServerNameRequired)
+// joinServer adds the user to the server and responds with the server and their status,
+// the invite, if any, is used in the same transaction, joining twice returns the existing status,
+// the user's gateway sessions are subscribed to the server
+func (ctx *ServerContext) joinServer(w http.ResponseWriter, r *http.Request, store *core.TopicStore, server *models.RoomsServer, invite *models.Invite) {
+	rCtx := r.Context()
+	db := ctx.Database.Client.WithContext(rCtx)
+	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+
+	// bots are members of the server they were created in only
+	if middlewares.IsBot(r) {
+		newErrorResponse(w, http.StatusForbidden, EnumForbidden)
 		return
 	}
 
-	userId := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
-
-	room := models.Room{
-		ServerID:  server.ID,
-		Type:      t.Type,
-		Name:      t.Name,
-		GroupName: t.GroupName,
+	if server.RequireVerifiedEmail {
+		user := models.NewUser().WithID(userID)
+		if err := user.FindByID(db); err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+		if !user.IsVerified() {
+			newErrorResponse(w, http.StatusForbidden, EnumEmailNotVerified)
+			return
+		}
 	}
 
-	if err := room.Create(ctx.Database.Client.WithContext(rCtx)); err != nil {
+	banned, err := models.IsBanned(db, server.ID, userID)
+	if err != nil {
 		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
 		return
 	}
-
-	status := models.RoomUserStatus{
-		UserID:   userId,
-		RoomID:   room.ID,
-		ServerID: server.ID,
+	if banned {
+		newErrorResponse(w, http.StatusForbidden, EnumBanned)
+		return
 	}
 
-	status.Create(ctx.Database.Client.WithContext(rCtx))
+	userStatus := models.NewServerUserStatus().WithUserID(userID).WithServerID(server.ID)
+	if err := userStatus.Find(db); err != nil {
+		if err != gorm.ErrRecordNotFound {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if invite != nil {
+				if err := invite.Use(tx); err != nil {
+					return err
+				}
+			}
+			if err := userStatus.Create(tx); err != nil {
+				return err
+			}
+			return models.CreateMemberRoomStatuses(tx, server.ID, userID)
+		})
+		if err != nil {
+			if err == models.ErrInviteInvalid {
+				newErrorResponse(w, http.StatusGone, EnumInviteExpired)
+				return
+			}
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+	}
 
-	RoomWithStatus := models.RoomWithStatus{
-		Room:   &room,
-		Status: &status,
+	serverWithStatus := &models.RoomsServerWithStatus{
+		RoomsServer: server,
+		Status:      *userStatus,
 	}
 
-	json, _ := json.Marshal(RoomWithStatus)
+	ctx.subscribeServer(db, store, *serverWithStatus, userID)
+
+	json, _ := json.Marshal(serverWithStatus)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(json)
 }
 
-func (ctx *ServerContext) JoinServer(w http.ResponseWriter, r *http.Request) {
+// update the server settings, requires ManageServer
+func (ctx *ServerContext) PatchServerSettings(w http.ResponseWriter, r *http.Request) {
 	rCtx := r.Context()
 	server, err := ctx.validateRoomsServerID(w, r)
 	if err != nil {
 		return
 	}
 
-	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+	if _, ok := ctx.requirePermission(w, r, server, models.PermissionManageServer); !ok {
+		return
+	}
 
-	userStatus := models.NewServerUserStatus().WithUserID(userID).WithServerID(server.ID)
-	if err := userStatus.Create(ctx.Database.Client.WithContext(rCtx)); err != nil {
-		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+	before := *server
+
+	// omitted fields are left unchanged
+	var t struct {
+		RequireVerifiedEmail *bool `json:"requireVerifiedEmail"`
+		IsPublic             *bool `json:"isPublic"`
+		IsDiscoverable       *bool `json:"isDiscoverable"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
 		return
 	}
 
-	serverWithStatus := &models.RoomsServerWithStatus{
-		RoomsServer: server,
-		Status:      *userStatus,
+	if t.RequireVerifiedEmail != nil {
+		server.RequireVerifiedEmail = *t.RequireVerifiedEmail
+	}
+	if t.IsPublic != nil {
+		server.IsPublic = *t.IsPublic
+	}
+	if t.IsDiscoverable != nil {
+		server.IsDiscoverable = *t.IsDiscoverable
 	}
 
-	json, _ := json.Marshal(serverWithStatus)
+	if err := server.Update(ctx.Database.Client.WithContext(rCtx)); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	ctx.audit(r, server.ID, models.AuditServerUpdate, models.AuditTargetServer, server.ID.String(), models.DiffChanges(before, server))
+
+	json, _ := json.Marshal(server)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(json)
 }
+
+// serverTopicIDs returns the topic of the server and the topics of its rooms, where its members are connected
+func (ctx *ServerContext) serverTopicIDs(r *http.Request, server *models.RoomsServer) []string {
+	topicIDs := []string{server.ID.String()}
+	roomIDs, err := server.GetRoomIDs(ctx.Database.Client.WithContext(r.Context()))
+	if err != nil {
+		log.Printf("Error getting the rooms of server [%s]: %v\n", server.ID, err)
+		return topicIDs
+	}
+
+	for _, id := range roomIDs {
+		topicIDs = append(topicIDs, id.String())
+	}
+	return topicIDs
+}
+
+// requireOwner responds with 403 unless the user owns the server
+func requireOwner(w http.ResponseWriter, r *http.Request, server *models.RoomsServer) bool {
+	userID := r.Context().Value(middlewares.CtxUserIDKey).(uuid.UUID)
+	if server.OwnerID != userID {
+		newErrorResponse(w, http.StatusForbidden, EnumNotOwner)
+		return false
+	}
+	return true
+}
+
+// update the name, icon, description and tags of the server, omitted fields are left unchanged
+func (ctx *ServerContext) PatchRoomsServer(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		server, err := ctx.validateRoomsServerID(w, r)
+		if err != nil {
+			return
+		}
+
+		if _, ok := ctx.requirePermission(w, r, server, models.PermissionManageServer); !ok {
+			return
+		}
+
+		before := *server
+
+		var t struct {
+			Name        *string   `json:"name"`
+			Icon        *string   `json:"icon"`
+			Description *string   `json:"description"`
+			Tags        *[]string `json:"tags"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+			return
+		}
+
+		if t.Name != nil {
+			if *t.Name == "" {
+				newErrorResponse(w, http.StatusBadRequest, EnumServerNameRequired)
+				return
+			}
+			server.Name = *t.Name
+		}
+
+		// an empty icon removes it
+		if t.Icon != nil {
+			if *t.Icon != "" {
+				u, err := url.Parse(*t.Icon)
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					newErrorResponse(w, http.StatusBadRequest, EnumServerIconInvalid)
+					return
+				}
+			}
+			server.Icon = *t.Icon
+		}
+
+		if t.Description != nil {
+			if len(*t.Description) > maxServerDescriptionLength {
+				newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Description is too long")
+				return
+			}
+			server.Description = *t.Description
+		}
+
+		if t.Tags != nil {
+			tags, err := models.NormalizeTags(*t.Tags)
+			if err != nil {
+				newErrorResponse(w, http.StatusBadRequest, EnumServerTagsInvalid)
+				return
+			}
+			server.Tags = tags
+		}
+
+		if err := server.Update(ctx.Database.Client.WithContext(r.Context())); err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		ctx.audit(r, server.ID, models.AuditServerUpdate, models.AuditTargetServer, server.ID.String(), models.DiffChanges(before, server))
+
+		json, _ := json.Marshal(server)
+		store.Broadcast(core.Event{Type: EventServerUpdate, Data: server}, ctx.serverTopicIDs(r, server)...)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+	}
+}
+
+// only the owner can delete the server, its rooms, messages, roles and the rest cascade
+// and the connected members are notified then disconnected
+func (ctx *ServerContext) DeleteRoomsServer(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		server, err := ctx.validateRoomsServerID(w, r)
+		if err != nil {
+			return
+		}
+
+		if !requireOwner(w, r, server) {
+			return
+		}
+
+		// the rooms are gone after the delete
+		topicIDs := ctx.serverTopicIDs(r, server)
+
+		if err := server.Delete(ctx.Database.Client.WithContext(r.Context())); err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		store.Broadcast(core.Event{Type: EventServerDelete, Data: map[string]uuid.UUID{"id": server.ID}}, topicIDs...)
+		store.Close("server deleted", topicIDs...)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// the owner hands the server to another member, requires the owner's password
+func (ctx *ServerContext) TransferServerOwnership(store *core.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := ctx.Database.Client.WithContext(r.Context())
+		server, err := ctx.validateRoomsServerID(w, r)
+		if err != nil {
+			return
+		}
+
+		if !requireOwner(w, r, server) {
+			return
+		}
+
+		var t struct {
+			UserID   uuid.UUID `json:"userId"`
+			Password string    `json:"password"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+			return
+		}
+
+		user, ok := ctx.findCurrentUser(w, r)
+		if !ok {
+			return
+		}
+
+		// users who only sign in with an identity provider have no password to confirm with
+		if !user.HasPassword() {
+			newErrorResponse(w, http.StatusUnauthorized, EnumPasswordInvalid)
+			return
+		}
+
+		// wrong passwords count like failed logins, a stolen access token can't guess it
+		throttles := newTwoFactorThrottles(r, user.ID)
+		if !throttles.check(w, db) {
+			return
+		}
+
+		if err := core.VerifyHashWithSalt(t.Password, user.HashedPassword); err != nil {
+			if err == core.ErrHashVerificationFailed {
+				throttles.fail(db)
+				newErrorResponse(w, http.StatusUnauthorized, EnumPasswordInvalid)
+				return
+			}
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		if t.UserID == user.ID {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "You already own the server")
+			return
+		}
+
+		if _, ok := ctx.findMember(w, r, server.ID, t.UserID); !ok {
+			return
+		}
+
+		// bots are owned by a member, they can't own servers
+		if err := models.NewBot().WithUserID(t.UserID).WithServerID(server.ID).Find(db); err == nil {
+			newErrorResponse(w, http.StatusBadRequest, EnumBadRequest, "Bots can't own servers")
+			return
+		}
+
+		previous := server.OwnerID
+		if err := server.TransferOwnership(db, t.UserID); err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		// owners see every room, both owners' rooms change
+		ctx.syncRooms(db, store, server, previous, t.UserID)
+
+		ctx.audit(r, server.ID, models.AuditServerTransfer, models.AuditTargetServer, server.ID.String(),
+			models.DiffChanges(map[string]any{"ownerId": previous}, map[string]any{"ownerId": server.OwnerID}))
+
+		json, _ := json.Marshal(server)
+		store.Broadcast(core.Event{Type: EventServerUpdate, Data: server}, ctx.serverTopicIDs(r, server)...)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+	}
+}
@@ -2,22 +2,25 @@ package handlers
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 	"net/mail"
 
+	"github.com/google/uuid"
 	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/middlewares"
 	"github.com/khalidibnwalid/Luma/models"
 	"gorm.io/gorm"
 )
 
 // TODO add a validator
-// TODO forget password
 // LoginHandler
 func (s *ServerContext) PostSession(w http.ResponseWriter, r *http.Request) {
 	rCtx := r.Context()
 	var req struct {
 		UsernameOrEmail string `json:"username"`
 		Password        string `json:"password"`
+		Device          string `json:"device"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -34,13 +37,21 @@ func (s *ServerContext) PostSession(w http.ResponseWriter, r *http.Request) {
 		newErrorResponse(w, http.StatusBadRequest, EnumPasswordInvalid)
 		return
 	}
+
+	db := s.Database.Client.WithContext(rCtx)
+	throttles := newLoginThrottles(r, req.UsernameOrEmail)
+	if !throttles.check(w, db) {
+		return
+	}
+
 	var user *models.User
 	// check if the user exists
 	if validateEmail(req.UsernameOrEmail) {
 		user = models.NewUser().WithEmail(req.UsernameOrEmail)
-		if err := user.FindByEmail(s.Database.Client.WithContext(rCtx)); err != nil {
+		if err := user.FindByEmail(db); err != nil {
 			if err == gorm.ErrRecordNotFound {
-				newErrorResponse(w, http.StatusUnauthorized, EnumUserDoesNotExist)
+				verifyDummyPassword(req.Password)
+				s.loginFailed(w, db, throttles, EnumUserDoesNotExist)
 				return
 			}
 			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
@@ -48,9 +59,10 @@ func (s *ServerContext) PostSession(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		user = models.NewUser().WithUsername(req.UsernameOrEmail)
-		if err := user.FindByUsername(s.Database.Client.WithContext(rCtx)); err != nil {
+		if err := user.FindByUsername(db); err != nil {
 			if err == gorm.ErrRecordNotFound {
-				newErrorResponse(w, http.StatusUnauthorized, EnumUserDoesNotExist)
+				verifyDummyPassword(req.Password)
+				s.loginFailed(w, db, throttles, EnumUserDoesNotExist)
 				return
 			}
 			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
@@ -58,19 +70,64 @@ func (s *ServerContext) PostSession(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// the username and the email of the account share its budget
+	if !throttles.withUser(user.ID).check(w, db) {
+		return
+	}
+
+	// bots authenticate with API tokens only
+	if user.IsBot {
+		verifyDummyPassword(req.Password)
+		s.loginFailed(w, db, throttles, EnumUserDoesNotExist)
+		return
+	}
+
+	// accounts created through an identity provider have no password
+	if !user.HasPassword() {
+		verifyDummyPassword(req.Password)
+		s.loginFailed(w, db, throttles, EnumPasswordInvalid)
+		return
+	}
+
 	// check if the password is correct
 	if err := core.VerifyHashWithSalt(req.Password, user.HashedPassword); err != nil {
 		if err == core.ErrHashVerificationFailed {
-			newErrorResponse(w, http.StatusUnauthorized, EnumPasswordInvalid)
+			s.loginFailed(w, db, throttles, EnumPasswordInvalid)
 			return
 		}
 		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
 		return
 	}
 
-	token, err := core.GenerateJwtToken(s.JwtSecret, user.ID.String())
+	// upgrade hashes made with older argon2 parameters while we have the plain password,
+	// a failure here shouldn't block the login
+	if core.NeedsRehash(user.HashedPassword) {
+		if err := user.UpdatePassword(db, req.Password); err != nil {
+			log.Printf("Error rehashing password: %v", err)
+		}
+	}
 
-	if err != nil {
+	// the session is only issued once the second factor is verified, the failures are reset then too
+	if user.TwoFactorEnabled() {
+		challengeToken, err := core.GenerateChallengeToken(s.Keys, user.ID.String(), req.Device)
+		if err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+
+		res := map[string]any{
+			"twoFactorRequired": true,
+			"challengeToken":    challengeToken,
+		}
+
+		json, _ := json.Marshal(res)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+		return
+	}
+
+	resetLoginThrottles(db, user)
+	if err := s.issueSession(w, r, user.ID, req.Device); err != nil {
 		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
 		return
 	}
@@ -78,20 +135,221 @@ func (s *ServerContext) PostSession(w http.ResponseWriter, r *http.Request) {
 	json, _ := json.Marshal(user)
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Add("Set-Cookie", core.SerializeCookieWithToken(token))
 	w.WriteHeader(http.StatusCreated)
 	w.Write(json)
 }
 
+// issueSession records a new session for the device and sets the access token and refresh token cookies,
+// the session ID is the `jti` of the access token and the family of the refresh tokens
+func (s *ServerContext) issueSession(w http.ResponseWriter, r *http.Request, userID uuid.UUID, device string) error {
+	db := s.Database.Client.WithContext(r.Context())
+
+	if device == "" {
+		device = r.UserAgent()
+	}
+
+	session := models.NewSession().
+		WithUserID(userID).
+		WithDevice(device).
+		WithUserAgent(r.UserAgent()).
+		WithIP(middlewares.ClientIP(r))
+	if err := session.Create(db); err != nil {
+		return err
+	}
+
+	token, err := core.GenerateJwtToken(s.Keys, userID.String(), session.ID.String())
+	if err != nil {
+		return err
+	}
+
+	refreshToken := models.NewRefreshToken().WithUserID(userID).WithFamilyID(session.ID)
+	rawRefreshToken, err := refreshToken.Generate()
+	if err != nil {
+		return err
+	}
+
+	if err := refreshToken.Create(db); err != nil {
+		return err
+	}
+
+	w.Header().Add("Set-Cookie", core.SerializeCookieWithToken(token))
+	w.Header().Add("Set-Cookie", core.SerializeRefreshCookie(rawRefreshToken))
+	return nil
+}
+
+// PostRefreshSession rotates the refresh token and issues a new access token,
+// reusing an already rotated refresh token revokes its whole family
+func (s *ServerContext) PostRefreshSession(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	db := s.Database.Client.WithContext(rCtx)
+
+	cookie, err := r.Cookie(core.RefreshTokenCookieName)
+	if err != nil || cookie.Value == "" {
+		newErrorResponse(w, http.StatusUnauthorized, EnumRefreshTokenInvalid)
+		return
+	}
+
+	refreshToken := models.NewRefreshToken()
+	if err := refreshToken.FindByToken(db, cookie.Value); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			w.Header().Add("Set-Cookie", core.SerializeRefreshCookie(""))
+			newErrorResponse(w, http.StatusUnauthorized, EnumRefreshTokenInvalid)
+			return
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	// a logged out session is not a reuse, just reject it
+	session := models.NewSession().WithID(refreshToken.FamilyID)
+	if err := session.FindByID(db); err != nil || !session.IsActive() {
+		w.Header().Add("Set-Cookie", core.SerializeRefreshCookie(""))
+		newErrorResponse(w, http.StatusUnauthorized, EnumRefreshTokenInvalid)
+		return
+	}
+
+	_, rawRefreshToken, err := refreshToken.Rotate(db)
+	if err != nil {
+		if err == models.ErrRefreshTokenReused || err == models.ErrRefreshTokenInvalid {
+			if err == models.ErrRefreshTokenReused {
+				log.Printf("Refresh token reuse detected for user %s, session %s revoked", refreshToken.UserID, session.ID)
+				if err := session.Revoke(db); err != nil {
+					log.Printf("Error revoking session: %v", err)
+				}
+			}
+			w.Header().Add("Set-Cookie", core.SerializeRefreshCookie(""))
+			newErrorResponse(w, http.StatusUnauthorized, EnumRefreshTokenInvalid)
+			return
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	if err := session.Extend(db); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	token, err := core.GenerateJwtToken(s.Keys, refreshToken.UserID.String(), session.ID.String())
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	w.Header().Add("Set-Cookie", core.SerializeCookieWithToken(token))
+	w.Header().Add("Set-Cookie", core.SerializeRefreshCookie(rawRefreshToken))
+	newOkResponse(w, http.StatusOK, EnumSessionRefreshed)
+}
+
 func validateEmail(email string) bool {
 	_, err := mail.ParseAddress(email)
 	return err == nil
 }
 
-// Just replace the cookie with an empty token
+// Revokes the current session (if any) and replaces both cookies with empty tokens
 func (s *ServerContext) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(core.RefreshTokenCookieName); err == nil && cookie.Value != "" {
+		db := s.Database.Client.WithContext(r.Context())
+		refreshToken := models.NewRefreshToken()
+		if err := refreshToken.FindByToken(db, cookie.Value); err == nil {
+			if err := models.NewSession().WithID(refreshToken.FamilyID).Revoke(db); err != nil {
+				log.Printf("Error revoking session: %v", err)
+			}
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Add("Set-Cookie", core.SerializeCookieWithToken(""))
+	w.Header().Add("Set-Cookie", core.SerializeRefreshCookie(""))
 
 	newOkResponse(w, http.StatusOK, EnumLoggedOut)
 }
+
+type sessionResponse struct {
+	models.Session
+	Current bool `json:"current"`
+}
+
+// list the active sessions (devices) of the user
+func (s *ServerContext) GetSessions(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+	currentSessionID, _ := rCtx.Value(middlewares.CtxSessionIDKey).(uuid.UUID)
+
+	sessions, err := models.GetActiveSessions(s.Database.Client.WithContext(rCtx), userID)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	res := make([]sessionResponse, len(sessions))
+	for i, session := range sessions {
+		res[i] = sessionResponse{
+			Session: session,
+			Current: session.ID == currentSessionID,
+		}
+	}
+
+	json, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// revoke a single session of the user, e.g. a lost device
+func (s *ServerContext) DeleteUserSession(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	db := s.Database.Client.WithContext(rCtx)
+	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+
+	sessionID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumSessionIdInvalid)
+		return
+	}
+
+	session := models.NewSession().WithID(sessionID)
+	// sessions of other users are reported as not found
+	if err := session.FindByID(db); err != nil || session.UserID != userID {
+		if err != nil && err != gorm.ErrRecordNotFound {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+		newErrorResponse(w, http.StatusNotFound, EnumSessionNotFound)
+		return
+	}
+
+	if err := session.Revoke(db); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	if currentSessionID, _ := rCtx.Value(middlewares.CtxSessionIDKey).(uuid.UUID); currentSessionID == sessionID {
+		w.Header().Add("Set-Cookie", core.SerializeCookieWithToken(""))
+		w.Header().Add("Set-Cookie", core.SerializeRefreshCookie(""))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revoke every session of the user including the current one
+func (s *ServerContext) DeleteAllSessions(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+
+	if err := models.RevokeAllSessions(s.Database.Client.WithContext(rCtx), userID); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	w.Header().Add("Set-Cookie", core.SerializeCookieWithToken(""))
+	w.Header().Add("Set-Cookie", core.SerializeRefreshCookie(""))
+	newOkResponse(w, http.StatusOK, EnumLoggedOut)
+}
+
+// publish the public signing keys so other services can verify access tokens
+func (s *ServerContext) GetJWKS(w http.ResponseWriter, r *http.Request) {
+	json, _ := json.Marshal(s.Keys.JWKS())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(json)
+}
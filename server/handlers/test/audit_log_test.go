@@ -0,0 +1,85 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/handlers"
+	"github.com/khalidibnwalid/Luma/models"
+	"github.com/khalidibnwalid/Luma/testutil"
+)
+
+func TestAuditLog(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	store := core.NewTopicStore()
+
+	getAuditLog := func(t *testing.T, server *models.RoomsServer, user *models.User, query string) (*httptest.ResponseRecorder, []models.AuditLogEntry) {
+		t.Helper()
+		r := serverRequest(http.MethodGet, "/servers/"+server.ID.String()+"/audit-log?"+query, nil, user.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.GetAuditLog(w, r)
+
+		var entries []models.AuditLogEntry
+		json.Unmarshal(w.Body.Bytes(), &entries)
+		return w, entries
+	}
+
+	t.Run("Should record role changes with a diff and the reason", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		role := mockRole(t, ctx, server, 0)
+
+		data := []byte(`{"name": "moderators"}`)
+		r := serverRequest(http.MethodPatch, "/servers/"+server.ID.String()+"/roles/"+role.ID.String(), data, owner.ID,
+			map[string]string{"id": server.ID.String(), "roleId": role.ID.String()})
+		r.Header.Set(handlers.AuditReasonHeader, "renaming")
+		w := httptest.NewRecorder()
+		ctx.PatchRole(store)(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", w.Code)
+		}
+
+		w, entries := getAuditLog(t, server, owner, "action="+models.AuditRoleUpdate)
+		if w.Code != http.StatusOK || len(entries) != 1 {
+			t.Fatalf("Expected 1 entry, got %d (%d)", len(entries), w.Code)
+		}
+
+		var changes map[string]models.AuditChange
+		json.Unmarshal(entries[0].Changes, &changes)
+		if len(changes) != 1 || changes["name"].Old != "role" || changes["name"].New != "moderators" {
+			t.Errorf("Unexpected changes: %v", changes)
+		}
+		if entries[0].ActorID != owner.ID || entries[0].TargetID != role.ID.String() || entries[0].Reason != "renaming" {
+			t.Errorf("Unexpected entry: %+v", entries[0])
+		}
+	})
+
+	t.Run("Should paginate newest first", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		for _, action := range []string{models.AuditRoleCreate, models.AuditRoleUpdate, models.AuditRoleDelete} {
+			models.NewAuditLogEntry().WithServerID(server.ID).WithActorID(owner.ID).WithAction(action).Create(ctx.Database.Client)
+		}
+
+		_, first := getAuditLog(t, server, owner, "limit=2")
+		if len(first) != 2 || first[0].Action != models.AuditRoleDelete {
+			t.Fatalf("Unexpected first page: %+v", first)
+		}
+
+		_, second := getAuditLog(t, server, owner, "limit=2&before="+first[1].ID.String())
+		if len(second) != 1 || second[0].Action != models.AuditRoleCreate {
+			t.Errorf("Unexpected second page: %+v", second)
+		}
+	})
+
+	t.Run("Should forbid members without ViewAuditLog", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+
+		if w, _ := getAuditLog(t, server, member, ""); w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code 403, got %d", w.Code)
+		}
+	})
+}
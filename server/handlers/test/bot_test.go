@@ -0,0 +1,142 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/handlers"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"github.com/khalidibnwalid/Luma/testutil"
+)
+
+func TestBots(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+
+	// echoes the principal set by the auth middleware
+	authed := middlewares.JwtAuthBuilder(ctx.Keys, ctx.Database)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"userId": r.Context().Value(middlewares.CtxUserIDKey).(uuid.UUID).String(),
+			"isBot":  middlewares.IsBot(r),
+		})
+	}))
+
+	requestAsBot := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/users", nil)
+		r.Header.Set("Authorization", "Bot "+token)
+		w := httptest.NewRecorder()
+		authed.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Should create a bot whose token authenticates as a bot principal", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		botName := "bot-" + uuid.NewString()[:8]
+
+		r := httptest.NewRequest(http.MethodPost, "/servers/"+server.ID.String()+"/bots", bytes.NewBuffer([]byte(`{"name": "`+botName+`"}`)))
+		w := httptest.NewRecorder()
+		r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, owner.ID))
+		r.SetPathValue("id", server.ID.String())
+
+		ctx.PostBot(w, r)
+
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status code 201, got %d", w.Code)
+		}
+
+		var resBody map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resBody); err != nil {
+			t.Fatalf("Wrong response format should be json: %v", err)
+		}
+
+		botID := resBody["userId"].(string)
+		t.Cleanup(func() {
+			models.NewBot().WithUserID(uuid.MustParse(botID)).Delete(ctx.Database.Client)
+		})
+
+		testutil.AssertInterface(t, map[string]interface{}{
+			"serverId": server.ID.String(),
+			"ownerId":  owner.ID.String(),
+			"user": map[string]interface{}{
+				"username": botName,
+				"isBot":    true,
+			},
+		}, resBody)
+
+		w = requestAsBot(resBody["token"].(string))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", w.Code)
+		}
+
+		var principal map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &principal)
+		testutil.AssertInterface(t, map[string]interface{}{
+			"userId": botID,
+			"isBot":  true,
+		}, principal)
+
+		// revoke the token
+		tokenID := resBody["apiToken"].(map[string]interface{})["id"].(string)
+		r = httptest.NewRequest(http.MethodDelete, "/servers/"+server.ID.String()+"/bots/"+botID+"/tokens/"+tokenID, nil)
+		w = httptest.NewRecorder()
+		r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, owner.ID))
+		r.SetPathValue("id", server.ID.String())
+		r.SetPathValue("botId", botID)
+		r.SetPathValue("tokenId", tokenID)
+
+		ctx.DeleteBotToken(w, r)
+
+		if w.Code != http.StatusNoContent {
+			t.Errorf("Expected status code 204, got %d", w.Code)
+		}
+
+		if w := requestAsBot(resBody["token"].(string)); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status code 401 for a revoked token, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should not let other users create bots", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+
+		r := httptest.NewRequest(http.MethodPost, "/servers/"+server.ID.String()+"/bots", bytes.NewBuffer([]byte(`{"name": "bot"}`)))
+		w := httptest.NewRecorder()
+		r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, user.ID))
+		r.SetPathValue("id", server.ID.String())
+
+		ctx.PostBot(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should reject unknown bot tokens", func(t *testing.T) {
+		if w := requestAsBot("luma_unknown"); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status code 401, got %d", w.Code)
+		}
+	})
+	t.Run("Should keep bots out of the routes of user accounts", func(t *testing.T) {
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+		request := func(isBot bool) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+			rCtx := context.WithValue(r.Context(), middlewares.CtxUserIDKey, user.ID)
+			r = r.WithContext(context.WithValue(rCtx, middlewares.CtxIsBotKey, isBot))
+			w := httptest.NewRecorder()
+			handlers.UsersOnly(ctx.GetSessions)(w, r)
+			return w
+		}
+
+		if w := request(true); w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code 403 for a bot, got %d", w.Code)
+		}
+		if w := request(false); w.Code != http.StatusOK {
+			t.Errorf("Expected status code 200 for a user, got %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,153 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/models"
+	"github.com/khalidibnwalid/Luma/testutil"
+)
+
+func TestGetDiscoverableServers(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	store := core.NewTopicStore()
+
+	// a tag of its own keeps the servers of other tests out of the results
+	newTag := func() string {
+		return strings.ReplaceAll(uuid.NewString(), "-", "")[:20]
+	}
+
+	discoverable := func(t *testing.T, description string, tags ...string) *models.RoomsServer {
+		t.Helper()
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		server.IsDiscoverable = true
+		server.Description = description
+		server.Tags = tags
+		if err := server.Update(ctx.Database.Client); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return server
+	}
+
+	discover := func(t *testing.T, userID uuid.UUID, query string) []models.DiscoverableServer {
+		t.Helper()
+		r := serverRequest(http.MethodGet, "/discover/servers?"+query, nil, userID, nil)
+		w := httptest.NewRecorder()
+		ctx.GetDiscoverableServers(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", w.Code)
+		}
+
+		var servers []models.DiscoverableServer
+		json.Unmarshal(w.Body.Bytes(), &servers)
+		return servers
+	}
+
+	t.Run("Should list discoverable servers with a tag, most members first", func(t *testing.T) {
+		tag := newTag()
+		quiet := discoverable(t, "", tag)
+		busy := discoverable(t, "", tag, "gaming")
+		mockMember(t, ctx, busy)
+		mockMember(t, ctx, busy)
+		hidden, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		hidden.Tags = models.Tags{tag}
+		hidden.Update(ctx.Database.Client)
+
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+		servers := discover(t, user.ID, "tag="+tag)
+
+		if len(servers) != 2 || servers[0].ID != busy.ID || servers[1].ID != quiet.ID {
+			t.Fatalf("Expected the busy then the quiet server, got %+v", servers)
+		}
+		if servers[0].MemberCount != 2 || len(servers[0].Tags) != 2 {
+			t.Errorf("Expected 2 members and 2 tags, got %+v", servers[0])
+		}
+	})
+
+	t.Run("Should search the name and the description", func(t *testing.T) {
+		tag := newTag()
+		match := discoverable(t, "a place for chess players", tag)
+		discoverable(t, "a place for painters", tag)
+
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+		servers := discover(t, user.ID, "tag="+tag+"&q=chess")
+
+		if len(servers) != 1 || servers[0].ID != match.ID {
+			t.Errorf("Expected only the chess server, got %+v", servers)
+		}
+	})
+
+	t.Run("Should paginate the newest servers first", func(t *testing.T) {
+		tag := newTag()
+		first := discoverable(t, "", tag)
+		second := discoverable(t, "", tag)
+
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+		servers := discover(t, user.ID, "tag="+tag+"&sort=new&limit=1")
+		if len(servers) != 1 || servers[0].ID != second.ID {
+			t.Fatalf("Expected the newest server, got %+v", servers)
+		}
+
+		servers = discover(t, user.ID, "tag="+tag+"&sort=new&limit=1&after="+servers[0].ID.String())
+		if len(servers) != 1 || servers[0].ID != first.ID {
+			t.Errorf("Expected the older server, got %+v", servers)
+		}
+	})
+
+	t.Run("Should reject an unknown sort", func(t *testing.T) {
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+		r := serverRequest(http.MethodGet, "/discover/servers?sort=random", nil, user.ID, nil)
+		w := httptest.NewRecorder()
+		ctx.GetDiscoverableServers(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should join a discoverable server without an invite", func(t *testing.T) {
+		server := discoverable(t, "", newTag())
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+
+		r := serverRequest(http.MethodPost, "/servers/"+server.ID.String(), nil, user.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.JoinServer(store)(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status code 200, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should set normalized tags on the server", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+
+		data := []byte(`{"tags": ["Gaming", "gaming", "speed-run"]}`)
+		r := serverRequest(http.MethodPatch, "/servers/"+server.ID.String(), data, owner.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PatchRoomsServer(store)(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", w.Code)
+		}
+
+		updated := models.NewRoomsServer()
+		updated.FindByID(ctx.Database.Client, server.ID)
+		if len(updated.Tags) != 2 || updated.Tags[0] != "gaming" || updated.Tags[1] != "speed-run" {
+			t.Errorf("Expected the tags to be normalized, got %v", updated.Tags)
+		}
+
+		r = serverRequest(http.MethodPatch, "/servers/"+server.ID.String(), []byte(`{"tags": ["no spaces"]}`), owner.ID, map[string]string{"id": server.ID.String()})
+		w = httptest.NewRecorder()
+		ctx.PatchRoomsServer(store)(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code 400, got %d", w.Code)
+		}
+	})
+}
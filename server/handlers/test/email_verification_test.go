@@ -0,0 +1,87 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/handlers"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"github.com/khalidibnwalid/Luma/testutil"
+)
+
+func TestEmailVerification(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	store := core.NewTopicStore()
+
+	t.Run("Should send a verification mail on signup and verify the email", func(t *testing.T) {
+		username, _ := core.GenerateRandomToken(10)
+		email := username + "@example.com"
+		data := []byte(`{"username": "` + username + `", "password": "testpassword", "email": "` + email + `"}`)
+		defer models.NewUser().WithUsername(username).Delete(ctx.Database.Client)
+
+		r := httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(data))
+		w := httptest.NewRecorder()
+		r.Header.Set("Content-Type", "application/json")
+
+		ctx.PostUser(w, r)
+
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status code 201, got %d", w.Code)
+		}
+
+		token := tokenFromMail(t, ctx, email)
+
+		r = httptest.NewRequest(http.MethodPost, "/email-verification/confirm", bytes.NewBuffer([]byte(`{"token": "`+token+`"}`)))
+		w = httptest.NewRecorder()
+
+		ctx.PostEmailVerificationConfirm(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status code 200, got %d", w.Code)
+		}
+
+		user := models.NewUser().WithUsername(username)
+		if err := user.FindByUsername(ctx.Database.Client); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		if !user.IsVerified() {
+			t.Errorf("Expected user to be verified")
+		}
+	})
+
+	t.Run("Should not join a server that requires a verified email", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		server.RequireVerifiedEmail = true
+		server.IsPublic = true
+		server.Update(ctx.Database.Client)
+
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+
+		r := httptest.NewRequest(http.MethodPost, "/servers/"+server.ID.String(), nil)
+		w := httptest.NewRecorder()
+		r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, user.ID))
+		r.SetPathValue("id", server.ID.String())
+
+		ctx.JoinServer(store)(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code 403, got %d", w.Code)
+		}
+
+		var resBody map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resBody); err != nil {
+			t.Errorf("Wrong response format should be json: %v", err)
+		}
+
+		testutil.AssertInterface(t, map[string]interface{}{
+			"error": handlers.EnumEmailNotVerified,
+		}, resBody)
+	})
+}
@@ -0,0 +1,225 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/handlers"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"github.com/khalidibnwalid/Luma/testutil"
+)
+
+// dialGateway connects to the gateway as the user and reads hello
+func dialGateway(t *testing.T, ctx handlers.ServerContext, store *core.TopicStore, sessions *core.SessionStore, userID uuid.UUID) *websocket.Conn {
+	t.Helper()
+	handler := ctx.Gateway(store, sessions)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, userID)))
+	}))
+	t.Cleanup(s.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if hello := readEnvelope(t, conn); hello.Op != core.OpHello {
+		t.Fatalf("Expected hello, got %+v", hello)
+	}
+	return conn
+}
+
+type envelope struct {
+	Op   int             `json:"op"`
+	Type string          `json:"t"`
+	Data json.RawMessage `json:"d"`
+	Seq  int64           `json:"s"`
+}
+
+func readEnvelope(t *testing.T, conn *websocket.Conn) envelope {
+	t.Helper()
+	var e envelope
+	if err := conn.ReadJSON(&e); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return e
+}
+
+func identify(t *testing.T, conn *websocket.Conn) envelope {
+	t.Helper()
+	conn.WriteJSON(map[string]any{"op": core.OpIdentify})
+	ready := readEnvelope(t, conn)
+	if ready.Op != core.OpDispatch || ready.Type != handlers.EventReady {
+		t.Fatalf("Expected READY, got %+v", ready)
+	}
+	return ready
+}
+
+func TestGateway(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	store := core.NewTopicStore()
+	sessions := core.NewSessionStore()
+
+	t.Run("Should identify with the user's servers and rooms and send messages", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		room := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		conn := dialGateway(t, ctx, store, sessions, owner.ID)
+
+		ready := identify(t, conn)
+		var data struct {
+			Servers []struct {
+				ID    uuid.UUID `json:"id"`
+				Rooms []struct {
+					ID uuid.UUID `json:"id"`
+				} `json:"rooms"`
+			} `json:"servers"`
+		}
+		json.Unmarshal(ready.Data, &data)
+		if len(data.Servers) != 1 || data.Servers[0].ID != server.ID || len(data.Servers[0].Rooms) != 1 || data.Servers[0].Rooms[0].ID != room.ID {
+			t.Fatalf("Expected the server with its room, got %s", ready.Data)
+		}
+
+		conn.WriteJSON(map[string]any{"op": core.OpHeartbeat})
+		if ack := readEnvelope(t, conn); ack.Op != core.OpHeartbeatAck {
+			t.Errorf("Expected a heartbeat ack, got %+v", ack)
+		}
+
+		conn.WriteJSON(map[string]any{"op": core.OpCommand, "t": handlers.EventMessageCreate, "d": map[string]any{
+			"roomId": room.ID, "content": "hello",
+		}})
+		message := readEnvelope(t, conn)
+		var msg models.Message
+		json.Unmarshal(message.Data, &msg)
+		if message.Type != handlers.EventMessageCreate || message.Seq != 2 || msg.Content != "hello" || msg.RoomID != room.ID {
+			t.Errorf("Expected the message as the second dispatch, got %+v", message)
+		}
+	})
+
+	t.Run("Should answer commands in rooms the user can't view with an error", func(t *testing.T) {
+		_, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		foreign := testutil.MockRoom(t, ctx.Database.Client, owner.ID)
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+		conn := dialGateway(t, ctx, store, sessions, user.ID)
+		identify(t, conn)
+
+		conn.WriteJSON(map[string]any{"op": core.OpCommand, "t": handlers.EventMessageCreate, "d": map[string]any{
+			"roomId": foreign.ID, "content": "hello", "nonce": "1",
+		}})
+		reply := readEnvelope(t, conn)
+		if reply.Op != core.OpCommandError || !strings.Contains(string(reply.Data), handlers.EnumNotFound) || !strings.Contains(string(reply.Data), `"nonce":"1"`) {
+			t.Errorf("Expected a not found error with the nonce, got %+v %s", reply, reply.Data)
+		}
+	})
+
+	t.Run("Should close sessions that send commands before identifying", func(t *testing.T) {
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+		conn := dialGateway(t, ctx, store, sessions, user.ID)
+
+		conn.WriteJSON(map[string]any{"op": core.OpCommand, "t": handlers.EventTypingStart})
+		_, _, err := conn.ReadMessage()
+		if !websocket.IsCloseError(err, core.CloseNotIdentified) {
+			t.Errorf("Expected a not identified close, got %v", err)
+		}
+	})
+
+	t.Run("Should dispatch new servers and tell kicked members", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		server.IsPublic = true
+		server.Update(ctx.Database.Client)
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+		conn := dialGateway(t, ctx, store, sessions, user.ID)
+		identify(t, conn)
+
+		r := serverRequest(http.MethodPost, "/servers/"+server.ID.String(), nil, user.ID, map[string]string{"id": server.ID.String()})
+		ctx.JoinServer(store)(httptest.NewRecorder(), r)
+		if created := readEnvelope(t, conn); created.Type != handlers.EventServerCreate {
+			t.Fatalf("Expected SERVER_CREATE, got %+v", created)
+		}
+
+		r = serverRequest(http.MethodDelete, "/servers/"+server.ID.String()+"/members/"+user.ID.String(), nil, owner.ID,
+			map[string]string{"id": server.ID.String(), "userId": user.ID.String()})
+		ctx.KickMember(store)(httptest.NewRecorder(), r)
+		if removed := readEnvelope(t, conn); removed.Type != handlers.EventServerRemove {
+			t.Fatalf("Expected SERVER_REMOVE, got %+v", removed)
+		}
+
+		// the session is no longer subscribed to the server
+		if subscribers := store.Subscribers(server.ID.String()); len(subscribers) != 0 {
+			t.Errorf("Expected no subscribers left, got %d", len(subscribers))
+		}
+	})
+
+	t.Run("Should stop dispatching a room once an overwrite hides it", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		room := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		member := mockMember(t, ctx, server)
+		conn := dialGateway(t, ctx, store, sessions, member.ID)
+		identify(t, conn)
+
+		target := "/rooms/" + room.ID.String() + "/overwrites/" + models.OverwriteTargetMember + "/" + member.ID.String()
+		pathValues := map[string]string{"id": room.ID.String(), "targetType": models.OverwriteTargetMember, "targetId": member.ID.String()}
+		data := []byte(`{"deny": ` + strconv.Itoa(int(models.PermissionViewRooms)) + `}`)
+		ctx.PutRoomOverwrite(store)(httptest.NewRecorder(), serverRequest(http.MethodPut, target, data, owner.ID, pathValues))
+		if deleted := readEnvelope(t, conn); deleted.Type != handlers.EventRoomDelete || !strings.Contains(string(deleted.Data), room.ID.String()) {
+			t.Fatalf("Expected ROOM_DELETE, got %+v", deleted)
+		}
+
+		// the messages of the room are no longer delivered, the next dispatch is the one sent to the user
+		store.Broadcast(core.Event{Type: handlers.EventMessageCreate, Data: "hidden"}, room.ID.String())
+		store.Broadcast(core.Event{Type: handlers.EventReadStateUpdate}, member.ID.String())
+		if next := readEnvelope(t, conn); next.Type != handlers.EventReadStateUpdate {
+			t.Fatalf("Expected no message from the hidden room, got %+v", next)
+		}
+
+		ctx.DeleteRoomOverwrite(store)(httptest.NewRecorder(), serverRequest(http.MethodDelete, target, nil, owner.ID, pathValues))
+		if created := readEnvelope(t, conn); created.Type != handlers.EventRoomCreate || !strings.Contains(string(created.Data), room.ID.String()) {
+			t.Fatalf("Expected ROOM_CREATE, got %+v", created)
+		}
+		if subscribers := store.Subscribers(room.ID.String()); len(subscribers) != 1 {
+			t.Errorf("Expected the member to be subscribed again, got %d subscribers", len(subscribers))
+		}
+	})
+
+	t.Run("Should resume a session with the dispatches it missed", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		conn := dialGateway(t, ctx, store, sessions, owner.ID)
+
+		var ready struct {
+			SessionID string `json:"sessionId"`
+		}
+		json.Unmarshal(identify(t, conn).Data, &ready)
+		conn.Close()
+
+		r := serverRequest(http.MethodPost, "/servers/"+server.ID.String()+"/rooms", []byte(`{"name": "general", "type": "text"}`), owner.ID,
+			map[string]string{"id": server.ID.String()})
+		ctx.PostRoomToServer(store)(httptest.NewRecorder(), r)
+
+		conn = dialGateway(t, ctx, store, sessions, owner.ID)
+		conn.WriteJSON(map[string]any{"op": core.OpResume, "d": map[string]any{"sessionId": ready.SessionID, "seq": 1}})
+		for _, expected := range []string{handlers.EventRoomCreate, handlers.EventResumed} {
+			if got := readEnvelope(t, conn); got.Type != expected {
+				t.Fatalf("Expected %s, got %+v", expected, got)
+			}
+		}
+
+		// unknown sessions can identify on the same connection
+		conn = dialGateway(t, ctx, store, sessions, owner.ID)
+		conn.WriteJSON(map[string]any{"op": core.OpResume, "d": map[string]any{"sessionId": "unknown", "seq": 0}})
+		if got := readEnvelope(t, conn); got.Op != core.OpInvalidSession {
+			t.Fatalf("Expected an invalid session, got %+v", got)
+		}
+		identify(t, conn)
+	})
+}
@@ -0,0 +1,103 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/models"
+	"github.com/khalidibnwalid/Luma/testutil"
+)
+
+func TestInvites(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	store := core.NewTopicStore()
+
+	redeem := func(code string, user *models.User) *httptest.ResponseRecorder {
+		r := serverRequest(http.MethodPost, "/invites/"+code, nil, user.ID, map[string]string{"code": code})
+		w := httptest.NewRecorder()
+		ctx.RedeemInvite(store)(w, r)
+		return w
+	}
+
+	t.Run("Should create an invite and join with it until it runs out of uses", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+
+		data := []byte(`{"maxAge": 3600, "maxUses": 1}`)
+		r := serverRequest(http.MethodPost, "/servers/"+server.ID.String()+"/invites", data, owner.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PostInvite(w, r)
+
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status code 201, got %d", w.Code)
+		}
+
+		var invite models.Invite
+		if err := json.Unmarshal(w.Body.Bytes(), &invite); err != nil {
+			t.Fatalf("Wrong response format should be json: %v", err)
+		}
+		if len(invite.Code) != 8 || invite.ExpiresAt == nil {
+			t.Errorf("Unexpected invite: %+v", invite)
+		}
+
+		first, _ := testutil.MockUser(t, ctx.Database.Client)
+		if w := redeem(invite.Code, first); w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", w.Code)
+		}
+		defer models.NewServerUserStatus().WithUserID(first.ID).WithServerID(server.ID).Delete(ctx.Database.Client)
+
+		// members redeeming again don't use the invite
+		if w := redeem(invite.Code, first); w.Code != http.StatusOK {
+			t.Errorf("Expected status code 200, got %d", w.Code)
+		}
+
+		second, _ := testutil.MockUser(t, ctx.Database.Client)
+		if w := redeem(invite.Code, second); w.Code != http.StatusGone {
+			t.Errorf("Expected status code 410, got %d", w.Code)
+		}
+
+		invite.Find(ctx.Database.Client)
+		if invite.Uses != 1 {
+			t.Errorf("Expected 1 use, got %d", invite.Uses)
+		}
+	})
+
+	t.Run("Should not join with an expired invite", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		invite := models.NewInvite().WithServerID(server.ID).WithCreatorID(owner.ID).WithMaxAge(time.Hour)
+		invite.Create(ctx.Database.Client)
+		expired := time.Now().Add(-time.Minute)
+		invite.ExpiresAt = &expired
+		ctx.Database.Client.Save(invite)
+
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+		if w := redeem(invite.Code, user); w.Code != http.StatusGone {
+			t.Errorf("Expected status code 410, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should only let the creator or managers revoke an invite", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		creator := mockMember(t, ctx, server)
+		other := mockMember(t, ctx, server)
+		invite := models.NewInvite().WithServerID(server.ID).WithCreatorID(creator.ID)
+		invite.Create(ctx.Database.Client)
+
+		for _, c := range []struct {
+			user *models.User
+			code int
+		}{{other, http.StatusForbidden}, {creator, http.StatusNoContent}, {owner, http.StatusNotFound}} {
+			r := serverRequest(http.MethodDelete, "/servers/"+server.ID.String()+"/invites/"+invite.Code, nil, c.user.ID,
+				map[string]string{"id": server.ID.String(), "code": invite.Code})
+			w := httptest.NewRecorder()
+			ctx.DeleteInvite(w, r)
+
+			if w.Code != c.code {
+				t.Errorf("Expected status code %d, got %d", c.code, w.Code)
+			}
+		}
+	})
+}
@@ -0,0 +1,153 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/handlers"
+	"github.com/khalidibnwalid/Luma/models"
+	"github.com/khalidibnwalid/Luma/testutil"
+)
+
+func mockLoginAttempt(ctx handlers.ServerContext, ip, username, password string) *httptest.ResponseRecorder {
+	data := []byte(`{"username": "` + username + `", "password": "` + password + `"}`)
+	r := httptest.NewRequest(http.MethodPost, "/sessions", bytes.NewBuffer(data))
+	r.RemoteAddr = ip + ":1234"
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	ctx.PostSession(w, r)
+	return w
+}
+
+func TestLoginThrottle(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+
+	t.Run("Should lock the account after too many failures, even with the right password", func(t *testing.T) {
+		user, pass := testutil.MockUser(t, ctx.Database.Client)
+		defer user.Delete(ctx.Database.Client)
+
+		for i := 0; i <= models.AccountThrottlePolicy.FreeAttempts; i++ {
+			w := mockLoginAttempt(ctx, "198.51.100.1", user.Username, "wrongpassword")
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("Expected status code 401 on attempt %d, got %d", i+1, w.Code)
+			}
+		}
+
+		// from another IP, the account itself is locked
+		w := mockLoginAttempt(ctx, "198.51.100.2", user.Username, pass)
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("Expected status code 429, got %d", w.Code)
+		}
+		if w.Header().Get("Retry-After") == "" {
+			t.Error("Expected Retry-After header to be set")
+		}
+
+		var resBody map[string]any
+		json.Unmarshal(w.Body.Bytes(), &resBody)
+		testutil.AssertInterface(t, map[string]any{
+			"error": handlers.EnumTooManyLoginAttempts,
+		}, resBody)
+	})
+
+	t.Run("Should lock the IP after too many failures across accounts", func(t *testing.T) {
+		user, pass := testutil.MockUser(t, ctx.Database.Client)
+		defer user.Delete(ctx.Database.Client)
+
+		for i := 0; i <= models.IPThrottlePolicy.FreeAttempts; i++ {
+			mockLoginAttempt(ctx, "198.51.100.3", uuid.NewString(), "wrongpassword")
+		}
+
+		if w := mockLoginAttempt(ctx, "198.51.100.3", user.Username, pass); w.Code != http.StatusTooManyRequests {
+			t.Errorf("Expected status code 429, got %d", w.Code)
+		}
+		if w := mockLoginAttempt(ctx, "198.51.100.4", user.Username, pass); w.Code != http.StatusCreated {
+			t.Errorf("Expected status code 201 from another IP, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should reset the account failures after a successful login", func(t *testing.T) {
+		user, pass := testutil.MockUser(t, ctx.Database.Client)
+		defer user.Delete(ctx.Database.Client)
+
+		for i := 0; i < models.AccountThrottlePolicy.FreeAttempts; i++ {
+			mockLoginAttempt(ctx, "198.51.100.5", user.Username, "wrongpassword")
+		}
+		if w := mockLoginAttempt(ctx, "198.51.100.5", user.Username, pass); w.Code != http.StatusCreated {
+			t.Fatalf("Expected status code 201, got %d", w.Code)
+		}
+		if w := mockLoginAttempt(ctx, "198.51.100.5", user.Username, "wrongpassword"); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status code 401 after the reset, got %d", w.Code)
+		}
+	})
+}
+
+func TestLoginThrottleAccount(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+
+	t.Run("Should count the failures of the username and the email together", func(t *testing.T) {
+		user, pass := testutil.MockUser(t, ctx.Database.Client)
+		defer user.Delete(ctx.Database.Client)
+
+		for i := 0; i <= models.AccountThrottlePolicy.FreeAttempts; i++ {
+			identifier := user.Username
+			if i%2 == 1 {
+				identifier = user.Email
+			}
+			mockLoginAttempt(ctx, "198.51.100.7", identifier, "wrongpassword")
+		}
+
+		if w := mockLoginAttempt(ctx, "198.51.100.8", user.Email, pass); w.Code != http.StatusTooManyRequests {
+			t.Errorf("Expected status code 429, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should not reset the failures before the second factor", func(t *testing.T) {
+		user, pass := testutil.MockUser(t, ctx.Database.Client)
+		defer user.Delete(ctx.Database.Client)
+		mockTwoFactor(t, ctx, user)
+
+		for i := 0; i < models.AccountThrottlePolicy.FreeAttempts; i++ {
+			mockLoginAttempt(ctx, "198.51.100.9", user.Username, "wrongpassword")
+		}
+		if w := mockLoginAttempt(ctx, "198.51.100.9", user.Username, pass); w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200 with a challenge, got %d", w.Code)
+		}
+
+		// the failures before the password are still counted
+		mockLoginAttempt(ctx, "198.51.100.9", user.Username, "wrongpassword")
+		if w := mockLoginAttempt(ctx, "198.51.100.9", user.Username, pass); w.Code != http.StatusTooManyRequests {
+			t.Errorf("Expected status code 429, got %d", w.Code)
+		}
+	})
+}
+
+func TestGenericLoginErrors(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	ctx.GenericLoginErrors = true
+
+	user, _ := testutil.MockUser(t, ctx.Database.Client)
+	defer user.Delete(ctx.Database.Client)
+
+	for name, username := range map[string]string{
+		"unknown user":   uuid.NewString(),
+		"wrong password": user.Username,
+	} {
+		t.Run("Should return the generic error for "+name, func(t *testing.T) {
+			w := mockLoginAttempt(ctx, "198.51.100.6", username, "wrongpassword")
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status code 401, got %d", w.Code)
+			}
+
+			var resBody map[string]any
+			json.Unmarshal(w.Body.Bytes(), &resBody)
+			testutil.AssertInterface(t, map[string]any{
+				"error": handlers.EnumInvalidCredentials,
+			}, resBody)
+		})
+	}
+}
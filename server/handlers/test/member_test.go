@@ -0,0 +1,164 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/models"
+	"github.com/khalidibnwalid/Luma/testutil"
+)
+
+func TestMembers(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	store := core.NewTopicStore()
+
+	list := func(t *testing.T, server *models.RoomsServer, member *models.User, query url.Values) []models.Member {
+		t.Helper()
+		r := serverRequest(http.MethodGet, "/servers/"+server.ID.String()+"/members?"+query.Encode(), nil, member.ID,
+			map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.GetMembers(store)(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", w.Code)
+		}
+
+		var members []models.Member
+		if err := json.Unmarshal(w.Body.Bytes(), &members); err != nil {
+			t.Fatalf("Wrong response format should be json: %v", err)
+		}
+		return members
+	}
+
+	t.Run("Should list the members with their roles and presence", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+		other := mockMember(t, ctx, server)
+		role := mockRole(t, ctx, server, 0, other)
+
+		members := list(t, server, member, url.Values{})
+		if len(members) != 2 {
+			t.Fatalf("Expected 2 members, got %d", len(members))
+		}
+		for _, m := range members {
+			if m.Presence != models.PresenceOffline {
+				t.Errorf("Expected offline presence, got %s", m.Presence)
+			}
+			if m.User.ID == other.ID && (len(m.RoleIDs) != 1 || m.RoleIDs[0] != role.ID) {
+				t.Errorf("Expected the member's role, got %v", m.RoleIDs)
+			}
+		}
+	})
+
+	t.Run("Should filter by role and search by nickname", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+		staff := mockMember(t, ctx, server)
+		role := mockRole(t, ctx, server, 0, staff)
+		models.NewServerUserStatus().WithUserID(member.ID).WithServerID(server.ID).SetNickname(ctx.Database.Client, "Night_Owl")
+
+		members := list(t, server, member, url.Values{"roleId": {role.ID.String()}})
+		if len(members) != 1 || members[0].User.ID != staff.ID {
+			t.Errorf("Expected only the staff member, got %d members", len(members))
+		}
+
+		members = list(t, server, member, url.Values{"q": {"night_"}})
+		if len(members) != 1 || members[0].User.ID != member.ID {
+			t.Errorf("Expected only the nicknamed member, got %d members", len(members))
+		}
+
+		// _ is not a wildcard
+		if members = list(t, server, member, url.Values{"q": {"night_owl_"}}); len(members) != 0 {
+			t.Errorf("Expected no members, got %d", len(members))
+		}
+	})
+
+	t.Run("Should paginate after the last member", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+		mockMember(t, ctx, server)
+		mockMember(t, ctx, server)
+
+		first := list(t, server, member, url.Values{"limit": {"2"}})
+		rest := list(t, server, member, url.Values{"limit": {"2"}, "after": {first[1].User.ID.String()}})
+		if len(first) != 2 || len(rest) != 1 {
+			t.Fatalf("Expected pages of 2 and 1, got %d and %d", len(first), len(rest))
+		}
+		if rest[0].User.Username <= first[1].User.Username {
+			t.Error("Expected the second page to come after the first")
+		}
+	})
+
+	t.Run("Should forbid users who are not members", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		outsider, _ := testutil.MockUser(t, ctx.Database.Client)
+
+		r := serverRequest(http.MethodGet, "/servers/"+server.ID.String()+"/members", nil, outsider.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.GetMembers(store)(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should set the member's own nickname", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+
+		r := serverRequest(http.MethodPatch, "/servers/"+server.ID.String()+"/members/@me", []byte(`{"nickname": "Nick"}`), member.ID,
+			map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PatchMemberMe(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", w.Code)
+		}
+
+		status := models.NewServerUserStatus().WithUserID(member.ID).WithServerID(server.ID)
+		status.Find(ctx.Database.Client)
+		if status.Nickname != "Nick" {
+			t.Errorf("Expected the nickname to be Nick, got %q", status.Nickname)
+		}
+	})
+
+	t.Run("Should leave the server and lose the room statuses", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+		testutil.MockRoom(t, ctx.Database.Client, member.ID, server)
+		testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+
+		r := serverRequest(http.MethodDelete, "/servers/"+server.ID.String()+"/members/@me", nil, member.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.LeaveServer(store)(w, r)
+
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code 204, got %d", w.Code)
+		}
+
+		if err := models.NewServerUserStatus().WithUserID(member.ID).WithServerID(server.ID).Find(ctx.Database.Client); err == nil {
+			t.Error("Expected the membership to be deleted")
+		}
+		var rooms int64
+		ctx.Database.Client.Model(&models.RoomUserStatus{}).Where("server_id = ? AND user_id = ?", server.ID, member.ID).Count(&rooms)
+		if rooms != 0 {
+			t.Errorf("Expected no room statuses, got %d", rooms)
+		}
+	})
+
+	t.Run("Should not let the owner leave", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+
+		r := serverRequest(http.MethodDelete, "/servers/"+server.ID.String()+"/members/@me", nil, owner.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.LeaveServer(store)(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code 400, got %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/models"
+	"github.com/khalidibnwalid/Luma/testutil"
+)
+
+func TestModeration(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	store := core.NewTopicStore()
+
+	t.Run("Should kick a member and remove their statuses and roles", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+		testutil.MockRoom(t, ctx.Database.Client, member.ID, server)
+		mockRole(t, ctx, server, 0, member)
+
+		r := serverRequest(http.MethodDelete, "/servers/"+server.ID.String()+"/members/"+member.ID.String(), nil, owner.ID,
+			map[string]string{"id": server.ID.String(), "userId": member.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.KickMember(store)(w, r)
+
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code 204, got %d", w.Code)
+		}
+
+		if err := models.NewServerUserStatus().WithUserID(member.ID).WithServerID(server.ID).Find(ctx.Database.Client); err == nil {
+			t.Error("Expected the membership to be deleted")
+		}
+		var rooms int64
+		ctx.Database.Client.Model(&models.RoomUserStatus{}).Where("server_id = ? AND user_id = ?", server.ID, member.ID).Count(&rooms)
+		roles, _ := models.GetMemberRoleIDs(ctx.Database.Client, server.ID, member.ID)
+		if rooms != 0 || len(roles) != 0 {
+			t.Errorf("Expected no room statuses and roles, got %d and %d", rooms, len(roles))
+		}
+	})
+
+	t.Run("Should not kick members with an equal or higher role", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		moderator := mockMember(t, ctx, server)
+		target := mockMember(t, ctx, server)
+		mockRole(t, ctx, server, models.PermissionKickMembers, moderator, target)
+
+		r := serverRequest(http.MethodDelete, "/servers/"+server.ID.String()+"/members/"+target.ID.String(), nil, moderator.ID,
+			map[string]string{"id": server.ID.String(), "userId": target.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.KickMember(store)(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should ban a member so they can't rejoin until unbanned", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		server.IsPublic = true
+		server.Update(ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+		pathValues := map[string]string{"id": server.ID.String(), "userId": member.ID.String()}
+
+		data := []byte(`{"reason": "spam", "duration": 0}`)
+		r := serverRequest(http.MethodPut, "/servers/"+server.ID.String()+"/bans/"+member.ID.String(), data, owner.ID, pathValues)
+		w := httptest.NewRecorder()
+		ctx.PutBan(store)(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", w.Code)
+		}
+
+		join := func() int {
+			r := serverRequest(http.MethodPost, "/servers/"+server.ID.String(), nil, member.ID, map[string]string{"id": server.ID.String()})
+			w := httptest.NewRecorder()
+			ctx.JoinServer(store)(w, r)
+			return w.Code
+		}
+
+		if code := join(); code != http.StatusForbidden {
+			t.Errorf("Expected status code 403, got %d", code)
+		}
+
+		r = serverRequest(http.MethodDelete, "/servers/"+server.ID.String()+"/bans/"+member.ID.String(), nil, owner.ID, pathValues)
+		w = httptest.NewRecorder()
+		ctx.DeleteBan(w, r)
+
+		if code := join(); code != http.StatusOK {
+			t.Errorf("Expected status code 200, got %d", code)
+		}
+	})
+
+	t.Run("Should reject durations that would overflow", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+		pathValues := map[string]string{"id": server.ID.String(), "userId": member.ID.String()}
+
+		// overflows to a negative duration once multiplied by a second
+		data := []byte(`{"duration": 9300000000}`)
+		r := serverRequest(http.MethodPut, "/servers/"+server.ID.String()+"/bans/"+member.ID.String(), data, owner.ID, pathValues)
+		w := httptest.NewRecorder()
+		ctx.PutBan(store)(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code 400 for the ban, got %d", w.Code)
+		}
+
+		r = serverRequest(http.MethodPut, "/servers/"+server.ID.String()+"/members/"+member.ID.String()+"/timeout", data, owner.ID, pathValues)
+		w = httptest.NewRecorder()
+		ctx.PutMemberTimeout(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code 400 for the timeout, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should time out a member so they can read but not send", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+		room := testutil.MockRoom(t, ctx.Database.Client, member.ID, server)
+
+		data := []byte(`{"duration": 600}`)
+		r := serverRequest(http.MethodPut, "/servers/"+server.ID.String()+"/members/"+member.ID.String()+"/timeout", data, owner.ID,
+			map[string]string{"id": server.ID.String(), "userId": member.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PutMemberTimeout(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", w.Code)
+		}
+
+		permissions, _ := models.ResolveRoomPermissions(ctx.Database.Client, server, room.Room, member.ID)
+		if permissions.Has(models.PermissionSendMessages) || !permissions.Has(models.PermissionViewRooms) {
+			t.Errorf("Expected a timed out member to only read, got %b", permissions)
+		}
+	})
+}
@@ -0,0 +1,247 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/handlers"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"github.com/khalidibnwalid/Luma/testutil"
+)
+
+// mockOIDCFlow runs the whole redirect dance, userID is the logged in user when linking
+func mockOIDCFlow(t *testing.T, ctx handlers.ServerContext, issuer *testutil.MockOIDCIssuer, userID *uuid.UUID) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/oidc/mock", nil)
+	r.SetPathValue("provider", "mock")
+	w := httptest.NewRecorder()
+	if userID != nil {
+		r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, *userID))
+		ctx.GetOIDCLink(w, r)
+	} else {
+		ctx.GetOIDCLogin(w, r)
+	}
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected status code 302, got %d", w.Code)
+	}
+	stateCookie := findCookie(w, core.OIDCStateCookieName)
+	if stateCookie == nil {
+		t.Fatal("Expected the state cookie to be set")
+	}
+
+	callback := issuer.Authorize(t, w.Header().Get("Location"))
+
+	r = httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	r.SetPathValue("provider", "mock")
+	r.AddCookie(stateCookie)
+	w = httptest.NewRecorder()
+	ctx.GetOIDCCallback(w, r)
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected status code 302, got %d", w.Code)
+	}
+	return w
+}
+
+func redirectQuery(t *testing.T, w *httptest.ResponseRecorder) (string, url.Values) {
+	t.Helper()
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return location.Path, location.Query()
+}
+
+func TestOIDC(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	issuer := testutil.NewMockOIDCIssuer(t)
+	ctx.OIDCProviders = map[string]*core.OIDCProvider{
+		"mock": issuer.Provider("mock", "http://localhost:8080/v1/auth/oidc/mock/callback"),
+	}
+
+	t.Run("Should sign up a new user and log them in on the next login", func(t *testing.T) {
+		issuer.Identity.Subject = uuid.NewString()
+		issuer.Identity.Email = uuid.NewString() + "@example.com"
+
+		w := mockOIDCFlow(t, ctx, issuer, nil)
+		if path, query := redirectQuery(t, w); path != "/" || query.Get("error") != "" {
+			t.Fatalf("Expected redirect to the app, got %s", w.Header().Get("Location"))
+		}
+		if findCookie(w, core.JwtSessionCookieName) == nil {
+			t.Fatal("Expected session cookie to be set")
+		}
+
+		identity := models.NewIdentity().WithProvider("mock").WithSubject(issuer.Identity.Subject)
+		if err := identity.FindBySubject(ctx.Database.Client); err != nil {
+			t.Fatalf("Expected the identity to be created: %v", err)
+		}
+		user := models.NewUser()
+		if err := user.FindByID(ctx.Database.Client, identity.UserID); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer user.Delete(ctx.Database.Client)
+
+		if user.Email != issuer.Identity.Email || !user.IsVerified() || user.HasPassword() {
+			t.Errorf("Unexpected user: %+v", user)
+		}
+
+		// logging in again finds the same user
+		w = mockOIDCFlow(t, ctx, issuer, nil)
+		if findCookie(w, core.JwtSessionCookieName) == nil {
+			t.Fatal("Expected session cookie to be set")
+		}
+		identities, _ := models.GetUserIdentities(ctx.Database.Client, user.ID)
+		if len(identities) != 1 {
+			t.Errorf("Expected 1 identity, got %d", len(identities))
+		}
+	})
+
+	t.Run("Should not take over an account with the same email", func(t *testing.T) {
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+		issuer.Identity.Subject = uuid.NewString()
+		issuer.Identity.Email = user.Email
+
+		w := mockOIDCFlow(t, ctx, issuer, nil)
+		if _, query := redirectQuery(t, w); query.Get("error") != handlers.EnumIdentityEmailInUse {
+			t.Errorf("Expected %s, got %s", handlers.EnumIdentityEmailInUse, w.Header().Get("Location"))
+		}
+		if findCookie(w, core.JwtSessionCookieName) != nil {
+			t.Error("Expected no session")
+		}
+	})
+
+	t.Run("Should link a provider to an existing account and unlink it", func(t *testing.T) {
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+		issuer.Identity.Subject = uuid.NewString()
+		issuer.Identity.Email = uuid.NewString() + "@example.com"
+
+		w := mockOIDCFlow(t, ctx, issuer, &user.ID)
+		if _, query := redirectQuery(t, w); query.Get("linked") != "mock" {
+			t.Fatalf("Expected the provider to be linked, got %s", w.Header().Get("Location"))
+		}
+
+		// the identity now logs into the existing account
+		w = mockOIDCFlow(t, ctx, issuer, nil)
+		if findCookie(w, core.JwtSessionCookieName) == nil {
+			t.Fatal("Expected session cookie to be set")
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/users/identities", nil)
+		r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, user.ID))
+		w = httptest.NewRecorder()
+		ctx.GetIdentities(w, r)
+
+		var identities []map[string]any
+		json.Unmarshal(w.Body.Bytes(), &identities)
+		if len(identities) != 1 || identities[0]["provider"] != "mock" {
+			t.Fatalf("Expected the linked identity, got %v", identities)
+		}
+
+		identityID := identities[0]["id"].(string)
+		r = httptest.NewRequest(http.MethodDelete, "/users/identities/"+identityID, nil)
+		r.SetPathValue("id", identityID)
+		r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, user.ID))
+		w = httptest.NewRecorder()
+		ctx.DeleteIdentity(w, r)
+
+		if w.Code != http.StatusNoContent {
+			t.Errorf("Expected status code 204, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should ask for the second factor in the fragment of the redirect", func(t *testing.T) {
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+		defer user.Delete(ctx.Database.Client)
+		mockTwoFactor(t, ctx, user)
+		issuer.Identity.Subject = uuid.NewString()
+		issuer.Identity.Email = uuid.NewString() + "@example.com"
+		mockOIDCFlow(t, ctx, issuer, &user.ID)
+
+		w := mockOIDCFlow(t, ctx, issuer, nil)
+		if findCookie(w, core.JwtSessionCookieName) != nil {
+			t.Fatal("Expected no session cookie before the second factor")
+		}
+
+		location, _ := url.Parse(w.Header().Get("Location"))
+		fragment, _ := url.ParseQuery(location.Fragment)
+		if location.Path != "/login/2fa" || location.RawQuery != "" || fragment.Get("challengeToken") == "" {
+			t.Errorf("Expected the challenge token in the fragment only, got %s", w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("Should not link an identity already linked to another account", func(t *testing.T) {
+		first, _ := testutil.MockUser(t, ctx.Database.Client)
+		second, _ := testutil.MockUser(t, ctx.Database.Client)
+		issuer.Identity.Subject = uuid.NewString()
+
+		mockOIDCFlow(t, ctx, issuer, &first.ID)
+		w := mockOIDCFlow(t, ctx, issuer, &second.ID)
+		if _, query := redirectQuery(t, w); query.Get("error") != handlers.EnumIdentityAlreadyLinked {
+			t.Errorf("Expected %s, got %s", handlers.EnumIdentityAlreadyLinked, w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("Should not unlink the only login method", func(t *testing.T) {
+		issuer.Identity.Subject = uuid.NewString()
+		issuer.Identity.Email = uuid.NewString() + "@example.com"
+		mockOIDCFlow(t, ctx, issuer, nil)
+
+		identity := models.NewIdentity().WithProvider("mock").WithSubject(issuer.Identity.Subject)
+		if err := identity.FindBySubject(ctx.Database.Client); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer models.NewUser().WithID(identity.UserID).Delete(ctx.Database.Client)
+
+		r := httptest.NewRequest(http.MethodDelete, "/users/identities/"+identity.ID.String(), nil)
+		r.SetPathValue("id", identity.ID.String())
+		r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, identity.UserID))
+		w := httptest.NewRecorder()
+		ctx.DeleteIdentity(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should reject a callback with a mismatched state", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/oidc/mock", nil)
+		r.SetPathValue("provider", "mock")
+		w := httptest.NewRecorder()
+		ctx.GetOIDCLogin(w, r)
+		stateCookie := findCookie(w, core.OIDCStateCookieName)
+
+		callback := issuer.Authorize(t, w.Header().Get("Location"))
+		query := callback.Query()
+		query.Set("state", "forged")
+
+		r = httptest.NewRequest(http.MethodGet, "/oidc/mock/callback?"+query.Encode(), nil)
+		r.SetPathValue("provider", "mock")
+		r.AddCookie(stateCookie)
+		w = httptest.NewRecorder()
+		ctx.GetOIDCCallback(w, r)
+
+		if _, query := redirectQuery(t, w); query.Get("error") != handlers.EnumOIDCStateInvalid {
+			t.Errorf("Expected %s, got %s", handlers.EnumOIDCStateInvalid, w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("Should return 404 for an unknown provider", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/oidc/unknown", nil)
+		r.SetPathValue("provider", "unknown")
+		w := httptest.NewRecorder()
+		ctx.GetOIDCLogin(w, r)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status code 404, got %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package handlers_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/handlers"
+	"github.com/khalidibnwalid/Luma/testutil"
+)
+
+var mailTokenRegex = regexp.MustCompile(`token=([^\s]+)`)
+
+// waits for the mail sent in the background and extracts the token from its link
+func tokenFromMail(t *testing.T, ctx handlers.ServerContext, to string) string {
+	t.Helper()
+	mailer := ctx.Mailer.(*core.MemoryMailer)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if mail, ok := mailer.Last(to); ok {
+			match := mailTokenRegex.FindStringSubmatch(mail.Body)
+			if match == nil {
+				t.Fatalf("Expected a token link in the mail body: %s", mail.Body)
+			}
+			token, _ := url.QueryUnescape(match[1])
+			return token
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Expected a mail to be sent to %s", to)
+	return ""
+}
+
+func mockResetConfirm(ctx handlers.ServerContext, token, password string) *httptest.ResponseRecorder {
+	data := []byte(`{"token": "` + token + `", "password": "` + password + `"}`)
+	r := httptest.NewRequest(http.MethodPost, "/password-reset/confirm", bytes.NewBuffer(data))
+	w := httptest.NewRecorder()
+	r.Header.Set("Content-Type", "application/json")
+
+	ctx.PostPasswordResetConfirm(w, r)
+	return w
+}
+
+func TestPasswordReset(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+
+	t.Run("Should reset the password with the mailed token only once", func(t *testing.T) {
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+
+		data := []byte(`{"email": "` + user.Email + `"}`)
+		r := httptest.NewRequest(http.MethodPost, "/password-reset", bytes.NewBuffer(data))
+		w := httptest.NewRecorder()
+		r.Header.Set("Content-Type", "application/json")
+
+		ctx.PostPasswordReset(w, r)
+
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("Expected status code 202, got %d", w.Code)
+		}
+
+		token := tokenFromMail(t, ctx, user.Email)
+
+		if w := mockResetConfirm(ctx, token, "newpassword"); w.Code != http.StatusOK {
+			t.Errorf("Expected status code 200, got %d", w.Code)
+		}
+
+		if w := mockResetConfirm(ctx, token, "anotherpassword"); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code 400 when reusing the token, got %d", w.Code)
+		}
+
+		login := []byte(`{"username": "` + user.Username + `", "password": "newpassword"}`)
+		r = httptest.NewRequest(http.MethodPost, "/sessions", bytes.NewBuffer(login))
+		w = httptest.NewRecorder()
+		ctx.PostSession(w, r)
+
+		if w.Code != http.StatusCreated {
+			t.Errorf("Expected to login with the new password, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should respond the same way for unknown emails", func(t *testing.T) {
+		data := []byte(`{"email": "does-not-exist@example.com"}`)
+		r := httptest.NewRequest(http.MethodPost, "/password-reset", bytes.NewBuffer(data))
+		w := httptest.NewRecorder()
+		r.Header.Set("Content-Type", "application/json")
+
+		ctx.PostPasswordReset(w, r)
+
+		if w.Code != http.StatusAccepted {
+			t.Errorf("Expected status code 202, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should reject an invalid token", func(t *testing.T) {
+		if w := mockResetConfirm(ctx, "invalid-token", "newpassword"); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code 400, got %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/models"
+	"github.com/khalidibnwalid/Luma/testutil"
+)
+
+func TestPermissionOverwrites(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	store := core.NewTopicStore()
+
+	t.Run("Should hide a staff room from members and show it to staff", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		room := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		member := mockMember(t, ctx, server)
+		staff := mockMember(t, ctx, server)
+		staffRole := mockRole(t, ctx, server, 0, staff)
+
+		put := func(targetType, targetID string, allow, deny models.Permission) {
+			data := []byte(`{"allow": ` + strconv.Itoa(int(allow)) + `, "deny": ` + strconv.Itoa(int(deny)) + `}`)
+			r := serverRequest(http.MethodPut, "/rooms/"+room.ID.String()+"/overwrites/"+targetType+"/"+targetID, data, owner.ID,
+				map[string]string{"id": room.ID.String(), "targetType": targetType, "targetId": targetID})
+			w := httptest.NewRecorder()
+			ctx.PutRoomOverwrite(store)(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status code 200, got %d", w.Code)
+			}
+		}
+		put(models.OverwriteTargetRole, everyoneRole(t, ctx, server).ID.String(), 0, models.PermissionViewRooms)
+		put(models.OverwriteTargetRole, staffRole.ID.String(), models.PermissionViewRooms, 0)
+
+		for _, c := range []struct {
+			user    *models.User
+			visible int
+		}{{member, 0}, {staff, 1}} {
+			status := &models.RoomUserStatus{UserID: c.user.ID, RoomID: room.ID, ServerID: server.ID}
+			status.Create(ctx.Database.Client)
+			defer status.Delete(ctx.Database.Client)
+
+			r := serverRequest(http.MethodGet, "/servers/"+server.ID.String()+"/rooms", nil, c.user.ID, map[string]string{"id": server.ID.String()})
+			w := httptest.NewRecorder()
+			ctx.GetRoomsOfServer(w, r)
+
+			var rooms []map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &rooms)
+			listed := 0
+			for _, rm := range rooms {
+				if rm["id"] == room.ID.String() {
+					listed++
+				}
+			}
+			if listed != c.visible {
+				t.Errorf("Expected the staff room to be listed %d times, got %d", c.visible, listed)
+			}
+		}
+
+		r := serverRequest(http.MethodGet, "/rooms/"+room.ID.String()+"/messages", nil, member.ID, map[string]string{"id": room.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.GETRoomMessages(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should let a member overwrite win over role overwrites", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		room := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		member := mockMember(t, ctx, server)
+
+		models.NewPermissionOverwrite().WithRoomID(room.ID).WithServerID(server.ID).
+			WithTarget(models.OverwriteTargetRole, everyoneRole(t, ctx, server).ID).WithDeny(models.PermissionSendMessages).
+			Upsert(ctx.Database.Client)
+
+		permissions, _ := models.ResolveRoomPermissions(ctx.Database.Client, server, room.Room, member.ID)
+		if permissions.Has(models.PermissionSendMessages) || !permissions.Has(models.PermissionViewRooms) {
+			t.Errorf("Expected a read-only room, got %b", permissions)
+		}
+
+		models.NewPermissionOverwrite().WithRoomID(room.ID).WithServerID(server.ID).
+			WithTarget(models.OverwriteTargetMember, member.ID).WithAllow(models.PermissionSendMessages).
+			Upsert(ctx.Database.Client)
+
+		permissions, _ = models.ResolveRoomPermissions(ctx.Database.Client, server, room.Room, member.ID)
+		if !permissions.Has(models.PermissionSendMessages) {
+			t.Errorf("Expected the member overwrite to allow sending, got %b", permissions)
+		}
+	})
+
+	t.Run("Should not allow overwriting without ManageRoles", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		room := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		member := mockMember(t, ctx, server)
+
+		data := []byte(`{"allow": 0, "deny": 1}`)
+		r := serverRequest(http.MethodPut, "/rooms/"+room.ID.String()+"/overwrites/member/"+owner.ID.String(), data, member.ID,
+			map[string]string{"id": room.ID.String(), "targetType": "member", "targetId": owner.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PutRoomOverwrite(store)(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code 403, got %d", w.Code)
+		}
+	})
+	t.Run("Should not make anyone an administrator of a room", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		room := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		member := mockMember(t, ctx, server)
+
+		data := []byte(`{"allow": ` + strconv.Itoa(int(models.PermissionAdministrator)) + `, "deny": 0}`)
+		r := serverRequest(http.MethodPut, "/rooms/"+room.ID.String()+"/overwrites/member/"+member.ID.String(), data, owner.ID,
+			map[string]string{"id": room.ID.String(), "targetType": "member", "targetId": member.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PutRoomOverwrite(store)(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code 400, got %d", w.Code)
+		}
+
+		permissions, _ := models.ResolveRoomPermissions(ctx.Database.Client, server, room.Room, member.ID)
+		if permissions.Has(models.PermissionManageRoles) {
+			t.Error("Expected the member not to manage roles in the room")
+		}
+	})
+}
@@ -0,0 +1,241 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/handlers"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"github.com/khalidibnwalid/Luma/testutil"
+)
+
+func mockMember(t *testing.T, ctx handlers.ServerContext, server *models.RoomsServer) *models.User {
+	t.Helper()
+	user, _ := testutil.MockUser(t, ctx.Database.Client)
+	status := models.NewServerUserStatus().WithUserID(user.ID).WithServerID(server.ID)
+	if err := status.Create(ctx.Database.Client); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { status.Delete(ctx.Database.Client) })
+	return user
+}
+
+func mockRole(t *testing.T, ctx handlers.ServerContext, server *models.RoomsServer, permissions models.Permission, members ...*models.User) *models.Role {
+	t.Helper()
+	role := models.NewRole().WithServerID(server.ID).WithName("role").WithPermissions(permissions)
+	if err := role.Create(ctx.Database.Client); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, member := range members {
+		models.NewMemberRole().WithUserID(member.ID).WithRoleID(role.ID).WithServerID(server.ID).Create(ctx.Database.Client)
+	}
+	t.Cleanup(func() { role.Delete(ctx.Database.Client) })
+	return role
+}
+
+// everyoneRole returns the @everyone role of the server, always the lowest
+func everyoneRole(t *testing.T, ctx handlers.ServerContext, server *models.RoomsServer) *models.Role {
+	t.Helper()
+	roles, _ := models.GetServerRoles(ctx.Database.Client, server.ID)
+	return &roles[len(roles)-1]
+}
+
+func serverRequest(method, target string, body []byte, userID uuid.UUID, pathValues map[string]string) *http.Request {
+	r := httptest.NewRequest(method, target, bytes.NewBuffer(body))
+	r.Header.Set("Content-Type", "application/json")
+	r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, userID))
+	for k, v := range pathValues {
+		r.SetPathValue(k, v)
+	}
+	return r
+}
+
+func TestPermissions(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	store := core.NewTopicStore()
+
+	t.Run("Should forbid creating rooms without ManageRooms", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+
+		data := []byte(`{"type": "text", "name": "general"}`)
+		r := serverRequest(http.MethodPost, "/servers/"+server.ID.String()+"/rooms", data, member.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PostRoomToServer(store)(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should allow creating rooms once a role grants ManageRooms", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+		mockRole(t, ctx, server, models.PermissionManageRooms, member)
+
+		data := []byte(`{"type": "text", "name": "general"}`)
+		r := serverRequest(http.MethodPost, "/servers/"+server.ID.String()+"/rooms", data, member.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PostRoomToServer(store)(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status code 200, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should forbid non members", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		outsider, _ := testutil.MockUser(t, ctx.Database.Client)
+
+		r := serverRequest(http.MethodGet, "/servers/"+server.ID.String()+"/rooms", nil, outsider.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.GetRoomsOfServer(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should resolve @everyone and member roles", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+		mockRole(t, ctx, server, models.PermissionKickMembers, member)
+
+		permissions, err := models.ResolvePermissions(ctx.Database.Client, server, member.ID)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if permissions != models.DefaultEveryonePermissions|models.PermissionKickMembers {
+			t.Errorf("Unexpected permissions %b", permissions)
+		}
+	})
+}
+
+func TestRoles(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	store := core.NewTopicStore()
+
+	t.Run("Should create a role above @everyone", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+
+		data := []byte(`{"name": "mods", "permissions": ` + strconv.Itoa(int(models.PermissionKickMembers)) + `}`)
+		r := serverRequest(http.MethodPost, "/servers/"+server.ID.String()+"/roles", data, owner.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PostRole(w, r)
+
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status code 201, got %d", w.Code)
+		}
+
+		roles, _ := models.GetServerRoles(ctx.Database.Client, server.ID)
+		if len(roles) != 2 || roles[0].Name != "mods" || roles[0].Position != 1 || !roles[1].IsDefault {
+			t.Errorf("Unexpected roles: %+v", roles)
+		}
+	})
+
+	t.Run("Should not grant permissions the member lacks", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+		mockRole(t, ctx, server, models.PermissionManageRoles, member)
+
+		data := []byte(`{"name": "admins", "permissions": ` + strconv.Itoa(int(models.PermissionAdministrator)) + `}`)
+		r := serverRequest(http.MethodPost, "/servers/"+server.ID.String()+"/roles", data, member.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PostRole(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should not manage roles at or above the member's top role", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+		own := mockRole(t, ctx, server, models.PermissionManageRoles, member)
+		// created later, so it sits above the member's role
+		higher := mockRole(t, ctx, server, 0)
+
+		for _, role := range []*models.Role{own, higher} {
+			r := serverRequest(http.MethodDelete, "/servers/"+server.ID.String()+"/roles/"+role.ID.String(), nil, member.ID,
+				map[string]string{"id": server.ID.String(), "roleId": role.ID.String()})
+			w := httptest.NewRecorder()
+			ctx.DeleteRole(store)(w, r)
+
+			if w.Code != http.StatusForbidden {
+				t.Errorf("Expected status code 403, got %d", w.Code)
+			}
+		}
+	})
+
+	t.Run("Should assign and remove a member role", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+		role := mockRole(t, ctx, server, models.PermissionBanMembers)
+
+		pathValues := map[string]string{"id": server.ID.String(), "userId": member.ID.String(), "roleId": role.ID.String()}
+		target := "/servers/" + server.ID.String() + "/members/" + member.ID.String() + "/roles/" + role.ID.String()
+
+		w := httptest.NewRecorder()
+		ctx.PutMemberRole(store)(w, serverRequest(http.MethodPut, target, nil, owner.ID, pathValues))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code 204, got %d", w.Code)
+		}
+
+		permissions, _ := models.ResolvePermissions(ctx.Database.Client, server, member.ID)
+		if !permissions.Has(models.PermissionBanMembers) {
+			t.Error("Expected the member to have BanMembers")
+		}
+
+		w = httptest.NewRecorder()
+		ctx.DeleteMemberRole(store)(w, serverRequest(http.MethodDelete, target, nil, owner.ID, pathValues))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code 204, got %d", w.Code)
+		}
+
+		permissions, _ = models.ResolvePermissions(ctx.Database.Client, server, member.ID)
+		if permissions.Has(models.PermissionBanMembers) {
+			t.Error("Expected the role to be removed")
+		}
+	})
+
+	t.Run("Should not move a role when another field is invalid", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		first := mockRole(t, ctx, server, 0)
+		second := mockRole(t, ctx, server, 0)
+
+		r := serverRequest(http.MethodPatch, "/servers/"+server.ID.String()+"/roles/"+first.ID.String(), []byte(`{"position": 2, "name": ""}`), owner.ID,
+			map[string]string{"id": server.ID.String(), "roleId": first.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PatchRole(store)(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected status code 400, got %d", w.Code)
+		}
+
+		roles, _ := models.GetServerRoles(ctx.Database.Client, server.ID)
+		if roles[0].ID != second.ID || roles[1].ID != first.ID {
+			t.Errorf("Expected the roles to keep their positions, got %+v", roles)
+		}
+	})
+
+	t.Run("Should not delete @everyone", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		roles, _ := models.GetServerRoles(ctx.Database.Client, server.ID)
+
+		r := serverRequest(http.MethodDelete, "/servers/"+server.ID.String()+"/roles/"+roles[0].ID.String(), nil, owner.ID,
+			map[string]string{"id": server.ID.String(), "roleId": roles[0].ID.String()})
+		w := httptest.NewRecorder()
+		ctx.DeleteRole(store)(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code 400, got %d", w.Code)
+		}
+	})
+}
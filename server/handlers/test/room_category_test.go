@@ -0,0 +1,323 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/handlers"
+	"github.com/khalidibnwalid/Luma/models"
+	"github.com/khalidibnwalid/Luma/testutil"
+)
+
+func TestRoomCategories(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	store := core.NewTopicStore()
+
+	newCategory := func(t *testing.T, server *models.RoomsServer, name string) *models.RoomCategory {
+		t.Helper()
+		category := models.NewRoomCategory().WithServerID(server.ID).WithName(name)
+		if err := category.Create(ctx.Database.Client); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return category
+	}
+
+	t.Run("Should create categories after the last one", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		newCategory(t, server, "Text")
+
+		r := serverRequest(http.MethodPost, "/servers/"+server.ID.String()+"/categories", []byte(`{"name": "Voice"}`), owner.ID,
+			map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PostCategory(w, r)
+
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status code 201, got %d", w.Code)
+		}
+
+		var category models.RoomCategory
+		json.Unmarshal(w.Body.Bytes(), &category)
+		if category.Name != "Voice" || category.Position != 1 {
+			t.Errorf("Expected Voice at position 1, got %s at %d", category.Name, category.Position)
+		}
+	})
+
+	t.Run("Should rename a room and move it into a category", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		room := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		category := newCategory(t, server, "Text")
+
+		data := []byte(`{"name": "general", "categoryId": "` + category.ID.String() + `"}`)
+		r := serverRequest(http.MethodPatch, "/rooms/"+room.ID.String(), data, owner.ID, map[string]string{"id": room.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PatchRoom(store)(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", w.Code)
+		}
+
+		updated := models.NewRoom()
+		updated.FindByID(ctx.Database.Client, room.ID)
+		if updated.Name != "general" || updated.CategoryID == nil || *updated.CategoryID != category.ID {
+			t.Errorf("Expected the room to be renamed and moved, got %+v", updated)
+		}
+
+		// null moves it back out
+		r = serverRequest(http.MethodPatch, "/rooms/"+room.ID.String(), []byte(`{"categoryId": null}`), owner.ID, map[string]string{"id": room.ID.String()})
+		w = httptest.NewRecorder()
+		ctx.PatchRoom(store)(w, r)
+
+		updated.FindByID(ctx.Database.Client, room.ID)
+		if w.Code != http.StatusOK || updated.CategoryID != nil {
+			t.Errorf("Expected the room to leave the category, got %d %v", w.Code, updated.CategoryID)
+		}
+	})
+
+	t.Run("Should require a room name", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		room := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+
+		r := serverRequest(http.MethodPatch, "/rooms/"+room.ID.String(), []byte(`{"name": ""}`), owner.ID, map[string]string{"id": room.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PatchRoom(store)(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected status code 400, got %d", w.Code)
+		}
+
+		var resBody map[string]any
+		json.Unmarshal(w.Body.Bytes(), &resBody)
+		testutil.AssertInterface(t, map[string]any{
+			"error": handlers.EnumRoomNameRequired,
+		}, resBody)
+	})
+
+	t.Run("Should shift the other rooms when moving a room", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		first := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		second := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		third := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		category := newCategory(t, server, "Text")
+
+		r := serverRequest(http.MethodPatch, "/rooms/"+third.ID.String(), []byte(`{"position": 0}`), owner.ID, map[string]string{"id": third.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PatchRoom(store)(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", w.Code)
+		}
+
+		expectPositions := func(t *testing.T, expected map[*models.RoomWithStatus]int) {
+			t.Helper()
+			for room, position := range expected {
+				updated := models.NewRoom()
+				updated.FindByID(ctx.Database.Client, room.ID)
+				if updated.Position != position {
+					t.Errorf("Expected room %s at position %d, got %d", room.Name, position, updated.Position)
+				}
+			}
+		}
+		expectPositions(t, map[*models.RoomWithStatus]int{third: 0, first: 1, second: 2})
+
+		// moving into a category closes the gap it leaves and goes last
+		data := []byte(`{"categoryId": "` + category.ID.String() + `"}`)
+		r = serverRequest(http.MethodPatch, "/rooms/"+first.ID.String(), data, owner.ID, map[string]string{"id": first.ID.String()})
+		w = httptest.NewRecorder()
+		ctx.PatchRoom(store)(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", w.Code)
+		}
+		expectPositions(t, map[*models.RoomWithStatus]int{third: 0, second: 1, first: 0})
+	})
+
+	t.Run("Should dispatch room updates to the server", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		room := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		conn := dialGateway(t, ctx, store, core.NewSessionStore(), owner.ID)
+		identify(t, conn)
+
+		r := serverRequest(http.MethodPatch, "/rooms/"+room.ID.String(), []byte(`{"name": "general"}`), owner.ID, map[string]string{"id": room.ID.String()})
+		ctx.PatchRoom(store)(httptest.NewRecorder(), r)
+
+		update := readEnvelope(t, conn)
+		var data models.Room
+		json.Unmarshal(update.Data, &data)
+		if update.Type != handlers.EventRoomUpdate || data.ID != room.ID || data.Name != "general" {
+			t.Errorf("Expected ROOM_UPDATE with the new name, got %+v", update)
+		}
+	})
+
+	t.Run("Should not move a room into a category of another server", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		room := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		other, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		category := newCategory(t, other, "Text")
+
+		data := []byte(`{"categoryId": "` + category.ID.String() + `"}`)
+		r := serverRequest(http.MethodPatch, "/rooms/"+room.ID.String(), data, owner.ID, map[string]string{"id": room.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PatchRoom(store)(w, r)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status code 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should reorder rooms and categories at once", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		first := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		second := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		text := newCategory(t, server, "Text")
+		voice := newCategory(t, server, "Voice")
+
+		data := []byte(fmt.Sprintf(`{
+			"categories": [{"id": "%s", "position": 0}, {"id": "%s", "position": 1}],
+			"rooms": [{"id": "%s", "position": 0, "categoryId": "%s"}, {"id": "%s", "position": 1, "categoryId": "%s"}]
+		}`, voice.ID, text.ID, second.ID, text.ID, first.ID, text.ID))
+		r := serverRequest(http.MethodPatch, "/servers/"+server.ID.String()+"/positions", data, owner.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PatchServerPositions(store)(w, r)
+
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code 204, got %d", w.Code)
+		}
+
+		categories, _ := models.GetServerCategories(ctx.Database.Client, server.ID)
+		if len(categories) != 2 || categories[0].ID != voice.ID {
+			t.Errorf("Expected Voice to come first, got %+v", categories)
+		}
+
+		rooms, _ := server.GetRooms(ctx.Database.Client, owner.ID)
+		if len(rooms) != 2 || rooms[0].ID != second.ID || rooms[0].CategoryID == nil || *rooms[0].CategoryID != text.ID {
+			t.Errorf("Expected the second room to come first in Text, got %+v", rooms)
+		}
+	})
+
+	t.Run("Should not reorder anything if a room is not in the server", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		room := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		foreign := testutil.MockRoom(t, ctx.Database.Client, owner.ID)
+
+		data := []byte(fmt.Sprintf(`{"rooms": [{"id": "%s", "position": 5}, {"id": "%s", "position": 6}]}`, room.ID, foreign.ID))
+		r := serverRequest(http.MethodPatch, "/servers/"+server.ID.String()+"/positions", data, owner.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PatchServerPositions(store)(w, r)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status code 404, got %d", w.Code)
+		}
+
+		unchanged := models.NewRoom()
+		unchanged.FindByID(ctx.Database.Client, room.ID)
+		if unchanged.Position != 0 {
+			t.Errorf("Expected the position to be rolled back, got %d", unchanged.Position)
+		}
+	})
+
+	t.Run("Should hide the rooms of a category denied to @everyone", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+		hidden := testutil.MockRoom(t, ctx.Database.Client, member.ID, server)
+		testutil.MockRoom(t, ctx.Database.Client, member.ID, server)
+		category := newCategory(t, server, "Staff")
+		hidden.Room.WithCategoryID(&category.ID).Update(ctx.Database.Client)
+
+		target := "/servers/" + server.ID.String() + "/categories/" + category.ID.String() + "/overwrites/role/" + everyoneRole(t, ctx, server).ID.String()
+		r := serverRequest(http.MethodPut, target, []byte(fmt.Sprintf(`{"deny": %d}`, models.PermissionViewRooms)), owner.ID, map[string]string{
+			"id": server.ID.String(), "categoryId": category.ID.String(), "targetType": models.OverwriteTargetRole, "targetId": everyoneRole(t, ctx, server).ID.String(),
+		})
+		w := httptest.NewRecorder()
+		ctx.PutCategoryOverwrite(store)(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", w.Code)
+		}
+
+		r = serverRequest(http.MethodGet, "/servers/"+server.ID.String()+"/rooms", nil, member.ID, map[string]string{"id": server.ID.String()})
+		w = httptest.NewRecorder()
+		ctx.GetRoomsOfServer(w, r)
+
+		var rooms []models.RoomWithStatus
+		json.Unmarshal(w.Body.Bytes(), &rooms)
+		if len(rooms) != 1 || rooms[0].ID == hidden.ID {
+			t.Errorf("Expected only the uncategorized room, got %d rooms", len(rooms))
+		}
+	})
+
+	t.Run("Should delete a room and keep the rooms of a deleted category", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		room := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		kept := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		category := newCategory(t, server, "Text")
+		kept.Room.WithCategoryID(&category.ID).Update(ctx.Database.Client)
+
+		r := serverRequest(http.MethodDelete, "/rooms/"+room.ID.String(), nil, owner.ID, map[string]string{"id": room.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.DeleteRoom(store)(w, r)
+
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code 204, got %d", w.Code)
+		}
+		if err := models.NewRoom().FindByID(ctx.Database.Client, room.ID); err == nil {
+			t.Error("Expected the room to be deleted")
+		}
+
+		r = serverRequest(http.MethodDelete, "/servers/"+server.ID.String()+"/categories/"+category.ID.String(), nil, owner.ID,
+			map[string]string{"id": server.ID.String(), "categoryId": category.ID.String()})
+		w = httptest.NewRecorder()
+		ctx.DeleteCategory(store)(w, r)
+
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code 204, got %d", w.Code)
+		}
+
+		remaining := models.NewRoom()
+		if err := remaining.FindByID(ctx.Database.Client, kept.ID); err != nil || remaining.CategoryID != nil {
+			t.Errorf("Expected the room to stay without a category, got %v %v", err, remaining.CategoryID)
+		}
+	})
+}
+
+func TestMigrateRoomGroups(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	db := ctx.Database.Client
+
+	server, _, owner := testutil.MockRoomsServer(t, db)
+	rooms := []*models.RoomWithStatus{
+		testutil.MockRoom(t, db, owner.ID, server),
+		testutil.MockRoom(t, db, owner.ID, server),
+		testutil.MockRoom(t, db, owner.ID, server),
+	}
+
+	// the column rooms had before categories
+	if err := db.Exec("ALTER TABLE rooms ADD COLUMN group_name text DEFAULT ''").Error; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i, group := range []string{"text", "voice", "text"} {
+		db.Exec("UPDATE rooms SET group_name = ?, category_id = NULL WHERE id = ?", group, rooms[i].Room.ID)
+	}
+
+	if err := models.MigrateRoomGroups(db); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if db.Migrator().HasColumn(&models.Room{}, "group_name") {
+		t.Error("Expected group_name to be dropped")
+	}
+
+	categories, _ := models.GetServerCategories(db, server.ID)
+	if len(categories) != 2 || categories[0].Name != "text" || categories[1].Name != "voice" {
+		t.Fatalf("Unexpected categories: %+v", categories)
+	}
+
+	for i, category := range []models.RoomCategory{categories[0], categories[1], categories[0]} {
+		room := models.NewRoom()
+		db.First(room, "id = ?", rooms[i].Room.ID)
+		if room.CategoryID == nil || *room.CategoryID != category.ID {
+			t.Errorf("Expected room %d in the %s category, got %v", i, category.Name, room.CategoryID)
+		}
+	}
+}
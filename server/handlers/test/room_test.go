@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -187,6 +188,36 @@ func TestGETRoom(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("Should tell the client when a message can't be posted", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		room := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		member := mockMember(t, ctx, server)
+		everyone := everyoneRole(t, ctx, server)
+		everyone.Permissions &^= models.PermissionSendMessages
+		everyone.Update(ctx.Database.Client)
+
+		s := httptest.NewServer(mockWSRoomHandler(t, ctx, member.ID, room.ID.String()))
+		defer s.Close()
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"content":"hello"}`))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var resBody map[string]any
+		if err := conn.ReadJSON(&resBody); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		testutil.AssertInterface(t, map[string]any{
+			"t": handlers.EventMessageError,
+			"d": map[string]any{"code": handlers.EnumMissingPermission},
+		}, resBody)
+	})
 }
 
 func TestPatchRoomStatus(t *testing.T) {
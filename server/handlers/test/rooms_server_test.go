@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
 	"github.com/khalidibnwalid/Luma/handlers"
 	"github.com/khalidibnwalid/Luma/middlewares"
 	"github.com/khalidibnwalid/Luma/models"
@@ -126,10 +127,10 @@ func TestGetRoomsOfServer(t *testing.T) {
 				originalRoom := rooms[i]
 
 				testutil.AssertInterface(t, map[string]interface{}{
-					"id":        originalRoom.ID.String(),
-					"name":      originalRoom.Name,
-					"type":      originalRoom.Type,
-					"groupName": originalRoom.GroupName,
+					"id":         originalRoom.ID.String(),
+					"name":       originalRoom.Name,
+					"type":       originalRoom.Type,
+					"categoryId": nil,
 				}, room)
 
 				if room["status"] == nil {
@@ -287,15 +288,17 @@ func TestGetUserRoomsServer(t *testing.T) {
 
 func TestPostRoomToServer(t *testing.T) {
 	ctx := testutil.NewTestingContext(t)
+	store := core.NewTopicStore()
 
 	t.Run("Should create a new room in server and return the room with user status", func(t *testing.T) {
 		server, _, user := testutil.MockRoomsServer(t, ctx.Database.Client)
 
 		roomName := "new-text-channel"
 		roomType := "text"
-		groupName := "Text Channels"
+		category := models.NewRoomCategory().WithServerID(server.ID).WithName("Text Channels")
+		category.Create(ctx.Database.Client)
 
-		data := []byte(`{"type": "` + roomType + `", "name": "` + roomName + `", "groupName": "` + groupName + `"}`)
+		data := []byte(`{"type": "` + roomType + `", "name": "` + roomName + `", "categoryId": "` + category.ID.String() + `"}`)
 
 		r := httptest.NewRequest(http.MethodPost, "/servers/"+server.ID.String()+"/rooms", bytes.NewBuffer(data))
 		w := httptest.NewRecorder()
@@ -303,7 +306,7 @@ func TestPostRoomToServer(t *testing.T) {
 		r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, user.ID))
 		r.SetPathValue("id", server.ID.String())
 
-		ctx.PostRoomToServer(w, r)
+		ctx.PostRoomToServer(store)(w, r)
 
 		if w.Code != http.StatusOK {
 			t.Errorf("Expected status code 200, got %d", w.Code)
@@ -315,10 +318,10 @@ func TestPostRoomToServer(t *testing.T) {
 		}
 
 		testutil.AssertInterface(t, map[string]interface{}{
-			"serverId":  server.ID.String(),
-			"name":      roomName,
-			"type":      roomType,
-			"groupName": groupName,
+			"serverId":   server.ID.String(),
+			"name":       roomName,
+			"type":       roomType,
+			"categoryId": category.ID.String(),
 			"status": map[string]interface{}{
 				"userId":   user.ID.String(),
 				"serverId": server.ID.String(),
@@ -344,7 +347,7 @@ func TestPostRoomToServer(t *testing.T) {
 		r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, user.ID))
 		r.SetPathValue("id", server.ID.String())
 
-		ctx.PostRoomToServer(w, r)
+		ctx.PostRoomToServer(store)(w, r)
 
 		if w.Code != http.StatusBadRequest {
 			t.Errorf("Expected status code 400, got %d", w.Code)
@@ -362,7 +365,7 @@ func TestPostRoomToServer(t *testing.T) {
 	t.Run("Should return error with empty type", func(t *testing.T) {
 		server, _, user := testutil.MockRoomsServer(t, ctx.Database.Client)
 
-		data := []byte(`{"type": "", "name": "test-room", "groupName": "Text Channels"}`)
+		data := []byte(`{"type": "", "name": "test-room"}`)
 
 		r := httptest.NewRequest(http.MethodPost, "/servers/"+server.ID.String()+"/rooms", bytes.NewBuffer(data))
 		w := httptest.NewRecorder()
@@ -370,7 +373,7 @@ func TestPostRoomToServer(t *testing.T) {
 		r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, user.ID))
 		r.SetPathValue("id", server.ID.String())
 
-		ctx.PostRoomToServer(w, r)
+		ctx.PostRoomToServer(store)(w, r)
 
 		if w.Code != http.StatusBadRequest {
 			t.Errorf("Expected status code 400, got %d", w.Code)
@@ -412,16 +415,19 @@ func TestPostRoomToServer(t *testing.T) {
 
 func TestJoinServer(t *testing.T) {
 	ctx := testutil.NewTestingContext(t)
+	store := core.NewTopicStore()
 
 	t.Run("Should join a server and return the server with user status", func(t *testing.T) {
 		server, _, user := testutil.MockRoomsServer(t, ctx.Database.Client)
+		server.IsPublic = true
+		server.Update(ctx.Database.Client)
 
 		r := httptest.NewRequest(http.MethodGet, "/servers/"+server.ID.String(), nil)
 		w := httptest.NewRecorder()
 		r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, user.ID))
 		r.SetPathValue("id", server.ID.String())
 
-		ctx.JoinServer(w, r)
+		ctx.JoinServer(store)(w, r)
 
 		if w.Code != http.StatusOK {
 			t.Errorf("Expected status code 200, got %d", w.Code)
@@ -445,6 +451,22 @@ func TestJoinServer(t *testing.T) {
 
 	})
 
+	t.Run("Should require an invite for private servers", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+
+		r := httptest.NewRequest(http.MethodPost, "/servers/"+server.ID.String(), nil)
+		w := httptest.NewRecorder()
+		r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, user.ID))
+		r.SetPathValue("id", server.ID.String())
+
+		ctx.JoinServer(store)(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code 403, got %d", w.Code)
+		}
+	})
+
 	t.Run("Should return error if server id is invalid", func(t *testing.T) {
 		_, _, user := testutil.MockRoomsServer(t, ctx.Database.Client)
 
@@ -453,7 +475,7 @@ func TestJoinServer(t *testing.T) {
 		r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, user.ID))
 		r.SetPathValue("id", "invalidID")
 
-		ctx.JoinServer(w, r)
+		ctx.JoinServer(store)(w, r)
 
 		if w.Code != http.StatusBadRequest {
 			t.Errorf("Expected status code 400, got %d", w.Code)
@@ -478,7 +500,7 @@ func TestJoinServer(t *testing.T) {
 		r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, user.ID))
 		r.SetPathValue("id", mockUUID.String())
 
-		ctx.JoinServer(w, r)
+		ctx.JoinServer(store)(w, r)
 
 		if w.Code != http.StatusNotFound {
 			t.Errorf("Expected status code 404, got %d", w.Code)
@@ -494,3 +516,237 @@ func TestJoinServer(t *testing.T) {
 		}, resBody)
 	})
 }
+
+func TestPatchRoomsServer(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	store := core.NewTopicStore()
+
+	t.Run("Should update the name, icon and description", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+
+		data := []byte(`{"name": "Renamed", "icon": "https://example.com/icon.png", "description": "A server"}`)
+		r := serverRequest(http.MethodPatch, "/servers/"+server.ID.String(), data, owner.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PatchRoomsServer(store)(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", w.Code)
+		}
+
+		updated := models.NewRoomsServer()
+		updated.FindByID(ctx.Database.Client, server.ID)
+		if updated.Name != "Renamed" || updated.Icon != "https://example.com/icon.png" || updated.Description != "A server" {
+			t.Errorf("Expected the server to be updated, got %+v", updated)
+		}
+	})
+
+	t.Run("Should reject icons that are not http urls", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+
+		data := []byte(`{"icon": "javascript:alert(1)"}`)
+		r := serverRequest(http.MethodPatch, "/servers/"+server.ID.String(), data, owner.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PatchRoomsServer(store)(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should forbid members without ManageServer", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+
+		r := serverRequest(http.MethodPatch, "/servers/"+server.ID.String(), []byte(`{"name": "Renamed"}`), member.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PatchRoomsServer(store)(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code 403, got %d", w.Code)
+		}
+	})
+}
+
+func TestDeleteRoomsServer(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	store := core.NewTopicStore()
+
+	t.Run("Should delete the server with its rooms", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		room := testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+
+		r := serverRequest(http.MethodDelete, "/servers/"+server.ID.String(), nil, owner.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.DeleteRoomsServer(store)(w, r)
+
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code 204, got %d", w.Code)
+		}
+
+		if err := models.NewRoomsServer().FindByID(ctx.Database.Client, server.ID); err == nil {
+			t.Error("Expected the server to be deleted")
+		}
+		var rooms int64
+		ctx.Database.Client.Model(&models.Room{}).Where("id = ?", room.Room.ID).Count(&rooms)
+		if rooms != 0 {
+			t.Error("Expected the rooms to be deleted")
+		}
+	})
+
+	t.Run("Should forbid members who don't own the server", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+		mockRole(t, ctx, server, models.PermissionAdministrator, member)
+
+		r := serverRequest(http.MethodDelete, "/servers/"+server.ID.String(), nil, member.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.DeleteRoomsServer(store)(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code 403, got %d", w.Code)
+		}
+	})
+}
+
+func TestTransferServerOwnership(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	store := core.NewTopicStore()
+
+	transfer := func(server *models.RoomsServer, userID uuid.UUID, body string) *httptest.ResponseRecorder {
+		r := serverRequest(http.MethodPost, "/servers/"+server.ID.String()+"/transfer", []byte(body), userID, map[string]string{"id": server.ID.String()})
+		// away from the IP of the other tests, the failures here add up
+		r.RemoteAddr = "203.0.113.2:1234"
+		w := httptest.NewRecorder()
+		ctx.TransferServerOwnership(store)(w, r)
+		return w
+	}
+
+	t.Run("Should transfer the server to a member with the owner's password", func(t *testing.T) {
+		owner, password := testutil.MockUser(t, ctx.Database.Client)
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client, owner)
+		member := mockMember(t, ctx, server)
+
+		w := transfer(server, owner.ID, `{"userId": "`+member.ID.String()+`", "password": "`+password+`"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", w.Code)
+		}
+
+		updated := models.NewRoomsServer()
+		updated.FindByID(ctx.Database.Client, server.ID)
+		if updated.OwnerID != member.ID {
+			t.Errorf("Expected the member to own the server, got %s", updated.OwnerID)
+		}
+	})
+
+	t.Run("Should reject a wrong password", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+
+		w := transfer(server, owner.ID, `{"userId": "`+member.ID.String()+`", "password": "wrong"}`)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status code 401, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should lock after too many wrong passwords", func(t *testing.T) {
+		owner, password := testutil.MockUser(t, ctx.Database.Client)
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client, owner)
+		member := mockMember(t, ctx, server)
+
+		for i := 0; i <= models.AccountThrottlePolicy.FreeAttempts; i++ {
+			if w := transfer(server, owner.ID, `{"userId": "`+member.ID.String()+`", "password": "wrong"}`); w.Code != http.StatusUnauthorized {
+				t.Fatalf("Expected status code 401 on attempt %d, got %d", i+1, w.Code)
+			}
+		}
+
+		if w := transfer(server, owner.ID, `{"userId": "`+member.ID.String()+`", "password": "`+password+`"}`); w.Code != http.StatusTooManyRequests {
+			t.Errorf("Expected status code 429, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should not transfer to users who are not members", func(t *testing.T) {
+		owner, password := testutil.MockUser(t, ctx.Database.Client)
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client, owner)
+		outsider, _ := testutil.MockUser(t, ctx.Database.Client)
+
+		w := transfer(server, owner.ID, `{"userId": "`+outsider.ID.String()+`", "password": "`+password+`"}`)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status code 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should forbid members who don't own the server", func(t *testing.T) {
+		server, _, _ := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member, password := testutil.MockUser(t, ctx.Database.Client)
+		models.NewServerUserStatus().WithUserID(member.ID).WithServerID(server.ID).Create(ctx.Database.Client)
+
+		w := transfer(server, member.ID, `{"userId": "`+member.ID.String()+`", "password": "`+password+`"}`)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code 403, got %d", w.Code)
+		}
+	})
+}
+
+func TestRoomStatusLifecycle(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+	store := core.NewTopicStore()
+
+	countStatuses := func(server *models.RoomsServer, userID uuid.UUID) int64 {
+		var count int64
+		ctx.Database.Client.Model(&models.RoomUserStatus{}).Where("server_id = ? AND user_id = ?", server.ID, userID).Count(&count)
+		return count
+	}
+
+	t.Run("Should give every member a status in new rooms", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		member := mockMember(t, ctx, server)
+
+		r := serverRequest(http.MethodPost, "/servers/"+server.ID.String()+"/rooms", []byte(`{"type": "text", "name": "general"}`), owner.ID,
+			map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.PostRoomToServer(store)(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", w.Code)
+		}
+		if countStatuses(server, member.ID) != 1 || countStatuses(server, owner.ID) != 1 {
+			t.Error("Expected the member and the creator to have a status in the room")
+		}
+	})
+
+	t.Run("Should give joining members a status in existing rooms", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		server.IsPublic = true
+		server.Update(ctx.Database.Client)
+		testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+
+		r := serverRequest(http.MethodPost, "/servers/"+server.ID.String(), nil, user.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.JoinServer(store)(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", w.Code)
+		}
+		if count := countStatuses(server, user.ID); count != 2 {
+			t.Errorf("Expected 2 room statuses, got %d", count)
+		}
+	})
+
+	t.Run("Should list the rooms of members without a status", func(t *testing.T) {
+		server, _, owner := testutil.MockRoomsServer(t, ctx.Database.Client)
+		testutil.MockRoom(t, ctx.Database.Client, owner.ID, server)
+		member := mockMember(t, ctx, server)
+
+		r := serverRequest(http.MethodGet, "/servers/"+server.ID.String()+"/rooms", nil, member.ID, map[string]string{"id": server.ID.String()})
+		w := httptest.NewRecorder()
+		ctx.GetRoomsOfServer(w, r)
+
+		var rooms []map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &rooms)
+		if w.Code != http.StatusOK || len(rooms) != 1 {
+			t.Errorf("Expected 1 room, got %d %d", w.Code, len(rooms))
+		}
+	})
+}
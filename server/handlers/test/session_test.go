@@ -2,13 +2,17 @@ package handlers_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/google/uuid"
 	"github.com/khalidibnwalid/Luma/core"
 	"github.com/khalidibnwalid/Luma/handlers"
+	"github.com/khalidibnwalid/Luma/middlewares"
 	"github.com/khalidibnwalid/Luma/testutil"
 )
 
@@ -17,7 +21,7 @@ func TestDeleteSession(t *testing.T) {
 	w := httptest.NewRecorder()
 
 	ctx := &handlers.ServerContext{
-		JwtSecret: "SECRET",
+		Keys: core.NewKeyringFromSecret("SECRET"),
 	}
 
 	ctx.DeleteSession(w, r)
@@ -207,4 +211,217 @@ func TestPostSession(t *testing.T) {
 		}
 	})
 
+	t.Run("Should rehash a password made with older argon2 parameters", func(t *testing.T) {
+		user, pass := testutil.MockUser(t, ctx.Database.Client)
+		defer user.Delete(ctx.Database.Client)
+
+		target := core.DefaultHashingOptions
+		core.DefaultHashingOptions.Memory = 4 * 1024
+		core.DefaultHashingOptions.Parallelism = 1
+		if err := user.UpdatePassword(ctx.Database.Client, pass); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		core.DefaultHashingOptions = target
+
+		data := []byte(`{"username": "` + user.Username + `", "password": "` + pass + `"}`)
+		r := httptest.NewRequest(http.MethodPost, "/session", bytes.NewBuffer(data))
+		w := httptest.NewRecorder()
+		r.Header.Set("Content-Type", "application/json")
+
+		ctx.PostSession(w, r)
+
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status code 201, got %d", w.Code)
+		}
+
+		if err := user.FindByID(ctx.Database.Client); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if core.NeedsRehash(user.HashedPassword) {
+			t.Errorf("Expected the password to be rehashed with the target parameters, got %s", user.HashedPassword)
+		}
+		if err := core.VerifyHashWithSalt(pass, user.HashedPassword); err != nil {
+			t.Errorf("Expected the new hash to verify, got %v", err)
+		}
+	})
+}
+
+func findCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func mockLogin(t *testing.T, ctx handlers.ServerContext) *httptest.ResponseRecorder {
+	t.Helper()
+	user, pass := testutil.MockUser(t, ctx.Database.Client)
+
+	data := []byte(`{"username": "` + user.Username + `", "password": "` + pass + `"}`)
+	r := httptest.NewRequest(http.MethodPost, "/sessions", bytes.NewBuffer(data))
+	w := httptest.NewRecorder()
+	r.Header.Set("Content-Type", "application/json")
+
+	ctx.PostSession(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code 201, got %d", w.Code)
+	}
+	return w
+}
+
+func mockRefresh(ctx handlers.ServerContext, refreshToken string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/sessions/refresh", nil)
+	r.AddCookie(&http.Cookie{Name: core.RefreshTokenCookieName, Value: refreshToken})
+	w := httptest.NewRecorder()
+
+	ctx.PostRefreshSession(w, r)
+	return w
+}
+
+func TestPostRefreshSession(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+
+	t.Run("Should rotate the refresh token and issue a new access token", func(t *testing.T) {
+		login := mockLogin(t, ctx)
+		refreshCookie := findCookie(login, core.RefreshTokenCookieName)
+		if refreshCookie == nil || refreshCookie.Value == "" {
+			t.Fatalf("Expected cookie %s to be set", core.RefreshTokenCookieName)
+		}
+
+		w := mockRefresh(ctx, refreshCookie.Value)
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status code 200, got %d", w.Code)
+		}
+
+		if c := findCookie(w, core.JwtSessionCookieName); c == nil || c.Value == "" {
+			t.Errorf("Expected cookie %s to be set", core.JwtSessionCookieName)
+		}
+
+		newRefreshCookie := findCookie(w, core.RefreshTokenCookieName)
+		if newRefreshCookie == nil || newRefreshCookie.Value == "" || newRefreshCookie.Value == refreshCookie.Value {
+			t.Errorf("Expected a new %s cookie", core.RefreshTokenCookieName)
+		}
+	})
+
+	t.Run("Should revoke the whole family when a rotated token is reused", func(t *testing.T) {
+		login := mockLogin(t, ctx)
+		oldToken := findCookie(login, core.RefreshTokenCookieName).Value
+
+		rotated := mockRefresh(ctx, oldToken)
+		if rotated.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", rotated.Code)
+		}
+		newToken := findCookie(rotated, core.RefreshTokenCookieName).Value
+
+		if w := mockRefresh(ctx, oldToken); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status code 401 on reuse, got %d", w.Code)
+		}
+
+		if w := mockRefresh(ctx, newToken); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status code 401 for a token of a revoked family, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should return 401 without a refresh token", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/sessions/refresh", nil)
+		w := httptest.NewRecorder()
+
+		ctx.PostRefreshSession(w, r)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status code 401, got %d", w.Code)
+		}
+	})
+}
+
+// reads the user and session IDs from the access token cookie of a login response
+func sessionFromLogin(t *testing.T, ctx handlers.ServerContext, w *httptest.ResponseRecorder) (uuid.UUID, uuid.UUID) {
+	t.Helper()
+	cookie := findCookie(w, core.JwtSessionCookieName)
+	if cookie == nil {
+		t.Fatalf("Expected cookie %s to be set", core.JwtSessionCookieName)
+	}
+
+	_, claims, ok := core.ValidateJwtToken(ctx.Keys, strings.TrimPrefix(cookie.Value, "Bearer "))
+	if !ok {
+		t.Fatalf("Expected a valid access token")
+	}
+
+	sub, _ := claims.GetSubject()
+	jti, _ := claims["jti"].(string)
+	return uuid.MustParse(sub), uuid.MustParse(jti)
+}
+
+func TestSessions(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+
+	t.Run("Should list the active sessions and mark the current one", func(t *testing.T) {
+		login := mockLogin(t, ctx)
+		userID, sessionID := sessionFromLogin(t, ctx, login)
+
+		r := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+		w := httptest.NewRecorder()
+		rCtx := context.WithValue(r.Context(), middlewares.CtxUserIDKey, userID)
+		r = r.WithContext(context.WithValue(rCtx, middlewares.CtxSessionIDKey, sessionID))
+
+		ctx.GetSessions(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status code 200, got %d", w.Code)
+		}
+
+		var resBody []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resBody); err != nil {
+			t.Fatalf("Wrong response format should be json: %v", err)
+		}
+
+		if len(resBody) != 1 {
+			t.Fatalf("Expected 1 session, got %d", len(resBody))
+		}
+
+		testutil.AssertInterface(t, map[string]interface{}{
+			"id":      sessionID.String(),
+			"userId":  userID.String(),
+			"current": true,
+		}, resBody[0])
+	})
+
+	t.Run("Should revoke a session and its refresh tokens", func(t *testing.T) {
+		login := mockLogin(t, ctx)
+		userID, sessionID := sessionFromLogin(t, ctx, login)
+
+		r := httptest.NewRequest(http.MethodDelete, "/sessions/"+sessionID.String(), nil)
+		w := httptest.NewRecorder()
+		r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, userID))
+		r.SetPathValue("id", sessionID.String())
+
+		ctx.DeleteUserSession(w, r)
+
+		if w.Code != http.StatusNoContent {
+			t.Errorf("Expected status code 204, got %d", w.Code)
+		}
+
+		refreshToken := findCookie(login, core.RefreshTokenCookieName).Value
+		if w := mockRefresh(ctx, refreshToken); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status code 401 for a revoked session, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should not revoke sessions of other users", func(t *testing.T) {
+		_, sessionID := sessionFromLogin(t, ctx, mockLogin(t, ctx))
+		otherUser, _ := testutil.MockUser(t, ctx.Database.Client)
+
+		r := httptest.NewRequest(http.MethodDelete, "/sessions/"+sessionID.String(), nil)
+		w := httptest.NewRecorder()
+		r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, otherUser.ID))
+		r.SetPathValue("id", sessionID.String())
+
+		ctx.DeleteUserSession(w, r)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status code 404, got %d", w.Code)
+		}
+	})
 }
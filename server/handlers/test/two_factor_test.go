@@ -0,0 +1,251 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/handlers"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"github.com/khalidibnwalid/Luma/testutil"
+)
+
+// enrolls the user in two-factor and returns the secret and the recovery codes
+func mockTwoFactor(t *testing.T, ctx handlers.ServerContext, user *models.User) (string, []string) {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/users/2fa", nil)
+	w := httptest.NewRecorder()
+	r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, user.ID))
+
+	ctx.PostTwoFactor(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code 201, got %d", w.Code)
+	}
+
+	var enrollment map[string]string
+	json.Unmarshal(w.Body.Bytes(), &enrollment)
+
+	code, _ := core.TotpCode(enrollment["secret"], time.Now())
+	r = httptest.NewRequest(http.MethodPost, "/users/2fa/verify", bytes.NewBuffer([]byte(`{"code": "`+code+`"}`)))
+	w = httptest.NewRecorder()
+	r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, user.ID))
+
+	ctx.PostTwoFactorVerify(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", w.Code)
+	}
+
+	var verification map[string][]string
+	json.Unmarshal(w.Body.Bytes(), &verification)
+
+	return enrollment["secret"], verification["recoveryCodes"]
+}
+
+func mockChallenge(t *testing.T, ctx handlers.ServerContext, user *models.User, pass string) string {
+	t.Helper()
+
+	data := []byte(`{"username": "` + user.Username + `", "password": "` + pass + `"}`)
+	r := httptest.NewRequest(http.MethodPost, "/sessions", bytes.NewBuffer(data))
+	w := httptest.NewRecorder()
+
+	ctx.PostSession(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", w.Code)
+	}
+
+	if findCookie(w, core.JwtSessionCookieName) != nil {
+		t.Errorf("Expected no session cookie before the second factor")
+	}
+
+	var resBody map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resBody)
+
+	testutil.AssertInterface(t, map[string]interface{}{
+		"twoFactorRequired": true,
+	}, resBody)
+
+	return resBody["challengeToken"].(string)
+}
+
+func mockTwoFactorSession(ctx handlers.ServerContext, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/sessions/2fa", bytes.NewBuffer([]byte(body)))
+	w := httptest.NewRecorder()
+
+	ctx.PostTwoFactorSession(w, r)
+	return w
+}
+
+func TestTwoFactor(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+
+	t.Run("Should require a code after the password and not accept a replayed code", func(t *testing.T) {
+		user, pass := testutil.MockUser(t, ctx.Database.Client)
+		secret, _ := mockTwoFactor(t, ctx, user)
+		challenge := mockChallenge(t, ctx, user, pass)
+
+		// the code of the current step was used by the enrollment
+		code, _ := core.TotpCode(secret, time.Now())
+		if w := mockTwoFactorSession(ctx, `{"challengeToken": "`+challenge+`", "code": "`+code+`"}`); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status code 401 for a replayed code, got %d", w.Code)
+		}
+
+		code, _ = core.TotpCode(secret, time.Now().Add(core.TotpPeriod*time.Second))
+		w := mockTwoFactorSession(ctx, `{"challengeToken": "`+challenge+`", "code": "`+code+`"}`)
+		if w.Code != http.StatusCreated {
+			t.Errorf("Expected status code 201, got %d", w.Code)
+		}
+
+		if c := findCookie(w, core.JwtSessionCookieName); c == nil || c.Value == "" {
+			t.Errorf("Expected cookie %s to be set", core.JwtSessionCookieName)
+		}
+	})
+
+	t.Run("Should accept a recovery code only once", func(t *testing.T) {
+		user, pass := testutil.MockUser(t, ctx.Database.Client)
+		_, recoveryCodes := mockTwoFactor(t, ctx, user)
+		challenge := mockChallenge(t, ctx, user, pass)
+
+		body := `{"challengeToken": "` + challenge + `", "recoveryCode": "` + recoveryCodes[0] + `"}`
+		if w := mockTwoFactorSession(ctx, body); w.Code != http.StatusCreated {
+			t.Errorf("Expected status code 201, got %d", w.Code)
+		}
+
+		if w := mockTwoFactorSession(ctx, body); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status code 401 for a used recovery code, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should reject a challenge token after too many wrong codes", func(t *testing.T) {
+		user, pass := testutil.MockUser(t, ctx.Database.Client)
+		defer user.Delete(ctx.Database.Client)
+		secret, _ := mockTwoFactor(t, ctx, user)
+		challenge := mockChallenge(t, ctx, user, pass)
+
+		for i := 0; i <= models.ChallengeThrottlePolicy.FreeAttempts; i++ {
+			if w := mockTwoFactorSession(ctx, `{"challengeToken": "`+challenge+`", "code": "000000"}`); w.Code != http.StatusUnauthorized {
+				t.Fatalf("Expected status code 401 on attempt %d, got %d", i+1, w.Code)
+			}
+		}
+
+		// even the right code is refused with this token
+		code, _ := core.TotpCode(secret, time.Now().Add(core.TotpPeriod*time.Second))
+		w := mockTwoFactorSession(ctx, `{"challengeToken": "`+challenge+`", "code": "`+code+`"}`)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status code 401, got %d", w.Code)
+		}
+
+		var resBody map[string]any
+		json.Unmarshal(w.Body.Bytes(), &resBody)
+		testutil.AssertInterface(t, map[string]any{
+			"error": handlers.EnumChallengeTokenInvalid,
+		}, resBody)
+	})
+
+	t.Run("Should lock the account after too many wrong codes across challenges", func(t *testing.T) {
+		user, pass := testutil.MockUser(t, ctx.Database.Client)
+		defer user.Delete(ctx.Database.Client)
+		secret, _ := mockTwoFactor(t, ctx, user)
+
+		var challenge string
+		for i := 0; i <= models.AccountThrottlePolicy.FreeAttempts; i++ {
+			challenge = mockChallenge(t, ctx, user, pass)
+			if w := mockTwoFactorSession(ctx, `{"challengeToken": "`+challenge+`", "code": "000000"}`); w.Code != http.StatusUnauthorized {
+				t.Fatalf("Expected status code 401 on attempt %d, got %d", i+1, w.Code)
+			}
+		}
+
+		code, _ := core.TotpCode(secret, time.Now().Add(core.TotpPeriod*time.Second))
+		w := mockTwoFactorSession(ctx, `{"challengeToken": "`+challenge+`", "code": "`+code+`"}`)
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("Expected status code 429, got %d", w.Code)
+		}
+		if w.Header().Get("Retry-After") == "" {
+			t.Error("Expected Retry-After header to be set")
+		}
+
+		// nor can a new challenge be asked for
+		if w := mockLoginAttempt(ctx, "192.0.2.1", user.Username, pass); w.Code != http.StatusTooManyRequests {
+			t.Errorf("Expected status code 429 for the password step, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should reject an invalid challenge token", func(t *testing.T) {
+		if w := mockTwoFactorSession(ctx, `{"challengeToken": "invalid", "code": "123456"}`); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status code 401, got %d", w.Code)
+		}
+	})
+}
+
+func mockDeleteTwoFactor(ctx handlers.ServerContext, user *models.User, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodDelete, "/users/2fa", bytes.NewBuffer([]byte(body)))
+	// away from the IP of the other tests, the failures here add up
+	r.RemoteAddr = "203.0.113.1:1234"
+	w := httptest.NewRecorder()
+	r = r.WithContext(context.WithValue(r.Context(), middlewares.CtxUserIDKey, user.ID))
+
+	ctx.DeleteTwoFactor(w, r)
+	return w
+}
+
+func TestDeleteTwoFactor(t *testing.T) {
+	ctx := testutil.NewTestingContext(t)
+
+	t.Run("Should require the password", func(t *testing.T) {
+		user, pass := testutil.MockUser(t, ctx.Database.Client)
+		defer user.Delete(ctx.Database.Client)
+		mockTwoFactor(t, ctx, user)
+
+		if w := mockDeleteTwoFactor(ctx, user, `{"password": "wrongpassword"}`); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status code 401, got %d", w.Code)
+		}
+		if w := mockDeleteTwoFactor(ctx, user, `{"password": "`+pass+`"}`); w.Code != http.StatusNoContent {
+			t.Errorf("Expected status code 204, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should lock after too many wrong passwords", func(t *testing.T) {
+		user, pass := testutil.MockUser(t, ctx.Database.Client)
+		defer user.Delete(ctx.Database.Client)
+		mockTwoFactor(t, ctx, user)
+
+		for i := 0; i <= models.AccountThrottlePolicy.FreeAttempts; i++ {
+			if w := mockDeleteTwoFactor(ctx, user, `{"password": "wrongpassword"}`); w.Code != http.StatusUnauthorized {
+				t.Fatalf("Expected status code 401 on attempt %d, got %d", i+1, w.Code)
+			}
+		}
+
+		if w := mockDeleteTwoFactor(ctx, user, `{"password": "`+pass+`"}`); w.Code != http.StatusTooManyRequests {
+			t.Errorf("Expected status code 429, got %d", w.Code)
+		}
+	})
+
+	t.Run("Should require a code from users without a password", func(t *testing.T) {
+		user, _ := testutil.MockUser(t, ctx.Database.Client)
+		defer user.Delete(ctx.Database.Client)
+		_, recoveryCodes := mockTwoFactor(t, ctx, user)
+		// like an account created through OIDC
+		if err := ctx.Database.Client.Model(user).Update("hashed_password", "").Error; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		if w := mockDeleteTwoFactor(ctx, user, `{"password": ""}`); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code 400, got %d", w.Code)
+		}
+		if w := mockDeleteTwoFactor(ctx, user, `{"recoveryCode": "invalid"}`); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status code 401, got %d", w.Code)
+		}
+		if w := mockDeleteTwoFactor(ctx, user, `{"recoveryCode": "`+recoveryCodes[0]+`"}`); w.Code != http.StatusNoContent {
+			t.Errorf("Expected status code 204, got %d", w.Code)
+		}
+	})
+}
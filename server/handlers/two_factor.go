@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/middlewares"
+	"github.com/khalidibnwalid/Luma/models"
+	"gorm.io/gorm"
+)
+
+const totpIssuer = "Luma"
+
+func (s *ServerContext) findCurrentUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	rCtx := r.Context()
+	userID := rCtx.Value(middlewares.CtxUserIDKey).(uuid.UUID)
+
+	user := models.NewUser().WithID(userID)
+	if err := user.FindByID(s.Database.Client.WithContext(rCtx)); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			newErrorResponse(w, http.StatusNotFound, EnumUserDoesNotExist)
+			return nil, false
+		}
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// verifyTotp validates the code and rejects replays of an already used code
+func (s *ServerContext) verifyTotp(db *gorm.DB, user *models.User, code string) (bool, error) {
+	step, ok := core.ValidateTotp(user.TotpSecret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return user.UseTotpStep(db, step)
+}
+
+// Start the two-factor enrollment, returns the secret and the otpauth URI to scan
+func (s *ServerContext) PostTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.findCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.TwoFactorEnabled() {
+		newErrorResponse(w, http.StatusBadRequest, EnumTwoFactorAlreadyEnabled)
+		return
+	}
+
+	secret, err := core.GenerateTotpSecret()
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	user.TotpSecret = secret
+	user.TotpLastStep = 0
+	if err := user.UpdateTotp(s.Database.Client.WithContext(r.Context())); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	res := map[string]string{
+		"secret": secret,
+		"uri":    core.TotpURI(totpIssuer, user.Username, secret),
+	}
+
+	json, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(json)
+}
+
+// Confirm the enrollment with a first code, enables two-factor and returns the recovery codes (shown once)
+func (s *ServerContext) PostTwoFactorVerify(w http.ResponseWriter, r *http.Request) {
+	db := s.Database.Client.WithContext(r.Context())
+	user, ok := s.findCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+		return
+	}
+
+	if user.TwoFactorEnabled() {
+		newErrorResponse(w, http.StatusBadRequest, EnumTwoFactorAlreadyEnabled)
+		return
+	}
+
+	if user.TotpSecret == "" {
+		newErrorResponse(w, http.StatusBadRequest, EnumTwoFactorNotEnrolled)
+		return
+	}
+
+	valid, err := s.verifyTotp(db, user, req.Code)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+	if !valid {
+		newErrorResponse(w, http.StatusBadRequest, EnumTwoFactorCodeInvalid)
+		return
+	}
+
+	codes, err := models.GenerateRecoveryCodes(db, user.ID)
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	user.TotpEnabledAt = &now
+	if err := user.UpdateTotp(db); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	res := map[string][]string{
+		"recoveryCodes": codes,
+	}
+
+	json, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// Disable two-factor, requires the password, or a TOTP or recovery code for accounts without one
+func (s *ServerContext) DeleteTwoFactor(w http.ResponseWriter, r *http.Request) {
+	db := s.Database.Client.WithContext(r.Context())
+	user, ok := s.findCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+		return
+	}
+
+	// wrong passwords and codes count like failed logins, a stolen access token can't guess them
+	throttles := newTwoFactorThrottles(r, user.ID)
+	if !throttles.check(w, db) {
+		return
+	}
+
+	if user.HasPassword() {
+		if err := core.VerifyHashWithSalt(req.Password, user.HashedPassword); err != nil {
+			if err == core.ErrHashVerificationFailed {
+				throttles.fail(db)
+				newErrorResponse(w, http.StatusUnauthorized, EnumPasswordInvalid)
+				return
+			}
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+	} else {
+		valid, err := s.checkSecondFactor(db, user, req.Code, req.RecoveryCode)
+		if err == errTwoFactorCodeRequired {
+			newErrorResponse(w, http.StatusBadRequest, EnumTwoFactorCodeRequired)
+			return
+		}
+		if err != nil {
+			newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+			return
+		}
+		if !valid {
+			throttles.fail(db)
+			newErrorResponse(w, http.StatusUnauthorized, EnumTwoFactorCodeInvalid)
+			return
+		}
+	}
+
+	user.TotpSecret = ""
+	user.TotpEnabledAt = nil
+	user.TotpLastStep = 0
+	if err := user.UpdateTotp(db); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	if err := models.DeleteRecoveryCodes(db, user.ID); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Second login step, exchanges the challenge token from PostSession and a TOTP or recovery code for a session
+func (s *ServerContext) PostTwoFactorSession(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	db := s.Database.Client.WithContext(rCtx)
+
+	var req struct {
+		ChallengeToken string `json:"challengeToken"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recoveryCode"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		newErrorResponse(w, http.StatusBadRequest, EnumBadRequest)
+		return
+	}
+
+	challenge, ok := core.ValidateChallengeToken(s.Keys, req.ChallengeToken)
+	if !ok {
+		newErrorResponse(w, http.StatusUnauthorized, EnumChallengeTokenInvalid)
+		return
+	}
+
+	uuidUserID, err := uuid.Parse(challenge.UserID)
+	if err != nil {
+		newErrorResponse(w, http.StatusUnauthorized, EnumChallengeTokenInvalid)
+		return
+	}
+
+	user := models.NewUser().WithID(uuidUserID)
+	if err := user.FindByID(db); err != nil {
+		newErrorResponse(w, http.StatusUnauthorized, EnumChallengeTokenInvalid)
+		return
+	}
+
+	if !user.TwoFactorEnabled() {
+		newErrorResponse(w, http.StatusUnauthorized, EnumChallengeTokenInvalid)
+		return
+	}
+
+	// wrong codes count against the account and the IP like wrong passwords,
+	// and a challenge token only gets a few of them
+	throttles := newTwoFactorThrottles(r, user.ID)
+	if !throttles.check(w, db) {
+		return
+	}
+
+	challengeThrottle := models.NewLoginThrottle().WithKey("challenge:" + challenge.ID)
+	if locked, err := challengeThrottle.LockedFor(db); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	} else if locked > 0 {
+		newErrorResponse(w, http.StatusUnauthorized, EnumChallengeTokenInvalid)
+		return
+	}
+
+	valid, err := s.checkSecondFactor(db, user, req.Code, req.RecoveryCode)
+	if err == errTwoFactorCodeRequired {
+		newErrorResponse(w, http.StatusBadRequest, EnumTwoFactorCodeRequired)
+		return
+	}
+	if err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+	if !valid {
+		throttles.fail(db)
+		if err := challengeThrottle.RecordFailure(db, models.ChallengeThrottlePolicy); err != nil {
+			log.Printf("Error recording two-factor failure: %v", err)
+		}
+		newErrorResponse(w, http.StatusUnauthorized, EnumTwoFactorCodeInvalid)
+		return
+	}
+
+	if err := challengeThrottle.Reset(db); err != nil {
+		log.Printf("Error resetting two-factor throttle: %v", err)
+	}
+	resetLoginThrottles(db, user)
+	if err := s.issueSession(w, r, user.ID, challenge.Device); err != nil {
+		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
+		return
+	}
+
+	json, _ := json.Marshal(user)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(json)
+}
+
+var errTwoFactorCodeRequired = errors.New("a TOTP or recovery code is required")
+
+// checkSecondFactor verifies the TOTP code, or consumes the recovery code when no TOTP code is given
+func (s *ServerContext) checkSecondFactor(db *gorm.DB, user *models.User, code, recoveryCode string) (bool, error) {
+	switch {
+	case code != "":
+		return s.verifyTotp(db, user, code)
+	case recoveryCode != "":
+		err := models.ConsumeRecoveryCode(db, user.ID, recoveryCode)
+		if err == models.ErrRecoveryCodeInvalid {
+			return false, nil
+		}
+		return err == nil, err
+	default:
+		return false, errTwoFactorCodeRequired
+	}
+}
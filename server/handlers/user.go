@@ -6,7 +6,6 @@ import (
 	"net/http"
 
 	"github.com/google/uuid"
-	"github.com/khalidibnwalid/Luma/core"
 	"github.com/khalidibnwalid/Luma/middlewares"
 	"github.com/khalidibnwalid/Luma/models"
 	"gorm.io/gorm"
@@ -93,9 +92,13 @@ func (s *ServerContext) PostUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// create a token for the user
-	token, err := core.GenerateJwtToken(s.JwtSecret, user.ID.String())
-	if err != nil {
+	// the user can use the app right away, some servers may require the email to be verified
+	if err := s.sendVerificationMail(s.Database.Client.WithContext(rCtx), user); err != nil {
+		log.Printf("Error creating verification token: %v", err)
+	}
+
+	// create a session for the user
+	if err := s.issueSession(w, r, user.ID, ""); err != nil {
 		newErrorResponse(w, http.StatusInternalServerError, EnumInternalServerError)
 		return
 	}
@@ -103,7 +106,6 @@ func (s *ServerContext) PostUser(w http.ResponseWriter, r *http.Request) {
 	json, _ := json.Marshal(user)
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Add("Set-Cookie", core.SerializeCookieWithToken(token))
 	w.WriteHeader(http.StatusCreated)
 	w.Write(json)
 }
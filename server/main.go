@@ -4,7 +4,12 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/khalidibnwalid/Luma/core"
 	"github.com/khalidibnwalid/Luma/handlers"
@@ -14,16 +19,27 @@ import (
 
 func main() {
 	env := models.GetEnv()
-	ctx := handlers.NewServerContext(env.MongoUri, env.PostgresUri, env.DbName, env.JwtSecret)
+	configureHashing(env)
+	configureWebsockets(env)
+	keys := newKeyring(env)
+	ctx := handlers.NewServerContext(env.MongoUri, env.PostgresUri, env.DbName, keys)
 	defer func() {
 		_ = ctx.Client.Disconnect(context.Background())
 	}()
+	ctx.Mailer = newMailer(env)
+	ctx.AppURL = env.AppUrl
+	ctx.GenericLoginErrors = env.LoginGenericErrors == "true"
+	ctx.OIDCProviders = newOIDCProviders(env)
 	topicStore := core.NewTopicStore()
+	sessionStore := core.NewSessionStore()
 
 	// Server
 	authedRoutes := core.NewApp()
 	authedRoutes.Use(middlewares.Logging)
-	authedRoutes.Use(middlewares.JwtAuthBuilder(env.JwtSecret))
+	authedRoutes.Use(middlewares.JwtAuthBuilder(keys, ctx.Database))
+
+	// real-time routes
+	authedRoutes.HandleFunc("GET /gateway", ctx.Gateway(topicStore, sessionStore))
 
 	// user data routes
 	// authedRoutes.HandleFunc("GET /user/{username}", ctx.UserGET)
@@ -31,38 +47,246 @@ func main() {
 	// servers routes
 	authedRoutes.HandleFunc("GET /servers", ctx.GetUserRoomsServer)
 	authedRoutes.HandleFunc("POST /servers", ctx.PostRoomsServer)
-	authedRoutes.HandleFunc("POST /servers/{id}", ctx.JoinServer)
+	authedRoutes.HandleFunc("POST /servers/{id}", ctx.JoinServer(topicStore))
+	authedRoutes.HandleFunc("PATCH /servers/{id}", ctx.PatchRoomsServer(topicStore))
+	authedRoutes.HandleFunc("DELETE /servers/{id}", ctx.DeleteRoomsServer(topicStore))
+	authedRoutes.HandleFunc("POST /servers/{id}/transfer", ctx.TransferServerOwnership(topicStore))
+	authedRoutes.HandleFunc("PATCH /servers/{id}/settings", ctx.PatchServerSettings)
+	authedRoutes.HandleFunc("GET /servers/{id}/permissions", ctx.GetServerPermissions)
+	authedRoutes.HandleFunc("GET /servers/{id}/audit-log", ctx.GetAuditLog)
+
+	// server invites routes
+	authedRoutes.HandleFunc("GET /servers/{id}/invites", ctx.GetInvites)
+	authedRoutes.HandleFunc("POST /servers/{id}/invites", ctx.PostInvite)
+	authedRoutes.HandleFunc("DELETE /servers/{id}/invites/{code}", ctx.DeleteInvite)
+	authedRoutes.HandleFunc("POST /invites/{code}", ctx.RedeemInvite(topicStore))
+
+	// server directory routes
+	authedRoutes.HandleFunc("GET /discover/servers", ctx.GetDiscoverableServers)
+
+	// server members routes
+	authedRoutes.HandleFunc("GET /servers/{id}/members", ctx.GetMembers(topicStore))
+	authedRoutes.HandleFunc("PATCH /servers/{id}/members/@me", ctx.PatchMemberMe)
+	authedRoutes.HandleFunc("DELETE /servers/{id}/members/@me", ctx.LeaveServer(topicStore))
+
+	// server moderation routes
+	authedRoutes.HandleFunc("DELETE /servers/{id}/members/{userId}", ctx.KickMember(topicStore))
+	authedRoutes.HandleFunc("PUT /servers/{id}/members/{userId}/timeout", ctx.PutMemberTimeout)
+	authedRoutes.HandleFunc("GET /servers/{id}/bans", ctx.GetBans)
+	authedRoutes.HandleFunc("PUT /servers/{id}/bans/{userId}", ctx.PutBan(topicStore))
+	authedRoutes.HandleFunc("DELETE /servers/{id}/bans/{userId}", ctx.DeleteBan)
+
+	// server roles routes
+	authedRoutes.HandleFunc("GET /servers/{id}/roles", ctx.GetRoles)
+	authedRoutes.HandleFunc("POST /servers/{id}/roles", ctx.PostRole)
+	authedRoutes.HandleFunc("PATCH /servers/{id}/roles/{roleId}", ctx.PatchRole(topicStore))
+	authedRoutes.HandleFunc("DELETE /servers/{id}/roles/{roleId}", ctx.DeleteRole(topicStore))
+	authedRoutes.HandleFunc("PUT /servers/{id}/members/{userId}/roles/{roleId}", ctx.PutMemberRole(topicStore))
+	authedRoutes.HandleFunc("DELETE /servers/{id}/members/{userId}/roles/{roleId}", ctx.DeleteMemberRole(topicStore))
+
+	// server bots routes
+	authedRoutes.HandleFunc("GET /servers/{id}/bots", ctx.GetBots)
+	authedRoutes.HandleFunc("POST /servers/{id}/bots", ctx.PostBot)
+	authedRoutes.HandleFunc("DELETE /servers/{id}/bots/{botId}", ctx.DeleteBot)
+	authedRoutes.HandleFunc("GET /servers/{id}/bots/{botId}/tokens", ctx.GetBotTokens)
+	authedRoutes.HandleFunc("POST /servers/{id}/bots/{botId}/tokens", ctx.PostBotToken)
+	authedRoutes.HandleFunc("DELETE /servers/{id}/bots/{botId}/tokens/{tokenId}", ctx.DeleteBotToken)
 
 	// server rooms routes
 	authedRoutes.HandleFunc("GET /servers/{id}", ctx.GetRoomsServer)
 	authedRoutes.HandleFunc("GET /servers/{id}/rooms", ctx.GetRoomsOfServer)
-	authedRoutes.HandleFunc("POST /servers/{id}/rooms", ctx.PostRoomToServer)
+	authedRoutes.HandleFunc("POST /servers/{id}/rooms", ctx.PostRoomToServer(topicStore))
+	authedRoutes.HandleFunc("PATCH /servers/{id}/positions", ctx.PatchServerPositions(topicStore))
+
+	// server room categories routes
+	authedRoutes.HandleFunc("GET /servers/{id}/categories", ctx.GetCategories)
+	authedRoutes.HandleFunc("POST /servers/{id}/categories", ctx.PostCategory)
+	authedRoutes.HandleFunc("PATCH /servers/{id}/categories/{categoryId}", ctx.PatchCategory)
+	authedRoutes.HandleFunc("DELETE /servers/{id}/categories/{categoryId}", ctx.DeleteCategory(topicStore))
+	authedRoutes.HandleFunc("GET /servers/{id}/categories/{categoryId}/overwrites", ctx.GetCategoryOverwrites)
+	authedRoutes.HandleFunc("PUT /servers/{id}/categories/{categoryId}/overwrites/{targetType}/{targetId}", ctx.PutCategoryOverwrite(topicStore))
+	authedRoutes.HandleFunc("DELETE /servers/{id}/categories/{categoryId}/overwrites/{targetType}/{targetId}", ctx.DeleteCategoryOverwrite(topicStore))
 
 	// room routes
 	authedRoutes.HandleFunc("GET /rooms/{id}/messages", ctx.GETRoomMessages)
 	authedRoutes.HandleFunc("/rooms/{id}", ctx.WSRoom(topicStore))
+	authedRoutes.HandleFunc("PATCH /rooms/{id}", ctx.PatchRoom(topicStore))
+	authedRoutes.HandleFunc("DELETE /rooms/{id}", ctx.DeleteRoom(topicStore))
+	authedRoutes.HandleFunc("GET /rooms/{id}/overwrites", ctx.GetRoomOverwrites)
+	authedRoutes.HandleFunc("PUT /rooms/{id}/overwrites/{targetType}/{targetId}", ctx.PutRoomOverwrite(topicStore))
+	authedRoutes.HandleFunc("DELETE /rooms/{id}/overwrites/{targetType}/{targetId}", ctx.DeleteRoomOverwrite(topicStore))
 	// room status routes
 	authedRoutes.HandleFunc("PATCH /rooms/{id}/status", ctx.PatchRoomStatus)
 
 	// user routes
 	authedRoutes.HandleFunc("GET /users", ctx.GetUser)
+	authedRoutes.HandleFunc("POST /users/verification", handlers.UsersOnly(ctx.PostEmailVerification))
+	authedRoutes.HandleFunc("POST /users/2fa", handlers.UsersOnly(ctx.PostTwoFactor))
+	authedRoutes.HandleFunc("POST /users/2fa/verify", handlers.UsersOnly(ctx.PostTwoFactorVerify))
+	authedRoutes.HandleFunc("DELETE /users/2fa", handlers.UsersOnly(ctx.DeleteTwoFactor))
+	authedRoutes.HandleFunc("GET /users/identities", handlers.UsersOnly(ctx.GetIdentities))
+	authedRoutes.HandleFunc("GET /users/identities/{provider}/link", handlers.UsersOnly(ctx.GetOIDCLink))
+	authedRoutes.HandleFunc("DELETE /users/identities/{id}", handlers.UsersOnly(ctx.DeleteIdentity))
+
+	// session (devices) routes
+	authedRoutes.HandleFunc("GET /sessions", handlers.UsersOnly(ctx.GetSessions))
+	authedRoutes.HandleFunc("DELETE /sessions", handlers.UsersOnly(ctx.DeleteAllSessions))
+	authedRoutes.HandleFunc("DELETE /sessions/{id}", handlers.UsersOnly(ctx.DeleteUserSession))
 
 	// auth routes
 	unAuthedRoutes := core.NewApp()
 	unAuthedRoutes.Use(middlewares.Logging)
 	unAuthedRoutes.HandleFunc("POST /sessions", ctx.PostSession)
 	unAuthedRoutes.HandleFunc("DELETE /sessions", ctx.DeleteSession)
+	unAuthedRoutes.HandleFunc("POST /sessions/refresh", ctx.PostRefreshSession)
+	unAuthedRoutes.HandleFunc("POST /sessions/2fa", ctx.PostTwoFactorSession)
 	unAuthedRoutes.HandleFunc("POST /users", ctx.PostUser)
+	unAuthedRoutes.HandleFunc("POST /password-reset", ctx.PostPasswordReset)
+	unAuthedRoutes.HandleFunc("POST /password-reset/confirm", ctx.PostPasswordResetConfirm)
+	unAuthedRoutes.HandleFunc("POST /email-verification/confirm", ctx.PostEmailVerificationConfirm)
+	unAuthedRoutes.HandleFunc("GET /oidc/{provider}", ctx.GetOIDCLogin)
+	unAuthedRoutes.HandleFunc("GET /oidc/{provider}/callback", ctx.GetOIDCCallback)
 
 	v1 := http.NewServeMux()
 	v1.Handle("/v1/", http.StripPrefix("/v1", authedRoutes.Mux))
 	v1.Handle("/v1/auth/", http.StripPrefix("/v1/auth", unAuthedRoutes.Mux))
+	v1.HandleFunc("GET /.well-known/jwks.json", ctx.GetJWKS)
 
 	server := http.Server{
 		Addr:    env.Port,
 		Handler: middlewares.CORS(v1),
 	}
 
-	log.Printf("Server Listening on port %s\n", strings.Replace(env.Port, ":", "", 1))
-	server.ListenAndServe()
+	stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	go func() {
+		log.Printf("Server Listening on port %s\n", strings.Replace(env.Port, ":", "", 1))
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("Server error: %v", err)
+		}
+	}()
+	<-stop.Done()
+
+	// websockets are hijacked so Shutdown doesn't wait for them, they are told to reconnect later
+	log.Println("Shutting down")
+	shutdown, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
+	server.Shutdown(shutdown)
+	ctx.Connections.CloseAll(core.CloseServerShutdown, "server shutting down")
+}
+
+// override the target argon2 parameters, existing hashes are upgraded on login
+func configureHashing(env *models.Env) {
+	parse := func(name, value string, bits int) uint64 {
+		n, err := strconv.ParseUint(value, 10, bits)
+		if err != nil || n == 0 {
+			log.Fatalf("Invalid %s: %q", name, value)
+		}
+		return n
+	}
+
+	if env.Argon2Memory != "" {
+		core.DefaultHashingOptions.Memory = uint32(parse("ARGON2_MEMORY", env.Argon2Memory, 32))
+	}
+	if env.Argon2Iterations != "" {
+		core.DefaultHashingOptions.Iterations = uint32(parse("ARGON2_ITERATIONS", env.Argon2Iterations, 32))
+	}
+	if env.Argon2Parallelism != "" {
+		core.DefaultHashingOptions.Parallelism = uint8(parse("ARGON2_PARALLELISM", env.Argon2Parallelism, 8))
+	}
+
+	// hashes above the bounds are rejected as tampered
+	opt, limit := core.DefaultHashingOptions, core.MaxHashingOptions
+	if opt.Memory > limit.Memory || opt.Iterations > limit.Iterations || opt.Parallelism > limit.Parallelism {
+		log.Fatalf("ARGON2_* above the maximum of m=%d, t=%d, p=%d", limit.Memory, limit.Iterations, limit.Parallelism)
+	}
+}
+
+// override how far behind websocket clients can fall, how long they can stay silent and how much they can send
+func configureWebsockets(env *models.Env) {
+	parse := func(name, value string) int {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid %s: %q", name, value)
+		}
+		return n
+	}
+	// 0 turns pings and the read timeout off
+	parseOptional := func(name, value string) int {
+		if value == "0" {
+			return 0
+		}
+		return parse(name, value)
+	}
+
+	if env.WsQueueSize != "" {
+		core.DefaultConnOptions.QueueSize = parse("WS_QUEUE_SIZE", env.WsQueueSize)
+	}
+	if env.WsWriteTimeout != "" {
+		core.DefaultConnOptions.WriteTimeout = time.Duration(parse("WS_WRITE_TIMEOUT", env.WsWriteTimeout)) * time.Second
+	}
+	if env.WsPingInterval != "" {
+		core.DefaultConnOptions.PingInterval = time.Duration(parseOptional("WS_PING_INTERVAL", env.WsPingInterval)) * time.Second
+	}
+	if env.WsReadTimeout != "" {
+		core.DefaultConnOptions.ReadTimeout = time.Duration(parseOptional("WS_READ_TIMEOUT", env.WsReadTimeout)) * time.Second
+	}
+	if env.WsMaxMessageSize != "" {
+		core.DefaultConnOptions.MaxMessageSize = int64(parse("WS_MAX_MESSAGE_SIZE", env.WsMaxMessageSize))
+	}
+	if env.WsRateLimit != "" {
+		core.DefaultConnOptions.RateLimit = parse("WS_RATE_LIMIT", env.WsRateLimit)
+	}
+	// clients answer the pings with pongs, which must arrive before the read timeout
+	if opt := core.DefaultConnOptions; opt.PingInterval > 0 && opt.ReadTimeout > 0 && opt.PingInterval >= opt.ReadTimeout {
+		log.Fatalf("WS_PING_INTERVAL (%s) must be shorter than WS_READ_TIMEOUT (%s)", opt.PingInterval, opt.ReadTimeout)
+	}
+	switch env.WsSlowConsumer {
+	case "":
+	case "disconnect":
+		core.DefaultConnOptions.SlowConsumer = core.SlowConsumerDisconnect
+	case "drop":
+		core.DefaultConnOptions.SlowConsumer = core.SlowConsumerDropFrames
+	default:
+		log.Fatalf("Invalid WS_SLOW_CONSUMER: %q", env.WsSlowConsumer)
+	}
+}
+
+// the keyring file when configured, otherwise a single HS256 key from JWT_SECRET
+func newKeyring(env *models.Env) *core.Keyring {
+	if env.JwtKeysFile == "" {
+		return core.NewKeyringFromSecret(env.JwtSecret)
+	}
+
+	keys, err := core.LoadKeyringFile(env.JwtKeysFile)
+	if err != nil {
+		log.Fatalf("Error loading JWT keyring: %v", err)
+	}
+	return keys
+}
+
+func newOIDCProviders(env *models.Env) map[string]*core.OIDCProvider {
+	if env.OidcProvidersFile == "" {
+		return map[string]*core.OIDCProvider{}
+	}
+
+	providers, err := core.LoadOIDCProvidersFile(env.OidcProvidersFile)
+	if err != nil {
+		log.Fatalf("Error loading OIDC providers: %v", err)
+	}
+	return providers
+}
+
+// SMTP when configured, otherwise mails are written to a local directory for development
+func newMailer(env *models.Env) core.Mailer {
+	if env.SmtpHost != "" {
+		return core.NewSMTPMailer(env.SmtpHost, env.SmtpPort, env.SmtpUsername, env.SmtpPassword, env.MailFrom)
+	}
+
+	dir := env.MailDir
+	if dir == "" {
+		dir = "mails"
+	}
+	log.Printf("SMTP_HOST is not set, mails will be written to %s\n", dir)
+	return core.NewFileMailer(dir, env.MailFrom)
 }
@@ -2,22 +2,40 @@ package middlewares
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/khalidibnwalid/Luma/core"
+	"github.com/khalidibnwalid/Luma/models"
 )
 
 type key string
 
 const CtxUserIDKey key = "auth.JWT_USER_ID"
+const CtxSessionIDKey key = "auth.JWT_SESSION_ID"
 
-// TODO token refreshing
-func JwtAuthBuilder(secret string) core.Middleware {
+// set to true when the principal is a bot authenticated with an API token
+const CtxIsBotKey key = "auth.IS_BOT"
+
+// when the access token expires, bots' API tokens don't
+const CtxExpiresAtKey key = "auth.EXPIRES_AT"
+
+const botAuthorizationScheme = "Bot "
+
+// JwtAuthBuilder accepts either a user session (the access token cookie) or a bot API token (`Authorization: Bot <token>` header).
+// expired access tokens are rejected, clients renew them through the refresh endpoint.
+// The `jti` of the token is checked against the sessions table so revoked sessions are rejected right away
+func JwtAuthBuilder(keys *core.Keyring, db *core.DBClient) core.Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if header := r.Header.Get("Authorization"); strings.HasPrefix(header, botAuthorizationScheme) {
+				authenticateBot(db, w, r, next, strings.TrimPrefix(header, botAuthorizationScheme))
+				return
+			}
+
 			cookie, err := r.Cookie(core.JwtSessionCookieName)
 			if err != nil {
 				unahuthorized(w)
@@ -30,7 +48,7 @@ func JwtAuthBuilder(secret string) core.Middleware {
 				return
 			}
 
-			_, claims, ok := core.ValidateJwtToken(secret, tokenString)
+			_, claims, ok := core.ValidateJwtToken(keys, tokenString)
 			if !ok || tokenExpired(claims["exp"].(float64)) {
 				unahuthorized(w)
 				return
@@ -44,12 +62,54 @@ func JwtAuthBuilder(secret string) core.Middleware {
 				return
 			}
 
-			r = r.WithContext(context.WithValue(r.Context(), CtxUserIDKey, uuidId))
+			sessionId, _ := claims["jti"].(string)
+			uuidSessionId, err := uuid.Parse(sessionId)
+			if err != nil {
+				unahuthorized(w)
+				return
+			}
+
+			session := models.NewSession().WithID(uuidSessionId)
+			if err := session.FindByID(db.Client.WithContext(r.Context())); err != nil || !session.IsActive() || session.UserID != uuidId {
+				unahuthorized(w)
+				return
+			}
+			session.Touch(db.Client.WithContext(r.Context()), ClientIP(r))
+
+			rCtx := context.WithValue(r.Context(), CtxUserIDKey, uuidId)
+			rCtx = context.WithValue(rCtx, CtxSessionIDKey, uuidSessionId)
+			rCtx = context.WithValue(rCtx, CtxIsBotKey, false)
+			rCtx = context.WithValue(rCtx, CtxExpiresAtKey, time.Unix(int64(claims["exp"].(float64)), 0))
+			r = r.WithContext(rCtx)
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
+func authenticateBot(db *core.DBClient, w http.ResponseWriter, r *http.Request, next http.Handler, rawToken string) {
+	if rawToken == "" {
+		unahuthorized(w)
+		return
+	}
+
+	token := models.NewApiToken()
+	if err := token.FindActiveByToken(db.Client.WithContext(r.Context()), rawToken); err != nil {
+		unahuthorized(w)
+		return
+	}
+	token.Touch(db.Client.WithContext(r.Context()))
+
+	rCtx := context.WithValue(r.Context(), CtxUserIDKey, token.BotID)
+	rCtx = context.WithValue(rCtx, CtxIsBotKey, true)
+	next.ServeHTTP(w, r.WithContext(rCtx))
+}
+
+// IsBot reports whether the request was authenticated with a bot API token
+func IsBot(r *http.Request) bool {
+	isBot, _ := r.Context().Value(CtxIsBotKey).(bool)
+	return isBot
+}
+
 func unahuthorized(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusUnauthorized)
 	w.Write([]byte(http.StatusText(http.StatusUnauthorized)))
@@ -59,3 +119,12 @@ func tokenExpired(exp float64) bool {
 	expInt := int64(exp)
 	return time.Now().Unix() > expInt
 }
+
+// ClientIP returns the address of the direct peer, forwarded headers are not trusted
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
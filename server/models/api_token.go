@@ -0,0 +1,117 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"gorm.io/gorm"
+)
+
+// prefix of raw API tokens, makes leaked tokens easy to spot
+const apiTokenPrefix = "luma_"
+
+// last-used time is only written when older than this
+const apiTokenTouchInterval = time.Minute
+
+// ApiToken is a long-lived, revocable credential of a bot, sent as `Authorization: Bot <token>`,
+// only its hash is stored
+type ApiToken struct {
+	gorm.Model  `json:"-"`
+	ID          uuid.UUID  `gorm:"primarykey;type:uuid;default:gen_random_uuid()" json:"id"`
+	BotID       uuid.UUID  `gorm:"column:bot_id;type:uuid;index" json:"botId"`
+	Name        string     `gorm:"column:name" json:"name"`
+	HashedToken string     `gorm:"column:hashed_token;uniqueIndex" json:"-"`
+	LastUsedAt  *time.Time `gorm:"column:last_used_at" json:"lastUsedAt"`
+	RevokedAt   *time.Time `gorm:"column:revoked_at" json:"revokedAt"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	// Relationships
+	Bot User `gorm:"foreignKey:BotID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+}
+
+func (ApiToken) TableName() string {
+	return "api_tokens"
+}
+
+func NewApiToken() *ApiToken {
+	return &ApiToken{}
+}
+
+func (t *ApiToken) WithID(id uuid.UUID) *ApiToken {
+	t.ID = id
+	return t
+}
+
+func (t *ApiToken) WithBotID(botID uuid.UUID) *ApiToken {
+	t.BotID = botID
+	return t
+}
+
+func (t *ApiToken) WithName(name string) *ApiToken {
+	t.Name = name
+	return t
+}
+
+// Generate creates the raw token and stores its hash in the struct, the raw token is never persisted
+func (t *ApiToken) Generate() (string, error) {
+	raw, err := core.GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	raw = apiTokenPrefix + raw
+	t.HashedToken = core.HashToken(raw)
+	return raw, nil
+}
+
+func (t *ApiToken) Create(db *gorm.DB) error {
+	result := db.Omit("Bot").Create(t)
+	return result.Error
+}
+
+// FindActiveByToken looks up a non-revoked token by the hash of the raw token
+func (t *ApiToken) FindActiveByToken(db *gorm.DB, raw string) error {
+	result := db.Where("hashed_token = ? AND revoked_at IS NULL", core.HashToken(raw)).First(t)
+	return result.Error
+}
+
+// Find by token and bot ID
+func (t *ApiToken) Find(db *gorm.DB) error {
+	result := db.Where("id = ? AND bot_id = ?", t.ID, t.BotID).First(t)
+	return result.Error
+}
+
+// Touch updates the last-used time at most once per apiTokenTouchInterval
+func (t *ApiToken) Touch(db *gorm.DB) error {
+	if t.LastUsedAt != nil && time.Since(*t.LastUsedAt) < apiTokenTouchInterval {
+		return nil
+	}
+
+	now := time.Now()
+	t.LastUsedAt = &now
+	result := db.Model(&ApiToken{}).
+		Where("id = ?", t.ID).
+		Update("last_used_at", now)
+	return result.Error
+}
+
+func (t *ApiToken) Revoke(db *gorm.DB) error {
+	now := time.Now()
+	t.RevokedAt = &now
+	result := db.Model(&ApiToken{}).
+		Where("id = ? AND revoked_at IS NULL", t.ID).
+		Update("revoked_at", now)
+	return result.Error
+}
+
+// GetBotTokens returns the tokens of a bot, revoked ones included
+func GetBotTokens(db *gorm.DB, botID uuid.UUID) ([]ApiToken, error) {
+	var tokens []ApiToken
+
+	result := db.Where("bot_id = ?", botID).
+		Order("created_at ASC").
+		Find(&tokens)
+
+	return tokens, result.Error
+}
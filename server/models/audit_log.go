@@ -0,0 +1,190 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const auditLogLimit = 50
+
+const (
+	AuditRoomCreate       = "room.create"
+	AuditRoomUpdate       = "room.update"
+	AuditRoomDelete       = "room.delete"
+	AuditRoomReorder      = "room.reorder"
+	AuditCategoryCreate   = "category.create"
+	AuditCategoryUpdate   = "category.update"
+	AuditCategoryDelete   = "category.delete"
+	AuditRoleCreate       = "role.create"
+	AuditRoleUpdate       = "role.update"
+	AuditRoleDelete       = "role.delete"
+	AuditMemberUpdate     = "member.update"
+	AuditMemberRoleAdd    = "member.role_add"
+	AuditMemberRoleRemove = "member.role_remove"
+	AuditOverwriteUpdate  = "overwrite.update"
+	AuditOverwriteDelete  = "overwrite.delete"
+	AuditMemberKick       = "member.kick"
+	AuditMemberBan        = "member.ban"
+	AuditMemberUnban      = "member.unban"
+	AuditMemberTimeout    = "member.timeout"
+	AuditInviteCreate     = "invite.create"
+	AuditInviteDelete     = "invite.delete"
+	AuditServerUpdate     = "server.update"
+	AuditServerTransfer   = "server.transfer"
+)
+
+const (
+	AuditTargetRoom      = "room"
+	AuditTargetCategory  = "category"
+	AuditTargetRole      = "role"
+	AuditTargetMember    = "member"
+	AuditTargetInvite    = "invite"
+	AuditTargetServer    = "server"
+	AuditTargetOverwrite = "overwrite"
+)
+
+// AuditChange is the value of a field before and after an action, nil on creation or deletion
+type AuditChange struct {
+	Old any `json:"old,omitempty"`
+	New any `json:"new,omitempty"`
+}
+
+// AuditLogEntry records who did what in a server, entries are append-only,
+// so there is no gorm.Model (no soft deletes nor updates)
+type AuditLogEntry struct {
+	ID         uuid.UUID       `gorm:"primarykey;type:uuid;default:gen_random_uuid()" json:"id"`
+	ServerID   uuid.UUID       `gorm:"column:server_id;type:uuid;index:idx_audit_server_created" json:"serverId"`
+	ActorID    uuid.UUID       `gorm:"column:actor_id;type:uuid;index" json:"actorId"`
+	Action     string          `gorm:"column:action;index" json:"action"`
+	TargetType string          `gorm:"column:target_type" json:"targetType"`
+	TargetID   string          `gorm:"column:target_id;index" json:"targetId"` // not always a UUID, e.g. invite codes
+	Changes    json.RawMessage `gorm:"column:changes;type:jsonb" json:"changes"`
+	Reason     string          `gorm:"column:reason" json:"reason"`
+	CreatedAt  time.Time       `gorm:"index:idx_audit_server_created" json:"createdAt"`
+	// Relationships
+	Server RoomsServer `gorm:"foreignKey:ServerID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+}
+
+func (AuditLogEntry) TableName() string {
+	return "audit_log"
+}
+
+func NewAuditLogEntry() *AuditLogEntry {
+	return &AuditLogEntry{}
+}
+
+func (e *AuditLogEntry) WithServerID(serverID uuid.UUID) *AuditLogEntry {
+	e.ServerID = serverID
+	return e
+}
+
+func (e *AuditLogEntry) WithActorID(actorID uuid.UUID) *AuditLogEntry {
+	e.ActorID = actorID
+	return e
+}
+
+func (e *AuditLogEntry) WithAction(action string) *AuditLogEntry {
+	e.Action = action
+	return e
+}
+
+func (e *AuditLogEntry) WithTarget(targetType, targetID string) *AuditLogEntry {
+	e.TargetType = targetType
+	e.TargetID = targetID
+	return e
+}
+
+func (e *AuditLogEntry) WithChanges(changes map[string]AuditChange) *AuditLogEntry {
+	if changes == nil {
+		changes = map[string]AuditChange{}
+	}
+	e.Changes, _ = json.Marshal(changes)
+	return e
+}
+
+func (e *AuditLogEntry) WithReason(reason string) *AuditLogEntry {
+	e.Reason = reason
+	return e
+}
+
+func (e *AuditLogEntry) Create(db *gorm.DB) error {
+	if e.Changes == nil {
+		e.WithChanges(nil)
+	}
+	result := db.Create(e)
+	return result.Error
+}
+
+// fields that change on every write, or never
+var auditIgnoredFields = map[string]bool{"id": true, "serverId": true, "createdAt": true, "updatedAt": true}
+
+// DiffChanges compares the JSON of two values field by field, a nil before is a creation
+// and a nil after is a deletion
+func DiffChanges(before, after any) map[string]AuditChange {
+	oldFields, newFields := map[string]any{}, map[string]any{}
+	if before != nil {
+		data, _ := json.Marshal(before)
+		json.Unmarshal(data, &oldFields)
+	}
+	if after != nil {
+		data, _ := json.Marshal(after)
+		json.Unmarshal(data, &newFields)
+	}
+
+	changes := map[string]AuditChange{}
+	for key, old := range oldFields {
+		if !auditIgnoredFields[key] && !reflect.DeepEqual(old, newFields[key]) {
+			changes[key] = AuditChange{Old: old, New: newFields[key]}
+		}
+	}
+	for key, value := range newFields {
+		if _, seen := oldFields[key]; !seen && !auditIgnoredFields[key] && value != nil {
+			changes[key] = AuditChange{New: value}
+		}
+	}
+	return changes
+}
+
+// AuditLogFilter narrows GetAuditLog, zero fields match everything,
+// Before is the ID of the last entry of the previous page
+type AuditLogFilter struct {
+	Action   string
+	ActorID  uuid.UUID
+	TargetID string
+	Before   uuid.UUID
+	Limit    int
+}
+
+// GetAuditLog returns the entries of the server, newest first
+func GetAuditLog(db *gorm.DB, serverID uuid.UUID, filter AuditLogFilter) ([]AuditLogEntry, error) {
+	query := db.Where("server_id = ?", serverID)
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.ActorID != uuid.Nil {
+		query = query.Where("actor_id = ?", filter.ActorID)
+	}
+	if filter.TargetID != "" {
+		query = query.Where("target_id = ?", filter.TargetID)
+	}
+	if filter.Before != uuid.Nil {
+		var cursor AuditLogEntry
+		if err := db.Where("id = ? AND server_id = ?", filter.Before, serverID).First(&cursor).Error; err != nil {
+			return nil, err
+		}
+		query = query.Where("(created_at, id) < (?, ?)", cursor.CreatedAt, cursor.ID)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 || limit > auditLogLimit {
+		limit = auditLogLimit
+	}
+
+	var entries []AuditLogEntry
+	result := query.Order("created_at DESC, id DESC").Limit(limit).Find(&entries)
+	return entries, result.Error
+}
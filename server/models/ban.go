@@ -0,0 +1,109 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Ban keeps a user out of a server, until it expires or is lifted
+type Ban struct {
+	gorm.Model  `json:"-"`
+	ID          uuid.UUID  `gorm:"primarykey;type:uuid;default:gen_random_uuid()" json:"id"`
+	ServerID    uuid.UUID  `gorm:"column:server_id;type:uuid;uniqueIndex:idx_ban_member" json:"serverId"`
+	UserID      uuid.UUID  `gorm:"column:user_id;type:uuid;uniqueIndex:idx_ban_member" json:"userId"`
+	ModeratorID uuid.UUID  `gorm:"column:moderator_id;type:uuid" json:"moderatorId"`
+	Reason      string     `gorm:"column:reason" json:"reason"`
+	ExpiresAt   *time.Time `gorm:"column:expires_at" json:"expiresAt"` // nil is permanent
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	// Relationships
+	Server RoomsServer `gorm:"foreignKey:ServerID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+	User   User        `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+}
+
+func (Ban) TableName() string {
+	return "bans"
+}
+
+func NewBan() *Ban {
+	return &Ban{}
+}
+
+func (b *Ban) WithServerID(serverID uuid.UUID) *Ban {
+	b.ServerID = serverID
+	return b
+}
+
+func (b *Ban) WithUserID(userID uuid.UUID) *Ban {
+	b.UserID = userID
+	return b
+}
+
+func (b *Ban) WithModeratorID(moderatorID uuid.UUID) *Ban {
+	b.ModeratorID = moderatorID
+	return b
+}
+
+func (b *Ban) WithReason(reason string) *Ban {
+	b.Reason = reason
+	return b
+}
+
+// a zero duration is permanent
+func (b *Ban) WithDuration(duration time.Duration) *Ban {
+	if duration > 0 {
+		expiresAt := time.Now().Add(duration)
+		b.ExpiresAt = &expiresAt
+	}
+	return b
+}
+
+// Upsert bans the user, banning them again replaces the reason and expiry
+func (b *Ban) Upsert(db *gorm.DB) error {
+	existing := NewBan().WithServerID(b.ServerID).WithUserID(b.UserID)
+	if err := existing.Find(db); err != nil {
+		if err != gorm.ErrRecordNotFound {
+			return err
+		}
+		return db.Create(b).Error
+	}
+
+	existing.ModeratorID, existing.Reason, existing.ExpiresAt = b.ModeratorID, b.Reason, b.ExpiresAt
+	*b = *existing
+	return db.Save(b).Error
+}
+
+// by server and user ID, expired bans included
+func (b *Ban) Find(db *gorm.DB) error {
+	result := db.Where("server_id = ? AND user_id = ?", b.ServerID, b.UserID).First(b)
+	return result.Error
+}
+
+func (b *Ban) Delete(db *gorm.DB) error {
+	result := db.Unscoped().Where("server_id = ? AND user_id = ?", b.ServerID, b.UserID).Delete(&Ban{})
+	return result.Error
+}
+
+func (b *Ban) IsActive() bool {
+	return b.ExpiresAt == nil || time.Now().Before(*b.ExpiresAt)
+}
+
+// IsBanned reports whether the user has an active ban in the server
+func IsBanned(db *gorm.DB, serverID, userID uuid.UUID) (bool, error) {
+	ban := NewBan().WithServerID(serverID).WithUserID(userID)
+	if err := ban.Find(db); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return ban.IsActive(), nil
+}
+
+func GetServerBans(db *gorm.DB, serverID uuid.UUID) ([]Ban, error) {
+	var bans []Ban
+	result := db.Where("server_id = ?", serverID).Order("created_at DESC").Find(&bans)
+	return bans, result.Error
+}
@@ -0,0 +1,102 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Bot links a bot user to the server it was created in and the user who owns it,
+// bots authenticate with ApiTokens instead of passwords
+type Bot struct {
+	gorm.Model `json:"-"`
+	UserID     uuid.UUID `gorm:"primaryKey;column:user_id;type:uuid" json:"userId"`
+	ServerID   uuid.UUID `gorm:"column:server_id;type:uuid;index" json:"serverId"`
+	OwnerID    uuid.UUID `gorm:"column:owner_id;type:uuid;index" json:"ownerId"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	// Relationships
+	User   User        `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;" json:"user"`
+	Owner  User        `gorm:"foreignKey:OwnerID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+	Server RoomsServer `gorm:"foreignKey:ServerID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+}
+
+func (Bot) TableName() string {
+	return "bots"
+}
+
+func NewBot() *Bot {
+	return &Bot{}
+}
+
+func (b *Bot) WithUserID(userID uuid.UUID) *Bot {
+	b.UserID = userID
+	return b
+}
+
+func (b *Bot) WithServerID(serverID uuid.UUID) *Bot {
+	b.ServerID = serverID
+	return b
+}
+
+func (b *Bot) WithOwnerID(ownerID uuid.UUID) *Bot {
+	b.OwnerID = ownerID
+	return b
+}
+
+// Create creates the bot user and makes it a member of its server
+func (b *Bot) Create(db *gorm.DB, username string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// bots have no password nor a real email, the email only has to be unique
+		b.User = User{
+			ID:       uuid.New(),
+			Username: username,
+			IsBot:    true,
+		}
+		b.User.Email = "bot-" + b.User.ID.String() + "@bots.invalid"
+		if err := b.User.Create(tx); err != nil {
+			return err
+		}
+
+		b.UserID = b.User.ID
+		if err := tx.Omit("User", "Owner", "Server").Create(b).Error; err != nil {
+			return err
+		}
+
+		if err := NewServerUserStatus().WithUserID(b.UserID).WithServerID(b.ServerID).Create(tx); err != nil {
+			return err
+		}
+		return CreateMemberRoomStatuses(tx, b.ServerID, b.UserID)
+	})
+}
+
+// Find by user and server ID, with the bot user joined
+func (b *Bot) Find(db *gorm.DB) error {
+	result := db.Joins("User").
+		Where("bots.user_id = ? AND bots.server_id = ?", b.UserID, b.ServerID).
+		First(b)
+	return result.Error
+}
+
+// Delete deletes the bot user, its membership and tokens cascade
+func (b *Bot) Delete(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", b.UserID).Delete(&Bot{}).Error; err != nil {
+			return err
+		}
+		return NewUser().WithID(b.UserID).Delete(tx)
+	})
+}
+
+// GetServerBots returns the bots of a server with their users
+func GetServerBots(db *gorm.DB, serverID uuid.UUID) ([]Bot, error) {
+	var bots []Bot
+
+	result := db.Joins("User").
+		Where("bots.server_id = ?", serverID).
+		Order("bots.created_at ASC").
+		Find(&bots)
+
+	return bots, result.Error
+}
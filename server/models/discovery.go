@@ -0,0 +1,152 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const discoveryLimit = 50
+
+const maxServerTags = 5
+
+const (
+	DiscoverySortPopular = "popular"
+	DiscoverySortNew     = "new"
+)
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9-]{1,24}$`)
+
+var ErrInvalidTags = errors.New("invalid tags")
+
+// Tags are the lowercase topics of a server, stored as a jsonb array
+type Tags []string
+
+func (t Tags) Value() (driver.Value, error) {
+	if t == nil {
+		t = Tags{}
+	}
+	data, err := json.Marshal(t)
+	return string(data), err
+}
+
+// servers without tags have an empty list rather than null
+func (t Tags) MarshalJSON() ([]byte, error) {
+	if t == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]string(t))
+}
+
+func (t *Tags) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*t = Tags{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, t)
+	case string:
+		return json.Unmarshal([]byte(v), t)
+	}
+	return errors.New("unsupported tags type")
+}
+
+// NormalizeTags lowercases and dedupes the tags, it fails with ErrInvalidTags
+// if there are too many or any of them is not made of letters, digits and dashes
+func NormalizeTags(tags []string) (Tags, error) {
+	normalized := Tags{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !tagPattern.MatchString(tag) {
+			return nil, ErrInvalidTags
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > maxServerTags {
+		return nil, ErrInvalidTags
+	}
+	return normalized, nil
+}
+
+// DiscoverableServer is what anyone can see of a discoverable server before joining
+type DiscoverableServer struct {
+	ID          uuid.UUID `json:"id"`
+	Name        string    `json:"name"`
+	Icon        string    `json:"icon"`
+	Description string    `json:"description"`
+	Tags        Tags      `json:"tags"`
+	MemberCount int64     `json:"memberCount"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// DiscoveryFilter narrows DiscoverServers, zero fields match everything,
+// After is the ID of the last server of the previous page
+type DiscoveryFilter struct {
+	Query string // full-text search on the name and the description
+	Tags  []string
+	Sort  string // popular (by member count) or new
+	After uuid.UUID
+	Limit int
+}
+
+const memberCountQuery = "(SELECT COUNT(*) FROM server_user_status WHERE server_user_status.server_id = rooms_servers.id AND server_user_status.deleted_at IS NULL)"
+
+// DiscoverServers returns the discoverable servers, most popular or newest first
+func DiscoverServers(db *gorm.DB, filter DiscoveryFilter) ([]DiscoverableServer, error) {
+	query := db.Model(&RoomsServer{}).
+		Select("rooms_servers.id, rooms_servers.name, rooms_servers.icon, rooms_servers.description, rooms_servers.tags, rooms_servers.created_at, " + memberCountQuery + " AS member_count").
+		Where("rooms_servers.is_discoverable")
+
+	if filter.Query != "" {
+		query = query.Where("to_tsvector('simple', rooms_servers.name || ' ' || COALESCE(rooms_servers.description, '')) @@ websearch_to_tsquery('simple', ?)", filter.Query)
+	}
+	if len(filter.Tags) > 0 {
+		tags, _ := Tags(filter.Tags).Value()
+		query = query.Where("rooms_servers.tags @> ?::jsonb", tags)
+	}
+
+	if filter.After != uuid.Nil {
+		var cursor DiscoverableServer
+		result := db.Model(&RoomsServer{}).
+			Select("rooms_servers.id, rooms_servers.created_at, "+memberCountQuery+" AS member_count").
+			Where("rooms_servers.id = ? AND rooms_servers.is_discoverable", filter.After).
+			Scan(&cursor)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil, gorm.ErrRecordNotFound
+		}
+
+		if filter.Sort == DiscoverySortNew {
+			query = query.Where("(rooms_servers.created_at, rooms_servers.id) < (?, ?)", cursor.CreatedAt, cursor.ID)
+		} else {
+			query = query.Where("("+memberCountQuery+", rooms_servers.id) < (?, ?)", cursor.MemberCount, cursor.ID)
+		}
+	}
+
+	if filter.Sort == DiscoverySortNew {
+		query = query.Order("rooms_servers.created_at DESC, rooms_servers.id DESC")
+	} else {
+		query = query.Order("member_count DESC, rooms_servers.id DESC")
+	}
+
+	limit := filter.Limit
+	if limit <= 0 || limit > discoveryLimit {
+		limit = discoveryLimit
+	}
+
+	var servers []DiscoverableServer
+	result := query.Limit(limit).Scan(&servers)
+	return servers, result.Error
+}
@@ -9,12 +9,41 @@ import (
 
 type Env struct {
 	// TODO delete this
-	MongoUri  string
-	DbName    string
+	MongoUri string
+	DbName   string
 	//
-	Port      string
-	JwtSecret string
+	Port        string
+	JwtSecret   string
 	PostgresUri string
+	// path of a JSON keyring file, when empty JwtSecret is used as the only (HS256) key
+	JwtKeysFile string
+	// target argon2id parameters of password hashes, memory in KiB, defaults are used when empty
+	Argon2Memory      string
+	Argon2Iterations  string
+	Argon2Parallelism string
+	// "true" to answer failed logins with one generic error
+	LoginGenericErrors string
+	// path of a JSON array of OpenID Connect providers
+	OidcProvidersFile string
+	// public URL of the client app, used in links sent by email
+	AppUrl string
+	// mails are sent through SMTP when SmtpHost is set, otherwise written to MailDir
+	SmtpHost     string
+	SmtpPort     string
+	SmtpUsername string
+	SmtpPassword string
+	MailFrom     string
+	MailDir      string
+	// outbound queue of websockets, write timeout in seconds and "disconnect" or "drop" for clients
+	// that fall behind, ping interval and read timeout in seconds, max message size in bytes
+	// and messages per minute, defaults are used when empty
+	WsQueueSize      string
+	WsWriteTimeout   string
+	WsSlowConsumer   string
+	WsPingInterval   string
+	WsReadTimeout    string
+	WsMaxMessageSize string
+	WsRateLimit      string
 }
 
 func GetEnv() *Env {
@@ -25,11 +54,31 @@ func GetEnv() *Env {
 
 	return &Env{
 		// TODO delete this
-		MongoUri:  os.Getenv("MONGO_URI"),
-		DbName:    os.Getenv("DB_NAME"),
+		MongoUri: os.Getenv("MONGO_URI"),
+		DbName:   os.Getenv("DB_NAME"),
 		//
-		Port:      ":" + os.Getenv("PORT"),
-		JwtSecret: os.Getenv("JWT_SECRET"),
-		PostgresUri: os.Getenv("POSTGRES_URI"),
+		Port:               ":" + os.Getenv("PORT"),
+		JwtSecret:          os.Getenv("JWT_SECRET"),
+		JwtKeysFile:        os.Getenv("JWT_KEYS_FILE"),
+		PostgresUri:        os.Getenv("POSTGRES_URI"),
+		Argon2Memory:       os.Getenv("ARGON2_MEMORY"),
+		Argon2Iterations:   os.Getenv("ARGON2_ITERATIONS"),
+		Argon2Parallelism:  os.Getenv("ARGON2_PARALLELISM"),
+		LoginGenericErrors: os.Getenv("LOGIN_GENERIC_ERRORS"),
+		OidcProvidersFile:  os.Getenv("OIDC_PROVIDERS_FILE"),
+		AppUrl:             os.Getenv("APP_URL"),
+		SmtpHost:           os.Getenv("SMTP_HOST"),
+		SmtpPort:           os.Getenv("SMTP_PORT"),
+		SmtpUsername:       os.Getenv("SMTP_USERNAME"),
+		SmtpPassword:       os.Getenv("SMTP_PASSWORD"),
+		MailFrom:           os.Getenv("MAIL_FROM"),
+		MailDir:            os.Getenv("MAIL_DIR"),
+		WsQueueSize:        os.Getenv("WS_QUEUE_SIZE"),
+		WsWriteTimeout:     os.Getenv("WS_WRITE_TIMEOUT"),
+		WsSlowConsumer:     os.Getenv("WS_SLOW_CONSUMER"),
+		WsPingInterval:     os.Getenv("WS_PING_INTERVAL"),
+		WsReadTimeout:      os.Getenv("WS_READ_TIMEOUT"),
+		WsMaxMessageSize:   os.Getenv("WS_MAX_MESSAGE_SIZE"),
+		WsRateLimit:        os.Getenv("WS_RATE_LIMIT"),
 	}
 }
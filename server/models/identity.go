@@ -0,0 +1,85 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Identity links a user to an account at an external OpenID Connect provider,
+// the provider's `sub` claim is stable so it identifies the account, not the email
+type Identity struct {
+	gorm.Model `json:"-"`
+	ID         uuid.UUID `gorm:"primarykey;type:uuid;default:gen_random_uuid()" json:"id"`
+	UserID     uuid.UUID `gorm:"column:user_id;type:uuid;index" json:"userId"`
+	Provider   string    `gorm:"column:provider;uniqueIndex:idx_identities_provider_subject" json:"provider"`
+	Subject    string    `gorm:"column:subject;uniqueIndex:idx_identities_provider_subject" json:"-"`
+	// email reported by the provider when the identity was linked, informative only
+	Email     string    `gorm:"column:email" json:"email"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Relationships
+	User User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+}
+
+func (Identity) TableName() string {
+	return "identities"
+}
+
+func NewIdentity() *Identity {
+	return &Identity{}
+}
+
+func (i *Identity) WithID(id uuid.UUID) *Identity {
+	i.ID = id
+	return i
+}
+
+func (i *Identity) WithUserID(userID uuid.UUID) *Identity {
+	i.UserID = userID
+	return i
+}
+
+func (i *Identity) WithProvider(provider string) *Identity {
+	i.Provider = provider
+	return i
+}
+
+func (i *Identity) WithSubject(subject string) *Identity {
+	i.Subject = subject
+	return i
+}
+
+func (i *Identity) WithEmail(email string) *Identity {
+	i.Email = email
+	return i
+}
+
+func (i *Identity) Create(db *gorm.DB) error {
+	result := db.Create(i)
+	return result.Error
+}
+
+// FindBySubject looks up the identity by provider and subject
+func (i *Identity) FindBySubject(db *gorm.DB) error {
+	result := db.Where("provider = ? AND subject = ?", i.Provider, i.Subject).First(i)
+	return result.Error
+}
+
+// Find looks up the identity by ID, scoped to the user
+func (i *Identity) Find(db *gorm.DB) error {
+	result := db.Where("id = ? AND user_id = ?", i.ID, i.UserID).First(i)
+	return result.Error
+}
+
+func (i *Identity) Delete(db *gorm.DB) error {
+	result := db.Unscoped().Delete(i)
+	return result.Error
+}
+
+func GetUserIdentities(db *gorm.DB, userID uuid.UUID) ([]Identity, error) {
+	var identities []Identity
+	result := db.Where("user_id = ?", userID).Order("created_at ASC").Find(&identities)
+	return identities, result.Error
+}
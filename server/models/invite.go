@@ -0,0 +1,122 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"gorm.io/gorm"
+)
+
+// 6 bytes make an 8 characters code
+const inviteCodeBytes = 6
+
+var ErrInviteInvalid = errors.New("invite is expired, used up or revoked")
+
+// Invite is a short code that lets users join a server, until it expires or runs out of uses
+type Invite struct {
+	gorm.Model `json:"-"`
+	ID         uuid.UUID  `gorm:"primarykey;type:uuid;default:gen_random_uuid()" json:"id"`
+	Code       string     `gorm:"column:code;uniqueIndex" json:"code"`
+	ServerID   uuid.UUID  `gorm:"column:server_id;type:uuid;index" json:"serverId"`
+	CreatorID  uuid.UUID  `gorm:"column:creator_id;type:uuid" json:"creatorId"`
+	ExpiresAt  *time.Time `gorm:"column:expires_at" json:"expiresAt"`       // nil never expires
+	MaxUses    int        `gorm:"column:max_uses;default:0" json:"maxUses"` // 0 is unlimited
+	Uses       int        `gorm:"column:uses;default:0" json:"uses"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	// Relationships
+	Server  RoomsServer `gorm:"foreignKey:ServerID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+	Creator User        `gorm:"foreignKey:CreatorID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+}
+
+func (Invite) TableName() string {
+	return "invites"
+}
+
+func NewInvite() *Invite {
+	return &Invite{}
+}
+
+func (i *Invite) WithCode(code string) *Invite {
+	i.Code = code
+	return i
+}
+
+func (i *Invite) WithServerID(serverID uuid.UUID) *Invite {
+	i.ServerID = serverID
+	return i
+}
+
+func (i *Invite) WithCreatorID(creatorID uuid.UUID) *Invite {
+	i.CreatorID = creatorID
+	return i
+}
+
+// a zero maxAge never expires
+func (i *Invite) WithMaxAge(maxAge time.Duration) *Invite {
+	if maxAge > 0 {
+		expiresAt := time.Now().Add(maxAge)
+		i.ExpiresAt = &expiresAt
+	}
+	return i
+}
+
+func (i *Invite) WithMaxUses(maxUses int) *Invite {
+	i.MaxUses = maxUses
+	return i
+}
+
+// Create generates the code and inserts the invite
+func (i *Invite) Create(db *gorm.DB) error {
+	code, err := core.GenerateRandomToken(inviteCodeBytes)
+	if err != nil {
+		return err
+	}
+	i.Code = code
+
+	result := db.Create(i)
+	return result.Error
+}
+
+func (i *Invite) Find(db *gorm.DB) error {
+	result := db.Where("code = ?", i.Code).First(i)
+	return result.Error
+}
+
+func (i *Invite) Delete(db *gorm.DB) error {
+	result := db.Unscoped().Where("code = ?", i.Code).Delete(&Invite{})
+	return result.Error
+}
+
+func (i *Invite) IsValid() bool {
+	if i.ExpiresAt != nil && time.Now().After(*i.ExpiresAt) {
+		return false
+	}
+	return i.MaxUses == 0 || i.Uses < i.MaxUses
+}
+
+// Use counts a use of the invite, atomically so concurrent joins can't go over the max uses,
+// it fails with ErrInviteInvalid if the invite can't be used anymore
+func (i *Invite) Use(db *gorm.DB) error {
+	result := db.Model(&Invite{}).
+		Where("code = ? AND (max_uses = 0 OR uses < max_uses) AND (expires_at IS NULL OR expires_at > ?)", i.Code, time.Now()).
+		Update("uses", gorm.Expr("uses + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInviteInvalid
+	}
+
+	i.Uses++
+	return nil
+}
+
+// GetServerInvites returns the invites of the server, expired and used up ones included
+func GetServerInvites(db *gorm.DB, serverID uuid.UUID) ([]Invite, error) {
+	var invites []Invite
+	result := db.Where("server_id = ?", serverID).Order("created_at DESC").Find(&invites)
+	return invites, result.Error
+}
@@ -0,0 +1,137 @@
+package models
+
+import (
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"gorm.io/gorm"
+)
+
+// ThrottlePolicy describes how failed logins on a key turn into a lockout
+type ThrottlePolicy struct {
+	// failures allowed before the first lockout
+	FreeAttempts int
+	// lockout after the first extra failure, doubled on every following one up to MaxLockout
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	// failures are forgotten after this long without a new one
+	ResetAfter time.Duration
+}
+
+// an IP is shared by many users (NAT, offices) so it gets more room than a single account
+var (
+	AccountThrottlePolicy = ThrottlePolicy{
+		FreeAttempts: 5,
+		BaseLockout:  30 * time.Second,
+		MaxLockout:   time.Hour,
+		ResetAfter:   24 * time.Hour,
+	}
+	IPThrottlePolicy = ThrottlePolicy{
+		FreeAttempts: 20,
+		BaseLockout:  30 * time.Second,
+		MaxLockout:   time.Hour,
+		ResetAfter:   time.Hour,
+	}
+	// a two-factor challenge token is rejected after its third wrong code, for longer than it lives
+	ChallengeThrottlePolicy = ThrottlePolicy{
+		FreeAttempts: 2,
+		BaseLockout:  core.ChallengeTokenTimeToLive,
+		MaxLockout:   core.ChallengeTokenTimeToLive,
+		ResetAfter:   core.ChallengeTokenTimeToLive,
+	}
+)
+
+// Lockout returns how long the key is locked after the given number of consecutive failures
+func (p ThrottlePolicy) Lockout(failures int) time.Duration {
+	extra := failures - p.FreeAttempts
+	if extra <= 0 {
+		return 0
+	}
+
+	// cap the exponent, the result is clamped to MaxLockout anyway
+	lockout := float64(p.BaseLockout) * math.Pow(2, float64(min(extra-1, 32)))
+	if lockout > float64(p.MaxLockout) {
+		return p.MaxLockout
+	}
+	return time.Duration(lockout)
+}
+
+// LoginThrottle counts the consecutive failed logins of a key (an IP or an account identifier)
+type LoginThrottle struct {
+	gorm.Model    `json:"-"`
+	ID            uuid.UUID  `gorm:"primarykey;type:uuid;default:gen_random_uuid()" json:"id"`
+	Key           string     `gorm:"column:key;uniqueIndex" json:"key"`
+	Failures      int        `gorm:"column:failures" json:"failures"`
+	LastFailureAt time.Time  `gorm:"column:last_failure_at" json:"lastFailureAt"`
+	LockedUntil   *time.Time `gorm:"column:locked_until" json:"lockedUntil"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+}
+
+func (LoginThrottle) TableName() string {
+	return "login_throttles"
+}
+
+func NewLoginThrottle() *LoginThrottle {
+	return &LoginThrottle{}
+}
+
+func (t *LoginThrottle) WithKey(key string) *LoginThrottle {
+	t.Key = key
+	return t
+}
+
+// LockedFor returns the remaining lockout of the key, zero if it isn't locked
+func (t *LoginThrottle) LockedFor(db *gorm.DB) (time.Duration, error) {
+	if err := db.Where("key = ?", t.Key).First(t).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	if t.LockedUntil == nil {
+		return 0, nil
+	}
+	return max(time.Until(*t.LockedUntil), 0), nil
+}
+
+// RecordFailure counts a failed login and locks the key according to the policy,
+// the counter is incremented in a single upsert so concurrent failures are all counted
+func (t *LoginThrottle) RecordFailure(db *gorm.DB, policy ThrottlePolicy) error {
+	now := time.Now()
+	err := db.Raw(`
+		INSERT INTO login_throttles (key, failures, last_failure_at, created_at, updated_at)
+		VALUES (?, 1, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_throttles.last_failure_at < ? THEN 1 ELSE login_throttles.failures + 1 END,
+			locked_until = CASE WHEN login_throttles.last_failure_at < ? THEN NULL ELSE login_throttles.locked_until END,
+			last_failure_at = EXCLUDED.last_failure_at,
+			updated_at = EXCLUDED.updated_at
+		RETURNING *`,
+		t.Key, now, now, now, now.Add(-policy.ResetAfter), now.Add(-policy.ResetAfter),
+	).Scan(t).Error
+	if err != nil {
+		return err
+	}
+
+	lockout := policy.Lockout(t.Failures)
+	if lockout == 0 {
+		return nil
+	}
+
+	lockedUntil := now.Add(lockout)
+	t.LockedUntil = &lockedUntil
+	result := db.Model(&LoginThrottle{}).
+		Where("key = ?", t.Key).
+		Update("locked_until", lockedUntil)
+	return result.Error
+}
+
+// Reset forgets the failures of the key, after a successful login
+func (t *LoginThrottle) Reset(db *gorm.DB) error {
+	result := db.Unscoped().Where("key = ?", t.Key).Delete(&LoginThrottle{})
+	return result.Error
+}
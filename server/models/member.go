@@ -0,0 +1,101 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const membersLimit = 100
+
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+// Member is a user as seen in the member list of a server
+type Member struct {
+	User         User        `json:"user"`
+	Nickname     string      `json:"nickname"`
+	RoleIDs      []uuid.UUID `json:"roleIds"`
+	TimeoutUntil *time.Time  `json:"timeoutUntil"`
+	Presence     string      `json:"presence"` // online or offline, only known to the handlers
+}
+
+// MemberFilter narrows GetServerMembers, zero fields match everything,
+// After is the user ID of the last member of the previous page
+type MemberFilter struct {
+	Query  string // matches the username or the nickname
+	RoleID uuid.UUID
+	After  uuid.UUID
+	Limit  int
+}
+
+// GetServerMembers returns the members of the server ordered by username
+func GetServerMembers(db *gorm.DB, serverID uuid.UUID, filter MemberFilter) ([]Member, error) {
+	query := db.Model(&ServerUserStatus{}).
+		Select("server_user_status.*").
+		Joins("JOIN users ON users.id = server_user_status.user_id").
+		Where("server_user_status.server_id = ?", serverID)
+
+	if filter.Query != "" {
+		// the query is matched literally
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(filter.Query) + "%"
+		query = query.Where("(users.username ILIKE ? OR server_user_status.nickname ILIKE ?)", pattern, pattern)
+	}
+	if filter.RoleID != uuid.Nil {
+		query = query.Where("server_user_status.user_id IN (?)",
+			db.Model(&MemberRole{}).Select("user_id").Where("role_id = ? AND server_id = ?", filter.RoleID, serverID))
+	}
+	if filter.After != uuid.Nil {
+		cursor := NewUser().WithID(filter.After)
+		if err := cursor.FindByID(db); err != nil {
+			return nil, err
+		}
+		query = query.Where("users.username > ?", cursor.Username)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 || limit > membersLimit {
+		limit = membersLimit
+	}
+
+	var statuses []ServerUserStatus
+	result := query.Preload("User").Order("users.username ASC").Limit(limit).Find(&statuses)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	userIDs := make([]uuid.UUID, len(statuses))
+	for i, status := range statuses {
+		userIDs[i] = status.UserID
+	}
+
+	var memberRoles []MemberRole
+	if len(userIDs) > 0 {
+		if err := db.Where("server_id = ? AND user_id IN ?", serverID, userIDs).Find(&memberRoles).Error; err != nil {
+			return nil, err
+		}
+	}
+	roles := make(map[uuid.UUID][]uuid.UUID)
+	for _, memberRole := range memberRoles {
+		roles[memberRole.UserID] = append(roles[memberRole.UserID], memberRole.RoleID)
+	}
+
+	members := make([]Member, len(statuses))
+	for i, status := range statuses {
+		members[i] = Member{
+			User:         status.User,
+			Nickname:     status.Nickname,
+			RoleIDs:      roles[status.UserID],
+			TimeoutUntil: status.TimeoutUntil,
+			Presence:     PresenceOffline,
+		}
+		if members[i].RoleIDs == nil {
+			members[i].RoleIDs = []uuid.UUID{}
+		}
+	}
+	return members, nil
+}
@@ -0,0 +1,212 @@
+package models
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Permission is a bitset of what a member can do in a server
+type Permission int64
+
+const (
+	PermissionViewRooms Permission = 1 << iota
+	PermissionSendMessages
+	PermissionManageMessages
+	PermissionManageRooms
+	PermissionManageRoles
+	PermissionManageServer
+	PermissionCreateInvites
+	PermissionKickMembers
+	PermissionBanMembers
+	PermissionTimeoutMembers
+	PermissionViewAuditLog
+	// grants every permission
+	PermissionAdministrator
+)
+
+const PermissionAll = PermissionAdministrator<<1 - 1
+
+// permissions room and category overwrites can set, an allowed Administrator would bypass every overwrite
+const PermissionOverwritable = PermissionAll &^ PermissionAdministrator
+
+// permissions of @everyone in new servers, and in servers created before roles existed
+const DefaultEveryonePermissions = PermissionViewRooms | PermissionSendMessages | PermissionCreateInvites
+
+// timed out members can only read
+const timedOutPermissions = PermissionViewRooms
+
+var ErrNotMember = errors.New("user is not a member of the server")
+
+// Has reports whether all the bits of perm are set, administrators have every permission
+func (p Permission) Has(perm Permission) bool {
+	return p&PermissionAdministrator != 0 || p&perm == perm
+}
+
+// MemberPermissions is what a member can do server-wide, with what is needed to apply room overwrites
+type MemberPermissions struct {
+	UserID         uuid.UUID
+	Base           Permission
+	EveryoneRoleID uuid.UUID
+	RoleIDs        []uuid.UUID
+	TimedOut       bool
+}
+
+// LoadMemberPermissions is the single source of truth for what a user can do in a server:
+// the owner has every permission, members have the union of @everyone and their roles,
+// it fails with ErrNotMember for users outside the server
+func LoadMemberPermissions(db *gorm.DB, server *RoomsServer, userID uuid.UUID) (*MemberPermissions, error) {
+	m := &MemberPermissions{UserID: userID}
+	if server.OwnerID == userID {
+		m.Base = PermissionAll
+		return m, nil
+	}
+
+	status := NewServerUserStatus().WithUserID(userID).WithServerID(server.ID)
+	if err := status.Find(db); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrNotMember
+		}
+		return nil, err
+	}
+	m.TimedOut = status.IsTimedOut()
+
+	var roles []Role
+	result := db.Model(&Role{}).
+		Select("id", "permissions", "is_default").
+		Where("server_id = ? AND (is_default OR id IN (?))", server.ID,
+			db.Model(&MemberRole{}).Select("role_id").Where("user_id = ? AND server_id = ?", userID, server.ID)).
+		Find(&roles)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	// the server's own @everyone replaces the fallback
+	m.Base = DefaultEveryonePermissions
+	for _, role := range roles {
+		if role.IsDefault {
+			m.Base = 0
+			m.EveryoneRoleID = role.ID
+		}
+	}
+	for _, role := range roles {
+		m.Base |= role.Permissions
+		if !role.IsDefault {
+			m.RoleIDs = append(m.RoleIDs, role.ID)
+		}
+	}
+
+	if m.Base.Has(PermissionAdministrator) {
+		m.Base = PermissionAll
+	} else if m.TimedOut {
+		m.Base &= timedOutPermissions
+	}
+	return m, nil
+}
+
+// InRoom applies the overwrites of a room's category then of the room itself, in each @everyone first,
+// then the member's roles together, then the member's own overwrite, administrators ignore overwrites
+func (m *MemberPermissions) InRoom(layers ...[]PermissionOverwrite) Permission {
+	permissions := m.Base
+	if permissions.Has(PermissionAdministrator) {
+		return permissions
+	}
+
+	for _, overwrites := range layers {
+		permissions = m.applyOverwrites(permissions, overwrites)
+	}
+	// overwrites saved before Administrator was rejected
+	permissions &= PermissionOverwritable
+	if m.TimedOut {
+		permissions &= timedOutPermissions
+	}
+	return permissions
+}
+
+func (m *MemberPermissions) applyOverwrites(permissions Permission, overwrites []PermissionOverwrite) Permission {
+	var roleAllow, roleDeny Permission
+	var member *PermissionOverwrite
+	for i, o := range overwrites {
+		switch {
+		case o.TargetType == OverwriteTargetRole && o.TargetID == m.EveryoneRoleID:
+			permissions = permissions&^o.Deny | o.Allow
+		case o.TargetType == OverwriteTargetRole && slices.Contains(m.RoleIDs, o.TargetID):
+			roleAllow |= o.Allow
+			roleDeny |= o.Deny
+		case o.TargetType == OverwriteTargetMember && o.TargetID == m.UserID:
+			member = &overwrites[i]
+		}
+	}
+
+	permissions = permissions&^roleDeny | roleAllow
+	if member != nil {
+		permissions = permissions&^member.Deny | member.Allow
+	}
+	return permissions
+}
+
+// ResolvePermissions returns the server-wide permissions of the user
+func ResolvePermissions(db *gorm.DB, server *RoomsServer, userID uuid.UUID) (Permission, error) {
+	m, err := LoadMemberPermissions(db, server, userID)
+	if err != nil {
+		return 0, err
+	}
+	return m.Base, nil
+}
+
+// ResolveRoomPermissions returns the permissions of the user in the room, after its overwrites
+func ResolveRoomPermissions(db *gorm.DB, server *RoomsServer, room *Room, userID uuid.UUID) (Permission, error) {
+	m, err := LoadMemberPermissions(db, server, userID)
+	if err != nil {
+		return 0, err
+	}
+	if m.Base.Has(PermissionAdministrator) {
+		return m.Base, nil
+	}
+
+	var categoryOverwrites []PermissionOverwrite
+	if room.CategoryID != nil {
+		if categoryOverwrites, err = GetCategoryOverwrites(db, *room.CategoryID); err != nil {
+			return 0, err
+		}
+	}
+
+	overwrites, err := GetRoomOverwrites(db, room.ID)
+	if err != nil {
+		return 0, err
+	}
+	return m.InRoom(categoryOverwrites, overwrites), nil
+}
+
+// ResolveCategoryPermissions returns the permissions of the user in the category, after its overwrites
+func ResolveCategoryPermissions(db *gorm.DB, server *RoomsServer, category *RoomCategory, userID uuid.UUID) (Permission, error) {
+	m, err := LoadMemberPermissions(db, server, userID)
+	if err != nil {
+		return 0, err
+	}
+	if m.Base.Has(PermissionAdministrator) {
+		return m.Base, nil
+	}
+
+	overwrites, err := GetCategoryOverwrites(db, category.ID)
+	if err != nil {
+		return 0, err
+	}
+	return m.InRoom(overwrites), nil
+}
+
+// TopRolePosition returns the highest position of the member's roles, members only manage roles below it
+func TopRolePosition(db *gorm.DB, server *RoomsServer, userID uuid.UUID) (int, error) {
+	var position *int
+	result := db.Model(&Role{}).
+		Select("MAX(roles.position)").
+		Joins("JOIN member_roles ON member_roles.role_id = roles.id").
+		Where("member_roles.user_id = ? AND roles.server_id = ?", userID, server.ID).
+		Scan(&position)
+	if result.Error != nil || position == nil {
+		return 0, result.Error
+	}
+	return *position, nil
+}
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	OverwriteTargetRole   = "role"
+	OverwriteTargetMember = "member"
+)
+
+// PermissionOverwrite allows or denies permissions in a single room or in every room of a category,
+// for a role or a member, exactly one of RoomID and CategoryID is set
+type PermissionOverwrite struct {
+	gorm.Model `json:"-"`
+	ID         uuid.UUID  `gorm:"primarykey;type:uuid;default:gen_random_uuid()" json:"id"`
+	RoomID     *uuid.UUID `gorm:"column:room_id;type:uuid;uniqueIndex:idx_overwrite_target" json:"roomId"`
+	CategoryID *uuid.UUID `gorm:"column:category_id;type:uuid;uniqueIndex:idx_category_overwrite_target" json:"categoryId"`
+	ServerID   uuid.UUID  `gorm:"column:server_id;type:uuid;index" json:"serverId"`
+	TargetType string     `gorm:"column:target_type;uniqueIndex:idx_overwrite_target;uniqueIndex:idx_category_overwrite_target" json:"targetType"` // role or member
+	TargetID   uuid.UUID  `gorm:"column:target_id;type:uuid;uniqueIndex:idx_overwrite_target;uniqueIndex:idx_category_overwrite_target" json:"targetId"`
+	Allow      Permission `gorm:"column:allow;default:0" json:"allow"`
+	Deny       Permission `gorm:"column:deny;default:0" json:"deny"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	// Relationships
+	Room     *Room         `gorm:"foreignKey:RoomID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+	Category *RoomCategory `gorm:"foreignKey:CategoryID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+}
+
+func (PermissionOverwrite) TableName() string {
+	return "permission_overwrites"
+}
+
+func NewPermissionOverwrite() *PermissionOverwrite {
+	return &PermissionOverwrite{}
+}
+
+func (o *PermissionOverwrite) WithRoomID(roomID uuid.UUID) *PermissionOverwrite {
+	o.RoomID = &roomID
+	return o
+}
+
+func (o *PermissionOverwrite) WithCategoryID(categoryID uuid.UUID) *PermissionOverwrite {
+	o.CategoryID = &categoryID
+	return o
+}
+
+func (o *PermissionOverwrite) WithServerID(serverID uuid.UUID) *PermissionOverwrite {
+	o.ServerID = serverID
+	return o
+}
+
+func (o *PermissionOverwrite) WithTarget(targetType string, targetID uuid.UUID) *PermissionOverwrite {
+	o.TargetType = targetType
+	o.TargetID = targetID
+	return o
+}
+
+func (o *PermissionOverwrite) WithAllow(allow Permission) *PermissionOverwrite {
+	o.Allow = allow
+	return o
+}
+
+func (o *PermissionOverwrite) WithDeny(deny Permission) *PermissionOverwrite {
+	o.Deny = deny
+	return o
+}
+
+// Upsert creates the overwrite of the target in the room or replaces its allow and deny
+func (o *PermissionOverwrite) Upsert(db *gorm.DB) error {
+	existing := &PermissionOverwrite{RoomID: o.RoomID, CategoryID: o.CategoryID}
+	existing.WithTarget(o.TargetType, o.TargetID)
+	if err := existing.Find(db); err != nil {
+		if err != gorm.ErrRecordNotFound {
+			return err
+		}
+		return db.Create(o).Error
+	}
+
+	existing.Allow, existing.Deny = o.Allow, o.Deny
+	*o = *existing
+	return db.Save(o).Error
+}
+
+// whereTarget scopes the query to the room or category and the target of the overwrite
+func (o *PermissionOverwrite) whereTarget(db *gorm.DB) *gorm.DB {
+	if o.CategoryID != nil {
+		db = db.Where("category_id = ?", *o.CategoryID)
+	} else {
+		db = db.Where("room_id = ?", o.RoomID)
+	}
+	return db.Where("target_type = ? AND target_id = ?", o.TargetType, o.TargetID)
+}
+
+// Find looks up the overwrite by room or category and target
+func (o *PermissionOverwrite) Find(db *gorm.DB) error {
+	result := o.whereTarget(db).First(o)
+	return result.Error
+}
+
+// use room or category and target to delete the overwrite
+func (o *PermissionOverwrite) Delete(db *gorm.DB) error {
+	result := o.whereTarget(db.Unscoped()).Delete(&PermissionOverwrite{})
+	return result.Error
+}
+
+func GetRoomOverwrites(db *gorm.DB, roomID uuid.UUID) ([]PermissionOverwrite, error) {
+	var overwrites []PermissionOverwrite
+	result := db.Where("room_id = ?", roomID).Find(&overwrites)
+	return overwrites, result.Error
+}
+
+func GetCategoryOverwrites(db *gorm.DB, categoryID uuid.UUID) ([]PermissionOverwrite, error) {
+	var overwrites []PermissionOverwrite
+	result := db.Where("category_id = ?", categoryID).Find(&overwrites)
+	return overwrites, result.Error
+}
+
+// GetServerOverwrites returns the overwrites of every room and category in the server,
+// grouped by the room or category ID
+func GetServerOverwrites(db *gorm.DB, serverID uuid.UUID) (map[uuid.UUID][]PermissionOverwrite, error) {
+	var overwrites []PermissionOverwrite
+	if err := db.Where("server_id = ?", serverID).Find(&overwrites).Error; err != nil {
+		return nil, err
+	}
+
+	byScope := make(map[uuid.UUID][]PermissionOverwrite)
+	for _, o := range overwrites {
+		scope := o.RoomID
+		if o.CategoryID != nil {
+			scope = o.CategoryID
+		}
+		byScope[*scope] = append(byScope[*scope], o)
+	}
+	return byScope, nil
+}
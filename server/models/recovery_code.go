@@ -0,0 +1,89 @@
+package models
+
+import (
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"gorm.io/gorm"
+)
+
+const recoveryCodesCount = 10
+
+var ErrRecoveryCodeInvalid = errors.New("recovery code is invalid or already used")
+
+// RecoveryCode is a one-time code that replaces a TOTP code when the authenticator is lost,
+// only its hash is stored
+type RecoveryCode struct {
+	gorm.Model `json:"-"`
+	ID         uuid.UUID  `gorm:"primarykey;type:uuid;default:gen_random_uuid()" json:"id"`
+	UserID     uuid.UUID  `gorm:"column:user_id;type:uuid;index" json:"userId"`
+	HashedCode string     `gorm:"column:hashed_code;index" json:"-"`
+	UsedAt     *time.Time `gorm:"column:used_at" json:"usedAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	// Relationships
+	User User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+}
+
+func (RecoveryCode) TableName() string {
+	return "recovery_codes"
+}
+
+// codes are shown as xxxx-xxxx-xxxx-xxxx and compared case-insensitively without the dash
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// GenerateRecoveryCodes replaces the recovery codes of a user and returns the raw codes
+func GenerateRecoveryCodes(db *gorm.DB, userID uuid.UUID) ([]string, error) {
+	codes := make([]string, recoveryCodesCount)
+	rows := make([]RecoveryCode, recoveryCodesCount)
+
+	for i := range codes {
+		bytes, err := core.GenerateRandomBytes(10)
+		if err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(base32.StdEncoding.EncodeToString(bytes))
+		codes[i] = raw[:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:]
+		rows[i] = RecoveryCode{
+			UserID:     userID,
+			HashedCode: core.HashToken(normalizeRecoveryCode(codes[i])),
+		}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := DeleteRecoveryCodes(tx, userID); err != nil {
+			return err
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// ConsumeRecoveryCode marks an unused code of the user as used
+func ConsumeRecoveryCode(db *gorm.DB, userID uuid.UUID, code string) error {
+	result := db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND hashed_code = ? AND used_at IS NULL", userID, core.HashToken(normalizeRecoveryCode(code))).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRecoveryCodeInvalid
+	}
+	return nil
+}
+
+func DeleteRecoveryCodes(db *gorm.DB, userID uuid.UUID) error {
+	result := db.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{})
+	return result.Error
+}
@@ -0,0 +1,142 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	// returned when an already rotated token is presented again, the whole family gets revoked
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+)
+
+// RefreshToken is an opaque, rotating token used to renew short-lived access tokens.
+// Every rotation creates a new token in the same family, only the hash of the token is stored.
+// The family ID is the ID of the Session the token belongs to.
+type RefreshToken struct {
+	gorm.Model   `json:"-"`
+	ID           uuid.UUID  `gorm:"primarykey;type:uuid;default:gen_random_uuid()" json:"id"`
+	UserID       uuid.UUID  `gorm:"column:user_id;type:uuid;index" json:"userId"`
+	FamilyID     uuid.UUID  `gorm:"column:family_id;type:uuid;index" json:"familyId"`
+	HashedToken  string     `gorm:"column:hashed_token;uniqueIndex" json:"-"`
+	ExpiresAt    time.Time  `gorm:"column:expires_at" json:"expiresAt"`
+	RevokedAt    *time.Time `gorm:"column:revoked_at" json:"revokedAt"`
+	ReplacedByID *uuid.UUID `gorm:"column:replaced_by_id;type:uuid" json:"-"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	UpdatedAt    time.Time  `json:"updatedAt"`
+	// Relationships
+	User User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+}
+
+func (RefreshToken) TableName() string {
+	return "refresh_tokens"
+}
+
+func NewRefreshToken() *RefreshToken {
+	return &RefreshToken{}
+}
+
+func (rt *RefreshToken) WithUserID(userID uuid.UUID) *RefreshToken {
+	rt.UserID = userID
+	return rt
+}
+
+func (rt *RefreshToken) WithFamilyID(familyID uuid.UUID) *RefreshToken {
+	rt.FamilyID = familyID
+	return rt
+}
+
+// Generate creates the raw token, stores its hash in the struct and returns the raw token,
+// the raw token is never persisted. A new family is started if none was set.
+func (rt *RefreshToken) Generate() (string, error) {
+	raw, err := core.GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	if rt.FamilyID == uuid.Nil {
+		rt.FamilyID = uuid.New()
+	}
+	rt.HashedToken = core.HashToken(raw)
+	rt.ExpiresAt = time.Now().Add(core.RefreshTokenTimeToLive)
+	return raw, nil
+}
+
+func (rt *RefreshToken) Create(db *gorm.DB) error {
+	result := db.Create(rt)
+	return result.Error
+}
+
+// FindByToken looks up a token by the hash of the raw token
+func (rt *RefreshToken) FindByToken(db *gorm.DB, raw string) error {
+	result := db.Where("hashed_token = ?", core.HashToken(raw)).First(rt)
+	return result.Error
+}
+
+func (rt *RefreshToken) Expired() bool {
+	return time.Now().After(rt.ExpiresAt)
+}
+
+// RevokeFamily revokes every token that was issued from the same login
+func (rt *RefreshToken) RevokeFamily(db *gorm.DB) error {
+	result := db.Model(&RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", rt.FamilyID).
+		Update("revoked_at", time.Now())
+	return result.Error
+}
+
+// Rotate revokes this token and issues its successor in the same family, it returns the new raw token.
+// Presenting a token that was already rotated or revoked is treated as theft and revokes the whole family.
+func (rt *RefreshToken) Rotate(db *gorm.DB) (*RefreshToken, string, error) {
+	if rt.RevokedAt != nil || rt.ReplacedByID != nil {
+		if err := rt.RevokeFamily(db); err != nil {
+			return nil, "", err
+		}
+		return nil, "", ErrRefreshTokenReused
+	}
+
+	if rt.Expired() {
+		return nil, "", ErrRefreshTokenInvalid
+	}
+
+	next := NewRefreshToken().WithUserID(rt.UserID).WithFamilyID(rt.FamilyID)
+	raw, err := next.Generate()
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := next.Create(tx); err != nil {
+			return err
+		}
+
+		// the condition on revoked_at guards against two concurrent refreshes of the same token
+		result := tx.Model(&RefreshToken{}).
+			Where("id = ? AND revoked_at IS NULL", rt.ID).
+			Updates(map[string]any{"revoked_at": time.Now(), "replaced_by_id": next.ID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrRefreshTokenReused
+		}
+		return nil
+	})
+
+	if err == ErrRefreshTokenReused {
+		if err := rt.RevokeFamily(db); err != nil {
+			return nil, "", err
+		}
+		return nil, "", ErrRefreshTokenReused
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return next, raw, nil
+}
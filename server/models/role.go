@@ -0,0 +1,189 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const EveryoneRoleName = "@everyone"
+
+// Role is a named set of permissions in a server, roles with a higher position outrank lower ones,
+// every server has one default role (@everyone, position 0) that applies to all members
+type Role struct {
+	gorm.Model  `json:"-"`
+	ID          uuid.UUID  `gorm:"primarykey;type:uuid;default:gen_random_uuid()" json:"id"`
+	ServerID    uuid.UUID  `gorm:"column:server_id;type:uuid;index" json:"serverId"`
+	Name        string     `gorm:"column:name" json:"name"`
+	Color       int        `gorm:"column:color;default:0" json:"color"`
+	Position    int        `gorm:"column:position;default:0" json:"position"`
+	Permissions Permission `gorm:"column:permissions;default:0" json:"permissions"`
+	IsDefault   bool       `gorm:"column:is_default;default:false" json:"isDefault"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	// Relationships
+	Server RoomsServer `gorm:"foreignKey:ServerID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+}
+
+func (Role) TableName() string {
+	return "roles"
+}
+
+func NewRole() *Role {
+	return &Role{}
+}
+
+// NewEveryoneRole returns the default role of a new server
+func NewEveryoneRole(serverID uuid.UUID) *Role {
+	return &Role{
+		ServerID:    serverID,
+		Name:        EveryoneRoleName,
+		Permissions: DefaultEveryonePermissions,
+		IsDefault:   true,
+	}
+}
+
+func (r *Role) WithID(id uuid.UUID) *Role {
+	r.ID = id
+	return r
+}
+
+func (r *Role) WithServerID(serverID uuid.UUID) *Role {
+	r.ServerID = serverID
+	return r
+}
+
+func (r *Role) WithName(name string) *Role {
+	r.Name = name
+	return r
+}
+
+func (r *Role) WithColor(color int) *Role {
+	r.Color = color
+	return r
+}
+
+func (r *Role) WithPermissions(permissions Permission) *Role {
+	r.Permissions = permissions
+	return r
+}
+
+// Create inserts the role right above @everyone, moving the other roles up
+func (r *Role) Create(db *gorm.DB) error {
+	if r.IsDefault {
+		return db.Create(r).Error
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Role{}).
+			Where("server_id = ? AND NOT is_default", r.ServerID).
+			Update("position", gorm.Expr("position + 1"))
+		if result.Error != nil {
+			return result.Error
+		}
+
+		r.Position = 1
+		return tx.Create(r).Error
+	})
+}
+
+// Move changes the position of the role, the roles in between shift to keep positions unique
+func (r *Role) Move(db *gorm.DB, position int) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		query := tx.Model(&Role{}).Where("server_id = ? AND NOT is_default AND id <> ?", r.ServerID, r.ID)
+		var result *gorm.DB
+		if position > r.Position {
+			result = query.Where("position > ? AND position <= ?", r.Position, position).Update("position", gorm.Expr("position - 1"))
+		} else {
+			result = query.Where("position >= ? AND position < ?", position, r.Position).Update("position", gorm.Expr("position + 1"))
+		}
+		if result.Error != nil {
+			return result.Error
+		}
+
+		r.Position = position
+		return tx.Model(&Role{}).Where("id = ?", r.ID).Update("position", position).Error
+	})
+}
+
+// Find looks up the role by ID, scoped to the server
+func (r *Role) Find(db *gorm.DB) error {
+	result := db.Where("id = ? AND server_id = ?", r.ID, r.ServerID).First(r)
+	return result.Error
+}
+
+func (r *Role) Update(db *gorm.DB) error {
+	result := db.Save(r)
+	return result.Error
+}
+
+func (r *Role) Delete(db *gorm.DB) error {
+	result := db.Unscoped().Delete(r)
+	return result.Error
+}
+
+// GetServerRoles returns the roles of the server, highest first
+func GetServerRoles(db *gorm.DB, serverID uuid.UUID) ([]Role, error) {
+	var roles []Role
+	result := db.Where("server_id = ?", serverID).Order("position DESC").Find(&roles)
+	return roles, result.Error
+}
+
+// MemberRole assigns a role to a member of the role's server
+type MemberRole struct {
+	gorm.Model `json:"-"`
+	UserID     uuid.UUID `gorm:"primaryKey;column:user_id;type:uuid;index" json:"userId"`
+	RoleID     uuid.UUID `gorm:"primaryKey;column:role_id;type:uuid;index" json:"roleId"`
+	ServerID   uuid.UUID `gorm:"column:server_id;type:uuid;index" json:"serverId"`
+	// Relationships
+	User User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+	Role Role `gorm:"foreignKey:RoleID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+}
+
+func (MemberRole) TableName() string {
+	return "member_roles"
+}
+
+func NewMemberRole() *MemberRole {
+	return &MemberRole{}
+}
+
+func (m *MemberRole) WithUserID(userID uuid.UUID) *MemberRole {
+	m.UserID = userID
+	return m
+}
+
+func (m *MemberRole) WithRoleID(roleID uuid.UUID) *MemberRole {
+	m.RoleID = roleID
+	return m
+}
+
+func (m *MemberRole) WithServerID(serverID uuid.UUID) *MemberRole {
+	m.ServerID = serverID
+	return m
+}
+
+// Create assigns the role, assigning it twice is a no-op
+func (m *MemberRole) Create(db *gorm.DB) error {
+	result := db.Where("user_id = ? AND role_id = ?", m.UserID, m.RoleID).FirstOrCreate(m)
+	return result.Error
+}
+
+func (m *MemberRole) Delete(db *gorm.DB) error {
+	result := db.Unscoped().Where("user_id = ? AND role_id = ?", m.UserID, m.RoleID).Delete(&MemberRole{})
+	return result.Error
+}
+
+// DeleteMemberRoles removes all the roles of a member, when they leave the server
+func DeleteMemberRoles(db *gorm.DB, serverID, userID uuid.UUID) error {
+	result := db.Unscoped().Where("server_id = ? AND user_id = ?", serverID, userID).Delete(&MemberRole{})
+	return result.Error
+}
+
+// GetMemberRoleIDs returns the IDs of the roles assigned to a member
+func GetMemberRoleIDs(db *gorm.DB, serverID, userID uuid.UUID) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	result := db.Model(&MemberRole{}).Where("server_id = ? AND user_id = ?", serverID, userID).Pluck("role_id", &ids)
+	return ids, result.Error
+}
@@ -15,13 +15,16 @@ type Room struct {
 	ID         uuid.UUID `gorm:"primarykey;type:uuid;default:gen_random_uuid()" json:"id"`
 	ServerID   uuid.UUID `gorm:"column:server_id;type:uuid;index" json:"serverId"`
 	Name       string    `gorm:"column:name" json:"name"`
-	GroupName  string    `gorm:"column:group_name" json:"groupName"`
-	Type       string    `gorm:"column:type" json:"type"` // direct, server room, server voice room, or users group
-	CreatedAt  time.Time `json:"createdAt"`
-	UpdatedAt  time.Time `json:"updatedAt"`
+	// rooms without a category are listed before the categories
+	CategoryID *uuid.UUID `gorm:"column:category_id;type:uuid;index" json:"categoryId"`
+	Position   int        `gorm:"column:position;default:0" json:"position"` // order in the category
+	Type       string     `gorm:"column:type" json:"type"`                   // direct, server room, server voice room, or users group
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
 	// Relationships
-	Server   RoomsServer `gorm:"foreignKey:ServerID;references:ID;constraint:OnDelete:CASCADE;" json:"server"`
-	Messages []Message   `gorm:"foreignKey:RoomID;references:ID;constraint:OnDelete:CASCADE;" json:"messages"`
+	Server   RoomsServer   `gorm:"foreignKey:ServerID;references:ID;constraint:OnDelete:CASCADE;" json:"server"`
+	Category *RoomCategory `gorm:"foreignKey:CategoryID;references:ID;constraint:OnDelete:SET NULL;" json:"-"`
+	Messages []Message     `gorm:"foreignKey:RoomID;references:ID;constraint:OnDelete:CASCADE;" json:"messages"`
 }
 
 type RoomWithStatus struct {
@@ -52,8 +55,8 @@ func (r *Room) WithName(name string) *Room {
 	return r
 }
 
-func (r *Room) WithGroupName(groupName string) *Room {
-	r.GroupName = groupName
+func (r *Room) WithCategoryID(categoryID *uuid.UUID) *Room {
+	r.CategoryID = categoryID
 	return r
 }
 
@@ -97,9 +100,65 @@ func (r *Room) GetMessages(db *gorm.DB, limit ...int) ([]Message, error) {
 	return messages, result.Error
 }
 
+// Create places the room after the last one of its category
 func (r *Room) Create(db *gorm.DB) error {
-	result := db.Create(r)
-	return result.Error
+	return db.Transaction(func(tx *gorm.DB) error {
+		query := tx.Model(&Room{}).Select("MAX(position)").Where("server_id = ?", r.ServerID)
+		if r.CategoryID != nil {
+			query = query.Where("category_id = ?", *r.CategoryID)
+		} else {
+			query = query.Where("category_id IS NULL")
+		}
+
+		var position *int
+		if err := query.Scan(&position).Error; err != nil {
+			return err
+		}
+		if position != nil {
+			r.Position = *position + 1
+		}
+		return tx.Create(r).Error
+	})
+}
+
+// siblings are the other rooms of the category, or the uncategorized ones
+func (r *Room) siblings(tx *gorm.DB, categoryID *uuid.UUID) *gorm.DB {
+	query := tx.Model(&Room{}).Where("server_id = ? AND id <> ?", r.ServerID, r.ID)
+	if categoryID != nil {
+		return query.Where("category_id = ?", *categoryID)
+	}
+	return query.Where("category_id IS NULL")
+}
+
+// Move places the room at the position of the category, shifting the rooms it leaves and the ones after it,
+// without a position it goes after the last room of the category
+func (r *Room) Move(db *gorm.DB, categoryID *uuid.UUID, position *int) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := r.siblings(tx, r.CategoryID).Where("position > ?", r.Position).Update("position", gorm.Expr("position - 1")).Error; err != nil {
+			return err
+		}
+
+		if position == nil {
+			var last *int
+			if err := r.siblings(tx, categoryID).Select("MAX(position)").Scan(&last).Error; err != nil {
+				return err
+			}
+			next := 0
+			if last != nil {
+				next = *last + 1
+			}
+			position = &next
+		} else if err := r.siblings(tx, categoryID).Where("position >= ?", *position).Update("position", gorm.Expr("position + 1")).Error; err != nil {
+			return err
+		}
+
+		r.CategoryID = categoryID
+		r.Position = *position
+		return tx.Model(&Room{}).Where("id = ?", r.ID).Updates(map[string]any{
+			"category_id": categoryID,
+			"position":    *position,
+		}).Error
+	})
 }
 
 func (r *Room) Delete(db *gorm.DB) error {
@@ -0,0 +1,166 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// RoomCategory groups the rooms of a server, its overwrites apply to every room in it
+type RoomCategory struct {
+	gorm.Model `json:"-"`
+	ID         uuid.UUID `gorm:"primarykey;type:uuid;default:gen_random_uuid()" json:"id"`
+	ServerID   uuid.UUID `gorm:"column:server_id;type:uuid;index" json:"serverId"`
+	Name       string    `gorm:"column:name" json:"name"`
+	Position   int       `gorm:"column:position;default:0" json:"position"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	// Relationships
+	Server RoomsServer `gorm:"foreignKey:ServerID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+}
+
+func (RoomCategory) TableName() string {
+	return "room_categories"
+}
+
+func NewRoomCategory() *RoomCategory {
+	return &RoomCategory{}
+}
+
+func (c *RoomCategory) WithID(id uuid.UUID) *RoomCategory {
+	c.ID = id
+	return c
+}
+
+func (c *RoomCategory) WithServerID(serverID uuid.UUID) *RoomCategory {
+	c.ServerID = serverID
+	return c
+}
+
+func (c *RoomCategory) WithName(name string) *RoomCategory {
+	c.Name = name
+	return c
+}
+
+// Create places the category after the last one of the server
+func (c *RoomCategory) Create(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var position *int
+		if err := tx.Model(&RoomCategory{}).Select("MAX(position)").Where("server_id = ?", c.ServerID).Scan(&position).Error; err != nil {
+			return err
+		}
+		if position != nil {
+			c.Position = *position + 1
+		}
+		return tx.Create(c).Error
+	})
+}
+
+// Find by ID and server ID
+func (c *RoomCategory) Find(db *gorm.DB) error {
+	result := db.Where("id = ? AND server_id = ?", c.ID, c.ServerID).First(c)
+	return result.Error
+}
+
+func (c *RoomCategory) Update(db *gorm.DB) error {
+	result := db.Save(c)
+	return result.Error
+}
+
+// Delete deletes the category, its rooms are left without a category
+func (c *RoomCategory) Delete(db *gorm.DB) error {
+	result := db.Unscoped().Delete(c)
+	return result.Error
+}
+
+// GetServerCategories returns the categories of a server in order
+func GetServerCategories(db *gorm.DB, serverID uuid.UUID) ([]RoomCategory, error) {
+	var categories []RoomCategory
+	result := db.Where("server_id = ?", serverID).Order("position ASC, created_at ASC").Find(&categories)
+	return categories, result.Error
+}
+
+// RoomPosition moves a room, a nil CategoryID keeps the room in its category unless Uncategorized is set
+type RoomPosition struct {
+	ID            uuid.UUID
+	Position      int
+	CategoryID    *uuid.UUID
+	Uncategorized bool
+}
+
+type CategoryPosition struct {
+	ID       uuid.UUID
+	Position int
+}
+
+// ReorderServer sets the positions of rooms and categories of the server in a single transaction,
+// nothing is changed and gorm.ErrRecordNotFound is returned if any of them is not in the server
+func ReorderServer(db *gorm.DB, serverID uuid.UUID, categories []CategoryPosition, rooms []RoomPosition) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, c := range categories {
+			result := tx.Model(&RoomCategory{}).Where("id = ? AND server_id = ?", c.ID, serverID).Update("position", c.Position)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return gorm.ErrRecordNotFound
+			}
+		}
+
+		for _, r := range rooms {
+			updates := map[string]any{"position": r.Position}
+			if r.Uncategorized {
+				updates["category_id"] = nil
+			} else if r.CategoryID != nil {
+				if err := NewRoomCategory().WithID(*r.CategoryID).WithServerID(serverID).Find(tx); err != nil {
+					return err
+				}
+				updates["category_id"] = *r.CategoryID
+			}
+
+			result := tx.Model(&Room{}).Where("id = ? AND server_id = ?", r.ID, serverID).Updates(updates)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return gorm.ErrRecordNotFound
+			}
+		}
+		return nil
+	})
+}
+
+// MigrateRoomGroups turns the group names rooms had before categories into categories of their server,
+// a no-op once the group_name column is dropped
+func MigrateRoomGroups(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&Room{}, "group_name") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.AutoMigrate(&RoomCategory{}, &Room{}); err != nil {
+			return err
+		}
+
+		// categories keep the order their first room was created in
+		if err := tx.Exec(`INSERT INTO room_categories (server_id, name, position, created_at, updated_at)
+			SELECT server_id, group_name, ROW_NUMBER() OVER (PARTITION BY server_id ORDER BY MIN(created_at)) - 1, NOW(), NOW()
+			FROM rooms WHERE group_name <> '' GROUP BY server_id, group_name`).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Exec(`UPDATE rooms SET category_id = c.id FROM room_categories c
+			WHERE c.server_id = rooms.server_id AND c.name = rooms.group_name AND rooms.group_name <> ''`).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Exec(`UPDATE rooms SET position = o.position FROM
+			(SELECT id, ROW_NUMBER() OVER (PARTITION BY server_id, category_id ORDER BY created_at) - 1 AS position FROM rooms) o
+			WHERE rooms.id = o.id`).Error; err != nil {
+			return err
+		}
+
+		return tx.Migrator().DropColumn(&Room{}, "group_name")
+	})
+}
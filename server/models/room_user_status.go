@@ -79,3 +79,38 @@ func (r *RoomUserStatus) Find(db *gorm.DB) error {
 		First(r)
 	return result.Error
 }
+
+// CreateMemberRoomStatuses gives a new member of the server a status in each of its rooms
+func CreateMemberRoomStatuses(db *gorm.DB, serverID, userID uuid.UUID) error {
+	var roomIDs []uuid.UUID
+	if err := db.Model(&Room{}).Where("server_id = ?", serverID).Pluck("id", &roomIDs).Error; err != nil {
+		return err
+	}
+	if len(roomIDs) == 0 {
+		return nil
+	}
+
+	statuses := make([]RoomUserStatus, len(roomIDs))
+	for i, roomID := range roomIDs {
+		statuses[i] = RoomUserStatus{UserID: userID, ServerID: serverID, RoomID: roomID}
+	}
+	return db.Create(&statuses).Error
+}
+
+// CreateRoomStatuses gives every member of the server a status in the new room,
+// the statuses are deleted with the room
+func CreateRoomStatuses(db *gorm.DB, room *Room) error {
+	var userIDs []uuid.UUID
+	if err := db.Model(&ServerUserStatus{}).Where("server_id = ?", room.ServerID).Pluck("user_id", &userIDs).Error; err != nil {
+		return err
+	}
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	statuses := make([]RoomUserStatus, len(userIDs))
+	for i, userID := range userIDs {
+		statuses[i] = RoomUserStatus{UserID: userID, ServerID: room.ServerID, RoomID: room.ID}
+	}
+	return db.Create(&statuses).Error
+}
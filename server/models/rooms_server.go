@@ -12,8 +12,18 @@ type RoomsServer struct {
 	ID         uuid.UUID `gorm:"primarykey;type:uuid;default:gen_random_uuid()" json:"id"`
 	OwnerID    uuid.UUID `gorm:"column:owner_id;type:uuid" json:"ownerId"`
 	Name       string    `gorm:"column:name" json:"name"`
-	CreatedAt  time.Time `json:"createdAt"`
-	UpdatedAt  time.Time `json:"updatedAt"`
+	// an http(s) URL of the server icon
+	Icon        string `gorm:"column:icon" json:"icon"`
+	Description string `gorm:"column:description" json:"description"`
+	// members need a verified email to join or send messages
+	RequireVerifiedEmail bool `gorm:"column:require_verified_email;default:false" json:"requireVerifiedEmail"`
+	// anyone can join public servers, others need an invite
+	IsPublic bool `gorm:"column:is_public;default:false" json:"isPublic"`
+	// discoverable servers are listed in the server directory and anyone can join them
+	IsDiscoverable bool      `gorm:"column:is_discoverable;default:false;index" json:"isDiscoverable"`
+	Tags           Tags      `gorm:"column:tags;type:jsonb;default:'[]'" json:"tags"`
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
 	// Relationships
 	Owner  User             `gorm:"foreignKey:OwnerID;constraint:OnDelete:CASCADE;" json:"owner"`
 	Status []RoomUserStatus `gorm:"foreignKey:ServerID;" json:"status"`
@@ -61,19 +71,48 @@ func (rs *RoomsServer) Update(db *gorm.DB) error {
 	return result.Error
 }
 
+// Delete deletes the server with its bot users, everything else in the server cascades
 func (rs *RoomsServer) Delete(db *gorm.DB) error {
-	result := db.Unscoped().Delete(rs)
-	return result.Error
+	return db.Transaction(func(tx *gorm.DB) error {
+		var botIDs []uuid.UUID
+		if err := tx.Model(&Bot{}).Where("server_id = ?", rs.ID).Pluck("user_id", &botIDs).Error; err != nil {
+			return err
+		}
+		if len(botIDs) > 0 {
+			if err := tx.Unscoped().Where("id IN ?", botIDs).Delete(&User{}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Unscoped().Delete(rs).Error
+	})
+}
+
+// TransferOwnership makes the member the owner of the server
+func (rs *RoomsServer) TransferOwnership(db *gorm.DB, ownerID uuid.UUID) error {
+	result := db.Model(rs).Update("owner_id", ownerID)
+	if result.Error != nil {
+		return result.Error
+	}
+	rs.OwnerID = ownerID
+	return nil
+}
+
+// GetRoomIDs returns the IDs of every room in this server
+func (rs *RoomsServer) GetRoomIDs(db *gorm.DB) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	result := db.Model(&Room{}).Where("server_id = ?", rs.ID).Pluck("id", &ids)
+	return ids, result.Error
 }
 
-// GetRooms gets all rooms for a user in this server
+// GetRooms gets all rooms for a user in this server, with the user's status in each room if they have one
 func (rs *RoomsServer) GetRooms(db *gorm.DB, userID uuid.UUID) ([]RoomWithStatus, error) {
 	var rooms []RoomWithStatus
 
 	err := db.Table("rooms").
-		Select("rooms.*, room_user_status.id as status_id, room_user_status.user_id, room_user_status.server_id, room_user_status.room_id, room_user_status.last_read_message_id, room_user_status.created_at as status_created_at, room_user_status.updated_at as status_updated_at").
-		Joins("LEFT JOIN room_user_status ON rooms.id = room_user_status.room_id").
-		Where("rooms.server_id = ? AND room_user_status.user_id = ?", rs.ID, userID).
+		Select("rooms.*, room_user_status.id as status_id, room_user_status.user_id, room_user_status.room_id, room_user_status.last_read_msg_id, room_user_status.created_at as status_created_at, room_user_status.updated_at as status_updated_at").
+		Joins("LEFT JOIN room_user_status ON rooms.id = room_user_status.room_id AND room_user_status.user_id = ?", userID).
+		Where("rooms.server_id = ?", rs.ID).
+		Order("rooms.position ASC, rooms.created_at ASC").
 		Scan(&rooms).Error
 
 	return rooms, err
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
@@ -11,7 +13,8 @@ type ServerUserStatus struct {
 	UserID     uuid.UUID `gorm:"primaryKey;column:user_id;type:uuid;index" json:"userId"`
 	ServerID   uuid.UUID `gorm:"primaryKey;column:server_id;type:uuid;index" json:"serverId"`
 	Nickname   string    `gorm:"column:nickname" json:"nickname"`
-	Roles      []string  `gorm:"type:text[];column:roles" json:"roles"`
+	// timed out members can't send messages until then
+	TimeoutUntil *time.Time `gorm:"column:timeout_until" json:"timeoutUntil"`
 	// Relationships
 	User   User        `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;" json:"user"`
 	Server RoomsServer `gorm:"foreignKey:ServerID;references:ID;constraint:OnDelete:CASCADE;" json:"server"`
@@ -47,11 +50,6 @@ func (s *ServerUserStatus) WithNickname(nickname string) *ServerUserStatus {
 	return s
 }
 
-func (s *ServerUserStatus) WithRoles(roles []string) *ServerUserStatus {
-	s.Roles = roles
-	return s
-}
-
 func (s *ServerUserStatus) Create(db *gorm.DB) error {
 	result := db.Create(s)
 	return result.Error
@@ -68,6 +66,41 @@ func (s *ServerUserStatus) Delete(db *gorm.DB) error {
 	return result.Error
 }
 
+func (s *ServerUserStatus) IsTimedOut() bool {
+	return s.TimeoutUntil != nil && time.Now().Before(*s.TimeoutUntil)
+}
+
+// SetTimeout times the member out until the deadline, nil clears the timeout
+func (s *ServerUserStatus) SetTimeout(db *gorm.DB, until *time.Time) error {
+	s.TimeoutUntil = until
+	result := db.Model(&ServerUserStatus{}).
+		Where("user_id = ? AND server_id = ?", s.UserID, s.ServerID).
+		Update("timeout_until", until)
+	return result.Error
+}
+
+// SetNickname changes the nickname of the member, an empty nickname shows the username
+func (s *ServerUserStatus) SetNickname(db *gorm.DB, nickname string) error {
+	s.Nickname = nickname
+	result := db.Model(&ServerUserStatus{}).
+		Where("user_id = ? AND server_id = ?", s.UserID, s.ServerID).
+		Update("nickname", nickname)
+	return result.Error
+}
+
+// RemoveMember deletes the membership of the user with their room statuses and roles
+func RemoveMember(db *gorm.DB, serverID, userID uuid.UUID) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := NewServerUserStatus().WithUserID(userID).WithServerID(serverID).Delete(tx); err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("server_id = ? AND user_id = ?", serverID, userID).Delete(&RoomUserStatus{}).Error; err != nil {
+			return err
+		}
+		return DeleteMemberRoles(tx, serverID, userID)
+	})
+}
+
 // by user and server ID
 func (s *ServerUserStatus) Find(db *gorm.DB) error {
 	result := db.Model(&ServerUserStatus{}).
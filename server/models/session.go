@@ -0,0 +1,153 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"gorm.io/gorm"
+)
+
+// sessions last-seen time is only written when older than this, to avoid a write on every request
+const sessionTouchInterval = time.Minute
+
+// Session is a server-side record of a login on a device, its ID is the `jti` claim of the access tokens
+// and the family ID of its refresh tokens, so revoking it invalidates both.
+type Session struct {
+	gorm.Model `json:"-"`
+	ID         uuid.UUID  `gorm:"primarykey;type:uuid;default:gen_random_uuid()" json:"id"`
+	UserID     uuid.UUID  `gorm:"column:user_id;type:uuid;index" json:"userId"`
+	Device     string     `gorm:"column:device" json:"device"`
+	UserAgent  string     `gorm:"column:user_agent" json:"userAgent"`
+	IP         string     `gorm:"column:ip" json:"ip"`
+	LastSeenAt time.Time  `gorm:"column:last_seen_at" json:"lastSeenAt"`
+	ExpiresAt  time.Time  `gorm:"column:expires_at" json:"expiresAt"`
+	RevokedAt  *time.Time `gorm:"column:revoked_at" json:"-"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	// Relationships
+	User User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+}
+
+func (Session) TableName() string {
+	return "sessions"
+}
+
+func NewSession() *Session {
+	return &Session{}
+}
+
+func (s *Session) WithID(id uuid.UUID) *Session {
+	s.ID = id
+	return s
+}
+
+func (s *Session) WithUserID(userID uuid.UUID) *Session {
+	s.UserID = userID
+	return s
+}
+
+func (s *Session) WithDevice(device string) *Session {
+	s.Device = device
+	return s
+}
+
+func (s *Session) WithUserAgent(userAgent string) *Session {
+	s.UserAgent = userAgent
+	return s
+}
+
+func (s *Session) WithIP(ip string) *Session {
+	s.IP = ip
+	return s
+}
+
+func (s *Session) Create(db *gorm.DB) error {
+	now := time.Now()
+	s.LastSeenAt = now
+	s.ExpiresAt = now.Add(core.RefreshTokenTimeToLive)
+	result := db.Create(s)
+	return result.Error
+}
+
+func (s *Session) FindByID(db *gorm.DB, id ...uuid.UUID) error {
+	var _id uuid.UUID
+
+	if len(id) > 0 {
+		_id = id[0]
+	} else {
+		_id = s.ID
+	}
+
+	result := db.First(s, _id)
+	return result.Error
+}
+
+func (s *Session) IsActive() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpiresAt)
+}
+
+// Touch updates the last-seen time (and ip) at most once per sessionTouchInterval
+func (s *Session) Touch(db *gorm.DB, ip string) error {
+	if time.Since(s.LastSeenAt) < sessionTouchInterval && s.IP == ip {
+		return nil
+	}
+
+	s.LastSeenAt = time.Now()
+	s.IP = ip
+	result := db.Model(&Session{}).
+		Where("id = ?", s.ID).
+		Updates(map[string]any{"last_seen_at": s.LastSeenAt, "ip": ip})
+	return result.Error
+}
+
+// Extend pushes the expiry of the session, called when its refresh token is rotated
+func (s *Session) Extend(db *gorm.DB) error {
+	s.ExpiresAt = time.Now().Add(core.RefreshTokenTimeToLive)
+	result := db.Model(&Session{}).
+		Where("id = ?", s.ID).
+		Update("expires_at", s.ExpiresAt)
+	return result.Error
+}
+
+// Revoke revokes the session and all of its refresh tokens
+func (s *Session) Revoke(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(&Session{}).
+			Where("id = ? AND revoked_at IS NULL", s.ID).
+			Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		s.RevokedAt = &now
+
+		return NewRefreshToken().WithFamilyID(s.ID).RevokeFamily(tx)
+	})
+}
+
+// GetActiveSessions returns the sessions of a user that are neither revoked nor expired, most recent first
+func GetActiveSessions(db *gorm.DB, userID uuid.UUID) ([]Session, error) {
+	var sessions []Session
+
+	result := db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").
+		Find(&sessions)
+
+	return sessions, result.Error
+}
+
+// RevokeAllSessions revokes every session of a user and their refresh tokens
+func RevokeAllSessions(db *gorm.DB, userID uuid.UUID) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(&Session{}).
+			Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&RefreshToken{}).
+			Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", now).Error
+	})
+}
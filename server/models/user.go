@@ -10,17 +10,25 @@ import (
 
 type User struct {
 	gorm.Model     `json:"-"`
-	ID             uuid.UUID `gorm:"primarykey;type:uuid;default:gen_random_uuid()" json:"id"`
-	Username       string    `gorm:"uniqueIndex" json:"username"`
-	Email          string    `gorm:"uniqueIndex" json:"-"`
-	HashedPassword string    `gorm:"column:hashed_password" json:"-"`
-	CreatedAt      time.Time `json:"createdAt"`
-	UpdatedAt      time.Time `json:"updatedAt"`
+	ID             uuid.UUID  `gorm:"primarykey;type:uuid;default:gen_random_uuid()" json:"id"`
+	Username       string     `gorm:"uniqueIndex" json:"username"`
+	Email          string     `gorm:"uniqueIndex" json:"-"`
+	HashedPassword string     `gorm:"column:hashed_password" json:"-"`
+	IsBot          bool       `gorm:"column:is_bot;default:false" json:"isBot"`
+	VerifiedAt     *time.Time `gorm:"column:verified_at" json:"verifiedAt"`
+	// the secret is set on enrollment, two-factor is only enforced once TotpEnabledAt is set
+	TotpSecret    string     `gorm:"column:totp_secret" json:"-"`
+	TotpEnabledAt *time.Time `gorm:"column:totp_enabled_at" json:"twoFactorEnabledAt"`
+	// last accepted time step, a code can't be used twice
+	TotpLastStep int64     `gorm:"column:totp_last_step;default:0" json:"-"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
 	// Relationships
 	Messages      []Message          `gorm:"foreignKey:AuthorID;constraint:OnDelete:CASCADE;" json:"messages"`
 	OwnedServers  []RoomsServer      `gorm:"foreignKey:OwnerID;constraint:OnDelete:CASCADE;" json:"ownedServers"`
 	ServersStatus []ServerUserStatus `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;" json:"serversStatus"`
 	RoomsStatus   []RoomUserStatus   `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;" json:"roomsStatus"`
+	Identities    []Identity         `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;" json:"-"`
 }
 
 func NewUser(username ...string) *User {
@@ -106,6 +114,62 @@ func (u *User) Update(db *gorm.DB) error {
 	return result.Error
 }
 
+// users created through an identity provider have no password until they set one (password reset)
+func (u *User) HasPassword() bool {
+	return u.HashedPassword != ""
+}
+
+func (u *User) IsVerified() bool {
+	return u.VerifiedAt != nil
+}
+
+// MarkVerified sets and saves only the verified_at column
+func (u *User) MarkVerified(db *gorm.DB) error {
+	now := time.Now()
+	u.VerifiedAt = &now
+	result := db.Model(&User{}).
+		Where("id = ?", u.ID).
+		Update("verified_at", u.VerifiedAt)
+	return result.Error
+}
+
+func (u *User) TwoFactorEnabled() bool {
+	return u.TotpEnabledAt != nil
+}
+
+// UseTotpStep records the step of an accepted code,
+// it returns false if a code of the same or a later step was already used
+func (u *User) UseTotpStep(db *gorm.DB, step int64) (bool, error) {
+	result := db.Model(&User{}).
+		Where("id = ? AND totp_last_step < ?", u.ID, step).
+		Update("totp_last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	u.TotpLastStep = step
+	return true, nil
+}
+
+// UpdateTotp saves only the two-factor columns
+func (u *User) UpdateTotp(db *gorm.DB) error {
+	result := db.Model(&User{}).
+		Where("id = ?", u.ID).
+		Updates(map[string]any{"totp_secret": u.TotpSecret, "totp_enabled_at": u.TotpEnabledAt, "totp_last_step": u.TotpLastStep})
+	return result.Error
+}
+
+// UpdatePassword hashes and saves only the password column
+func (u *User) UpdatePassword(db *gorm.DB, unhashedPassword string) error {
+	u.WithPassword(unhashedPassword)
+	result := db.Model(&User{}).
+		Where("id = ?", u.ID).
+		Update("hashed_password", u.HashedPassword)
+	return result.Error
+}
+
 func (u *User) Delete(db *gorm.DB) error {
 	result := db.Unscoped().Delete(u)
 	return result.Error
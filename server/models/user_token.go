@@ -0,0 +1,108 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+	"gorm.io/gorm"
+)
+
+// purposes of single-use user tokens
+const (
+	TokenPurposePasswordReset     = "password_reset"
+	TokenPurposeEmailVerification = "email_verification"
+)
+
+var ErrUserTokenInvalid = errors.New("token is invalid, expired or already used")
+
+// UserToken is a single-use, expiring token sent to the user (e.g. by email),
+// only the hash of the token is stored
+type UserToken struct {
+	gorm.Model  `json:"-"`
+	ID          uuid.UUID  `gorm:"primarykey;type:uuid;default:gen_random_uuid()" json:"id"`
+	UserID      uuid.UUID  `gorm:"column:user_id;type:uuid;index" json:"userId"`
+	Purpose     string     `gorm:"column:purpose;index" json:"purpose"`
+	HashedToken string     `gorm:"column:hashed_token;uniqueIndex" json:"-"`
+	ExpiresAt   time.Time  `gorm:"column:expires_at" json:"expiresAt"`
+	UsedAt      *time.Time `gorm:"column:used_at" json:"usedAt"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	// Relationships
+	User User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;" json:"-"`
+}
+
+func (UserToken) TableName() string {
+	return "user_tokens"
+}
+
+func NewUserToken() *UserToken {
+	return &UserToken{}
+}
+
+func (t *UserToken) WithUserID(userID uuid.UUID) *UserToken {
+	t.UserID = userID
+	return t
+}
+
+func (t *UserToken) WithPurpose(purpose string) *UserToken {
+	t.Purpose = purpose
+	return t
+}
+
+// Generate creates the raw token valid for ttl and stores its hash in the struct, the raw token is never persisted
+func (t *UserToken) Generate(ttl time.Duration) (string, error) {
+	raw, err := core.GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	t.HashedToken = core.HashToken(raw)
+	t.ExpiresAt = time.Now().Add(ttl)
+	return raw, nil
+}
+
+func (t *UserToken) Create(db *gorm.DB) error {
+	result := db.Create(t)
+	return result.Error
+}
+
+// Consume marks the token as used and loads it into the struct,
+// it fails with ErrUserTokenInvalid if the token is unknown, expired, already used or for another purpose
+func (t *UserToken) Consume(db *gorm.DB, raw, purpose string) error {
+	if err := db.Where("hashed_token = ? AND purpose = ?", core.HashToken(raw), purpose).First(t).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return ErrUserTokenInvalid
+		}
+		return err
+	}
+
+	if t.UsedAt != nil || time.Now().After(t.ExpiresAt) {
+		return ErrUserTokenInvalid
+	}
+
+	// the condition on used_at makes sure a token can't be consumed twice concurrently
+	now := time.Now()
+	result := db.Model(&UserToken{}).
+		Where("id = ? AND used_at IS NULL", t.ID).
+		Update("used_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserTokenInvalid
+	}
+
+	t.UsedAt = &now
+	return nil
+}
+
+// InvalidateUserTokens marks the unused tokens of a user for a purpose as used,
+// so only the most recently issued token stays valid
+func InvalidateUserTokens(db *gorm.DB, userID uuid.UUID, purpose string) error {
+	result := db.Model(&UserToken{}).
+		Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+		Update("used_at", time.Now())
+	return result.Error
+}
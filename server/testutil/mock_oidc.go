@@ -0,0 +1,209 @@
+package testutil
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/khalidibnwalid/Luma/core"
+)
+
+// MockOIDCIdentity is the account the mock issuer signs in on the next authorization
+type MockOIDCIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+type mockOIDCCode struct {
+	clientID      string
+	redirectURI   string
+	codeChallenge string
+	nonce         string
+	identity      MockOIDCIdentity
+}
+
+// MockOIDCIssuer is a local OpenID Connect provider, its authorize endpoint signs in Identity without any UI
+type MockOIDCIssuer struct {
+	Server       *httptest.Server
+	ClientID     string
+	ClientSecret string
+	Identity     MockOIDCIdentity
+
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]mockOIDCCode
+}
+
+func NewMockOIDCIssuer(t *testing.T) *MockOIDCIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	m := &MockOIDCIssuer{
+		ClientID:     "luma",
+		ClientSecret: "luma-secret",
+		Identity: MockOIDCIdentity{
+			Subject:       uuid.NewString(),
+			Email:         uuid.NewString() + "@example.com",
+			EmailVerified: true,
+			Name:          "Mock User",
+		},
+		key:   key,
+		codes: make(map[string]mockOIDCCode),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("GET /jwks", m.jwks)
+	mux.HandleFunc("GET /authorize", m.authorize)
+	mux.HandleFunc("POST /token", m.token)
+	m.Server = httptest.NewServer(mux)
+
+	t.Cleanup(m.Server.Close)
+	return m
+}
+
+func (m *MockOIDCIssuer) Issuer() string {
+	return m.Server.URL
+}
+
+// Provider returns a client of the issuer registered under name
+func (m *MockOIDCIssuer) Provider(name, redirectURL string) *core.OIDCProvider {
+	return core.NewOIDCProvider(core.OIDCProviderConfig{
+		Name:         name,
+		Issuer:       m.Issuer(),
+		ClientID:     m.ClientID,
+		ClientSecret: m.ClientSecret,
+		RedirectURL:  redirectURL,
+	})
+}
+
+// SignIDToken signs arbitrary claims with the issuer key
+func (m *MockOIDCIssuer) SignIDToken(claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "mock"
+	signed, _ := token.SignedString(m.key)
+	return signed
+}
+
+// Authorize follows the provider redirect of a login, returns the callback URL with the code and state
+func (m *MockOIDCIssuer) Authorize(t *testing.T, authURL string) *url.URL {
+	t.Helper()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("Expected the issuer to redirect, got %d", res.StatusCode)
+	}
+
+	callback, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return callback
+}
+
+func (m *MockOIDCIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 m.Issuer(),
+		"authorization_endpoint": m.Issuer() + "/authorize",
+		"token_endpoint":         m.Issuer() + "/token",
+		"jwks_uri":               m.Issuer() + "/jwks",
+	})
+}
+
+func (m *MockOIDCIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "mock",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (m *MockOIDCIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != m.ClientID || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	code := uuid.NewString()
+	m.mu.Lock()
+	m.codes[code] = mockOIDCCode{
+		clientID:      query.Get("client_id"),
+		redirectURI:   query.Get("redirect_uri"),
+		codeChallenge: query.Get("code_challenge"),
+		nonce:         query.Get("nonce"),
+		identity:      m.Identity,
+	}
+	m.mu.Unlock()
+
+	callback, _ := url.Parse(query.Get("redirect_uri"))
+	callback.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, callback.String(), http.StatusFound)
+}
+
+func (m *MockOIDCIssuer) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, _ := r.BasicAuth()
+	if clientID != m.ClientID || clientSecret != m.ClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	m.mu.Lock()
+	code, ok := m.codes[r.FormValue("code")]
+	delete(m.codes, r.FormValue("code"))
+	m.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || code.redirectURI != r.FormValue("redirect_uri") ||
+		code.codeChallenge != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	idToken := m.SignIDToken(jwt.MapClaims{
+		"iss":            m.Issuer(),
+		"aud":            code.clientID,
+		"sub":            code.identity.Subject,
+		"email":          code.identity.Email,
+		"email_verified": code.identity.EmailVerified,
+		"name":           code.identity.Name,
+		"nonce":          code.nonce,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Minute).Unix(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": uuid.NewString(),
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
@@ -17,14 +17,19 @@ func MockRoom(t *testing.T, db *gorm.DB, userId uuid.UUID, server ...*models.Roo
 	} else {
 		_server, _, _ = MockRoomsServer(t, db)
 	}
+	// the user has to be a member to access the room
+	member := models.NewServerUserStatus().WithUserID(userId).WithServerID(_server.ID)
+	if err := member.Find(db); err != nil {
+		member.Create(db)
+		t.Cleanup(func() { member.Delete(db) })
+	}
+
 	roomName, _ := core.GenerateRandomString(10)
-	groupname, _ := core.GenerateRandomString(4)
 
 	room := &models.Room{
-		ServerID:  _server.ID,
-		GroupName: groupname,
-		Name:      roomName,
-		Type:      "direct",
+		ServerID: _server.ID,
+		Name:     roomName,
+		Type:     "direct",
 	}
 
 	room.Create(db)
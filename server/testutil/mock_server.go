@@ -22,6 +22,7 @@ func MockRoomsServer(t *testing.T, db *gorm.DB, user ...*models.User) (*models.R
 	server := models.NewRoomsServer().WithOwnerID(_user.ID)
 	server.Name, _ = core.GenerateRandomString(10)
 	server.Create(db)
+	models.NewEveryoneRole(server.ID).Create(db)
 	status := models.NewServerUserStatus().WithUserID(_user.ID).WithServerID(server.ID)
 
 	t.Cleanup(func() {
@@ -33,17 +33,26 @@ func NewTestingContext(t *testing.T) handlers.ServerContext {
 		t.Fatalf("Postgres connection error: %v", err)
 	}
 
-	db.Client.AutoMigrate(&models.User{}, &models.RoomsServer{}, &models.ServerUserStatus{}, &models.Room{}, &models.RoomUserStatus{} ,&models.Message{})
+	db.Client.AutoMigrate(&models.User{}, &models.RoomsServer{}, &models.ServerUserStatus{}, &models.RoomCategory{}, &models.Room{}, &models.RoomUserStatus{}, &models.Message{}, &models.RefreshToken{}, &models.Session{}, &models.UserToken{}, &models.RecoveryCode{}, &models.Bot{}, &models.ApiToken{}, &models.LoginThrottle{}, &models.Identity{}, &models.Role{}, &models.MemberRole{}, &models.PermissionOverwrite{}, &models.Invite{}, &models.Ban{}, &models.AuditLogEntry{})
+	if err = models.MigrateRoomGroups(db.Client); err != nil {
+		t.Fatalf("Room groups migration error: %v", err)
+	}
 
 	if err = db.Client.Exec("SELECT 1").Error; err != nil {
 		t.Fatalf("Postgres ping error: %v", err)
 	}
 
+	// all test requests share the httptest IP, don't let earlier runs lock it
+	db.Client.Exec("DELETE FROM login_throttles")
+
 	ctx := &handlers.ServerContext{
-		Db:        client.Database("Testing"),
-		Client:    client,
-		JwtSecret: "SECRET",
-		Database:  db,
+		Db:          client.Database("Testing"),
+		Client:      client,
+		Keys:        core.NewKeyringFromSecret("SECRET"),
+		Database:    db,
+		Mailer:      core.NewMemoryMailer(),
+		AppURL:      "http://localhost:3000",
+		Connections: core.NewConnections(),
 	}
 
 	t.Cleanup(func() {